@@ -3,7 +3,10 @@ package main
 import (
 	"flag"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 type HTTP struct {
@@ -40,15 +43,53 @@ type MQ struct {
 	pass  string
 	vhost string
 
-	exchange string
-	queue    string
-	binding  string
+	exchange     string
+	exchangeType string
+	queue        string
+	bindings     []string
+
+	legacyExchange   string // direct exchange events are also published to until consumers move off it
+	legacyRoutingKey string
+
+	maxInFlight int // unconfirmed publishes allowed at once
+}
+
+type NATS struct {
+	url    string
+	stream string
+}
+
+type PGNotify struct {
+	channel       string        // notified with the sequence number of each new event
+	retention     time.Duration // how long processed events are kept; 0 keeps them forever
+	pruneInterval time.Duration
+}
+
+type CDC struct {
+	slot        string // logical replication slot holding the confirmed position
+	publication string
+}
+
+type Changes struct {
+	retention     time.Duration // how long the change feed keeps entries; 0 keeps them forever
+	pruneInterval time.Duration
+	// how often committed changes are given their feed position
+	positionInterval time.Duration
 }
 
 type Config struct {
-	db DB
-	mq MQ
-	h  HTTP
+	db   DB
+	mq   MQ
+	nats NATS
+	h    HTTP
+	cdc  CDC
+	pg   PGNotify
+	ch   Changes
+
+	broker      string // rabbitmq, nats or postgres
+	eventSource string // handler: the command handlers publish; cdc: changes are read from the WAL
+
+	shutdownTimeout time.Duration
 }
 
 var (
@@ -82,14 +123,77 @@ func getConfig() Config {
 		flag.StringVar(&instance.mq.vhost, "mq-vhost", os.Getenv("RABBITMQ_VHOST"), "RabbitMQ vhost")
 
 		flag.StringVar(&instance.mq.exchange, "mq-exchange", os.Getenv("RABBITMQ_EXCHANGE"), "RabbitMQ exchange")
+		flag.StringVar(&instance.mq.exchangeType, "mq-exchange-type", envOr("RABBITMQ_EXCHANGE_TYPE", "topic"), "RabbitMQ exchange type")
 		flag.StringVar(&instance.mq.queue, "mq-queue", os.Getenv("RABBITMQ_QUEUE"), "RabbitMQ queue")
-		flag.StringVar(&instance.mq.binding, "mq-binding", os.Getenv("RABBITMQ_BINDING"), "RabbitMQ binding")
+
+		var bindings string
+		flag.StringVar(&bindings, "mq-binding", envOr("RABBITMQ_BINDING", "product.*"), "Comma-separated RabbitMQ binding patterns")
+
+		flag.StringVar(&instance.mq.legacyExchange, "mq-legacy-exchange", os.Getenv("RABBITMQ_LEGACY_EXCHANGE"), "Direct exchange events are also published to while consumers migrate, empty to stop")
+		flag.StringVar(&instance.mq.legacyRoutingKey, "mq-legacy-routing-key", envOr("RABBITMQ_LEGACY_ROUTING_KEY", "product_event"), "Routing key of the legacy exchange")
+
+		flag.IntVar(&instance.mq.maxInFlight, "mq-max-in-flight", envInt("RABBITMQ_MAX_IN_FLIGHT", 256), "RabbitMQ max unconfirmed publishes")
+
+		flag.StringVar(&instance.nats.url, "nats-url", envOr("NATS_URL", "nats://localhost:4222"), "NATS server URL")
+		flag.StringVar(&instance.nats.stream, "nats-stream", envOr("NATS_STREAM", "PRODUCTS"), "NATS JetStream stream")
+
+		flag.StringVar(&instance.broker, "broker", envOr("BROKER", "rabbitmq"), "Event transport: rabbitmq, nats or postgres")
+		flag.StringVar(&instance.pg.channel, "pg-notify-channel", envOr("PG_NOTIFY_CHANNEL", "product_events"), "Postgres channel notified of new events")
+		flag.DurationVar(&instance.pg.retention, "pg-events-retention", envDuration("PG_EVENTS_RETENTION", 7*24*time.Hour), "How long events processed by every consumer are kept in product_events, 0 to keep them forever")
+		flag.DurationVar(&instance.pg.pruneInterval, "pg-events-prune-interval", envDuration("PG_EVENTS_PRUNE_INTERVAL", time.Hour), "How often processed events past retention are removed from product_events")
+
+		flag.StringVar(&instance.eventSource, "event-source", envOr("EVENT_SOURCE", "handler"), "Where events are published from: handler or cdc")
+		flag.StringVar(&instance.cdc.slot, "cdc-slot", envOr("CDC_SLOT", "product_events"), "Logical replication slot used by cdc")
+		flag.StringVar(&instance.cdc.publication, "cdc-publication", envOr("CDC_PUBLICATION", "product_events"), "Publication followed by cdc")
+
+		flag.DurationVar(&instance.ch.retention, "changes-retention", envDuration("CHANGES_RETENTION", 7*24*time.Hour), "How long the change feed keeps entries, 0 to keep them forever")
+		flag.DurationVar(&instance.ch.pruneInterval, "changes-prune-interval", envDuration("CHANGES_PRUNE_INTERVAL", time.Hour), "How often expired change feed entries are removed")
+		flag.DurationVar(&instance.ch.positionInterval, "changes-position-interval", envDuration("CHANGES_POSITION_INTERVAL", 250*time.Millisecond), "How often committed changes are added to the change feed")
 
 		flag.StringVar(&instance.h.host, "http-host", os.Getenv("HTTP_HOST"), "HTTP host")
 		flag.StringVar(&instance.h.port, "http-port", os.Getenv("HTTP_PORT"), "HTTP port")
 
+		flag.DurationVar(&instance.shutdownTimeout, "shutdown-timeout", envDuration("SHUTDOWN_TIMEOUT", 15*time.Second), "Graceful shutdown timeout")
+
 		flag.Parse()
+
+		instance.mq.bindings = splitList(bindings)
 	})
 
 	return instance
 }
+
+// envOr returns the value of the environment variable key, or fallback if it is unset or empty.
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// envInt returns the environment variable key parsed as an int, or fallback if it is unset or invalid.
+func envInt(key string, fallback int) int {
+	if v, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return v
+	}
+	return fallback
+}
+
+// envDuration returns the environment variable key parsed as a duration, or fallback if it is unset or invalid.
+func envDuration(key string, fallback time.Duration) time.Duration {
+	if v, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		return v
+	}
+	return fallback
+}
+
+// splitList splits a comma-separated list, dropping blank entries.
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
@@ -2,49 +2,204 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/ziliscite/cqrs_product/internal/adapters/cdc"
 	"github.com/ziliscite/cqrs_product/internal/adapters/http_handler"
+	"github.com/ziliscite/cqrs_product/internal/adapters/nats"
+	"github.com/ziliscite/cqrs_product/internal/adapters/pgnotify"
 	"github.com/ziliscite/cqrs_product/internal/adapters/postgresql"
 	"github.com/ziliscite/cqrs_product/internal/adapters/rabbitmq"
 	"github.com/ziliscite/cqrs_product/internal/application"
+	"github.com/ziliscite/cqrs_product/internal/application/command"
+	"github.com/ziliscite/cqrs_product/internal/ports"
+	"github.com/ziliscite/cqrs_product/pkg/natsjs"
 	"github.com/ziliscite/cqrs_product/pkg/postgres"
 	"github.com/ziliscite/cqrs_product/pkg/rabbit"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
 func main() {
 	cfg := getConfig()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	// cancelled on SIGINT/SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	startCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
-	db, err := postgres.Open(ctx, cfg.db.dsn())
+	db, err := postgres.Open(startCtx, cfg.db.dsn())
 	if err != nil {
 		panic(err)
 	}
-	defer db.Close()
 
 	if err = postgres.AutoMigrate(cfg.db.dsn()); err != nil {
+		db.Close()
 		return
 	}
 
-	mq, err := rabbit.Dial(cfg.mq.user, cfg.mq.pass, cfg.mq.host, cfg.mq.port, cfg.mq.vhost)
+	repo := postgresql.NewRepository(db)
+	changes := postgresql.NewChangeLog(db)
+
+	cu, closeConn, err := newPublisher(startCtx, cfg, db)
 	if err != nil {
 		panic(err)
 	}
-	defer mq.Close()
 
-	pub := rabbit.NewClient(mq)
-	repo := postgresql.NewRepository(db)
+	sourceCtx, stopSource := context.WithCancel(ctx)
+	defer stopSource()
 
-	cu, err := rabbitmq.NewProducer(pub, cfg.mq.exchange, cfg.mq.queue, cfg.mq.binding)
-	if err != nil {
-		panic(err)
+	sourceErrs := make(chan error, 1)
+	var app application.Service
+	switch cfg.eventSource {
+	case "handler":
+		app = application.NewService(repo, changes, cu)
+	case "cdc":
+		// events come from the WAL, so the command handlers must not publish them too
+		app = application.NewService(repo, changes, discard{})
+
+		src := cdc.NewSource(db, cfg.db.dsn(), cfg.cdc.slot, cfg.cdc.publication, cu)
+		go func() {
+			sourceErrs <- src.Run(sourceCtx)
+		}()
+	default:
+		log.Printf("unknown event source %q", cfg.eventSource)
+		closeConn()
+		db.Close()
+		return
+	}
+
+	go postgresql.PositionChanges(ctx, db, cfg.ch.positionInterval)
+
+	if cfg.ch.retention > 0 && cfg.ch.pruneInterval > 0 {
+		go prune(ctx, "changes", cfg.ch.retention, cfg.ch.pruneInterval, func(ctx context.Context) (int64, error) {
+			return app.PruneChanges.Handle(ctx, command.NewPruneChanges(cfg.ch.retention))
+		})
+	}
+
+	if cfg.broker == "postgres" && cfg.pg.retention > 0 && cfg.pg.pruneInterval > 0 {
+		go prune(ctx, "events", cfg.pg.retention, cfg.pg.pruneInterval, func(ctx context.Context) (int64, error) {
+			return pgnotify.Prune(ctx, db, time.Now().Add(-cfg.pg.retention))
+		})
 	}
 
-	app := application.NewService(repo, cu)
 	srv := handler.NewHandler(app)
 
-	if err = srv.Run(cfg.h.addr()); err != nil {
-		panic(err)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.Run(cfg.h.addr())
+	}()
+
+	select {
+	case err = <-errs:
+		log.Println("server stopped:", err)
+	case err = <-sourceErrs:
+		log.Println("event source stopped:", err)
+		sourceErrs <- err // let the shutdown below see it as finished
+	case <-ctx.Done():
+		log.Println("shutting down")
+	}
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), cfg.shutdownTimeout)
+	defer cancelShutdown()
+
+	// stop taking requests first, so nothing publishes while the publisher is flushed
+	if err = srv.Shutdown(shutdownCtx); err != nil {
+		log.Println("failed to shut down http server:", err)
+	}
+
+	if cfg.eventSource == "cdc" {
+		// a transaction whose events aren't all confirmed yet is replayed on restart
+		stopSource()
+		select {
+		case <-sourceErrs:
+		case <-shutdownCtx.Done():
+			log.Println("timed out waiting for the event source")
+		}
+	}
+
+	if err = cu.Close(shutdownCtx); err != nil {
+		log.Println("failed to flush publisher:", err)
+	}
+
+	closeConn()
+	db.Close()
+}
+
+// prune calls remove right away and then every interval until ctx is done, logging how many
+// entries older than retention it removed; what names them in the log.
+func prune(ctx context.Context, what string, retention, interval time.Duration, remove func(context.Context) (int64, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		n, err := remove(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("failed to prune %s: %v", what, err)
+		} else if n > 0 {
+			log.Printf("pruned %d %s older than %s", n, what, retention)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// discard is the command handlers' publisher when events are captured from the WAL instead.
+type discard struct{}
+
+func (discard) Publish(context.Context, []byte, string) error { return nil }
+
+func (discard) Close(context.Context) error { return nil }
+
+// newPublisher connects to the event transport selected by cfg.broker.
+// The returned func closes the underlying connection.
+func newPublisher(ctx context.Context, cfg Config, db *pgxpool.Pool) (ports.Publisher, func(), error) {
+	switch cfg.broker {
+	case "rabbitmq":
+		mq, err := rabbit.Dial(cfg.mq.user, cfg.mq.pass, cfg.mq.host, cfg.mq.port, cfg.mq.vhost)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		kind, err := rabbit.ParseExchangeType(cfg.mq.exchangeType)
+		if err != nil {
+			mq.Close()
+			return nil, nil, err
+		}
+
+		legacy := rabbitmq.LegacyRoute{Exchange: cfg.mq.legacyExchange, RoutingKey: cfg.mq.legacyRoutingKey}
+		pub, err := rabbitmq.NewProducer(rabbit.NewClient(mq), cfg.mq.exchange, kind, cfg.mq.queue, cfg.mq.bindings, legacy, cfg.mq.maxInFlight)
+		if err != nil {
+			mq.Close()
+			return nil, nil, err
+		}
+
+		return pub, func() { mq.Close() }, nil
+	case "nats":
+		nc, js, err := natsjs.Connect(cfg.nats.url)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		pub, err := nats.NewPublisher(ctx, js, cfg.nats.stream)
+		if err != nil {
+			nc.Close()
+			return nil, nil, err
+		}
+
+		return pub, nc.Close, nil
+	case "postgres":
+		return pgnotify.NewPublisher(db, cfg.pg.channel), func() {}, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown broker %q", cfg.broker)
 	}
 }
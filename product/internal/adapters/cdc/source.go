@@ -0,0 +1,379 @@
+// Package cdc publishes product events by following the products table through
+// PostgreSQL logical replication, so writes made outside the API are published too.
+package cdc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/ziliscite/cqrs_product/internal/application/command"
+	"github.com/ziliscite/cqrs_product/internal/ports"
+	"github.com/ziliscite/cqrs_product/pkg/pgrepl"
+	"log"
+	"strconv"
+	"time"
+)
+
+const (
+	table = "products"
+
+	// statusInterval is how often the position is confirmed to the server while idle.
+	statusInterval = 10 * time.Second
+)
+
+// source publishes the changes of each committed transaction, then confirms the
+// transaction's LSN to the replication slot. A crash before the confirmation replays
+// the transaction on restart; its events carry IDs derived from the LSN, so the search
+// service recognises the repeats.
+type source struct {
+	db          *pgxpool.Pool
+	dsn         string
+	slot        string
+	publication string
+	pub         ports.Publisher
+
+	schema string // schema of the followed table, resolved on Run
+}
+
+func NewSource(db *pgxpool.Pool, dsn, slot, publication string, pub ports.Publisher) ports.EventSource {
+	return &source{
+		db:          db,
+		dsn:         dsn,
+		slot:        slot,
+		publication: publication,
+		pub:         pub,
+	}
+}
+
+// event is a row change waiting for its transaction to commit.
+type event struct {
+	kind    string
+	payload interface{}
+}
+
+func (s *source) Run(ctx context.Context) error {
+	if err := s.ensureReplicaIdentity(ctx); err != nil {
+		return err
+	}
+
+	if err := s.ensurePublication(ctx); err != nil {
+		return err
+	}
+
+	conn, err := pgrepl.Connect(ctx, s.dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if err = pgrepl.CreateSlot(ctx, conn, s.slot); err != nil {
+		return err
+	}
+
+	if err = pgrepl.StartReplication(ctx, conn, s.slot, 0, s.publication); err != nil {
+		return err
+	}
+	log.Printf("following %s through slot %s", table, s.slot)
+
+	var (
+		acked     pgrepl.LSN
+		relations = make(map[uint32]*pgrepl.Relation)
+		begin     *pgrepl.Begin // set while inside a transaction
+		pending   []event
+	)
+
+	deadline := time.Now().Add(statusInterval)
+	for {
+		if time.Now().After(deadline) {
+			if err = pgrepl.SendStandbyStatus(conn, acked); err != nil {
+				return err
+			}
+			deadline = time.Now().Add(statusInterval)
+		}
+
+		recvCtx, cancel := context.WithDeadline(ctx, deadline)
+		msg, err := conn.ReceiveMessage(recvCtx)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if pgconn.Timeout(err) {
+				continue
+			}
+			return err
+		}
+
+		var data []byte
+		switch msg := msg.(type) {
+		case *pgproto3.CopyData:
+			data = msg.Data
+		case *pgproto3.ErrorResponse:
+			return pgconn.ErrorResponseToPgError(msg)
+		default:
+			continue
+		}
+
+		m, err := pgrepl.ParseCopyData(data)
+		if err != nil {
+			return err
+		}
+
+		switch m := m.(type) {
+		case *pgrepl.Keepalive:
+			// outside a transaction everything up to the server's position has been handled
+			if begin == nil && m.ServerWALEnd > acked {
+				acked = m.ServerWALEnd
+			}
+			if m.ReplyRequested {
+				deadline = time.Time{}
+			}
+		case *pgrepl.XLogData:
+			change, err := pgrepl.Decode(m.Data)
+			if err != nil {
+				return err
+			}
+
+			switch c := change.(type) {
+			case *pgrepl.Relation:
+				relations[c.ID] = c
+			case *pgrepl.Begin:
+				begin, pending = c, pending[:0]
+			case *pgrepl.Insert, *pgrepl.Update, *pgrepl.Delete:
+				if begin == nil {
+					return errors.New("row change outside of a transaction")
+				}
+
+				e, ok, err := toEvent(relations, s.schema, c)
+				if err != nil {
+					return err
+				}
+				if ok {
+					pending = append(pending, e)
+				}
+			case *pgrepl.Commit:
+				if err = s.publish(ctx, c.CommitLSN, pending); err != nil {
+					return err
+				}
+
+				acked, begin = c.EndLSN, nil
+				deadline = time.Time{} // confirm right away
+			}
+		}
+	}
+}
+
+// publish publishes a transaction's events in commit order, each waiting for its confirm.
+func (s *source) publish(ctx context.Context, commit pgrepl.LSN, events []event) error {
+	for i, e := range events {
+		eventID := fmt.Sprintf("%s-%d", commit, i)
+
+		var msg []byte
+		var err error
+		switch p := e.payload.(type) {
+		case command.CreateProductRequest:
+			p.EventID = eventID
+			msg, err = json.Marshal(p)
+		case command.UpdateProductRequest:
+			p.EventID = eventID
+			msg, err = json.Marshal(p)
+		case command.DeleteProductRequest:
+			p.EventID = eventID
+			msg, err = json.Marshal(p)
+		}
+		if err != nil {
+			return err
+		}
+
+		if err = s.send(ctx, msg, e.kind); err != nil {
+			return fmt.Errorf("publish %s event at %s: %w", e.kind, commit, err)
+		}
+	}
+
+	return nil
+}
+
+// confirmer is a publisher whose Publish returns before the broker has taken the event,
+// and which can also publish waiting for that.
+type confirmer interface {
+	PublishConfirmed(ctx context.Context, payload []byte, event string) error
+}
+
+// send publishes an event, waiting until the broker has taken it: the slot only moves past
+// a transaction once all of its events are delivered.
+func (s *source) send(ctx context.Context, payload []byte, event string) error {
+	if c, ok := s.pub.(confirmer); ok {
+		return c.PublishConfirmed(ctx, payload, event)
+	}
+	return s.pub.Publish(ctx, payload, event)
+}
+
+// toEvent turns a row change of the products table in schema into an event; changes to
+// other tables, including products tables in other schemas, are skipped.
+func toEvent(relations map[uint32]*pgrepl.Relation, schema string, change interface{}) (event, bool, error) {
+	var (
+		relID    uint32
+		tuple    pgrepl.Tuple
+		oldTuple pgrepl.Tuple // the row before an update
+		kind     string
+	)
+	switch c := change.(type) {
+	case *pgrepl.Insert:
+		relID, tuple, kind = c.RelationID, c.New, "create"
+	case *pgrepl.Update:
+		relID, tuple, oldTuple, kind = c.RelationID, c.New, c.Old, "update"
+	case *pgrepl.Delete:
+		relID, tuple, kind = c.RelationID, c.Old, "delete"
+	}
+
+	rel, ok := relations[relID]
+	if !ok {
+		return event{}, false, fmt.Errorf("change to unknown relation %d", relID)
+	}
+	if rel.Namespace != schema || rel.Name != table {
+		return event{}, false, nil
+	}
+
+	row, err := decodeRow(rel, tuple)
+	if err != nil {
+		return event{}, false, err
+	}
+
+	switch kind {
+	case "create":
+		return event{kind: kind, payload: command.CreateProductRequest{
+			ID: row.id, Name: row.name, Price: row.price, Category: row.category, Version: row.version,
+		}}, true, nil
+	case "update":
+		req := command.UpdateProductRequest{
+			ID: row.id, Name: row.name, Price: row.price, Category: row.category, Version: row.version,
+		}
+
+		// without the old row consumers fall back to assuming everything changed
+		if oldTuple != nil {
+			prev, err := decodeRow(rel, oldTuple)
+			if err != nil {
+				return event{}, false, err
+			}
+			req.Previous = prev.snapshot()
+			req.Changed = prev.changed(row)
+		}
+
+		return event{kind: kind, payload: req}, true, nil
+	default:
+		if row.version == 0 {
+			return event{}, false, fmt.Errorf("delete of %s carries no version; is %s REPLICA IDENTITY FULL?", row.id, table)
+		}
+		return event{kind: kind, payload: command.DeleteProductRequest{
+			ID: row.id, Version: row.version + 1, Last: row.snapshot(),
+		}}, true, nil
+	}
+}
+
+type row struct {
+	id       string
+	name     string
+	category string
+	price    float64
+	version  int64
+}
+
+func (r row) snapshot() *command.ProductSnapshot {
+	return &command.ProductSnapshot{Name: r.name, Price: r.price, Category: r.category, Version: r.version}
+}
+
+// changed lists the fields whose values differ between r and next, like product.Product.Changed.
+func (r row) changed(next row) []string {
+	var fields []string
+	if r.name != next.name {
+		fields = append(fields, "name")
+	}
+	if r.price != next.price {
+		fields = append(fields, "price")
+	}
+	if r.category != next.category {
+		fields = append(fields, "category")
+	}
+	return fields
+}
+
+func decodeRow(rel *pgrepl.Relation, tuple pgrepl.Tuple) (row, error) {
+	var r row
+	for i, col := range rel.Columns {
+		if i >= len(tuple) || tuple[i] == nil {
+			continue
+		}
+
+		v := string(tuple[i])
+		var err error
+		switch col {
+		case "id":
+			r.id = v
+		case "name":
+			r.name = v
+		case "category":
+			r.category = v
+		case "price":
+			r.price, err = strconv.ParseFloat(v, 64)
+		case "version":
+			r.version, err = strconv.ParseInt(v, 10, 64)
+		}
+		if err != nil {
+			return r, fmt.Errorf("decode %s.%s: %w", table, col, err)
+		}
+	}
+
+	if r.id == "" {
+		return r, errors.New("row change without an id")
+	}
+	return r, nil
+}
+
+// ensureReplicaIdentity resolves the schema of the products table and makes it REPLICA
+// IDENTITY FULL, so deletes carry the whole old row, version included, and updates the
+// row they replaced. It is only needed here: every write pays for the extra WAL.
+func (s *source) ensureReplicaIdentity(ctx context.Context) error {
+	var identity string
+	if err := s.db.QueryRow(ctx, `
+		SELECT n.nspname, c.relreplident::text
+		FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.oid = $1::regclass
+	`, table,
+	).Scan(&s.schema, &identity); err != nil {
+		return err
+	}
+
+	if identity == "f" {
+		return nil
+	}
+
+	_, err := s.db.Exec(ctx, fmt.Sprintf("ALTER TABLE %s REPLICA IDENTITY FULL",
+		pgx.Identifier{s.schema, table}.Sanitize(),
+	))
+	return err
+}
+
+// ensurePublication creates the publication of the products table if it doesn't exist.
+func (s *source) ensurePublication(ctx context.Context) error {
+	var exists bool
+	if err := s.db.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM pg_publication WHERE pubname = $1)
+	`, s.publication,
+	).Scan(&exists); err != nil {
+		return err
+	}
+
+	if exists {
+		return nil
+	}
+
+	_, err := s.db.Exec(ctx, fmt.Sprintf("CREATE PUBLICATION %s FOR TABLE %s",
+		pgx.Identifier{s.publication}.Sanitize(), pgx.Identifier{table}.Sanitize(),
+	))
+	return err
+}
@@ -0,0 +1,114 @@
+package cdc
+
+import (
+	"github.com/ziliscite/cqrs_product/internal/application/command"
+	"github.com/ziliscite/cqrs_product/pkg/pgrepl"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const id = "0195f0c4-7a1e-7cc1-9f4b-3b2f1c7e8a10"
+
+var columns = []string{"id", "name", "price", "category", "version"}
+
+// relations holds products in the public schema and a products table in another schema.
+var relations = map[uint32]*pgrepl.Relation{
+	16385: {ID: 16385, Namespace: "public", Name: "products", Columns: columns},
+	16400: {ID: 16400, Namespace: "archive", Name: "products", Columns: columns},
+	16410: {ID: 16410, Namespace: "public", Name: "product_changes", Columns: []string{"seq", "id"}},
+}
+
+func tuple(values ...string) pgrepl.Tuple {
+	t := make(pgrepl.Tuple, len(values))
+	for i, v := range values {
+		if v != "" {
+			t[i] = []byte(v)
+		}
+	}
+	return t
+}
+
+func TestToEvent(t *testing.T) {
+	tests := []struct {
+		name   string
+		change interface{}
+		want   event
+	}{
+		{"insert", &pgrepl.Insert{RelationID: 16385, New: tuple(id, "Trail shoe", "89.90", "shoes", "1")}, event{
+			kind:    "create",
+			payload: command.CreateProductRequest{ID: id, Name: "Trail shoe", Price: 89.9, Category: "shoes", Version: 1},
+		}},
+		{"update with old row", &pgrepl.Update{
+			RelationID: 16385,
+			Old:        tuple(id, "Trail shoe", "89.90", "shoes", "1"),
+			New:        tuple(id, "Trail shoe", "79.90", "shoes", "2"),
+		}, event{
+			kind: "update",
+			payload: command.UpdateProductRequest{
+				ID: id, Name: "Trail shoe", Price: 79.9, Category: "shoes", Version: 2,
+				Previous: &command.ProductSnapshot{Name: "Trail shoe", Price: 89.9, Category: "shoes", Version: 1},
+				Changed:  []string{"price"},
+			},
+		}},
+		{"update without old row", &pgrepl.Update{RelationID: 16385, New: tuple(id, "Trail shoe", "79.90", "shoes", "2")}, event{
+			kind:    "update",
+			payload: command.UpdateProductRequest{ID: id, Name: "Trail shoe", Price: 79.9, Category: "shoes", Version: 2},
+		}},
+		{"delete", &pgrepl.Delete{RelationID: 16385, Old: tuple(id, "Trail shoe", "79.90", "shoes", "2")}, event{
+			kind: "delete",
+			payload: command.DeleteProductRequest{
+				ID: id, Version: 3,
+				Last: &command.ProductSnapshot{Name: "Trail shoe", Price: 79.9, Category: "shoes", Version: 2},
+			},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok, err := toEvent(relations, "public", tt.change)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				t.Fatal("change was skipped")
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("toEvent() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestToEventSkipsOtherTables(t *testing.T) {
+	for _, relID := range []uint32{16400, 16410} {
+		change := &pgrepl.Insert{RelationID: relID, New: tuple(id, "Trail shoe", "89.90", "shoes", "1")}
+
+		_, ok, err := toEvent(relations, "public", change)
+		if err != nil || ok {
+			t.Errorf("change to %s.%s: ok = %v, err = %v, want it skipped", relations[relID].Namespace, relations[relID].Name, ok, err)
+		}
+	}
+}
+
+func TestToEventErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		change interface{}
+		want   string
+	}{
+		{"unknown relation", &pgrepl.Insert{RelationID: 1, New: tuple(id)}, "unknown relation"},
+		{"delete with key only", &pgrepl.Delete{RelationID: 16385, Old: tuple(id, "", "", "", "")}, "REPLICA IDENTITY FULL"},
+		{"row without id", &pgrepl.Insert{RelationID: 16385, New: tuple("", "Trail shoe", "89.90", "shoes", "1")}, "without an id"},
+		{"malformed price", &pgrepl.Insert{RelationID: 16385, New: tuple(id, "Trail shoe", "cheap", "shoes", "1")}, "products.price"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := toEvent(relations, "public", tt.change)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("toEvent() error = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
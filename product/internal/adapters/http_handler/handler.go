@@ -1,16 +1,28 @@
 package handler
 
 import (
+	"context"
+	"errors"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/ziliscite/cqrs_product/internal/application"
 	"github.com/ziliscite/cqrs_product/internal/application/command"
+	"github.com/ziliscite/cqrs_product/internal/application/query"
+	"github.com/ziliscite/cqrs_product/internal/domain/product"
 	"github.com/ziliscite/cqrs_product/internal/ports"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 type handler struct {
-	app application.Service
-	en  *gin.Engine
+	app  application.Service
+	en   *gin.Engine
+	srv  *http.Server
+	stop chan struct{} // closed on Shutdown, ending long polls early
+	once sync.Once
 }
 
 func NewHandler(app application.Service) ports.Handler {
@@ -18,20 +30,36 @@ func NewHandler(app application.Service) ports.Handler {
 	r.Use(gin.Logger())
 	r.Use(gin.Recovery())
 	return &handler{
-		app: app,
-		en:  r,
+		app:  app,
+		en:   r,
+		srv:  &http.Server{Handler: r},
+		stop: make(chan struct{}),
 	}
 }
 
+// Run serves HTTP on addr until Shutdown is called.
 func (h *handler) Run(addr string) error {
 	h.setupRoutes()
-	return h.en.Run(addr)
+
+	h.srv.Addr = addr
+	if err := h.srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Shutdown stops accepting connections and waits for in-flight requests to finish, or ctx to be done.
+func (h *handler) Shutdown(ctx context.Context) error {
+	h.once.Do(func() { close(h.stop) })
+	return h.srv.Shutdown(ctx)
 }
 
 func (h *handler) setupRoutes() {
 	h.en.POST("/products", h.CreateProduct)
 	h.en.PATCH("/products/:id", h.UpdateProduct)
 	h.en.DELETE("/products/:id", h.DeleteProduct)
+	h.en.GET("/products/export", h.ExportProducts)
+	h.en.GET("/changes", h.ListChanges)
 
 	// health check
 	h.en.GET("/health", func(c *gin.Context) {
@@ -57,11 +85,14 @@ func (h *handler) CreateProduct(c *gin.Context) {
 		return
 	}
 
-	if err := h.app.Create.Handle(c, cmd); err != nil {
+	tok, err := h.app.Create.Handle(c, cmd)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	setToken(c, tok)
+	c.Header("Location", "/products/"+tok.ID)
 	c.Status(http.StatusCreated)
 }
 
@@ -89,11 +120,17 @@ func (h *handler) UpdateProduct(c *gin.Context) {
 		return
 	}
 
-	if err := h.app.Update.Handle(c, cmd); err != nil {
+	tok, err := h.app.Update.Handle(c, cmd)
+	if err != nil {
+		if errors.Is(err, product.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	setToken(c, tok)
 	c.Status(http.StatusNoContent)
 }
 
@@ -111,10 +148,119 @@ func (h *handler) DeleteProduct(c *gin.Context) {
 		return
 	}
 
-	if err = h.app.Delete.Handle(c, cmd); err != nil {
+	tok, err := h.app.Delete.Handle(c, cmd)
+	if err != nil {
+		if errors.Is(err, product.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	setToken(c, tok)
 	c.Status(http.StatusNoContent)
 }
+
+// setToken returns the consistency token of a write, which the search service accepts
+// to serve reads that reflect it.
+func setToken(c *gin.Context, tok product.Token) {
+	c.Header("X-Consistency-Token", tok.String())
+	c.Header("X-Product-Version", strconv.FormatInt(tok.Version, 10))
+}
+
+func (h *handler) ExportProducts(c *gin.Context) {
+	var limit int
+	if l := c.Query("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit param"})
+			return
+		}
+	}
+
+	after := c.Query("after")
+	if after != "" {
+		if _, err := uuid.Parse(after); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid after param"})
+			return
+		}
+	}
+
+	var ids []string
+	if v := c.Query("ids"); v != "" {
+		ids = strings.Split(v, ",")
+		for _, id := range ids {
+			if _, err := uuid.Parse(id); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid ids param"})
+				return
+			}
+		}
+	}
+
+	q, err := query.NewExportProducts(after, limit, ids)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	page, err := h.app.Export.Handle(c, q)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, page)
+}
+
+func (h *handler) ListChanges(c *gin.Context) {
+	var limit int
+	if l := c.Query("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit param"})
+			return
+		}
+	}
+
+	// seconds to wait for a change when there is none yet
+	var wait time.Duration
+	if w := c.Query("wait"); w != "" {
+		secs, err := strconv.Atoi(w)
+		if err != nil || secs < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid wait param"})
+			return
+		}
+		wait = time.Duration(secs) * time.Second
+	}
+
+	q, err := query.NewListChanges(c.Query("cursor"), limit, wait)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cursor param"})
+		return
+	}
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-h.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	page, err := h.app.Changes.Handle(ctx, q)
+	if err != nil {
+		if errors.Is(err, product.ErrChangesPruned) {
+			// the client has to start over, e.g. from /products/export
+			c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, page)
+}
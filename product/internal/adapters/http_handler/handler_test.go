@@ -0,0 +1,165 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/ziliscite/cqrs_product/internal/application"
+	"github.com/ziliscite/cqrs_product/internal/application/query"
+	"github.com/ziliscite/cqrs_product/internal/domain/product"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// start runs h on a free loopback address until the test ends, returning its base URL
+// and the channel Run's result is sent on.
+func start(t *testing.T, h *handler) (string, <-chan error) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	ran := make(chan error, 1)
+	go func() { ran <- h.Run(addr) }()
+	t.Cleanup(func() { _ = h.Shutdown(context.Background()) })
+
+	base := "http://" + addr
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if res, err := http.Get(base + "/health"); err == nil {
+			_ = res.Body.Close()
+			return base, ran
+		}
+	}
+	t.Fatalf("%s never answered", base)
+	return "", nil
+}
+
+func TestShutdownWaitsForInFlightRequests(t *testing.T) {
+	h := NewHandler(application.Service{}).(*handler)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	h.en.POST("/slow", func(c *gin.Context) {
+		close(started)
+		<-release
+		c.Status(http.StatusCreated)
+	})
+	base, ran := start(t, h)
+
+	slow := make(chan int, 1)
+	go func() {
+		res, err := http.Post(base+"/slow", "application/json", nil)
+		if err != nil {
+			slow <- 0
+			return
+		}
+		_ = res.Body.Close()
+		slow <- res.StatusCode
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- h.Shutdown(context.Background()) }()
+
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown() = %v with a request in flight, want it to wait", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if status := <-slow; status != http.StatusCreated {
+		t.Errorf("in-flight request: status %d, want it to complete with %d", status, http.StatusCreated)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown() = %v", err)
+	}
+	if err := <-ran; err != nil {
+		t.Errorf("Run() = %v after Shutdown, want nil", err)
+	}
+}
+
+// changesFunc is a query.ListChangesHandler running a func.
+type changesFunc func(ctx context.Context, q query.ListChanges) (query.ChangePage, error)
+
+func (f changesFunc) Handle(ctx context.Context, q query.ListChanges) (query.ChangePage, error) {
+	return f(ctx, q)
+}
+
+func TestListChangesStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		err    error
+		want   int
+	}{
+		{"ok", "/changes?limit=10&wait=0", nil, http.StatusOK},
+		{"malformed cursor", "/changes?cursor=bogus", nil, http.StatusBadRequest},
+		{"malformed limit", "/changes?limit=0", nil, http.StatusBadRequest},
+		{"malformed wait", "/changes?wait=-1", nil, http.StatusBadRequest},
+		{"pruned", "/changes?cursor=YzE6MQ", product.ErrChangesPruned, http.StatusGone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHandler(application.Service{Changes: changesFunc(func(context.Context, query.ListChanges) (query.ChangePage, error) {
+				return query.ChangePage{Items: []query.ChangeItem{}}, tt.err
+			})}).(*handler)
+			h.setupRoutes()
+
+			rec := httptest.NewRecorder()
+			h.en.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			if rec.Code != tt.want {
+				t.Errorf("GET %s: status %d, want %d: %s", tt.target, rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+}
+
+func TestShutdownEndsLongPolls(t *testing.T) {
+	polling := make(chan struct{})
+	h := NewHandler(application.Service{Changes: changesFunc(func(ctx context.Context, q query.ListChanges) (query.ChangePage, error) {
+		close(polling)
+		<-ctx.Done()
+		return query.ChangePage{Items: []query.ChangeItem{}, NextCursor: "same"}, nil
+	})}).(*handler)
+	base, _ := start(t, h)
+
+	type result struct {
+		status int
+		page   query.ChangePage
+	}
+	polled := make(chan result, 1)
+	go func() {
+		var r result
+		res, err := http.Get(base + "/changes?wait=30")
+		if err == nil {
+			r.status = res.StatusCode
+			_ = json.NewDecoder(res.Body).Decode(&r.page)
+			_ = res.Body.Close()
+		}
+		polled <- r
+	}()
+	<-polling
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := h.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() = %v, want the long poll ended rather than waited out", err)
+	}
+
+	// the client gets its cursor back to poll again elsewhere
+	if r := <-polled; r.status != http.StatusOK || r.page.NextCursor != "same" {
+		t.Errorf("long poll ended with %d %+v, want an empty page", r.status, r.page)
+	}
+}
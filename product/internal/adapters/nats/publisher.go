@@ -0,0 +1,60 @@
+package nats
+
+import (
+	"context"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/ziliscite/cqrs_product/internal/domain/product"
+	"github.com/ziliscite/cqrs_product/internal/ports"
+	"github.com/ziliscite/cqrs_product/pkg/natsjs"
+	"log"
+)
+
+type publisher struct {
+	js jetstream.JetStream
+}
+
+// NewPublisher publishes product events to JetStream, creating the stream if needed.
+func NewPublisher(ctx context.Context, js jetstream.JetStream, stream string) (ports.Publisher, error) {
+	if _, err := natsjs.EnsureStream(ctx, js, stream, []string{"product.>"}); err != nil {
+		return nil, err
+	}
+
+	return &publisher{js: js}, nil
+}
+
+func (p *publisher) Publish(ctx context.Context, payload []byte, event string) error {
+	subject, ok := product.RoutingKey(event)
+	if !ok {
+		return fmt.Errorf("unknown event type %q", event)
+	}
+
+	log.Println("publishing", event, "to", subject)
+
+	msg := nats.NewMsg(subject)
+	msg.Header.Set("event_type", event)
+	msg.Data = payload
+
+	// waits for the stream to acknowledge the message
+	_, err := p.js.PublishMsg(ctx, msg)
+	return err
+}
+
+// Close drains the underlying connection, flushing anything still buffered.
+func (p *publisher) Close(ctx context.Context) error {
+	done := make(chan struct{})
+	nc := p.js.Conn()
+	nc.SetClosedHandler(func(*nats.Conn) { close(done) })
+
+	if err := nc.Drain(); err != nil {
+		return err
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
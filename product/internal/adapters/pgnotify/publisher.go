@@ -0,0 +1,78 @@
+// Package pgnotify carries product events through Postgres: each event is appended to the
+// product_events table and announced with pg_notify, so subscribers can LISTEN for new
+// events and catch up by sequence number after missing some.
+package pgnotify
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/ziliscite/cqrs_product/internal/domain/product"
+	"github.com/ziliscite/cqrs_product/internal/ports"
+	"log"
+	"strconv"
+	"time"
+)
+
+// publishLock is the advisory lock key held while an event is appended.
+const publishLock int64 = 0x70726f64 // "prod"
+
+type publisher struct {
+	db      *pgxpool.Pool
+	channel string
+}
+
+func NewPublisher(db *pgxpool.Pool, channel string) ports.Publisher {
+	return &publisher{db: db, channel: channel}
+}
+
+// Publish stores the event and notifies listeners of its sequence number; the
+// notification is only sent once the insert commits.
+func (p *publisher) Publish(ctx context.Context, payload []byte, event string) error {
+	if _, ok := product.RoutingKey(event); !ok {
+		return fmt.Errorf("unknown event type %q", event)
+	}
+
+	log.Println("publishing", event, "to", p.channel)
+
+	return pgx.BeginFunc(ctx, p.db, func(tx pgx.Tx) error {
+		// publishes are serialised so events commit in sequence order; otherwise a subscriber
+		// catching up past a later sequence number could skip one still being committed
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, publishLock); err != nil {
+			return err
+		}
+
+		var seq int64
+		if err := tx.QueryRow(ctx, `
+			INSERT INTO product_events (event, payload) VALUES ($1, $2) RETURNING seq
+		`, event, payload,
+		).Scan(&seq); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec(ctx, `SELECT pg_notify($1, $2)`, p.channel, strconv.FormatInt(seq, 10))
+		return err
+	})
+}
+
+// Close is a no-op: the pool belongs to the caller.
+func (p *publisher) Close(context.Context) error {
+	return nil
+}
+
+// Prune deletes the events published before the given time that every consumer recorded
+// in product_event_offsets has processed, and returns how many it deleted. A consumer that
+// is retired must have its row removed, or it holds pruning back for good.
+func Prune(ctx context.Context, db *pgxpool.Pool, before time.Time) (int64, error) {
+	tag, err := db.Exec(ctx, `
+		DELETE FROM product_events
+		WHERE created_at < $1
+		AND seq <= (SELECT COALESCE(MIN(seq), 0) FROM product_event_offsets)
+	`, before,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
@@ -0,0 +1,151 @@
+package postgresql
+
+import (
+	"context"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/ziliscite/cqrs_product/internal/domain/product"
+	"github.com/ziliscite/cqrs_product/internal/ports"
+	"log"
+	"time"
+)
+
+// positionLock is the advisory lock key held while changes are given positions.
+const positionLock int64 = 0x63686731 // "chg1"
+
+// changeLog reads the product_changes table, which a trigger on products appends to.
+// Changes are read in pos order, not seq: seq is taken when a row is written, so a
+// transaction can commit a lower seq after a reader has moved past it. A change only gets
+// a pos, from PositionChanges, once every transaction that started before it has finished,
+// so no earlier position can appear later. Prune always removes a prefix of the log, so
+// the horizon alone tells which cursors are too old.
+type changeLog struct {
+	db *pgxpool.Pool
+}
+
+func NewChangeLog(db *pgxpool.Pool) ports.ChangeLog {
+	return &changeLog{db: db}
+}
+
+func (l *changeLog) Since(ctx context.Context, after int64, limit int) ([]product.Change, error) {
+	rows, err := l.db.Query(ctx, `
+		SELECT pos, product_id, version, deleted, name, price, category, changed_at FROM product_changes
+		WHERE pos > $1
+		ORDER BY pos
+		LIMIT $2
+	`, after, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []product.Change
+	for rows.Next() {
+		var (
+			c              product.Change
+			deleted        bool
+			name, category *string
+			price          *float64
+		)
+		if err = rows.Scan(&c.Seq, &c.ID, &c.Version, &deleted, &name, &price, &category, &c.ChangedAt); err != nil {
+			return nil, err
+		}
+
+		if !deleted {
+			p, err := product.New(*name, *category, *price)
+			if err != nil {
+				return nil, err
+			}
+			p.SetID(c.ID)
+			p.SetVersion(c.Version)
+			c.Product = p
+		}
+
+		changes = append(changes, c)
+	}
+
+	return changes, rows.Err()
+}
+
+// PositionChanges positions the changes of finished transactions right away and then every
+// interval until ctx is done, so the log's readers never write. Instances sharing the
+// database take turns; a change reaches the feed at most one interval after it commits.
+func PositionChanges(ctx context.Context, db *pgxpool.Pool, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := position(ctx, db); err != nil && ctx.Err() == nil {
+			log.Printf("failed to position changes: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// position gives the changes of finished transactions the next positions in the log.
+// Every transaction with an ID below the snapshot's xmin has finished, and new ones get
+// higher IDs, so the changes positioned in one pass can't be followed by earlier ones.
+// A transaction left open holds the feed back, but never lets it skip a change.
+func position(ctx context.Context, db *pgxpool.Pool) error {
+	return pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		var locked bool
+		if err := tx.QueryRow(ctx, `SELECT pg_try_advisory_xact_lock($1)`, positionLock).Scan(&locked); err != nil {
+			return err
+		}
+
+		// another instance is positioning them already
+		if !locked {
+			return nil
+		}
+
+		_, err := tx.Exec(ctx, `
+			WITH ready AS (
+				SELECT seq, row_number() OVER (ORDER BY seq) AS n FROM product_changes
+				WHERE pos IS NULL AND xid < pg_snapshot_xmin(pg_current_snapshot())
+			), base AS (
+				-- pruning may have removed every positioned change, but never reuse a position
+				SELECT GREATEST(
+					(SELECT MAX(pos) FROM product_changes),
+					(SELECT seq FROM product_changes_horizon)
+				) AS pos
+			)
+			UPDATE product_changes c SET pos = base.pos + ready.n
+			FROM ready, base
+			WHERE c.seq = ready.seq
+		`)
+		return err
+	})
+}
+
+func (l *changeLog) Horizon(ctx context.Context) (int64, error) {
+	var seq int64
+	if err := l.db.QueryRow(ctx, `SELECT seq FROM product_changes_horizon`).Scan(&seq); err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
+
+func (l *changeLog) Prune(ctx context.Context, before time.Time) (int64, error) {
+	var n int64
+	if err := l.db.QueryRow(ctx, `
+		WITH pruned AS (
+			DELETE FROM product_changes
+			WHERE pos <= (SELECT MAX(pos) FROM product_changes WHERE changed_at < $1)
+			RETURNING pos
+		), moved AS (
+			UPDATE product_changes_horizon SET seq = GREATEST(seq, (SELECT MAX(pos) FROM pruned))
+			WHERE EXISTS (SELECT 1 FROM pruned)
+		)
+		SELECT count(*) FROM pruned
+	`, before,
+	).Scan(&n); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
@@ -2,6 +2,8 @@ package postgresql
 
 import (
 	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
 	"github.com/ziliscite/cqrs_product/internal/domain/product"
 	"github.com/ziliscite/cqrs_product/internal/ports"
 
@@ -20,8 +22,8 @@ func NewRepository(db *pgxpool.Pool) ports.Repository {
 
 func (r *repo) Create(ctx context.Context, product *product.Product) error {
 	if _, err := r.db.Exec(ctx, `
-		INSERT INTO products (id, name, price, category) VALUES ($1, $2, $3, $4)
-	`, product.ID(), product.Name(), product.Price(), product.Category(),
+		INSERT INTO products (id, name, price, category, version) VALUES ($1, $2, $3, $4, $5)
+	`, product.ID(), product.Name(), product.Price(), product.Category(), product.Version(),
 	); err != nil {
 		return err
 	}
@@ -29,24 +31,121 @@ func (r *repo) Create(ctx context.Context, product *product.Product) error {
 	return nil
 }
 
-func (r *repo) Update(ctx context.Context, product *product.Product) error {
-	if _, err := r.db.Exec(ctx, `
-		UPDATE products SET name = $2, price = $3, category = $4 WHERE id = $1
-	`, product.ID(), product.Name(), product.Price(), product.Category(),
-	); err != nil {
-		return err
+func (r *repo) Update(ctx context.Context, p *product.Product) (*product.Product, error) {
+	var (
+		name, category string
+		price          float64
+		version        int64
+	)
+	// the subquery locks the row and reads it as it was before the update
+	if err := r.db.QueryRow(ctx, `
+		UPDATE products SET name = $2, price = $3, category = $4, version = products.version + 1
+		FROM (SELECT id, name, price, category, version FROM products WHERE id = $1 FOR UPDATE) AS prev
+		WHERE products.id = prev.id
+		RETURNING prev.name, prev.price, prev.category, prev.version
+	`, p.ID(), p.Name(), p.Price(), p.Category(),
+	).Scan(&name, &price, &category, &version); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, product.ErrNotFound
+		}
+		return nil, err
 	}
 
-	return nil
+	prev, err := product.New(name, category, price)
+	if err != nil {
+		return nil, err
+	}
+	prev.SetID(p.ID())
+	prev.SetVersion(version)
+
+	p.SetVersion(version + 1)
+	return prev, nil
 }
 
-func (r *repo) Delete(ctx context.Context, id string) error {
-	if _, err := r.db.Exec(ctx, `
+func (r *repo) Delete(ctx context.Context, id string) (*product.Product, error) {
+	var (
+		name, category string
+		price          float64
+		version        int64
+	)
+	if err := r.db.QueryRow(ctx, `
 		DELETE FROM products WHERE id = $1
+		RETURNING name, price, category, version
 	`, id,
-	); err != nil {
-		return err
+	).Scan(&name, &price, &category, &version); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, product.ErrNotFound
+		}
+		return nil, err
 	}
 
-	return nil
+	p, err := product.New(name, category, price)
+	if err != nil {
+		return nil, err
+	}
+	p.SetID(id)
+	p.SetVersion(version)
+
+	return p, nil
+}
+
+func (r *repo) List(ctx context.Context, after string, limit int) ([]*product.Product, error) {
+	var cursor *string // NULL starts from the first product
+	if after != "" {
+		cursor = &after
+	}
+
+	rows, err := r.db.Query(ctx, `
+		SELECT id, name, price, category, version FROM products
+		WHERE $1::uuid IS NULL OR id > $1::uuid
+		ORDER BY id
+		LIMIT $2
+	`, cursor, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanProducts(rows)
+}
+
+func (r *repo) ListByIDs(ctx context.Context, ids []string) ([]*product.Product, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT id, name, price, category, version FROM products
+		WHERE id = ANY($1::uuid[])
+		ORDER BY id
+	`, ids,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanProducts(rows)
+}
+
+func scanProducts(rows pgx.Rows) ([]*product.Product, error) {
+	defer rows.Close()
+
+	var products []*product.Product
+	for rows.Next() {
+		var (
+			id, name, category string
+			price              float64
+			version            int64
+		)
+		if err := rows.Scan(&id, &name, &price, &category, &version); err != nil {
+			return nil, err
+		}
+
+		p, err := product.New(name, category, price)
+		if err != nil {
+			return nil, err
+		}
+		p.SetID(id)
+		p.SetVersion(version)
+
+		products = append(products, p)
+	}
+
+	return products, rows.Err()
 }
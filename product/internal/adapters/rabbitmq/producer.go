@@ -2,68 +2,274 @@ package rabbitmq
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/rabbitmq/amqp091-go"
+	"github.com/ziliscite/cqrs_product/internal/domain/product"
 	"github.com/ziliscite/cqrs_product/internal/ports"
 	"github.com/ziliscite/cqrs_product/pkg/rabbit"
 	"log"
+	"sync"
+	"time"
 )
 
+const (
+	// publishAttempts bounds how often an event is sent to an exchange that failed to take it.
+	publishAttempts = 3
+	// publishBackoff is the wait before the first resend; each further one waits longer.
+	publishBackoff = 200 * time.Millisecond
+)
+
+// LegacyRoute is the direct exchange and routing key every event was published with before
+// topic routing. While set, each event is published there too, so consumers still bound to
+// it keep receiving events until they move to the topic exchange.
+type LegacyRoute struct {
+	Exchange   string // empty once every consumer has moved
+	RoutingKey string // e.g. "product_event"
+}
+
 type producer struct {
 	cfg struct {
 		exchange string
 		queue    string
-		binding  string
+		bindings []string
+		legacy   LegacyRoute
 	}
 
-	c *rabbit.Client
+	c   *rabbit.Client
+	pub *rabbit.AsyncPublisher
+
+	mu       sync.Mutex // guards closing, so no settle starts once Close waits for them
+	closing  bool
+	settling sync.WaitGroup // events whose confirms are still awaited
+}
+
+// route is an exchange and routing key an event is published with.
+type route struct {
+	exchange, key string
 }
 
-func NewProducer(c *rabbit.Client, exchange, queue, binding string) (ports.Publisher, error) {
+// delivery is an event sent on every route, with the confirm awaited from each.
+type delivery struct {
+	event   string
+	payload []byte
+	headers amqp091.Table
+	routes  []route
+	futures []*rabbit.Future
+}
+
+func NewProducer(c *rabbit.Client, exchange string, kind rabbit.ExchangeType, queue string, bindings []string, legacy LegacyRoute, maxInFlight int) (ports.Publisher, error) {
+	if legacy.Exchange != "" && legacy.Exchange == exchange {
+		return nil, fmt.Errorf("legacy exchange %q must differ from the exchange published to", exchange)
+	}
+
 	ch, err := c.Channel()
 	if err != nil {
 		return nil, err
 	}
 	defer c.Put(ch)
 
-	// product
-	if err = c.CreateExchange(ch, exchange, rabbit.ExchangeDirect, true, false); err != nil {
+	// product_events
+	if err = c.CreateExchange(ch, exchange, kind, true, false); err != nil {
 		return nil, err
 	}
 
-	// product_queue
-	if err = c.CreateQueue(ch, queue, true, false); err != nil {
-		return nil, err
+	if legacy.Exchange != "" {
+		// product_exchange, as it was declared before topic routing. The queue is left to
+		// its consumer, which moves its binding over to the new exchange when it upgrades.
+		if err = c.CreateExchange(ch, legacy.Exchange, rabbit.ExchangeDirect, true, false); err != nil {
+			return nil, err
+		}
+	} else {
+		// product_queue
+		if err = c.CreateQueue(ch, queue, true, false); err != nil {
+			return nil, err
+		}
+
+		// product.*
+		for _, binding := range bindings {
+			if err = c.CreateBinding(ch, queue, binding, exchange); err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	// product_event
-	if err = c.CreateBinding(ch, queue, binding, exchange); err != nil {
+	// confirms are pipelined on a dedicated channel, so concurrent requests don't wait on each other
+	pub, err := c.NewAsyncPublisher(maxInFlight)
+	if err != nil {
 		return nil, err
 	}
 
 	return &producer{
-		c: c,
+		c:   c,
+		pub: pub,
 		cfg: struct {
 			exchange string
 			queue    string
-			binding  string
+			bindings []string
+			legacy   LegacyRoute
 		}{
 			exchange: exchange,
 			queue:    queue,
-			binding:  binding,
+			bindings: bindings,
+			legacy:   legacy,
 		},
 	}, nil
 }
 
+// Publish hands the event to the broker and returns without waiting for its confirm, so
+// requests don't queue behind each other's round trips. The confirm is awaited in the
+// background: an exchange that fails to take the event is sent it again, and an event
+// that still isn't delivered is logged. Consumers skip the duplicates a resend can cause.
 func (p *producer) Publish(ctx context.Context, payload []byte, event string) error {
-	ch, err := p.c.Channel()
+	p.mu.Lock()
+	if p.closing {
+		p.mu.Unlock()
+		return rabbit.ErrPublisherClosed
+	}
+	p.settling.Add(1)
+	p.mu.Unlock()
+
+	d, err := p.send(ctx, payload, event)
 	if err != nil {
+		p.settling.Done()
 		return err
 	}
-	defer p.c.Put(ch)
 
-	log.Println("publishing", event, "to", p.cfg.queue)
+	go p.settle(d)
+	return nil
+}
+
+// PublishConfirmed publishes the event and waits until the broker has taken it, for callers
+// that must not move on before then, such as the change data capture source.
+func (p *producer) PublishConfirmed(ctx context.Context, payload []byte, event string) error {
+	d, err := p.send(ctx, payload, event)
+	if err != nil {
+		return err
+	}
+
+	errs := make([]error, len(d.futures))
+	for i, f := range d.futures {
+		errs[i] = f.Wait(ctx)
+	}
+	return delivered(errs...)
+}
+
+// send publishes the event on its route and, while consumers move over, the legacy one.
+func (p *producer) send(ctx context.Context, payload []byte, event string) (*delivery, error) {
+	key, ok := product.RoutingKey(event)
+	if !ok {
+		return nil, fmt.Errorf("unknown event type %q", event)
+	}
+
+	d := &delivery{
+		event:   event,
+		payload: payload,
+		// event_type is kept for consumers that still dispatch on the header instead of the routing key
+		headers: amqp091.Table{"event_type": event},
+		routes:  []route{{p.cfg.exchange, key}},
+	}
+	if p.cfg.legacy.Exchange != "" {
+		d.routes = append(d.routes, route{p.cfg.legacy.Exchange, p.cfg.legacy.RoutingKey})
+	}
+
+	log.Println("publishing", event, "to", p.cfg.exchange, "with", key)
+
+	d.futures = make([]*rabbit.Future, len(d.routes))
+	for i, r := range d.routes {
+		f, err := p.pub.PublishJSON(ctx, r.exchange, r.key, payload, d.headers)
+		if err != nil {
+			return nil, err
+		}
+		d.futures[i] = f
+	}
+
+	return d, nil
+}
+
+// settle waits for every route's confirm, resending the event on routes that failed until
+// it is delivered or publishAttempts is reached.
+func (p *producer) settle(d *delivery) {
+	defer p.settling.Done()
+
+	errs := make([]error, len(d.routes))
+	for attempt := 1; ; attempt++ {
+		for i, f := range d.futures {
+			if f != nil {
+				<-f.Done()
+				errs[i] = f.Err()
+			}
+		}
+
+		err := delivered(errs...)
+		if err == nil {
+			return
+		}
+		if attempt == publishAttempts {
+			log.Printf("giving up on %s event %s after %d attempts: %v", d.event, eventID(d.payload), attempt, err)
+			return
+		}
+
+		log.Printf("resending %s event %s: %v", d.event, eventID(d.payload), err)
+		time.Sleep(publishBackoff * time.Duration(attempt))
+
+		for i, r := range d.routes {
+			d.futures[i] = nil
+			if errs[i] == nil {
+				continue
+			}
+			if d.futures[i], err = p.pub.PublishJSON(context.Background(), r.exchange, r.key, d.payload, d.headers); err != nil {
+				errs[i] = err
+			}
+		}
+	}
+}
+
+// eventID reads the event ID from an event's payload, for logging.
+func eventID(payload []byte) string {
+	var e struct {
+		EventID string `json:"event_id"`
+	}
+	_ = json.Unmarshal(payload, &e)
+	return e.EventID
+}
+
+// delivered combines the outcomes of publishing an event on both exchanges. While consumers
+// move over, each queue is bound to one of them, so the event is delivered if either routed it.
+func delivered(errs ...error) error {
+	routed := false
+	for _, err := range errs {
+		if err == nil {
+			routed = true
+		} else if !errors.Is(err, rabbit.ErrUnroutable) {
+			return err
+		}
+	}
+
+	if !routed {
+		return rabbit.ErrUnroutable
+	}
+	return nil
+}
+
+// Close stops taking events, waits for outstanding confirms and resends, and closes the
+// publishing channel.
+func (p *producer) Close(ctx context.Context) error {
+	p.mu.Lock()
+	p.closing = true
+	p.mu.Unlock()
+
+	settled := make(chan struct{})
+	go func() {
+		p.settling.Wait()
+		close(settled)
+	}()
+
+	select {
+	case <-settled:
+	case <-ctx.Done():
+	}
 
-	return p.c.SendDeferredJSON(ctx, ch, p.cfg.exchange, p.cfg.binding, payload, amqp091.Table{
-		"event_type": event,
-	})
+	return p.pub.Close(ctx)
 }
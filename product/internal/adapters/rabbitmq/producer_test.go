@@ -0,0 +1,33 @@
+package rabbitmq
+
+import (
+	"errors"
+	"github.com/ziliscite/cqrs_product/pkg/rabbit"
+	"testing"
+)
+
+func TestDelivered(t *testing.T) {
+	broken := errors.New("connection reset")
+
+	tests := []struct {
+		name string
+		errs []error
+		want error
+	}{
+		{"routed", []error{nil}, nil},
+		{"unroutable", []error{rabbit.ErrUnroutable}, rabbit.ErrUnroutable},
+		{"routed by the legacy exchange only", []error{rabbit.ErrUnroutable, nil}, nil},
+		{"routed by the new exchange only", []error{nil, rabbit.ErrUnroutable}, nil},
+		{"routed by neither", []error{rabbit.ErrUnroutable, rabbit.ErrUnroutable}, rabbit.ErrUnroutable},
+		{"nacked", []error{nil, rabbit.ErrNacked}, rabbit.ErrNacked},
+		{"failed", []error{broken, nil}, broken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := delivered(tt.errs...); !errors.Is(err, tt.want) || (tt.want == nil && err != nil) {
+				t.Errorf("delivered(%v) = %v, want %v", tt.errs, err, tt.want)
+			}
+		})
+	}
+}
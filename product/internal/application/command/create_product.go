@@ -3,6 +3,7 @@ package command
 import (
 	"context"
 	"encoding/json"
+	"github.com/google/uuid"
 	"github.com/ziliscite/cqrs_product/internal/domain/product"
 	"github.com/ziliscite/cqrs_product/internal/ports"
 )
@@ -41,14 +42,16 @@ func NewCreateProduct(name, category string, price float64) (CreateProductEvent,
 }
 
 type CreateProductRequest struct {
+	EventID  string  `json:"event_id"`
 	ID       string  `json:"id"`
 	Name     string  `json:"name"`
 	Price    float64 `json:"price"`
 	Category string  `json:"category"`
+	Version  int64   `json:"version"`
 }
 
 type CreateProductHandler interface {
-	Handle(ctx context.Context, cmd CreateProductEvent) error
+	Handle(ctx context.Context, cmd CreateProductEvent) (product.Token, error)
 }
 
 type createProductHandler struct {
@@ -60,25 +63,31 @@ func NewCreateProductHandler(repo ports.Repository, producer ports.Publisher) Cr
 	return &createProductHandler{repo: repo, pub: producer}
 }
 
-func (h *createProductHandler) Handle(ctx context.Context, cmd CreateProductEvent) error {
+func (h *createProductHandler) Handle(ctx context.Context, cmd CreateProductEvent) (product.Token, error) {
 	p, err := product.New(cmd.Name, cmd.Category, cmd.Price)
 	if err != nil {
-		return err
+		return product.Token{}, err
 	}
 
 	if err = h.repo.Create(ctx, p); err != nil {
-		return err
+		return product.Token{}, err
 	}
 
 	msg, err := json.Marshal(CreateProductRequest{
+		EventID:  uuid.NewString(),
 		ID:       p.ID(),
 		Name:     p.Name(),
 		Price:    p.Price(),
 		Category: p.Category(),
+		Version:  p.Version(),
 	})
 	if err != nil {
-		return err
+		return product.Token{}, err
 	}
 
-	return h.pub.Publish(ctx, msg, "create")
+	if err = h.pub.Publish(ctx, msg, "create"); err != nil {
+		return product.Token{}, err
+	}
+
+	return product.Token{ID: p.ID(), Version: p.Version()}, nil
 }
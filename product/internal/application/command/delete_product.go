@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"github.com/google/uuid"
 	"github.com/ziliscite/cqrs_product/internal/domain/product"
 	"github.com/ziliscite/cqrs_product/internal/ports"
 )
@@ -25,11 +26,15 @@ func NewDeleteProduct(id string) (DeleteProduct, error) {
 }
 
 type DeleteProductRequest struct {
-	ID string `json:"id"`
+	EventID string `json:"event_id"`
+	ID      string `json:"id"`
+	Version int64  `json:"version"` // one past the last stored version, so the delete supersedes it
+
+	Last *ProductSnapshot `json:"last,omitempty"` // the state the product was deleted in
 }
 
 type DeleteProductHandler interface {
-	Handle(ctx context.Context, cmd DeleteProduct) error
+	Handle(ctx context.Context, cmd DeleteProduct) (product.Token, error)
 }
 
 type deleteProductHandler struct {
@@ -41,17 +46,25 @@ func NewDeleteProductHandler(repo ports.Repository, producer ports.Publisher) De
 	return &deleteProductHandler{repo: repo, pub: producer}
 }
 
-func (h *deleteProductHandler) Handle(ctx context.Context, cmd DeleteProduct) error {
-	if err := h.repo.Delete(ctx, cmd.ID.String()); err != nil {
-		return err
+func (h *deleteProductHandler) Handle(ctx context.Context, cmd DeleteProduct) (product.Token, error) {
+	p, err := h.repo.Delete(ctx, cmd.ID.String())
+	if err != nil {
+		return product.Token{}, err
 	}
 
 	msg, err := json.Marshal(DeleteProductRequest{
-		ID: cmd.ID.String(),
+		EventID: uuid.NewString(),
+		ID:      p.ID(),
+		Version: p.Version() + 1,
+		Last:    NewProductSnapshot(p),
 	})
 	if err != nil {
-		return err
+		return product.Token{}, err
+	}
+
+	if err = h.pub.Publish(ctx, msg, "delete"); err != nil {
+		return product.Token{}, err
 	}
 
-	return h.pub.Publish(ctx, msg, "delete")
+	return product.Token{ID: p.ID(), Version: p.Version() + 1}, nil
 }
@@ -0,0 +1,33 @@
+package command
+
+import (
+	"context"
+	"github.com/ziliscite/cqrs_product/internal/ports"
+	"time"
+)
+
+type PruneChanges struct {
+	Before time.Time
+}
+
+// NewPruneChanges prunes the changes older than retention.
+func NewPruneChanges(retention time.Duration) PruneChanges {
+	return PruneChanges{Before: time.Now().Add(-retention)}
+}
+
+// PruneChangesHandler enforces the change log's retention.
+type PruneChangesHandler interface {
+	Handle(ctx context.Context, cmd PruneChanges) (int64, error)
+}
+
+type pruneChangesHandler struct {
+	log ports.ChangeLog
+}
+
+func NewPruneChangesHandler(log ports.ChangeLog) PruneChangesHandler {
+	return &pruneChangesHandler{log: log}
+}
+
+func (h *pruneChangesHandler) Handle(ctx context.Context, cmd PruneChanges) (int64, error) {
+	return h.log.Prune(ctx, cmd.Before)
+}
@@ -0,0 +1,21 @@
+package command
+
+import "github.com/ziliscite/cqrs_product/internal/domain/product"
+
+// ProductSnapshot is the state of a product at some version, carried by events so
+// consumers can tell what a change replaced.
+type ProductSnapshot struct {
+	Name     string  `json:"name"`
+	Price    float64 `json:"price"`
+	Category string  `json:"category"`
+	Version  int64   `json:"version"`
+}
+
+func NewProductSnapshot(p *product.Product) *ProductSnapshot {
+	return &ProductSnapshot{
+		Name:     p.Name(),
+		Price:    p.Price(),
+		Category: p.Category(),
+		Version:  p.Version(),
+	}
+}
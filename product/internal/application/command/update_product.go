@@ -3,6 +3,7 @@ package command
 import (
 	"context"
 	"encoding/json"
+	"github.com/google/uuid"
 	"github.com/ziliscite/cqrs_product/internal/domain/product"
 	"github.com/ziliscite/cqrs_product/internal/ports"
 )
@@ -47,14 +48,19 @@ func NewUpdateProduct(id, name, category string, price float64) (UpdateProductEv
 }
 
 type UpdateProductRequest struct {
+	EventID  string  `json:"event_id"`
 	ID       string  `json:"id"`
 	Name     string  `json:"name"`
 	Price    float64 `json:"price"`
 	Category string  `json:"category"`
+	Version  int64   `json:"version"`
+
+	Previous *ProductSnapshot `json:"previous,omitempty"` // the state this update replaced
+	Changed  []string         `json:"changed,omitempty"`  // fields that differ from previous
 }
 
 type UpdateProductHandler interface {
-	Handle(ctx context.Context, cmd UpdateProductEvent) error
+	Handle(ctx context.Context, cmd UpdateProductEvent) (product.Token, error)
 }
 
 type updateProductHandler struct {
@@ -66,26 +72,35 @@ func NewUpdateProductHandler(repo ports.Repository, producer ports.Publisher) Up
 	return &updateProductHandler{repo: repo, pub: producer}
 }
 
-func (h *updateProductHandler) Handle(ctx context.Context, cmd UpdateProductEvent) error {
+func (h *updateProductHandler) Handle(ctx context.Context, cmd UpdateProductEvent) (product.Token, error) {
 	p, err := product.New(cmd.Name, cmd.Category, cmd.Price)
 	if err != nil {
-		return err
+		return product.Token{}, err
 	}
 	p.SetID(cmd.ID)
 
-	if err = h.repo.Update(ctx, p); err != nil {
-		return err
+	prev, err := h.repo.Update(ctx, p)
+	if err != nil {
+		return product.Token{}, err
 	}
 
 	msg, err := json.Marshal(UpdateProductRequest{
+		EventID:  uuid.NewString(),
 		ID:       p.ID(),
 		Name:     p.Name(),
 		Price:    p.Price(),
 		Category: p.Category(),
+		Version:  p.Version(),
+		Previous: NewProductSnapshot(prev),
+		Changed:  prev.Changed(p),
 	})
 	if err != nil {
-		return err
+		return product.Token{}, err
+	}
+
+	if err = h.pub.Publish(ctx, msg, "update"); err != nil {
+		return product.Token{}, err
 	}
 
-	return h.pub.Publish(ctx, msg, "update")
+	return product.Token{ID: p.ID(), Version: p.Version()}, nil
 }
@@ -0,0 +1,97 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"github.com/ziliscite/cqrs_product/internal/domain/product"
+	"github.com/ziliscite/cqrs_product/internal/ports"
+)
+
+const (
+	DefaultExportLimit = 500
+	MaxExportLimit     = 5000
+)
+
+type ExportProducts struct {
+	After string // exclusive ID cursor; empty starts from the beginning
+	Limit int
+	IDs   []string // if set, exports just these products in a single page
+}
+
+func NewExportProducts(after string, limit int, ids []string) (ExportProducts, error) {
+	if len(ids) > MaxExportLimit {
+		return ExportProducts{}, fmt.Errorf("at most %d ids can be exported at once", MaxExportLimit)
+	}
+
+	if limit <= 0 {
+		limit = DefaultExportLimit
+	}
+	if limit > MaxExportLimit {
+		limit = MaxExportLimit
+	}
+
+	return ExportProducts{
+		After: after,
+		Limit: limit,
+		IDs:   ids,
+	}, nil
+}
+
+type ExportedProduct struct {
+	ID       string  `json:"id"`
+	Name     string  `json:"name"`
+	Price    float64 `json:"price"`
+	Category string  `json:"category"`
+	Version  int64   `json:"version"`
+}
+
+type ExportPage struct {
+	Items []ExportedProduct `json:"items"`
+	Next  string            `json:"next,omitempty"` // cursor for the next page; empty on the last one
+}
+
+// ExportProductsHandler pages through every product in ID order, so downstream
+// projections can be rebuilt from the system of record.
+type ExportProductsHandler interface {
+	Handle(ctx context.Context, query ExportProducts) (ExportPage, error)
+}
+
+type exportProductsHandler struct {
+	repo ports.Repository
+}
+
+func NewExportProductsHandler(repo ports.Repository) ExportProductsHandler {
+	return &exportProductsHandler{repo: repo}
+}
+
+func (h *exportProductsHandler) Handle(ctx context.Context, query ExportProducts) (ExportPage, error) {
+	var (
+		products []*product.Product
+		err      error
+	)
+	if len(query.IDs) > 0 {
+		products, err = h.repo.ListByIDs(ctx, query.IDs)
+	} else {
+		products, err = h.repo.List(ctx, query.After, query.Limit)
+	}
+	if err != nil {
+		return ExportPage{}, err
+	}
+
+	page := ExportPage{Items: make([]ExportedProduct, len(products))}
+	for i, p := range products {
+		page.Items[i] = ExportedProduct{
+			ID:       p.ID(),
+			Name:     p.Name(),
+			Price:    p.Price(),
+			Category: p.Category(),
+			Version:  p.Version(),
+		}
+	}
+
+	if len(query.IDs) == 0 && len(products) == query.Limit {
+		page.Next = products[len(products)-1].ID()
+	}
+
+	return page, nil
+}
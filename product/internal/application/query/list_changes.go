@@ -0,0 +1,187 @@
+package query
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"github.com/ziliscite/cqrs_product/internal/domain/product"
+	"github.com/ziliscite/cqrs_product/internal/ports"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultChangesLimit = 100
+	MaxChangesLimit     = 1000
+	MaxChangesWait      = 30 * time.Second
+
+	// changesPollInterval is how often the log is re-read while a long poll waits for changes.
+	changesPollInterval = 500 * time.Millisecond
+
+	cursorPrefix = "c1:"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+type ListChanges struct {
+	After    int64 // position the cursor points at
+	Resuming bool  // false when reading from the start of the retained log
+	Limit    int
+	Wait     time.Duration // how long to wait for changes when there are none yet
+}
+
+// NewListChanges reads from the position encoded in cursor, or from the oldest retained change if it is empty.
+func NewListChanges(cursor string, limit int, wait time.Duration) (ListChanges, error) {
+	var q ListChanges
+	if cursor != "" {
+		after, err := decodeCursor(cursor)
+		if err != nil {
+			return q, err
+		}
+		q.After = after
+		q.Resuming = true
+	}
+
+	if limit <= 0 {
+		limit = DefaultChangesLimit
+	}
+	if limit > MaxChangesLimit {
+		limit = MaxChangesLimit
+	}
+	q.Limit = limit
+
+	if wait < 0 {
+		wait = 0
+	}
+	if wait > MaxChangesWait {
+		wait = MaxChangesWait
+	}
+	q.Wait = wait
+
+	return q, nil
+}
+
+// encodeCursor makes the log position opaque to clients, so its format can change.
+func encodeCursor(seq int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(cursorPrefix + strconv.FormatInt(seq, 10)))
+}
+
+func decodeCursor(cursor string) (int64, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, ErrInvalidCursor
+	}
+
+	s, ok := strings.CutPrefix(string(b), cursorPrefix)
+	if !ok {
+		return 0, ErrInvalidCursor
+	}
+
+	seq, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || seq < 0 {
+		return 0, ErrInvalidCursor
+	}
+
+	return seq, nil
+}
+
+type ChangeItem struct {
+	ID        string           `json:"id"`
+	Version   int64            `json:"version"`
+	Deleted   bool             `json:"deleted"`
+	Product   *ExportedProduct `json:"product,omitempty"` // unset for a tombstone
+	ChangedAt time.Time        `json:"changed_at"`
+}
+
+type ChangePage struct {
+	Items      []ChangeItem `json:"items"`
+	NextCursor string       `json:"next_cursor"` // always set, so an empty page can be polled again
+	HasMore    bool         `json:"has_more"`
+}
+
+// ListChangesHandler serves the change log to consumers that pull it instead of subscribing to events.
+type ListChangesHandler interface {
+	Handle(ctx context.Context, query ListChanges) (ChangePage, error)
+}
+
+type listChangesHandler struct {
+	log ports.ChangeLog
+}
+
+func NewListChangesHandler(log ports.ChangeLog) ListChangesHandler {
+	return &listChangesHandler{log: log}
+}
+
+// Handle returns the changes after the cursor. When there are none it waits up to query.Wait
+// for some to arrive, and returns an empty page if none do or ctx is done first.
+func (h *listChangesHandler) Handle(ctx context.Context, query ListChanges) (ChangePage, error) {
+	if query.Resuming {
+		horizon, err := h.log.Horizon(ctx)
+		if err != nil {
+			return ChangePage{}, err
+		}
+
+		// a cursor at the horizon has read every change pruned; one below it has missed some
+		if query.After < horizon {
+			return ChangePage{}, product.ErrChangesPruned
+		}
+	}
+
+	deadline := time.Now().Add(query.Wait)
+	for {
+		// one extra tells whether there is more to read
+		changes, err := h.log.Since(ctx, query.After, query.Limit+1)
+		if err != nil {
+			if ctx.Err() != nil {
+				return newChangePage(nil, query), nil
+			}
+			return ChangePage{}, err
+		}
+
+		wait := time.Until(deadline)
+		if len(changes) > 0 || wait <= 0 {
+			return newChangePage(changes, query), nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return newChangePage(nil, query), nil
+		case <-time.After(min(wait, changesPollInterval)):
+		}
+	}
+}
+
+func newChangePage(changes []product.Change, query ListChanges) ChangePage {
+	page := ChangePage{Items: make([]ChangeItem, 0, len(changes))}
+	if len(changes) > query.Limit {
+		changes = changes[:query.Limit]
+		page.HasMore = true
+	}
+
+	last := query.After
+	for _, c := range changes {
+		item := ChangeItem{
+			ID:        c.ID,
+			Version:   c.Version,
+			Deleted:   c.Deleted(),
+			ChangedAt: c.ChangedAt,
+		}
+
+		if p := c.Product; p != nil {
+			item.Product = &ExportedProduct{
+				ID:       p.ID(),
+				Name:     p.Name(),
+				Price:    p.Price(),
+				Category: p.Category(),
+				Version:  p.Version(),
+			}
+		}
+
+		page.Items = append(page.Items, item)
+		last = c.Seq
+	}
+
+	page.NextCursor = encodeCursor(last)
+	return page
+}
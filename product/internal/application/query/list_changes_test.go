@@ -0,0 +1,236 @@
+package query
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"github.com/ziliscite/cqrs_product/internal/domain/product"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLog is a change log holding changes positioned 1, 2, ...; reads stages more of them
+// as it is read, one batch per Since call, staying at the last.
+type fakeLog struct {
+	mu      sync.Mutex
+	changes []product.Change
+	reads   [][]product.Change
+	horizon int64
+	err     error
+	since   int // Since calls
+}
+
+func (l *fakeLog) Since(_ context.Context, after int64, limit int) ([]product.Change, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.since++
+	if l.err != nil {
+		return nil, l.err
+	}
+	if len(l.reads) > 0 {
+		l.changes = append(l.changes, l.reads[0]...)
+		l.reads = l.reads[1:]
+	}
+
+	var out []product.Change
+	for _, c := range l.changes {
+		if c.Seq > after && len(out) < limit {
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+func (l *fakeLog) Horizon(context.Context) (int64, error) {
+	return l.horizon, nil
+}
+
+func (l *fakeLog) Prune(context.Context, time.Time) (int64, error) {
+	return 0, nil
+}
+
+func change(t *testing.T, seq int64, id string) product.Change {
+	t.Helper()
+	p, err := product.New("Trail Shoe", "shoes", 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetID(id)
+	p.SetVersion(1)
+	return product.Change{Seq: seq, ID: id, Version: 1, Product: p, ChangedAt: time.Now()}
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	for _, pos := range []int64{0, 1, 42, 1 << 40} {
+		q, err := NewListChanges(encodeCursor(pos), 0, 0)
+		if err != nil {
+			t.Fatalf("NewListChanges(encodeCursor(%d)) = %v", pos, err)
+		}
+		if q.After != pos || !q.Resuming {
+			t.Errorf("cursor for %d read as %+v", pos, q)
+		}
+	}
+
+	q, err := NewListChanges("", 0, 0)
+	if err != nil || q.Resuming || q.After != 0 {
+		t.Errorf("NewListChanges without a cursor = %+v, %v, want the start of the log", q, err)
+	}
+}
+
+func TestInvalidCursors(t *testing.T) {
+	encode := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+
+	for name, cursor := range map[string]string{
+		"not base64":     "not base64!",
+		"bare position":  encode("42"),
+		"unknown format": encode("c2:42"),
+		"not a number":   encode(cursorPrefix + "x"),
+		"negative":       encode(cursorPrefix + "-1"),
+		"padded":         base64.URLEncoding.EncodeToString([]byte(cursorPrefix + "4")),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := NewListChanges(cursor, 0, 0); !errors.Is(err, ErrInvalidCursor) {
+				t.Errorf("NewListChanges(%q) = %v, want ErrInvalidCursor", cursor, err)
+			}
+		})
+	}
+}
+
+func TestListChangesBounds(t *testing.T) {
+	tests := []struct {
+		limit, wantLimit int
+		wait, wantWait   time.Duration
+	}{
+		{0, DefaultChangesLimit, 0, 0},
+		{-1, DefaultChangesLimit, -time.Second, 0},
+		{10, 10, time.Second, time.Second},
+		{MaxChangesLimit + 1, MaxChangesLimit, time.Hour, MaxChangesWait},
+	}
+
+	for _, tt := range tests {
+		q, err := NewListChanges("", tt.limit, tt.wait)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if q.Limit != tt.wantLimit || q.Wait != tt.wantWait {
+			t.Errorf("NewListChanges(%d, %s) = limit %d, wait %s, want %d, %s", tt.limit, tt.wait, q.Limit, q.Wait, tt.wantLimit, tt.wantWait)
+		}
+	}
+}
+
+func TestListChangesPages(t *testing.T) {
+	log := &fakeLog{changes: []product.Change{change(t, 1, "a"), change(t, 2, "b"), change(t, 3, "c")}}
+	h := NewListChangesHandler(log)
+
+	q, _ := NewListChanges("", 2, 0)
+	page, err := h.Handle(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Items) != 2 || page.Items[1].ID != "b" || !page.HasMore {
+		t.Fatalf("first page = %+v, want a and b with more to read", page)
+	}
+
+	q, _ = NewListChanges(page.NextCursor, 2, 0)
+	if page, err = h.Handle(context.Background(), q); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Items) != 1 || page.Items[0].ID != "c" || page.HasMore {
+		t.Fatalf("second page = %+v, want only c", page)
+	}
+
+	// the end of the log can be polled again from where it was left
+	last := page.NextCursor
+	q, _ = NewListChanges(last, 2, 0)
+	if page, err = h.Handle(context.Background(), q); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Items) != 0 || page.NextCursor != last {
+		t.Errorf("page past the end = %+v, want it empty with cursor %q", page, last)
+	}
+}
+
+func TestListChangesHorizon(t *testing.T) {
+	tests := []struct {
+		name   string
+		cursor string
+		want   error
+	}{
+		{"from the start", "", nil},
+		{"at the horizon", encodeCursor(5), nil},
+		{"past the horizon", encodeCursor(6), nil},
+		{"below the horizon", encodeCursor(4), product.ErrChangesPruned},
+		{"from the very start", encodeCursor(0), product.ErrChangesPruned},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewListChangesHandler(&fakeLog{changes: []product.Change{change(t, 6, "a")}, horizon: 5})
+
+			q, err := NewListChanges(tt.cursor, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = h.Handle(context.Background(), q); !errors.Is(err, tt.want) {
+				t.Errorf("Handle() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestListChangesWaitsForChanges(t *testing.T) {
+	log := &fakeLog{reads: [][]product.Change{nil, nil, {change(t, 1, "a")}}}
+	h := NewListChangesHandler(log)
+
+	q, _ := NewListChanges("", 0, 10*time.Second)
+	started := time.Now()
+	page, err := h.Handle(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Items) != 1 || page.Items[0].ID != "a" {
+		t.Errorf("page = %+v, want the change that arrived", page)
+	}
+	if log.since != 3 {
+		t.Errorf("read the log %d times, want until the change arrived", log.since)
+	}
+	// two polls, not the whole wait
+	if took := time.Since(started); took > 5*changesPollInterval {
+		t.Errorf("returned after %s, want soon after the change arrived", took)
+	}
+}
+
+func TestListChangesStopsWaiting(t *testing.T) {
+	h := NewListChangesHandler(&fakeLog{})
+	q, _ := NewListChanges(encodeCursor(3), 0, 100*time.Millisecond)
+
+	page, err := h.Handle(context.Background(), q)
+	if err != nil || len(page.Items) != 0 || page.NextCursor != encodeCursor(3) {
+		t.Errorf("Handle() after the wait = %+v, %v, want an empty page at the same cursor", page, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	q.Wait = MaxChangesWait
+
+	started := time.Now()
+	page, err = h.Handle(ctx, q)
+	if err != nil || len(page.Items) != 0 {
+		t.Errorf("Handle() when ctx is done = %+v, %v, want an empty page", page, err)
+	}
+	if took := time.Since(started); took > time.Second {
+		t.Errorf("returned %s after starting, want when ctx was done", took)
+	}
+}
+
+func TestListChangesErrors(t *testing.T) {
+	failed := errors.New("database unavailable")
+	h := NewListChangesHandler(&fakeLog{err: failed})
+
+	q, _ := NewListChanges("", 0, 0)
+	if _, err := h.Handle(context.Background(), q); !errors.Is(err, failed) {
+		t.Errorf("Handle() = %v, want the log's error", err)
+	}
+}
@@ -2,6 +2,7 @@ package application
 
 import (
 	"github.com/ziliscite/cqrs_product/internal/application/command"
+	"github.com/ziliscite/cqrs_product/internal/application/query"
 	"github.com/ziliscite/cqrs_product/internal/ports"
 )
 
@@ -9,12 +10,20 @@ type Service struct {
 	Create command.CreateProductHandler
 	Update command.UpdateProductHandler
 	Delete command.DeleteProductHandler
+	Export query.ExportProductsHandler
+
+	Changes      query.ListChangesHandler
+	PruneChanges command.PruneChangesHandler
 }
 
-func NewService(repo ports.Repository, cu ports.Publisher) Service {
+func NewService(repo ports.Repository, changes ports.ChangeLog, cu ports.Publisher) Service {
 	return Service{
 		Create: command.NewCreateProductHandler(repo, cu),
 		Update: command.NewUpdateProductHandler(repo, cu),
 		Delete: command.NewDeleteProductHandler(repo, cu),
+		Export: query.NewExportProductsHandler(repo),
+
+		Changes:      query.NewListChangesHandler(changes),
+		PruneChanges: command.NewPruneChangesHandler(changes),
 	}
 }
@@ -0,0 +1,24 @@
+package product
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrChangesPruned is returned when reading the change log from a position whose
+// following changes have already been removed by retention.
+var ErrChangesPruned = errors.New("changes after cursor have been pruned")
+
+// Change is an entry of the product change log: the state a write left a product in,
+// or a tombstone when it was deleted.
+type Change struct {
+	Seq       int64 // position in the log; a change is never positioned before one already read
+	ID        string
+	Version   int64
+	Product   *Product // nil for a tombstone
+	ChangedAt time.Time
+}
+
+func (c Change) Deleted() bool {
+	return c.Product == nil
+}
@@ -0,0 +1,15 @@
+package product
+
+// routingKeys maps events onto the routing keys they are published under (AMQP topics, NATS subjects),
+// so consumers can subscribe to a subset of events, e.g. "product.deleted" or "product.*".
+var routingKeys = map[string]string{
+	"create": "product.created",
+	"update": "product.updated",
+	"delete": "product.deleted",
+}
+
+// RoutingKey returns the routing key the event is published under, e.g. "product.updated" for "update".
+func RoutingKey(event string) (string, bool) {
+	key, ok := routingKeys[event]
+	return key, ok
+}
@@ -5,6 +5,8 @@ import (
 	"github.com/google/uuid"
 )
 
+var ErrNotFound = errors.New("product not found")
+
 type ID string
 
 func NewID() ID {
@@ -20,6 +22,7 @@ type Product struct {
 	name     string
 	price    float64
 	category string
+	version  int64 // incremented on every change, starting at 1
 }
 
 func New(name, category string, price float64) (*Product, error) {
@@ -40,6 +43,7 @@ func New(name, category string, price float64) (*Product, error) {
 		name:     name,
 		price:    price,
 		category: category,
+		version:  1,
 	}, nil
 }
 
@@ -62,3 +66,26 @@ func (p *Product) Price() float64 {
 func (p *Product) Category() string {
 	return p.category
 }
+
+func (p *Product) Version() int64 {
+	return p.version
+}
+
+func (p *Product) SetVersion(version int64) {
+	p.version = version
+}
+
+// Changed lists the fields ("name", "price", "category") whose values differ between p and next.
+func (p *Product) Changed(next *Product) []string {
+	var fields []string
+	if p.name != next.name {
+		fields = append(fields, "name")
+	}
+	if p.price != next.price {
+		fields = append(fields, "price")
+	}
+	if p.category != next.category {
+		fields = append(fields, "category")
+	}
+	return fields
+}
@@ -0,0 +1,15 @@
+package product
+
+import "strconv"
+
+// Token identifies the version a write left a product at. Clients hand it to the search
+// service to read their own writes: it waits until the product has reached that version.
+type Token struct {
+	ID      string
+	Version int64
+}
+
+// String encodes the token as "<id>:<version>".
+func (t Token) String() string {
+	return t.ID + ":" + strconv.FormatInt(t.Version, 10)
+}
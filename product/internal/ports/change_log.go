@@ -0,0 +1,17 @@
+package ports
+
+import (
+	"context"
+	"github.com/ziliscite/cqrs_product/internal/domain/product"
+	"time"
+)
+
+// ChangeLog is the durable, ordered log of product changes.
+type ChangeLog interface {
+	// Since returns up to limit changes positioned after after, in position order.
+	Since(ctx context.Context, after int64, limit int) ([]product.Change, error)
+	// Horizon returns the highest position removed by Prune, or 0.
+	Horizon(ctx context.Context) (int64, error)
+	// Prune removes the changes made before t and returns how many were removed.
+	Prune(ctx context.Context, before time.Time) (int64, error)
+}
@@ -0,0 +1,9 @@
+package ports
+
+import "context"
+
+// EventSource publishes product events from a source other than the command handlers.
+type EventSource interface {
+	// Run publishes events until ctx is done or the source fails.
+	Run(ctx context.Context) error
+}
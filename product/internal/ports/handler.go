@@ -1,10 +1,16 @@
 package ports
 
-import "github.com/gin-gonic/gin"
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+)
 
 type Handler interface {
 	Run(addr string) error
+	Shutdown(ctx context.Context) error
 	CreateProduct(c *gin.Context)
 	UpdateProduct(c *gin.Context)
 	DeleteProduct(c *gin.Context)
+	ExportProducts(c *gin.Context)
+	ListChanges(c *gin.Context)
 }
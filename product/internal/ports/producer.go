@@ -6,4 +6,5 @@ import (
 
 type Publisher interface {
 	Publish(ctx context.Context, payload []byte, event string) error
+	Close(ctx context.Context) error
 }
@@ -6,7 +6,14 @@ import (
 )
 
 type Repository interface {
+	// List returns up to limit products with an ID greater than after, in ID order.
+	List(ctx context.Context, after string, limit int) ([]*product.Product, error)
+	// ListByIDs returns the products among ids that exist, in ID order.
+	ListByIDs(ctx context.Context, ids []string) ([]*product.Product, error)
+
 	Create(ctx context.Context, product *product.Product) error
-	Update(ctx context.Context, product *product.Product) error
-	Delete(ctx context.Context, id string) error
+	// Update stores the product, bumps its version and returns its previous state.
+	Update(ctx context.Context, product *product.Product) (*product.Product, error)
+	// Delete removes the product and returns its last state.
+	Delete(ctx context.Context, id string) (*product.Product, error)
 }
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS product_events (
+    seq BIGSERIAL PRIMARY KEY,
+    event VARCHAR(16) NOT NULL,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
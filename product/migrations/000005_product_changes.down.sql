@@ -0,0 +1,4 @@
+DROP TRIGGER IF EXISTS product_changes ON products;
+DROP FUNCTION IF EXISTS record_product_change();
+DROP TABLE IF EXISTS product_changes_horizon;
+DROP TABLE IF EXISTS product_changes;
@@ -0,0 +1,47 @@
+CREATE TABLE IF NOT EXISTS product_changes (
+    seq BIGSERIAL PRIMARY KEY,
+    product_id uuid NOT NULL,
+    version BIGINT NOT NULL,
+    deleted BOOLEAN NOT NULL DEFAULT false,
+    name VARCHAR(255),
+    price DECIMAL(10, 2),
+    category VARCHAR(255),
+    changed_at TIMESTAMPTZ NOT NULL DEFAULT clock_timestamp(),
+    -- the writing transaction; a change gets its feed position, pos, once every transaction
+    -- that could still add an earlier one has finished
+    xid xid8 NOT NULL DEFAULT pg_current_xact_id(),
+    pos BIGINT UNIQUE
+);
+
+CREATE INDEX IF NOT EXISTS product_changes_changed_at ON product_changes (changed_at);
+CREATE INDEX IF NOT EXISTS product_changes_unpositioned ON product_changes (seq) WHERE pos IS NULL;
+
+-- the highest pos removed by retention; cursors below it have missed changes
+CREATE TABLE IF NOT EXISTS product_changes_horizon (
+    id BOOLEAN PRIMARY KEY DEFAULT true CHECK (id),
+    seq BIGINT NOT NULL
+);
+
+INSERT INTO product_changes_horizon (seq) VALUES (0) ON CONFLICT DO NOTHING;
+
+CREATE OR REPLACE FUNCTION record_product_change() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        -- one past the last stored version, matching the delete event
+        INSERT INTO product_changes (product_id, version, deleted) VALUES (OLD.id, OLD.version + 1, true);
+        RETURN OLD;
+    END IF;
+
+    INSERT INTO product_changes (product_id, version, name, price, category)
+    VALUES (NEW.id, NEW.version, NEW.name, NEW.price, NEW.category);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS product_changes ON products;
+CREATE TRIGGER product_changes AFTER INSERT OR UPDATE OR DELETE ON products
+    FOR EACH ROW EXECUTE FUNCTION record_product_change();
+
+-- the feed starts with the current catalog, already positioned
+INSERT INTO product_changes (product_id, version, name, price, category, pos)
+SELECT id, version, name, price, category, row_number() OVER (ORDER BY id) FROM products;
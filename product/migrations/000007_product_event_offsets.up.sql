@@ -0,0 +1,6 @@
+-- how far each search service consumer has read product_events; events every consumer
+-- has processed can be pruned
+CREATE TABLE IF NOT EXISTS product_event_offsets (
+    consumer VARCHAR(255) PRIMARY KEY,
+    seq BIGINT NOT NULL
+);
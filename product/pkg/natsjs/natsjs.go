@@ -0,0 +1,46 @@
+// Package natsjs provides helpers for using NATS JetStream as the product event transport.
+//
+// Subjects mirror the AMQP topic routing keys ("product.created", ...), so binding
+// patterns written for RabbitMQ can be reused via Subject.
+package natsjs
+
+import (
+	"context"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"strings"
+)
+
+// Connect connects to the NATS server at url and returns the connection and its JetStream context.
+func Connect(url string) (*nats.Conn, jetstream.JetStream, error) {
+	nc, err := nats.Connect(url, nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		nc.Close()
+		return nil, nil, err
+	}
+
+	return nc, js, nil
+}
+
+// EnsureStream creates the stream capturing subjects, or updates it if it already exists.
+func EnsureStream(ctx context.Context, js jetstream.JetStream, name string, subjects []string) (jetstream.Stream, error) {
+	return js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:     name,
+		Subjects: subjects,
+		Storage:  jetstream.FileStorage,
+	})
+}
+
+// Subject converts an AMQP topic pattern to a NATS subject, e.g. "product.#" to "product.>".
+// The single-word wildcard "*" means the same in both.
+func Subject(pattern string) string {
+	if strings.HasSuffix(pattern, "#") {
+		return strings.TrimSuffix(pattern, "#") + ">"
+	}
+	return pattern
+}
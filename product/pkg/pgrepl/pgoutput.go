@@ -0,0 +1,192 @@
+package pgrepl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// The pgoutput messages below are those needed to follow row changes; see
+// https://www.postgresql.org/docs/current/protocol-logicalrep-message-formats.html
+
+type Begin struct {
+	FinalLSN LSN // LSN of the transaction's commit
+	Xid      uint32
+}
+
+type Commit struct {
+	CommitLSN LSN
+	EndLSN    LSN // end of the transaction in the WAL; confirming it acknowledges the whole transaction
+}
+
+type Relation struct {
+	ID        uint32
+	Namespace string
+	Name      string
+	Columns   []string
+}
+
+// Tuple holds a row's columns in text format, in relation column order. A null column is nil.
+type Tuple [][]byte
+
+type Insert struct {
+	RelationID uint32
+	New        Tuple
+}
+
+type Update struct {
+	RelationID uint32
+	Old        Tuple // set with REPLICA IDENTITY FULL, or when the key changed
+	New        Tuple
+}
+
+type Delete struct {
+	RelationID uint32
+	Old        Tuple // the whole row with REPLICA IDENTITY FULL, otherwise just the key
+}
+
+// Decode decodes a pgoutput message into one of the types above. Other messages, such
+// as types, origins and truncates, decode to nil.
+func Decode(data []byte) (interface{}, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty pgoutput message")
+	}
+
+	d := &decoder{buf: data[1:]}
+	var msg interface{}
+	switch data[0] {
+	case 'B':
+		msg = &Begin{FinalLSN: LSN(d.uint64()), Xid: d.skip(8).uint32()}
+	case 'C':
+		d.skip(1) // flags
+		msg = &Commit{CommitLSN: LSN(d.uint64()), EndLSN: LSN(d.uint64())}
+	case 'R':
+		r := &Relation{ID: d.uint32(), Namespace: d.string(), Name: d.string()}
+		d.skip(1) // replica identity
+		n := int(d.uint16())
+		for i := 0; i < n && d.err == nil; i++ {
+			d.skip(1) // flags
+			r.Columns = append(r.Columns, d.string())
+			d.skip(8) // type oid and modifier
+		}
+		msg = r
+	case 'I':
+		msg = &Insert{RelationID: d.uint32(), New: d.expect('N').tuple()}
+	case 'U':
+		u := &Update{RelationID: d.uint32()}
+		switch d.byte() {
+		case 'K', 'O':
+			u.Old = d.tuple()
+			u.New = d.expect('N').tuple()
+		case 'N':
+			u.New = d.tuple()
+		default:
+			d.fail("update")
+		}
+		msg = u
+	case 'D':
+		del := &Delete{RelationID: d.uint32()}
+		switch d.byte() {
+		case 'K', 'O':
+			del.Old = d.tuple()
+		default:
+			d.fail("delete")
+		}
+		msg = del
+	default:
+		return nil, nil
+	}
+
+	if d.err != nil {
+		return nil, fmt.Errorf("decode pgoutput %q: %w", data[0], d.err)
+	}
+	return msg, nil
+}
+
+// decoder reads big-endian fields, recording the first error instead of returning it.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+// take returns the next n bytes. Once decoding has failed it returns zeroes, enough for
+// the fixed-size reads, so callers needn't check after every field.
+func (d *decoder) take(n int) []byte {
+	if d.err == nil && len(d.buf) < n {
+		d.err = errors.New("message too short")
+	}
+	if d.err != nil {
+		return make([]byte, min(n, 8))
+	}
+
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) fail(what string) {
+	if d.err == nil {
+		d.err = fmt.Errorf("malformed %s message", what)
+	}
+}
+
+func (d *decoder) skip(n int) *decoder {
+	d.take(n)
+	return d
+}
+
+func (d *decoder) byte() byte {
+	return d.take(1)[0]
+}
+
+func (d *decoder) expect(b byte) *decoder {
+	if got := d.byte(); got != b && d.err == nil {
+		d.err = fmt.Errorf("expected %q, got %q", b, got)
+	}
+	return d
+}
+
+func (d *decoder) uint16() uint16 {
+	return binary.BigEndian.Uint16(d.take(2))
+}
+
+func (d *decoder) uint32() uint32 {
+	return binary.BigEndian.Uint32(d.take(4))
+}
+
+func (d *decoder) uint64() uint64 {
+	return binary.BigEndian.Uint64(d.take(8))
+}
+
+func (d *decoder) string() string {
+	if d.err != nil {
+		return ""
+	}
+
+	i := bytes.IndexByte(d.buf, 0)
+	if i < 0 {
+		d.err = errors.New("unterminated string")
+		return ""
+	}
+
+	s := string(d.buf[:i])
+	d.buf = d.buf[i+1:]
+	return s
+}
+
+func (d *decoder) tuple() Tuple {
+	n := int(d.uint16())
+	t := make(Tuple, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		switch kind := d.byte(); kind {
+		case 'n', 'u': // null, or an unchanged TOASTed value
+			t = append(t, nil)
+		case 't', 'b':
+			t = append(t, d.take(int(d.uint32())))
+		default:
+			d.err = fmt.Errorf("unknown tuple column kind %q", kind)
+		}
+	}
+	return t
+}
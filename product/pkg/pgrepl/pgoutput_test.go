@@ -0,0 +1,138 @@
+package pgrepl
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Messages as pgoutput (proto_version 1) sends them for the products table, relation
+// 16385, in a transaction that commits at 0/1A2B3C8.
+const (
+	id = "0195f0c4-7a1e-7cc1-9f4b-3b2f1c7e8a10"
+
+	beginMsg = "B\x00\x00\x00\x00\x01\xa2\xb3\xc8\x00\x02\xc7i\xfd\xfb\x00\x00\x00\x00\x02\xee"
+
+	// REPLICA IDENTITY FULL: every column is flagged as part of the identity
+	relationMsg = "R\x00\x00@\x01public\x00products\x00f\x00\x05" +
+		"\x01id\x00\x00\x00\x0b\x86\xff\xff\xff\xff" +
+		"\x01name\x00\x00\x00\x04\x13\x00\x00\x01\x03" +
+		"\x01price\x00\x00\x00\x06\xa4\x00\x0a\x00\x06" +
+		"\x01category\x00\x00\x00\x04\x13\x00\x00\x01\x03" +
+		"\x01version\x00\x00\x00\x00\x14\xff\xff\xff\xff"
+
+	// INSERT INTO products VALUES ('0195f0c4-…', 'Trail shoe', 89.90, 'shoes')
+	insertMsg = "I\x00\x00@\x01N\x00\x05t\x00\x00\x00$" + id +
+		"t\x00\x00\x00\x0aTrail shoet\x00\x00\x00\x0589.90t\x00\x00\x00\x05shoest\x00\x00\x00\x011"
+
+	// UPDATE products SET price = 79.90, version = 2, with REPLICA IDENTITY FULL
+	updateFullMsg = "U\x00\x00@\x01O\x00\x05t\x00\x00\x00$" + id +
+		"t\x00\x00\x00\x0aTrail shoet\x00\x00\x00\x0589.90t\x00\x00\x00\x05shoest\x00\x00\x00\x011" +
+		"N\x00\x05t\x00\x00\x00$" + id +
+		"t\x00\x00\x00\x0aTrail shoet\x00\x00\x00\x0579.90t\x00\x00\x00\x05shoest\x00\x00\x00\x012"
+
+	// the same update with REPLICA IDENTITY DEFAULT: no old row, as the key didn't change
+	updateNewMsg = "U\x00\x00@\x01N\x00\x05t\x00\x00\x00$" + id +
+		"t\x00\x00\x00\x0aTrail shoet\x00\x00\x00\x0579.90t\x00\x00\x00\x05shoest\x00\x00\x00\x012"
+
+	// DELETE FROM products, with REPLICA IDENTITY FULL
+	deleteFullMsg = "D\x00\x00@\x01O\x00\x05t\x00\x00\x00$" + id +
+		"t\x00\x00\x00\x0aTrail shoet\x00\x00\x00\x0579.90t\x00\x00\x00\x05shoest\x00\x00\x00\x012"
+
+	// the same delete with REPLICA IDENTITY DEFAULT: only the key, the rest null
+	deleteKeyMsg = "D\x00\x00@\x01K\x00\x05t\x00\x00\x00$" + id + "nnnn"
+
+	commitMsg = "C\x00\x00\x00\x00\x00\x01\xa2\xb3\xc8\x00\x00\x00\x00\x01\xa2\xb3\xf8\x00\x02\xc7i\xfd\xfb\x00\x00"
+
+	// TRUNCATE products
+	truncateMsg = "T\x00\x00\x00\x01\x00\x00\x00@\x01"
+)
+
+func row(values ...string) Tuple {
+	t := make(Tuple, len(values))
+	for i, v := range values {
+		if v != "" {
+			t[i] = []byte(v)
+		}
+	}
+	return t
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  string
+		want interface{}
+	}{
+		{"begin", beginMsg, &Begin{FinalLSN: 0x1A2B3C8, Xid: 750}},
+		{"commit", commitMsg, &Commit{CommitLSN: 0x1A2B3C8, EndLSN: 0x1A2B3F8}},
+		{"relation", relationMsg, &Relation{
+			ID: 16385, Namespace: "public", Name: "products",
+			Columns: []string{"id", "name", "price", "category", "version"},
+		}},
+		{"insert", insertMsg, &Insert{
+			RelationID: 16385,
+			New:        row(id, "Trail shoe", "89.90", "shoes", "1"),
+		}},
+		{"update with old row", updateFullMsg, &Update{
+			RelationID: 16385,
+			Old:        row(id, "Trail shoe", "89.90", "shoes", "1"),
+			New:        row(id, "Trail shoe", "79.90", "shoes", "2"),
+		}},
+		{"update without old row", updateNewMsg, &Update{
+			RelationID: 16385,
+			New:        row(id, "Trail shoe", "79.90", "shoes", "2"),
+		}},
+		{"delete with old row", deleteFullMsg, &Delete{
+			RelationID: 16385,
+			Old:        row(id, "Trail shoe", "79.90", "shoes", "2"),
+		}},
+		{"delete with key only", deleteKeyMsg, &Delete{
+			RelationID: 16385,
+			Old:        row(id, "", "", "", ""),
+		}},
+		{"truncate is skipped", truncateMsg, nil},
+		{"unchanged toasted column", "I\x00\x00@\x01N\x00\x02t\x00\x00\x00\x011u", &Insert{
+			RelationID: 16385,
+			New:        row("1", ""),
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Decode([]byte(tt.msg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Decode() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  string
+		want string
+	}{
+		{"empty", "", "empty pgoutput message"},
+		{"truncated begin", beginMsg[:12], "message too short"},
+		{"truncated tuple", insertMsg[:len(insertMsg)-3], "message too short"},
+		{"unterminated relation name", "R\x00\x00@\x01public\x00prod", "unterminated string"},
+		{"unknown column kind", "I\x00\x00@\x01N\x00\x01x", "unknown tuple column kind"},
+		{"insert without new row", "I\x00\x00@\x01O\x00\x00", "expected 'N'"},
+		{"update with unknown tuple", "U\x00\x00@\x01X\x00\x00", "malformed update message"},
+		{"delete with new row", "D\x00\x00@\x01N\x00\x00", "malformed delete message"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Decode([]byte(tt.msg))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Decode() error = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+// Package pgrepl is a minimal client for PostgreSQL logical replication with the
+// pgoutput plugin, built on pgconn.
+package pgrepl
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"net/url"
+	"regexp"
+	"time"
+)
+
+// LSN is a position in the write-ahead log.
+type LSN uint64
+
+// ParseLSN parses the textual form of an LSN, e.g. 16/B374D848.
+func ParseLSN(s string) (LSN, error) {
+	var hi, lo uint32
+	if _, err := fmt.Sscanf(s, "%X/%X", &hi, &lo); err != nil {
+		return 0, fmt.Errorf("invalid lsn %q: %w", s, err)
+	}
+	return LSN(uint64(hi)<<32 | uint64(lo)), nil
+}
+
+func (l LSN) String() string {
+	return fmt.Sprintf("%X/%X", uint32(l>>32), uint32(l))
+}
+
+// Connect opens a replication connection to the database in dsn.
+func Connect(ctx context.Context, dsn string) (*pgconn.PgConn, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	q := u.Query()
+	q.Set("replication", "database")
+	u.RawQuery = q.Encode()
+
+	return pgconn.Connect(ctx, u.String())
+}
+
+var slotName = regexp.MustCompile(`^[a-z0-9_]{1,63}$`)
+
+// CreateSlot creates a pgoutput replication slot, unless one by that name exists.
+func CreateSlot(ctx context.Context, conn *pgconn.PgConn, slot string) error {
+	if !slotName.MatchString(slot) {
+		return fmt.Errorf("invalid slot name %q", slot)
+	}
+
+	_, err := conn.Exec(ctx, fmt.Sprintf("CREATE_REPLICATION_SLOT %s LOGICAL pgoutput", slot)).ReadAll()
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "42710" { // duplicate_object
+		return nil
+	}
+	return err
+}
+
+// StartReplication starts streaming changes for publication from slot. A zero start
+// resumes from the last position confirmed with SendStandbyStatus.
+func StartReplication(ctx context.Context, conn *pgconn.PgConn, slot string, start LSN, publication string) error {
+	if !slotName.MatchString(slot) || !slotName.MatchString(publication) {
+		return fmt.Errorf("invalid slot %q or publication %q", slot, publication)
+	}
+
+	conn.Frontend().SendQuery(&pgproto3.Query{String: fmt.Sprintf(
+		"START_REPLICATION SLOT %s LOGICAL %s (proto_version '1', publication_names '%s')", slot, start, publication,
+	)})
+	if err := conn.Frontend().Flush(); err != nil {
+		return err
+	}
+
+	for {
+		msg, err := conn.ReceiveMessage(ctx)
+		if err != nil {
+			return err
+		}
+
+		switch msg := msg.(type) {
+		case *pgproto3.CopyBothResponse:
+			return nil
+		case *pgproto3.ErrorResponse:
+			return pgconn.ErrorResponseToPgError(msg)
+		}
+	}
+}
+
+// postgresEpoch is the reference point of timestamps in the replication protocol.
+var postgresEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// SendStandbyStatus confirms that every change up to lsn has been processed, letting
+// the server release the WAL before it.
+func SendStandbyStatus(conn *pgconn.PgConn, lsn LSN) error {
+	data := make([]byte, 0, 34)
+	data = append(data, 'r')
+	data = binary.BigEndian.AppendUint64(data, uint64(lsn)) // written
+	data = binary.BigEndian.AppendUint64(data, uint64(lsn)) // flushed
+	data = binary.BigEndian.AppendUint64(data, uint64(lsn)) // applied
+	data = binary.BigEndian.AppendUint64(data, uint64(time.Since(postgresEpoch).Microseconds()))
+	data = append(data, 0) // no reply requested
+
+	buf, err := (&pgproto3.CopyData{Data: data}).Encode(nil)
+	if err != nil {
+		return err
+	}
+	return conn.Frontend().SendUnbufferedEncodedCopyData(buf)
+}
+
+// XLogData carries a chunk of WAL, here a pgoutput message.
+type XLogData struct {
+	WALStart     LSN
+	ServerWALEnd LSN
+	Data         []byte
+}
+
+// Keepalive is sent by the server while idle; it wants a status update if ReplyRequested.
+type Keepalive struct {
+	ServerWALEnd   LSN
+	ReplyRequested bool
+}
+
+// ParseCopyData parses a message of the replication stream into *XLogData or *Keepalive.
+func ParseCopyData(data []byte) (interface{}, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty replication message")
+	}
+
+	switch data[0] {
+	case 'w':
+		if len(data) < 25 {
+			return nil, errors.New("short XLogData message")
+		}
+		return &XLogData{
+			WALStart:     LSN(binary.BigEndian.Uint64(data[1:])),
+			ServerWALEnd: LSN(binary.BigEndian.Uint64(data[9:])),
+			Data:         data[25:],
+		}, nil
+	case 'k':
+		if len(data) < 18 {
+			return nil, errors.New("short keepalive message")
+		}
+		return &Keepalive{
+			ServerWALEnd:   LSN(binary.BigEndian.Uint64(data[1:])),
+			ReplyRequested: data[17] == 1,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown replication message %q", data[0])
+	}
+}
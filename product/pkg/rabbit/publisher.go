@@ -0,0 +1,358 @@
+package rabbit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"slices"
+	"sync"
+)
+
+var (
+	// ErrNacked is returned by Future.Wait when the broker refused the message.
+	ErrNacked = errors.New("message was nacked by the broker")
+
+	// ErrUnroutable is returned by Future.Wait when no queue is bound to receive the message.
+	ErrUnroutable = errors.New("message could not be routed to any queue")
+
+	// ErrPublisherClosed is returned when publishing on a closed AsyncPublisher.
+	ErrPublisherClosed = errors.New("publisher is closed")
+
+	// ErrChannelClosed is returned by Future.Wait when the channel closed before the message was confirmed.
+	ErrChannelClosed = errors.New("publishing channel closed before the message was confirmed")
+)
+
+// Future is the eventual outcome of a message published through an AsyncPublisher.
+type Future struct {
+	done chan struct{}
+	err  error
+}
+
+func newFuture() *Future {
+	return &Future{done: make(chan struct{})}
+}
+
+func (f *Future) resolve(err error) {
+	f.err = err
+	close(f.done)
+}
+
+// Done returns a channel that is closed once the broker has confirmed or refused the message.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Err returns the outcome of the publish. It is only meaningful once Done is closed.
+func (f *Future) Err() error {
+	return f.err
+}
+
+// Wait blocks until the message is confirmed, refused, or ctx is done.
+func (f *Future) Wait(ctx context.Context) error {
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// channel is the part of *amqp.Channel an AsyncPublisher publishes on.
+type channel interface {
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(returns chan amqp.Return) chan amqp.Return
+	GetNextPublishSeqNo() uint64
+	PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Close() error
+}
+
+// AsyncPublisher publishes on a dedicated channel in confirmation mode without waiting
+// for each confirm before sending the next message. Confirms are matched to messages by
+// delivery tag, so many messages can be in flight on the same channel at once.
+//
+// Messages are published as mandatory: one the broker can't route to any queue resolves
+// with ErrUnroutable rather than being dropped. If the channel is closed by an exception,
+// its unconfirmed messages fail with ErrChannelClosed and the next Publish opens a new one.
+//
+// It is safe for concurrent use.
+type AsyncPublisher struct {
+	open func() (channel, error)
+
+	mu     sync.Mutex // serializes publishes so delivery tags follow publish order
+	sess   *session   // channel being published on; nil until the next Publish opens one
+	closed bool
+
+	slots    chan struct{}  // bounds the number of unconfirmed messages
+	inflight sync.WaitGroup // tracks unconfirmed messages for Close
+}
+
+// session is one channel of an AsyncPublisher, with the messages awaiting its confirms.
+// Delivery tags restart on every channel, so each keeps its own.
+type session struct {
+	ch      channel
+	pending map[uint64]*pending
+	done    chan struct{} // closed when the confirm listener exits
+}
+
+// pending is a message awaiting its confirm.
+type pending struct {
+	future        *Future
+	exchange, key string
+	msg           amqp.Publishing
+	returned      bool // the broker returned it as unroutable
+}
+
+// matches reports whether r is the message itself: a basic.return carries no delivery tag.
+func (p *pending) matches(r amqp.Return) bool {
+	return !p.returned &&
+		r.Exchange == p.exchange &&
+		r.RoutingKey == p.key &&
+		r.MessageId == p.msg.MessageId &&
+		bytes.Equal(r.Body, p.msg.Body)
+}
+
+// NewAsyncPublisher opens a new channel on the client's connection and returns a publisher
+// which allows at most maxInFlight unconfirmed messages at a time.
+func (p *Client) NewAsyncPublisher(maxInFlight int) (*AsyncPublisher, error) {
+	return newAsyncPublisher(func() (channel, error) {
+		ch, err := p.conn.Channel()
+		if err != nil {
+			return nil, err
+		}
+		return ch, nil
+	}, maxInFlight)
+}
+
+func newAsyncPublisher(open func() (channel, error), maxInFlight int) (*AsyncPublisher, error) {
+	if maxInFlight <= 0 {
+		return nil, fmt.Errorf("max in-flight must be positive, got %d", maxInFlight)
+	}
+
+	a := &AsyncPublisher{
+		open:  open,
+		slots: make(chan struct{}, maxInFlight),
+	}
+
+	// open the first channel now, so a broken connection fails at startup
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.session(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// session returns the channel to publish on, opening one if the last was closed. Callers hold mu.
+func (a *AsyncPublisher) session() (*session, error) {
+	if a.sess != nil {
+		return a.sess, nil
+	}
+
+	ch, err := a.open()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = ch.Confirm(false); err != nil {
+		_ = ch.Close()
+		return nil, err
+	}
+
+	s := &session{
+		ch:      ch,
+		pending: make(map[uint64]*pending, cap(a.slots)),
+		done:    make(chan struct{}),
+	}
+
+	// the listeners must always be drained, otherwise they block the connection
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, cap(a.slots)))
+	returns := ch.NotifyReturn(make(chan amqp.Return, cap(a.slots)))
+	go a.listen(s, confirms, returns)
+
+	a.sess = s
+	return s, nil
+}
+
+// Publish sends msg and returns a Future which resolves when the broker confirms it.
+// It blocks while the in-flight limit is reached, until a slot frees up or ctx is done.
+func (a *AsyncPublisher) Publish(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) (*Future, error) {
+	select {
+	case a.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		<-a.slots
+		return nil, ErrPublisherClosed
+	}
+
+	s, err := a.session()
+	if err != nil {
+		<-a.slots
+		return nil, err
+	}
+
+	// register the future before sending, so a fast confirm always finds it
+	tag := s.ch.GetNextPublishSeqNo()
+	f := newFuture()
+	s.pending[tag] = &pending{future: f, exchange: exchange, key: routingKey, msg: msg}
+	a.inflight.Add(1)
+
+	if err = s.ch.PublishWithContext(ctx, exchange, routingKey, true, false, msg); err != nil {
+		delete(s.pending, tag)
+		a.inflight.Done()
+		<-a.slots
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// PublishJSON is Publish for a persistent JSON payload.
+func (a *AsyncPublisher) PublishJSON(ctx context.Context, exchange, routingKey string, payload []byte, headers map[string]interface{}) (*Future, error) {
+	return a.Publish(ctx, exchange, routingKey, amqp.Publishing{
+		Headers:      headers,
+		ContentType:  "application/json",
+		Body:         payload,
+		DeliveryMode: amqp.Persistent,
+	})
+}
+
+// listen resolves the session's futures as confirms arrive. The broker sends a message's
+// basic.return before its basic.ack, so returns already queued are read before each
+// confirm is resolved. When the channel closes, every future still pending is failed
+// with ErrChannelClosed and the next Publish opens a new channel.
+func (a *AsyncPublisher) listen(s *session, confirms <-chan amqp.Confirmation, returns <-chan amqp.Return) {
+	defer close(s.done)
+
+	for confirms != nil {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			a.returned(s, r)
+		case c, ok := <-confirms:
+			if !ok {
+				confirms = nil
+				continue
+			}
+			a.drainReturns(s, returns)
+			a.confirm(s, c)
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.sess == s {
+		a.sess = nil
+	}
+	for tag, p := range s.pending {
+		delete(s.pending, tag)
+		p.future.resolve(ErrChannelClosed)
+		a.inflight.Done()
+		<-a.slots
+	}
+}
+
+func (a *AsyncPublisher) drainReturns(s *session, returns <-chan amqp.Return) {
+	for returns != nil {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				return
+			}
+			a.returned(s, r)
+		default:
+			return
+		}
+	}
+}
+
+// returned marks the message r returns as unroutable. Returns come back in publish order, so
+// of identical messages still awaiting their confirm, the earliest not yet returned is taken.
+func (a *AsyncPublisher) returned(s *session, r amqp.Return) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	tags := make([]uint64, 0, len(s.pending))
+	for tag := range s.pending {
+		tags = append(tags, tag)
+	}
+	slices.Sort(tags)
+
+	for _, tag := range tags {
+		if p := s.pending[tag]; p.matches(r) {
+			p.returned = true
+			return
+		}
+	}
+}
+
+func (a *AsyncPublisher) confirm(s *session, c amqp.Confirmation) {
+	a.mu.Lock()
+	p, ok := s.pending[c.DeliveryTag]
+	delete(s.pending, c.DeliveryTag)
+	a.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	switch {
+	case !c.Ack:
+		p.future.resolve(ErrNacked)
+	case p.returned:
+		p.future.resolve(ErrUnroutable)
+	default:
+		p.future.resolve(nil)
+	}
+
+	a.inflight.Done()
+	<-a.slots
+}
+
+// Close stops accepting new messages, waits until every in-flight message has been
+// confirmed or ctx is done, and then closes the underlying channel.
+func (a *AsyncPublisher) Close(ctx context.Context) error {
+	a.mu.Lock()
+	a.closed = true
+	a.mu.Unlock()
+
+	flushed := make(chan struct{})
+	go func() {
+		a.inflight.Wait()
+		close(flushed)
+	}()
+
+	var err error
+	select {
+	case <-flushed:
+	case <-ctx.Done():
+		err = fmt.Errorf("flushing publisher: %w", ctx.Err())
+	}
+
+	a.mu.Lock()
+	s := a.sess
+	a.mu.Unlock()
+	if s == nil {
+		return err
+	}
+
+	if cerr := s.ch.Close(); cerr != nil && !errors.Is(cerr, amqp.ErrClosed) && err == nil {
+		err = cerr
+	}
+
+	<-s.done
+	return err
+}
@@ -8,6 +8,7 @@ package rabbit
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	amqp "github.com/rabbitmq/amqp091-go"
 	"sync"
@@ -124,9 +125,21 @@ func (e ExchangeType) String() string {
 	}[e]
 }
 
-// CreateExchange creates a new exchange.
+// ParseExchangeType returns the ExchangeType named by s, e.g. "topic".
+func ParseExchangeType(s string) (ExchangeType, error) {
+	for _, e := range []ExchangeType{ExchangeDirect, ExchangeFanout, ExchangeTopic, ExchangeHeaders} {
+		if e.String() == s {
+			return e, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown exchange type %q", s)
+}
+
+// CreateExchange creates a new exchange. An exchange's type can't be changed once declared,
+// so redeclaring an existing exchange with another type fails and closes ch.
 func (p *Client) CreateExchange(ch *amqp.Channel, exchangeName string, exchangeType ExchangeType, durable, autoDelete bool) error {
-	return ch.ExchangeDeclare(
+	err := ch.ExchangeDeclare(
 		exchangeName,
 		exchangeType.String(),
 		durable,
@@ -135,6 +148,12 @@ func (p *Client) CreateExchange(ch *amqp.Channel, exchangeName string, exchangeT
 		false,
 		nil,
 	)
+
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) && amqpErr.Code == amqp.PreconditionFailed {
+		return fmt.Errorf("exchange %q exists with a type other than %s, declare a new exchange instead: %w", exchangeName, exchangeType, err)
+	}
+	return err
 }
 
 // CreateBinding creates a new binding between a queue and an exchange.
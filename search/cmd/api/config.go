@@ -2,7 +2,10 @@ package main
 
 import (
 	"flag"
+	"github.com/ziliscite/cqrs_search/internal/adapters/elastic"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -10,6 +13,8 @@ import (
 type HTTP struct {
 	host string
 	port string
+
+	adminToken string // bearer token for /admin; the admin API is disabled without one
 }
 
 func (h HTTP) addr() string {
@@ -24,12 +29,22 @@ type Redis struct {
 	db       string
 
 	ttl time.Duration // in seconds
+
+	eventTTL   time.Duration // how long processed event IDs are remembered
+	suggestTTL time.Duration // how long typeahead suggestions are cached
 }
 
 type Elastic struct {
 	host  string
 	port  string
 	index string
+
+	language string // stemmer language of the name analyzer
+	synonyms string // synonyms file, relative to the Elasticsearch config directory
+}
+
+func (e Elastic) analysis() elastic.Analysis {
+	return elastic.Analysis{Language: e.language, SynonymsPath: e.synonyms}
 }
 
 type MQ struct {
@@ -39,16 +54,73 @@ type MQ struct {
 	pass  string
 	vhost string
 
-	exchange string
-	queue    string
-	binding  string
+	exchange     string
+	exchangeType string
+	queue        string
+	bindings     []string
+
+	legacyExchange   string // direct exchange the queue is unbound from, see rabbitmq.LegacyRoute
+	legacyRoutingKey string
+}
+
+type NATS struct {
+	url     string
+	stream  string
+	durable string
+}
+
+type Postgres struct {
+	host string
+	port string
+	user string
+	pass string
+	db   string
+	ssl  bool
+
+	channel  string // notified with the sequence number of each new event
+	consumer string // name the processed offset is stored under
+}
+
+func (p Postgres) dsn() string {
+	dsn := "postgres://" + p.user + ":" + p.pass + "@" + p.host + ":" + p.port + "/" + p.db
+	if !p.ssl {
+		return dsn + "?sslmode=disable"
+	}
+	return dsn
+}
+
+type Consumer struct {
+	workers  int // events for different products are processed in parallel
+	prefetch int // unacknowledged deliveries held at once
+}
+
+type Rebuild struct {
+	productURL string // base URL of the product service
+	batchSize  int    // products exported and indexed per request
+}
+
+type Reconcile struct {
+	interval  time.Duration // 0 disables scheduled runs
+	repair    bool          // whether scheduled runs repair the drift they find
+	batchSize int
 }
 
 type Config struct {
-	h  HTTP
-	r  Redis
-	e  Elastic
-	mq MQ
+	h    HTTP
+	r    Redis
+	e    Elastic
+	mq   MQ
+	nats NATS
+	pg   Postgres
+	c    Consumer
+	rb   Rebuild
+	rc   Reconcile
+
+	broker string // rabbitmq, nats or postgres
+
+	consistencyWait time.Duration // how long a read with a consistency token waits for the index
+
+	shutdownTimeout time.Duration
 }
 
 var (
@@ -62,6 +134,7 @@ func getConfig() Config {
 
 		flag.StringVar(&instance.h.host, "http-host", os.Getenv("HTTP_HOST"), "HTTP host")
 		flag.StringVar(&instance.h.port, "http-port", os.Getenv("HTTP_PORT"), "HTTP port")
+		flag.StringVar(&instance.h.adminToken, "admin-token", os.Getenv("ADMIN_TOKEN"), "Bearer token required by the admin API, which is disabled if empty")
 
 		flag.StringVar(&instance.r.host, "redis-host", os.Getenv("REDIS_HOST"), "Redis host")
 		flag.StringVar(&instance.r.port, "redis-port", os.Getenv("REDIS_PORT"), "Redis port")
@@ -77,9 +150,14 @@ func getConfig() Config {
 		}
 		instance.r.ttl = ttl
 
+		flag.DurationVar(&instance.r.suggestTTL, "redis-suggest-ttl", envDuration("REDIS_SUGGEST_TTL", 30*time.Second), "How long typeahead suggestions are cached")
+		flag.DurationVar(&instance.r.eventTTL, "redis-event-ttl", envDuration("REDIS_EVENT_TTL", 24*time.Hour), "How long processed event IDs are remembered")
+
 		flag.StringVar(&instance.e.host, "elastic-host", os.Getenv("ELASTICSEARCH_HOST"), "Elastic host")
 		flag.StringVar(&instance.e.port, "elastic-port", os.Getenv("ELASTICSEARCH_PORT"), "Elastic port")
 		flag.StringVar(&instance.e.index, "elastic-index", os.Getenv("ELASTICSEARCH_INDEX"), "Elastic index")
+		flag.StringVar(&instance.e.language, "elastic-language", envOr("ELASTICSEARCH_LANGUAGE", "english"), "Stemmer language of the name analyzer, empty to disable stemming")
+		flag.StringVar(&instance.e.synonyms, "elastic-synonyms", envOr("ELASTICSEARCH_SYNONYMS_PATH", "analysis/synonyms.txt"), "Synonyms file, relative to the Elasticsearch config directory")
 
 		flag.StringVar(&instance.mq.host, "mq-host", os.Getenv("RABBITMQ_HOST"), "RabbitMQ host")
 		flag.StringVar(&instance.mq.port, "mq-port", os.Getenv("RABBITMQ_PORT"), "RabbitMQ port")
@@ -88,11 +166,91 @@ func getConfig() Config {
 		flag.StringVar(&instance.mq.vhost, "mq-vhost", os.Getenv("RABBITMQ_VHOST"), "RabbitMQ vhost")
 
 		flag.StringVar(&instance.mq.exchange, "mq-exchange", os.Getenv("RABBITMQ_EXCHANGE"), "RabbitMQ exchange")
+		flag.StringVar(&instance.mq.exchangeType, "mq-exchange-type", envOr("RABBITMQ_EXCHANGE_TYPE", "topic"), "RabbitMQ exchange type")
 		flag.StringVar(&instance.mq.queue, "mq-queue", os.Getenv("RABBITMQ_QUEUE"), "RabbitMQ queue")
-		flag.StringVar(&instance.mq.binding, "mq-binding", os.Getenv("RABBITMQ_BINDING"), "RabbitMQ binding")
+
+		flag.StringVar(&instance.mq.legacyExchange, "mq-legacy-exchange", os.Getenv("RABBITMQ_LEGACY_EXCHANGE"), "Direct exchange the queue was bound to before topic routing, unbound at startup")
+		flag.StringVar(&instance.mq.legacyRoutingKey, "mq-legacy-routing-key", envOr("RABBITMQ_LEGACY_ROUTING_KEY", "product_event"), "Routing key of the legacy exchange binding")
+
+		var bindings string
+		flag.StringVar(&bindings, "mq-binding", envOr("RABBITMQ_BINDING", "product.*"), "Comma-separated RabbitMQ binding patterns")
+
+		flag.StringVar(&instance.nats.url, "nats-url", envOr("NATS_URL", "nats://localhost:4222"), "NATS server URL")
+		flag.StringVar(&instance.nats.stream, "nats-stream", envOr("NATS_STREAM", "PRODUCTS"), "NATS JetStream stream")
+		flag.StringVar(&instance.nats.durable, "nats-durable", envOr("NATS_DURABLE", "search"), "NATS JetStream durable consumer")
+
+		flag.StringVar(&instance.pg.host, "pg-host", os.Getenv("POSTGRES_HOST"), "Postgres host, for the postgres broker")
+		flag.StringVar(&instance.pg.port, "pg-port", os.Getenv("POSTGRES_PORT"), "Postgres port")
+		flag.StringVar(&instance.pg.user, "pg-user", os.Getenv("POSTGRES_USER"), "Postgres user")
+		flag.StringVar(&instance.pg.pass, "pg-pass", os.Getenv("POSTGRES_PASSWORD"), "Postgres password")
+		flag.StringVar(&instance.pg.db, "pg-db", os.Getenv("POSTGRES_DB"), "Postgres database")
+		flag.BoolVar(&instance.pg.ssl, "pg-ssl", os.Getenv("POSTGRES_SSL") == "enable", "Postgres ssl")
+		flag.StringVar(&instance.pg.channel, "pg-notify-channel", envOr("PG_NOTIFY_CHANNEL", "product_events"), "Postgres channel notified of new events")
+		flag.StringVar(&instance.pg.consumer, "pg-notify-consumer", envOr("PG_NOTIFY_CONSUMER", "search"), "Name the processed event offset is stored under")
+
+		flag.IntVar(&instance.c.workers, "consumer-workers", envInt("CONSUMER_WORKERS", 4), "Event consumer workers")
+		flag.IntVar(&instance.c.prefetch, "consumer-prefetch", envInt("CONSUMER_PREFETCH", 16), "Event consumer prefetch")
+
+		flag.StringVar(&instance.rb.productURL, "product-url", envOr("PRODUCT_SERVICE_URL", "http://localhost:8080"), "Product service base URL, used by rebuild")
+		flag.IntVar(&instance.rb.batchSize, "rebuild-batch-size", envInt("REBUILD_BATCH_SIZE", 500), "Products indexed per batch during rebuild")
+
+		flag.DurationVar(&instance.rc.interval, "reconcile-interval", envDuration("RECONCILE_INTERVAL", 0), "How often to reconcile the index with the product service, 0 to only run on demand")
+		flag.BoolVar(&instance.rc.repair, "reconcile-repair", envBool("RECONCILE_REPAIR", false), "Repair drift found by scheduled reconciliation")
+		flag.IntVar(&instance.rc.batchSize, "reconcile-batch-size", envInt("RECONCILE_BATCH_SIZE", 500), "Products compared per page during reconciliation")
+
+		flag.StringVar(&instance.broker, "broker", envOr("BROKER", "rabbitmq"), "Event transport: rabbitmq, nats or postgres")
+
+		flag.DurationVar(&instance.consistencyWait, "consistency-wait", envDuration("CONSISTENCY_WAIT", 2*time.Second), "How long a read with a consistency token waits for the index to catch up")
+
+		flag.DurationVar(&instance.shutdownTimeout, "shutdown-timeout", envDuration("SHUTDOWN_TIMEOUT", 15*time.Second), "Graceful shutdown timeout")
 
 		flag.Parse()
+
+		instance.mq.bindings = splitList(bindings)
 	})
 
 	return instance
 }
+
+// envOr returns the value of the environment variable key, or fallback if it is unset or empty.
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// envInt returns the environment variable key parsed as an int, or fallback if it is unset or invalid.
+func envInt(key string, fallback int) int {
+	if v, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return v
+	}
+	return fallback
+}
+
+// envBool returns the environment variable key parsed as a bool, or fallback if it is unset or invalid.
+func envBool(key string, fallback bool) bool {
+	if v, err := strconv.ParseBool(os.Getenv(key)); err == nil {
+		return v
+	}
+	return fallback
+}
+
+// envDuration returns the environment variable key parsed as a duration, or fallback if it is unset or invalid.
+func envDuration(key string, fallback time.Duration) time.Duration {
+	if v, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		return v
+	}
+	return fallback
+}
+
+// splitList splits a comma-separated list, dropping blank entries.
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
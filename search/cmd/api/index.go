@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"github.com/ziliscite/cqrs_search/internal/adapters/elastic"
+	client "github.com/ziliscite/cqrs_search/internal/adapters/http_client"
+	cache "github.com/ziliscite/cqrs_search/internal/adapters/redis_cache"
+	"github.com/ziliscite/cqrs_search/internal/application/command"
+	"github.com/ziliscite/cqrs_search/internal/ports"
+	"net/http"
+	"time"
+)
+
+// The rebuild and migrate commands run alongside a serving instance, whose consumer keeps
+// the new index current until it is swapped in.
+
+// rebuild repopulates the search index from the product service and swaps it in.
+func rebuild(ctx context.Context, cfg Config) error {
+	return withProjection(cfg, func(proj ports.Projection, ch ports.CacheInvalidator) error {
+		src := client.NewProductSource(&http.Client{Timeout: 30 * time.Second}, cfg.rb.productURL)
+
+		cmd, err := command.NewRebuildProjection(cfg.rb.batchSize)
+		if err != nil {
+			return err
+		}
+
+		return command.NewRebuildProjectionHandler(src, proj, ch).Handle(ctx, cmd)
+	})
+}
+
+// migrate moves the search index to the latest mapping version and swaps it in.
+func migrate(ctx context.Context, cfg Config) error {
+	return withProjection(cfg, func(proj ports.Projection, ch ports.CacheInvalidator) error {
+		return command.NewMigrateIndexHandler(proj, ch).Handle(ctx)
+	})
+}
+
+func withProjection(cfg Config, fn func(proj ports.Projection, ch ports.CacheInvalidator) error) error {
+	ESClient, err := elastic.NewESClient(cfg.e.host, cfg.e.port, nil)
+	if err != nil {
+		return err
+	}
+
+	proj, err := elastic.NewProjection(ESClient, cfg.e.index, cfg.e.analysis())
+	if err != nil {
+		return err
+	}
+
+	redisClient, err := cache.NewRedisClient(cfg.r.user, cfg.r.password, cfg.r.host, cfg.r.port, cfg.r.db)
+	if err != nil {
+		return err
+	}
+	defer redisClient.Close()
+
+	return fn(proj, cache.NewCacher(redisClient, cfg.r.ttl))
+}
@@ -1,24 +1,62 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/ziliscite/cqrs_search/internal/adapters/consumer"
 	"github.com/ziliscite/cqrs_search/internal/adapters/elastic"
+	client "github.com/ziliscite/cqrs_search/internal/adapters/http_client"
 	handler "github.com/ziliscite/cqrs_search/internal/adapters/http_handler"
+	"github.com/ziliscite/cqrs_search/internal/adapters/nats"
+	"github.com/ziliscite/cqrs_search/internal/adapters/pgnotify"
 	"github.com/ziliscite/cqrs_search/internal/adapters/rabbitmq"
 	cache "github.com/ziliscite/cqrs_search/internal/adapters/redis_cache"
 	"github.com/ziliscite/cqrs_search/internal/application"
+	"github.com/ziliscite/cqrs_search/internal/application/command"
+	"github.com/ziliscite/cqrs_search/internal/ports"
+	"github.com/ziliscite/cqrs_search/pkg/natsjs"
 	"github.com/ziliscite/cqrs_search/pkg/rabbit"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
 	cfg := getConfig()
 
+	// cancelled on SIGINT/SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	switch flag.Arg(0) {
+	case "":
+	case "rebuild":
+		if err := rebuild(ctx, cfg); err != nil {
+			log.Fatal("rebuild failed: ", err)
+		}
+		return
+	case "migrate":
+		if err := migrate(ctx, cfg); err != nil {
+			log.Fatal("migrate failed: ", err)
+		}
+		return
+	default:
+		log.Fatalf("unknown command %q", flag.Arg(0))
+	}
+
 	// initialize repo
-	ESClient, err := elastic.NewESClient(cfg.e.host, cfg.e.port)
+	esTransport := http.DefaultTransport.(*http.Transport).Clone()
+	ESClient, err := elastic.NewESClient(cfg.e.host, cfg.e.port, esTransport)
 	if err != nil {
 		panic(err)
 	}
 
-	repo, err := elastic.NewRepository(ESClient, cfg.e.index) // "products"
+	repo, err := elastic.NewRepository(ESClient, cfg.e.index, cfg.e.analysis()) // "products"
 	if err != nil {
 		panic(err)
 	}
@@ -30,30 +68,133 @@ func main() {
 	cacher := cache.NewCacher(redisClient, cfg.r.ttl)
 
 	// initialize services
-	app := application.NewService(repo, cacher)
+	app := application.NewService(repo, cacher, cache.NewSuggestionCache(redisClient, cfg.r.suggestTTL), cfg.consistencyWait)
 
 	// initialize drivers
-	rabbitConn, err := rabbit.Dial(cfg.mq.user, cfg.mq.pass, cfg.mq.host, cfg.mq.port, cfg.mq.vhost)
+	sub, closeConn, err := newSubscriber(ctx, cfg)
 	if err != nil {
 		panic(err)
 	}
-	rabbitClient := rabbit.NewClient(rabbitConn)
 
-	consumer, err := rabbitmq.NewConsumer(rabbitClient, cfg.mq.exchange, cfg.mq.queue, cfg.mq.binding, app.Command)
-	if err != nil {
-		panic(err)
-	}
+	cons := consumer.NewConsumer(sub, app.Command, cache.NewEventLog(redisClient, cfg.r.eventTTL), cfg.c.workers, cfg.c.prefetch)
+	src := client.NewProductSource(&http.Client{Timeout: 30 * time.Second}, cfg.rb.productURL)
+	rec := application.NewReconciler(ctx, command.NewReconcileHandler(src, elastic.NewIndexStore(ESClient, cfg.e.index), repo, cacher))
+
+	reload := command.NewReloadAnalyzersHandler(elastic.NewAnalyzers(ESClient, cfg.e.index), cacher)
 
-	srv := handler.NewHandler(app.Query)
+	srv := handler.NewHandler(app.Query, rec, reload, cfg.rc.batchSize, cfg.h.adminToken)
 
 	// start server
+	consumeCtx, stopConsuming := context.WithCancel(context.Background())
+	defer stopConsuming()
+
+	consumed := make(chan error, 1)
 	go func() {
-		if err = consumer.Consume(); err != nil {
+		consumed <- cons.Consume(consumeCtx)
+	}()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.Run(cfg.h.addr())
+	}()
+
+	if cfg.rc.interval > 0 {
+		cmd, err := command.NewReconcile(cfg.rc.repair, cfg.rc.batchSize)
+		if err != nil {
 			panic(err)
 		}
-	}()
 
-	if err = srv.Run(cfg.h.addr()); err != nil {
-		panic(err)
+		go rec.Schedule(cfg.rc.interval, cmd)
+	}
+
+	select {
+	case err = <-errs:
+		log.Println("server stopped:", err)
+	case err = <-consumed:
+		log.Println("consumer stopped:", err)
+		consumed <- err // let the shutdown below see it as finished
+	case <-ctx.Done():
+		log.Println("shutting down")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.shutdownTimeout)
+	defer cancel()
+
+	if err = srv.Shutdown(shutdownCtx); err != nil {
+		log.Println("failed to shut down http server:", err)
+	}
+
+	// cancel the subscription and wait for in-flight events
+	stopConsuming()
+	select {
+	case <-consumed:
+	case <-shutdownCtx.Done():
+		log.Println("timed out waiting for in-flight events")
+	}
+
+	if err = sub.Close(); err != nil {
+		log.Println("failed to close subscriber:", err)
+	}
+
+	if err = redisClient.Close(); err != nil {
+		log.Println("failed to close redis:", err)
+	}
+
+	esTransport.CloseIdleConnections()
+	closeConn()
+}
+
+// newSubscriber connects to the event transport selected by cfg.broker.
+// The returned func closes the underlying connection.
+func newSubscriber(ctx context.Context, cfg Config) (ports.Subscriber, func(), error) {
+	switch cfg.broker {
+	case "rabbitmq":
+		rabbitConn, err := rabbit.Dial(cfg.mq.user, cfg.mq.pass, cfg.mq.host, cfg.mq.port, cfg.mq.vhost)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		kind, err := rabbit.ParseExchangeType(cfg.mq.exchangeType)
+		if err != nil {
+			rabbitConn.Close()
+			return nil, nil, err
+		}
+
+		legacy := rabbitmq.LegacyRoute{Exchange: cfg.mq.legacyExchange, RoutingKey: cfg.mq.legacyRoutingKey}
+		sub, err := rabbitmq.NewSubscriber(rabbit.NewClient(rabbitConn), cfg.mq.exchange, kind, cfg.mq.queue, cfg.mq.bindings, legacy, cfg.c.prefetch)
+		if err != nil {
+			rabbitConn.Close()
+			return nil, nil, err
+		}
+
+		return sub, func() { rabbitConn.Close() }, nil
+	case "nats":
+		nc, js, err := natsjs.Connect(cfg.nats.url)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		sub, err := nats.NewSubscriber(ctx, js, cfg.nats.stream, cfg.nats.durable, cfg.mq.bindings, cfg.c.prefetch)
+		if err != nil {
+			nc.Close()
+			return nil, nil, err
+		}
+
+		return sub, nc.Close, nil
+	case "postgres":
+		db, err := pgxpool.New(ctx, cfg.pg.dsn())
+		if err != nil {
+			return nil, nil, err
+		}
+
+		sub, err := pgnotify.NewSubscriber(ctx, db, cfg.pg.channel, cfg.pg.consumer)
+		if err != nil {
+			db.Close()
+			return nil, nil, err
+		}
+
+		return sub, db.Close, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown broker %q", cfg.broker)
 	}
 }
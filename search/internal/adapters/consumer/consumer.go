@@ -0,0 +1,319 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"github.com/ziliscite/cqrs_search/internal/application"
+	"github.com/ziliscite/cqrs_search/internal/application/command"
+	"github.com/ziliscite/cqrs_search/internal/domain/product"
+	"github.com/ziliscite/cqrs_search/internal/ports"
+	"hash/fnv"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	retryAttempts = 3
+	retryBackoff  = 200 * time.Millisecond
+)
+
+// duplicateEvents counts redelivered events that were acknowledged without being applied again.
+var duplicateEvents = expvar.NewInt("search_duplicate_events_total")
+
+// consumer feeds product events from any transport into the application commands.
+//
+// Messages are partitioned across a fixed pool of workers by product ID, so events
+// for the same product are applied one at a time and in delivery order, while
+// different products are processed in parallel. A failed event is retried in place,
+// so later events for the product wait behind it rather than overtaking it; once the
+// retries run out it is handed back to the transport to be redelivered.
+type consumer struct {
+	sub     ports.Subscriber
+	cmd     *application.Command
+	events  ports.EventLog
+	workers int
+	buffer  int
+	backoff time.Duration
+}
+
+// NewConsumer returns a consumer dispatching to workers, each queueing up to buffer messages.
+// The subscriber's prefetch is a good buffer: no more than that can be in flight anyway.
+func NewConsumer(sub ports.Subscriber, cmd *application.Command, events ports.EventLog, workers, buffer int) ports.Consumer {
+	if workers <= 0 {
+		workers = 1
+	}
+
+	if buffer <= 0 {
+		buffer = 1
+	}
+
+	return &consumer{
+		sub:     sub,
+		cmd:     cmd,
+		events:  events,
+		workers: workers,
+		buffer:  buffer,
+		backoff: retryBackoff,
+	}
+}
+
+func (c *consumer) Consume(ctx context.Context) error {
+	bus, err := c.sub.Subscribe(ctx)
+	if err != nil {
+		return err
+	}
+
+	// handlers outlive ctx, so a write that has started is not cut off by shutdown
+	handleCtx := context.WithoutCancel(ctx)
+
+	partitions := make([]chan ports.Message, c.workers)
+
+	var wg sync.WaitGroup
+	for i := range partitions {
+		// buffered so one busy product doesn't hold up dispatching to the other workers
+		partitions[i] = make(chan ports.Message, c.buffer)
+
+		wg.Add(1)
+		go func(in <-chan ports.Message) {
+			defer wg.Done()
+			for m := range in {
+				if ctx.Err() != nil {
+					// shutting down: hand back what hasn't started yet
+					if err := m.Nack(true); err != nil {
+						log.Printf("failed to requeue message: %v", err)
+					}
+					continue
+				}
+
+				c.handle(handleCtx, ctx.Done(), m)
+			}
+		}(partitions[i])
+	}
+
+	for msg := range bus {
+		partitions[c.partition(msg)] <- msg
+	}
+
+	for _, p := range partitions {
+		close(p)
+	}
+
+	wg.Wait()
+	return nil
+}
+
+// partition picks the worker for msg by hashing the product ID in its payload.
+func (c *consumer) partition(msg ports.Message) int {
+	var payload struct {
+		ID string `json:"id"`
+	}
+
+	// a malformed payload fails in process anyway; any worker will do
+	_ = json.Unmarshal(msg.Body(), &payload)
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(payload.ID))
+	return int(h.Sum32() % uint32(c.workers))
+}
+
+// handle processes msg and settles it: acked on success or when it was already applied,
+// rejected when it can never be applied. A failure is retried in place, holding up the
+// partition, until the retries run out or done is closed, which hands msg back.
+func (c *consumer) handle(ctx context.Context, done <-chan struct{}, m ports.Message) {
+	log.Printf("New Message: %s %s", m.Event(), m.Body())
+
+	var payload struct {
+		EventID string `json:"event_id"`
+	}
+	_ = json.Unmarshal(m.Body(), &payload)
+
+	if payload.EventID != "" {
+		seen, err := c.events.Seen(ctx, payload.EventID)
+		if err != nil {
+			log.Printf("failed to look up event %s: %v", payload.EventID, err)
+		}
+
+		if seen {
+			log.Printf("skipping duplicate event %s", payload.EventID)
+			duplicateEvents.Add(1)
+			c.ack(m)
+			return
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := c.process(ctx, m)
+		if err == nil {
+			break
+		}
+
+		log.Printf("failed to process event %s (attempt %d): %v", payload.EventID, attempt, err)
+		if rejected(err) {
+			log.Printf("rejecting event %s: it can never be applied", payload.EventID)
+			c.nack(m, false)
+			return
+		}
+
+		select {
+		case <-time.After(c.backoff * time.Duration(attempt)):
+		case <-done:
+			c.nack(m, true)
+			return
+		}
+
+		if attempt == retryAttempts {
+			// redelivered later rather than dropped, letting the partition move on meanwhile
+			log.Printf("requeueing event %s after %d attempts", payload.EventID, attempt)
+			c.nack(m, true)
+			return
+		}
+	}
+
+	// a failure here only costs a harmless re-apply if the event is redelivered
+	if payload.EventID != "" {
+		if err := c.events.MarkSeen(ctx, payload.EventID); err != nil {
+			log.Printf("failed to record event %s: %v", payload.EventID, err)
+		}
+	}
+
+	c.ack(m)
+}
+
+func (c *consumer) ack(m ports.Message) {
+	if err := m.Ack(); err != nil {
+		log.Printf("failed to ack message: %v", err)
+	}
+}
+
+func (c *consumer) nack(m ports.Message, requeue bool) {
+	if err := m.Nack(requeue); err != nil {
+		log.Printf("failed to nack message: %v", err)
+	}
+}
+
+var (
+	errUnknownEvent = errors.New("unknown event type")
+	errMalformed    = errors.New("malformed event")
+)
+
+// rejected reports whether err means the event can never be applied, however often it is retried.
+func rejected(err error) bool {
+	var invalid command.Errs
+	return errors.Is(err, errUnknownEvent) || errors.Is(err, errMalformed) || errors.As(err, &invalid)
+}
+
+func (c *consumer) process(ctx context.Context, msg ports.Message) error {
+	switch msg.Event() {
+	case "create":
+		if err := c.CreateProduct(ctx, msg.Body()); err != nil {
+			return err
+		}
+	case "update":
+		if err := c.UpdateProduct(ctx, msg.Body()); err != nil {
+			return err
+		}
+	case "delete":
+		if err := c.DeleteProduct(ctx, msg.Body()); err != nil {
+			return err
+		}
+	default:
+		return errUnknownEvent
+	}
+
+	return nil
+}
+
+func (c *consumer) CreateProduct(ctx context.Context, payload []byte) error {
+	var request struct {
+		ID       string  `json:"id"`
+		Name     string  `json:"name"`
+		Category string  `json:"category"`
+		Price    float64 `json:"price"`
+		Version  int64   `json:"version"`
+	}
+
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return fmt.Errorf("%w: %v", errMalformed, err)
+	}
+
+	cmd, errs := command.NewCreateProduct(request.ID, request.Name, request.Category, request.Price, request.Version)
+	if errs != nil {
+		return errs
+	}
+
+	log.Printf("CreateProduct: %v %v %v %v", cmd.ID, cmd.Name, cmd.Category, cmd.Price)
+	return c.cmd.Create.Handle(ctx, cmd)
+}
+
+// snapshot is the state of a product carried by update and delete events.
+type snapshot struct {
+	Name     string  `json:"name"`
+	Price    float64 `json:"price"`
+	Category string  `json:"category"`
+	Version  int64   `json:"version"`
+}
+
+// product returns the snapshot as a product, or nil if the event carried none or it is invalid.
+func (s *snapshot) product(id string) *product.Product {
+	if s == nil {
+		return nil
+	}
+
+	p, err := product.New(s.Name, s.Category, s.Price)
+	if err != nil {
+		log.Printf("ignoring invalid snapshot of %s: %v", id, err)
+		return nil
+	}
+	p.SetID(id)
+	p.SetVersion(s.Version)
+	return p
+}
+
+func (c *consumer) UpdateProduct(ctx context.Context, payload []byte) error {
+	var request struct {
+		ID       string    `json:"id"`
+		Name     string    `json:"name"`
+		Category string    `json:"category"`
+		Price    float64   `json:"price"`
+		Version  int64     `json:"version"`
+		Previous *snapshot `json:"previous"`
+		Changed  []string  `json:"changed"`
+	}
+
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return fmt.Errorf("%w: %v", errMalformed, err)
+	}
+
+	cmd, errs := command.NewUpdateProduct(request.ID, request.Name, request.Category, request.Price, request.Version)
+	if errs != nil {
+		return errs
+	}
+	cmd.Previous = request.Previous.product(request.ID)
+	cmd.Changed = request.Changed
+
+	return c.cmd.Update.Handle(ctx, cmd)
+}
+
+func (c *consumer) DeleteProduct(ctx context.Context, payload []byte) error {
+	var request struct {
+		ID      string    `json:"id"`
+		Version int64     `json:"version"`
+		Last    *snapshot `json:"last"`
+	}
+
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return fmt.Errorf("%w: %v", errMalformed, err)
+	}
+
+	cmd, err := command.NewDeleteProduct(request.ID, request.Version)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errMalformed, err)
+	}
+	cmd.Last = request.Last.product(request.ID)
+
+	return c.cmd.Delete.Handle(ctx, cmd)
+}
@@ -0,0 +1,541 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ziliscite/cqrs_search/internal/adapters/memory"
+	"github.com/ziliscite/cqrs_search/internal/application"
+	"github.com/ziliscite/cqrs_search/internal/application/command"
+	"github.com/ziliscite/cqrs_search/internal/ports"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// store stands in for the write side, recording what each handler applied.
+type store struct {
+	mu       sync.Mutex
+	applied  map[string][]int64 // product id → versions applied, in order
+	attempts map[string]int     // "id@version" → calls made
+	active   map[string]int     // product id → handlers running
+	overlap  bool               // whether two handlers ever ran for one product at once
+
+	// fail, if set, fails the call for id at version on the given attempt
+	fail func(id string, version int64, attempt int) error
+	// enter, if set, is called once the call for id has started
+	enter func(id string)
+}
+
+func newStore() *store {
+	return &store{
+		applied:  map[string][]int64{},
+		attempts: map[string]int{},
+		active:   map[string]int{},
+	}
+}
+
+func (s *store) apply(id string, version int64) error {
+	s.mu.Lock()
+	key := fmt.Sprintf("%s@%d", id, version)
+	s.attempts[key]++
+	attempt := s.attempts[key]
+	s.active[id]++
+	if s.active[id] > 1 {
+		s.overlap = true
+	}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		s.active[id]--
+		s.mu.Unlock()
+	}()
+
+	if s.enter != nil {
+		s.enter(id)
+	}
+
+	// give a handler for the same product the chance to overlap, if dispatch allowed it
+	time.Sleep(time.Millisecond)
+
+	if s.fail != nil {
+		if err := s.fail(id, version, attempt); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	s.applied[id] = append(s.applied[id], version)
+	s.mu.Unlock()
+	return nil
+}
+
+type createHandler struct{ *store }
+
+func (h createHandler) Handle(_ context.Context, cmd command.CreateProductEvent) error {
+	return h.apply(cmd.ID, cmd.Version)
+}
+
+type updateHandler struct{ *store }
+
+func (h updateHandler) Handle(_ context.Context, cmd command.UpdateProductEvent) error {
+	return h.apply(cmd.ID, cmd.Version)
+}
+
+type deleteHandler struct{ *store }
+
+func (h deleteHandler) Handle(_ context.Context, cmd command.DeleteProduct) error {
+	return h.apply(cmd.ID, cmd.Version)
+}
+
+// eventLog is an in-memory ports.EventLog.
+type eventLog struct {
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+func (l *eventLog) Seen(_ context.Context, eventID string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.seen[eventID], nil
+}
+
+func (l *eventLog) MarkSeen(_ context.Context, eventID string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seen[eventID] = true
+	return nil
+}
+
+// recorder wraps the in-memory bus, recording how each message, by event ID, was settled.
+type recorder struct {
+	*memory.Bus
+	subscribed chan struct{}
+
+	mu        sync.Mutex
+	delivered int                 // messages handed to the consumer
+	settled   map[string]string   // event id → how it was last settled: "ack", "nack" or "requeue"
+	history   map[string][]string // event id → how it was settled on each delivery
+}
+
+func newRecorder(buffer int) *recorder {
+	return &recorder{Bus: memory.NewBus(buffer), subscribed: make(chan struct{}), settled: map[string]string{}, history: map[string][]string{}}
+}
+
+func (r *recorder) Subscribe(ctx context.Context) (<-chan ports.Message, error) {
+	in, err := r.Bus.Subscribe(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan ports.Message)
+	go func() {
+		defer close(out)
+		for m := range in {
+			out <- &recordedMessage{Message: m, r: r}
+
+			r.mu.Lock()
+			r.delivered++
+			r.mu.Unlock()
+		}
+	}()
+
+	close(r.subscribed)
+	return out, nil
+}
+
+// waitDelivered waits until n messages have been handed to the consumer.
+func (r *recorder) waitDelivered(t *testing.T, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		r.mu.Lock()
+		delivered := r.delivered
+		r.mu.Unlock()
+		if delivered >= n {
+			return
+		}
+	}
+	t.Fatalf("fewer than %d messages delivered", n)
+}
+
+func (r *recorder) settle(m ports.Message, how string) {
+	var payload struct {
+		EventID string `json:"event_id"`
+	}
+	_ = json.Unmarshal(m.Body(), &payload)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.settled[payload.EventID] = how
+	r.history[payload.EventID] = append(r.history[payload.EventID], how)
+}
+
+type recordedMessage struct {
+	ports.Message
+	r *recorder
+}
+
+func (m *recordedMessage) Ack() error {
+	m.r.settle(m, "ack")
+	return m.Message.Ack()
+}
+
+func (m *recordedMessage) Nack(requeue bool) error {
+	if requeue {
+		m.r.settle(m, "requeue")
+	} else {
+		m.r.settle(m, "nack")
+	}
+	return m.Message.Nack(requeue)
+}
+
+type event struct {
+	ID      string `json:"event_id"`
+	Kind    string `json:"-"`
+	Product string `json:"id"`
+	Version int64  `json:"version"`
+}
+
+// run consumes events with workers, publishing them all and then closing the bus, and
+// returns the recorder once the consumer has drained.
+func run(t *testing.T, s *store, log *eventLog, workers int, events []event) *recorder {
+	t.Helper()
+
+	r := newRecorder(len(events))
+	if log == nil {
+		log = &eventLog{seen: map[string]bool{}}
+	}
+
+	c := newTestConsumer(r, s, log, workers, len(events))
+	c.backoff = time.Millisecond
+
+	consumed := make(chan error, 1)
+	go func() { consumed <- c.Consume(context.Background()) }()
+	<-r.subscribed
+
+	for _, e := range events {
+		publish(t, r, e)
+	}
+
+	// every event is buffered by now, and is still delivered after the bus closes
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-consumed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("consumer did not drain")
+	}
+
+	return r
+}
+
+func newTestConsumer(r *recorder, s *store, log *eventLog, workers, buffer int) *consumer {
+	cmd := &application.Command{Create: createHandler{s}, Update: updateHandler{s}, Delete: deleteHandler{s}}
+	return NewConsumer(r, cmd, log, workers, buffer).(*consumer)
+}
+
+func publish(t *testing.T, r *recorder, e event) {
+	t.Helper()
+
+	body, err := json.Marshal(struct {
+		event
+		Name     string  `json:"name"`
+		Category string  `json:"category"`
+		Price    float64 `json:"price"`
+	}{e, "Trail shoe", "shoes", 89.9})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = r.Publish(context.Background(), body, e.Kind); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// updates returns n update events for product, versions 1 to n.
+func updates(product string, n int) []event {
+	events := make([]event, n)
+	for i := range events {
+		events[i] = event{ID: fmt.Sprintf("%s-%d", product, i+1), Kind: "update", Product: product, Version: int64(i + 1)}
+	}
+	return events
+}
+
+func TestConsumeAppliesEventsForOneProductInOrder(t *testing.T) {
+	s := newStore()
+	events := append(updates("a", 20), updates("b", 20)...)
+
+	settled := run(t, s, nil, 4, events).settled
+
+	if s.overlap {
+		t.Error("events for one product were applied concurrently")
+	}
+	for _, id := range []string{"a", "b"} {
+		if got := s.applied[id]; !ascending(got, 20) {
+			t.Errorf("product %s: applied versions %v, want 1 to 20 in order", id, got)
+		}
+	}
+	for _, e := range events {
+		if settled[e.ID] != "ack" {
+			t.Errorf("event %s settled %q, want ack", e.ID, settled[e.ID])
+		}
+	}
+}
+
+func TestConsumeAppliesDifferentProductsInParallel(t *testing.T) {
+	// find two products that land on different workers
+	c := &consumer{workers: 2}
+	a, b := "a", ""
+	for i := 0; b == ""; i++ {
+		id := fmt.Sprintf("p%d", i)
+		if c.partition(bodyMessage(id)) != c.partition(bodyMessage(a)) {
+			b = id
+		}
+	}
+
+	// each handler waits for the other to start, which only happens if they run at once
+	var (
+		mu      sync.Mutex
+		started int
+		both    = make(chan struct{})
+	)
+
+	s := newStore()
+	s.enter = func(string) {
+		mu.Lock()
+		if started++; started == 2 {
+			close(both)
+		}
+		mu.Unlock()
+
+		select {
+		case <-both:
+		case <-time.After(2 * time.Second):
+		}
+	}
+	s.fail = func(string, int64, int) error {
+		select {
+		case <-both:
+			return nil
+		default:
+			return errors.New("handlers for different products did not run in parallel")
+		}
+	}
+
+	settled := run(t, s, nil, 2, []event{
+		{ID: "e1", Kind: "create", Product: a, Version: 1},
+		{ID: "e2", Kind: "create", Product: b, Version: 1},
+	}).settled
+
+	if settled["e1"] != "ack" || settled["e2"] != "ack" {
+		t.Errorf("settled %v, want both acked", settled)
+	}
+	if s.attempts[a+"@1"] != 1 || s.attempts[b+"@1"] != 1 {
+		t.Errorf("attempts %v, want each event applied once", s.attempts)
+	}
+}
+
+func TestConsumeRetriesAFailureBeforeLaterEventsForTheProduct(t *testing.T) {
+	s := newStore()
+	s.fail = func(id string, version int64, attempt int) error {
+		if version == 1 && attempt < retryAttempts {
+			return errors.New("elasticsearch unavailable")
+		}
+		return nil
+	}
+
+	settled := run(t, s, nil, 1, updates("a", 3)).settled
+
+	if got := s.applied["a"]; !ascending(got, 3) {
+		t.Errorf("applied versions %v, want 1, 2, 3", got)
+	}
+	if s.attempts["a@1"] != retryAttempts {
+		t.Errorf("version 1 tried %d times, want %d", s.attempts["a@1"], retryAttempts)
+	}
+	for _, id := range []string{"a-1", "a-2", "a-3"} {
+		if settled[id] != "ack" {
+			t.Errorf("event %s settled %q, want ack", id, settled[id])
+		}
+	}
+}
+
+func TestConsumeSettlesMessages(t *testing.T) {
+	s := newStore()
+	s.fail = func(id string, _ int64, attempt int) error {
+		// fails every attempt of the first delivery, and succeeds once redelivered
+		if id == "flaky" && attempt <= retryAttempts {
+			return errors.New("elasticsearch unavailable")
+		}
+		return nil
+	}
+	log := &eventLog{seen: map[string]bool{"dup": true}}
+	duplicates := duplicateEvents.Value()
+
+	r := run(t, s, log, 2, []event{
+		{ID: "ok", Kind: "create", Product: "a", Version: 1},
+		{ID: "dup", Kind: "update", Product: "a", Version: 2},
+		{ID: "unknown", Kind: "rename", Product: "b", Version: 1},
+		{ID: "invalid", Kind: "delete", Product: "c", Version: 0},
+		{ID: "failing", Kind: "delete", Product: "flaky", Version: 1},
+	})
+
+	want := map[string][]string{
+		"ok":      {"ack"},
+		"dup":     {"ack"},
+		"unknown": {"nack"},
+		"invalid": {"nack"},
+		"failing": {"requeue", "ack"},
+	}
+	for id, how := range want {
+		if !slices.Equal(r.history[id], how) {
+			t.Errorf("event %s settled %v, want %v", id, r.history[id], how)
+		}
+	}
+
+	if got := s.applied["a"]; len(got) != 1 || got[0] != 1 {
+		t.Errorf("applied %v to a, want only version 1: the duplicate is skipped", got)
+	}
+	if got := duplicateEvents.Value() - duplicates; got != 1 {
+		t.Errorf("counted %d duplicate events, want 1", got)
+	}
+	if s.attempts["c@0"] != 0 {
+		t.Errorf("invalid event tried %d times, want it rejected without being applied", s.attempts["c@0"])
+	}
+	if s.attempts["flaky@1"] != retryAttempts+1 {
+		t.Errorf("failing event tried %d times, want %d: every retry, then once redelivered", s.attempts["flaky@1"], retryAttempts+1)
+	}
+	if !log.seen["ok"] || !log.seen["failing"] || log.seen["invalid"] {
+		t.Errorf("seen %v, want only applied events recorded", log.seen)
+	}
+}
+
+func ascending(versions []int64, n int) bool {
+	if len(versions) != n {
+		return false
+	}
+	for i, v := range versions {
+		if v != int64(i+1) {
+			return false
+		}
+	}
+	return true
+}
+
+// bodyMessage is a message carrying only a product ID, enough to partition it.
+type bodyMessage string
+
+func (m bodyMessage) Event() string           { return "update" }
+func (m bodyMessage) Body() []byte            { return []byte(`{"id":"` + string(m) + `"}`) }
+func (m bodyMessage) Redelivered() bool       { return false }
+func (m bodyMessage) Ack() error              { return nil }
+func (m bodyMessage) Nack(requeue bool) error { return nil }
+
+func TestConsumeFinishesInFlightEventsOnShutdown(t *testing.T) {
+	s := newStore()
+	started, release := make(chan struct{}), make(chan struct{})
+	s.enter = func(string) {
+		select {
+		case <-started:
+		default:
+			close(started)
+			<-release
+		}
+	}
+
+	r := newRecorder(3)
+	c := newTestConsumer(r, s, &eventLog{seen: map[string]bool{}}, 1, 3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	consumed := make(chan error, 1)
+	go func() { consumed <- c.Consume(ctx) }()
+	<-r.subscribed
+
+	for _, e := range updates("a", 3) {
+		publish(t, r, e)
+	}
+
+	// a-1 is being applied; a-2 and a-3 wait behind it in the partition
+	<-started
+	r.waitDelivered(t, 3)
+	cancel()
+
+	select {
+	case err := <-consumed:
+		t.Fatalf("Consume() = %v with an event in flight, want it to wait", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case err := <-consumed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("consumer did not stop")
+	}
+
+	if got := s.applied["a"]; !slices.Equal(got, []int64{1}) {
+		t.Errorf("applied %v, want only the in-flight version 1", got)
+	}
+
+	want := map[string]string{"a-1": "ack", "a-2": "requeue", "a-3": "requeue"}
+	for id, how := range want {
+		if r.settled[id] != how {
+			t.Errorf("event %s settled %q, want %q", id, r.settled[id], how)
+		}
+	}
+}
+
+func TestConsumeRequeuesARetryingEventOnShutdown(t *testing.T) {
+	s := newStore()
+	failed := make(chan struct{}, 1)
+	s.fail = func(string, int64, int) error {
+		select {
+		case failed <- struct{}{}:
+		default:
+		}
+		return errors.New("elasticsearch unavailable")
+	}
+
+	r := newRecorder(1)
+	c := newTestConsumer(r, s, &eventLog{seen: map[string]bool{}}, 1, 1)
+	c.backoff = time.Hour // shutdown, not the retries running out, settles it
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	consumed := make(chan error, 1)
+	go func() { consumed <- c.Consume(ctx) }()
+	<-r.subscribed
+
+	publish(t, r, event{ID: "a-1", Kind: "update", Product: "a", Version: 1})
+	<-failed
+	cancel()
+
+	select {
+	case err := <-consumed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("consumer did not stop while backing off")
+	}
+
+	if !slices.Equal(r.history["a-1"], []string{"requeue"}) {
+		t.Errorf("event a-1 settled %v, want [requeue]", r.history["a-1"])
+	}
+	if s.attempts["a@1"] != 1 {
+		t.Errorf("tried %d times, want 1: no retry after shutdown", s.attempts["a@1"])
+	}
+}
@@ -0,0 +1,109 @@
+package elastic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"github.com/ziliscite/cqrs_search/internal/ports"
+)
+
+// analyzedMapping is the first mapping version whose name field uses the analyzers below.
+const analyzedMapping = 4
+
+// Analysis configures the analysis chain of the name field. It is read when an index is
+// created, so changing it takes a rebuild; only the synonyms can be reloaded in place.
+type Analysis struct {
+	Language     string // stemmer language, e.g. "english"; empty disables stemming
+	SynonymsPath string // synonyms file, relative to the Elasticsearch config directory; empty disables synonyms
+}
+
+// settings defines the product_name analyzer, which names are indexed with, and
+// product_name_search, which queries are analysed with. Synonyms only apply at search
+// time, which is what lets them be reloaded without reindexing. The product_sort
+// normalizer folds name.keyword so sorting by name ignores case and accents.
+func (a Analysis) settings() map[string]interface{} {
+	filters := map[string]interface{}{}
+	index := []string{"lowercase", "asciifolding"}
+	search := []string{"lowercase", "asciifolding"}
+
+	if a.SynonymsPath != "" {
+		filters["product_synonyms"] = map[string]interface{}{
+			"type":          "synonym_graph",
+			"synonyms_path": a.SynonymsPath,
+			"updateable":    true,
+		}
+		search = append(search, "product_synonyms")
+	}
+
+	// stemming comes after synonyms, so the synonyms file lists plain words
+	if a.Language != "" {
+		filters["product_stemmer"] = map[string]interface{}{
+			"type":     "stemmer",
+			"language": a.Language,
+		}
+		index = append(index, "product_stemmer")
+		search = append(search, "product_stemmer")
+	}
+
+	return map[string]interface{}{
+		"filter": filters,
+		"analyzer": map[string]interface{}{
+			"product_name": map[string]interface{}{
+				"type":      "custom",
+				"tokenizer": "standard",
+				"filter":    index,
+			},
+			"product_name_search": map[string]interface{}{
+				"type":      "custom",
+				"tokenizer": "standard",
+				"filter":    search,
+			},
+		},
+		"normalizer": map[string]interface{}{
+			"product_sort": map[string]interface{}{
+				"type":   "custom",
+				"filter": []string{"lowercase", "asciifolding"},
+			},
+		},
+	}
+}
+
+func NewAnalyzers(client *elasticsearch.Client, index string) ports.Analyzers {
+	return newRepo(client, index)
+}
+
+// ReloadSearchAnalyzers rereads the synonyms file on every node holding the live index,
+// and returns the analyzers that were reloaded.
+func (r *repo) ReloadSearchAnalyzers(ctx context.Context) ([]string, error) {
+	req := esapi.IndicesReloadSearchAnalyzersRequest{
+		Index: []string{r.idx},
+	}
+
+	res, err := req.Do(ctx, r.c)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, fmt.Errorf("error reloading search analyzers: %s", res.String())
+	}
+
+	var response struct {
+		ReloadDetails []struct {
+			ReloadedAnalyzers []string `json:"reloaded_analyzers"`
+		} `json:"reload_details"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+
+	var reloaded []string
+	for _, d := range response.ReloadDetails {
+		reloaded = append(reloaded, d.ReloadedAnalyzers...)
+	}
+
+	return reloaded, nil
+}
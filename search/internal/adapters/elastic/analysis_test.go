@@ -0,0 +1,76 @@
+package elastic
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestAnalysisSettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		analysis Analysis
+	}{
+		{"analysis", Analysis{Language: "english", SynonymsPath: "analysis/synonyms.txt"}},
+		{"analysis_plain", Analysis{}},
+		{"analysis_synonyms", Analysis{SynonymsPath: "analysis/synonyms.txt"}},
+		{"analysis_stemmer", Analysis{Language: "german"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			golden(t, tt.name, tt.analysis.settings())
+		})
+	}
+}
+
+func TestIndexBody(t *testing.T) {
+	analysis := Analysis{Language: "english", SynonymsPath: "analysis/synonyms.txt"}
+	golden(t, "index", productIndex(latestMapping(), analysis))
+
+	// indices of older mappings are rebuilt as they were, without the analyzers
+	settings := productIndex(analyzedMapping-1, analysis)["settings"].(map[string]interface{})
+	if _, ok := settings["analysis"]; ok {
+		t.Errorf("mapping v%d index has analysis settings", analyzedMapping-1)
+	}
+}
+
+func TestReloadSearchAnalyzers(t *testing.T) {
+	tests := []struct {
+		name     string
+		analysis Analysis
+		want     []string
+	}{
+		// synonyms only apply at search time, so only that analyzer reloads
+		{"synonyms", Analysis{Language: "english", SynonymsPath: "analysis/synonyms.txt"}, []string{"product_name_search"}},
+		{"no synonyms", Analysis{Language: "english"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, r := newFakeES(t)
+			r.analysis = tt.analysis
+			if err := r.EnsureIndex(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := r.ReloadSearchAnalyzers(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("ReloadSearchAnalyzers() = %v, want %v", got, tt.want)
+			}
+			if len(f.sent("/products/_reload_search_analyzers")) != 1 {
+				t.Error("reload not sent to the live alias")
+			}
+		})
+	}
+}
+
+func TestReloadSearchAnalyzersWithoutAnIndex(t *testing.T) {
+	_, r := newFakeES(t)
+	if _, err := r.ReloadSearchAnalyzers(context.Background()); err == nil {
+		t.Error("ReloadSearchAnalyzers() = nil error with no live index")
+	}
+}
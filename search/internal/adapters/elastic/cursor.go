@@ -0,0 +1,143 @@
+package elastic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"log"
+	"net/http"
+
+	"github.com/ziliscite/cqrs_search/internal/domain/product"
+	"github.com/ziliscite/cqrs_search/pkg/esquery"
+)
+
+// pitKeepAlive is how long a cursor's point in time stays open after each page.
+const pitKeepAlive = "5m"
+
+// cursorBody builds the request for the page of opts' cursor walk, read from pit.
+func cursorBody(opts *product.Search, pit string) *esquery.SearchRequest {
+	_, size := opts.Pagination()
+	body := searchBody(opts).
+		Size(size).
+		Sort(append(sortClauses(opts.Sort()), esquery.SortBy("id", "asc"))...).
+		TrackTotalHits(true).
+		PointInTime(pit, pitKeepAlive)
+	if cursor := opts.Cursor(); cursor.Started() {
+		body.SearchAfter(cursor.After)
+	}
+	return body
+}
+
+// searchAfter serves a page of a cursor walk. The first page opens a point in time, so
+// the walk sees the index as it was when it started; the last one closes it. Hits are
+// sorted with id as a tiebreaker, which needs mapping v2 like Scan.
+func (r *repo) searchAfter(ctx context.Context, opts *product.Search) (*product.Result, error) {
+	cursor := opts.Cursor()
+
+	pit := cursor.PIT
+	if !cursor.Started() {
+		var err error
+		if pit, err = r.openPIT(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	body, err := json.Marshal(cursorBody(opts, pit))
+	if err != nil {
+		return nil, err
+	}
+
+	// the point in time determines the index, so none is given
+	req := esapi.SearchRequest{Body: bytes.NewReader(body)}
+
+	res, err := req.Do(ctx, r.c)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("search after %s: %w", cursor.PIT, product.ErrCursorExpired)
+	}
+
+	if res.IsError() {
+		return nil, searchError("error searching with cursor", res)
+	}
+
+	var response struct {
+		PIT          string          `json:"pit_id"` // may differ from the one searched with
+		Aggregations json.RawMessage `json:"aggregations"`
+		Hits         struct {
+			Total struct {
+				Value int64 `json:"value"`
+			} `json:"total"`
+			Hits []hit `json:"hits"`
+		} `json:"hits"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+
+	items := toHits(response.Hits.Hits)
+	result := product.NewResult(opts, items, response.Hits.Total.Value)
+	if result.Facets, err = parseFacets(opts.Facets(), response.Aggregations); err != nil {
+		return nil, err
+	}
+
+	if !result.HasNext || len(items) == 0 {
+		r.closePIT(ctx, response.PIT)
+		return result, nil
+	}
+
+	last := response.Hits.Hits[len(items)-1]
+	result.NextCursor = cursor.Next(opts, response.PIT, last.Sort, len(items)).String()
+	return result, nil
+}
+
+func (r *repo) openPIT(ctx context.Context) (string, error) {
+	req := esapi.OpenPointInTimeRequest{
+		Index:     []string{r.idx},
+		KeepAlive: pitKeepAlive,
+	}
+
+	res, err := req.Do(ctx, r.c)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return "", fmt.Errorf("error opening point in time: %s", res.String())
+	}
+
+	var response struct {
+		ID string `json:"id"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return "", err
+	}
+
+	return response.ID, nil
+}
+
+// closePIT releases a finished walk's point in time early; it would expire on its own anyway.
+func (r *repo) closePIT(ctx context.Context, pit string) {
+	body, err := json.Marshal(map[string]string{"id": pit})
+	if err != nil {
+		return
+	}
+
+	req := esapi.ClosePointInTimeRequest{Body: bytes.NewReader(body)}
+	res, err := req.Do(ctx, r.c)
+	if err != nil {
+		log.Printf("failed to close point in time: %v", err)
+		return
+	}
+	defer res.Body.Close()
+
+	if res.IsError() && res.StatusCode != http.StatusNotFound {
+		log.Printf("failed to close point in time: %s", res.String())
+	}
+}
@@ -0,0 +1,126 @@
+package elastic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/ziliscite/cqrs_search/internal/domain/product"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+// walk answers point in time searches over products with ids, sorted by id, the way
+// search_after pages through them.
+func walk(t *testing.T, ids ...string) func(index string, body []byte) (int, interface{}) {
+	return func(_ string, body []byte) (int, interface{}) {
+		var req struct {
+			PIT struct {
+				ID string `json:"id"`
+			} `json:"pit"`
+			Size        int      `json:"size"`
+			SearchAfter []string `json:"search_after"`
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			return http.StatusBadRequest, esError("parsing_exception", err.Error())
+		}
+
+		hits := []interface{}{}
+		for _, id := range ids {
+			if len(req.SearchAfter) > 0 && id <= req.SearchAfter[len(req.SearchAfter)-1] {
+				continue
+			}
+			if len(hits) == req.Size {
+				break
+			}
+			hits = append(hits, map[string]interface{}{"_source": shoe(t, id, 1), "sort": []string{id}})
+		}
+
+		return http.StatusOK, map[string]interface{}{
+			"pit_id": req.PIT.ID,
+			"hits":   map[string]interface{}{"total": map[string]interface{}{"value": len(ids)}, "hits": hits},
+		}
+	}
+}
+
+func TestCursorWalk(t *testing.T) {
+	f, r := ensured(t)
+	f.search = walk(t, "a", "b", "c", "d", "e")
+	ctx := context.Background()
+
+	search := func(cursor *product.Cursor) *product.Search {
+		return product.NewSearch().WithCategory("shoes").WithPageSize(2).WithCursor(cursor)
+	}
+
+	var (
+		seen   []string
+		cursor = &product.Cursor{}
+		pages  int
+	)
+	for {
+		result, err := r.Search(ctx, search(cursor))
+		if err != nil {
+			t.Fatalf("page %d: %v", pages+1, err)
+		}
+		pages++
+		for _, h := range result.Items {
+			seen = append(seen, h.Product.ID())
+		}
+		if result.Page != 0 || result.Total != 5 {
+			t.Errorf("page %d: page number %d, total %d, want none and 5", pages, result.Page, result.Total)
+		}
+
+		if result.NextCursor == "" {
+			if result.HasNext {
+				t.Errorf("page %d has a next page but no cursor to it", pages)
+			}
+			break
+		}
+		if pages > 5 {
+			t.Fatal("walk never ended")
+		}
+
+		// the cursor goes through the client
+		if cursor, err = product.ParseCursor(result.NextCursor); err != nil {
+			t.Fatal(err)
+		}
+		if !cursor.Matches(search(nil)) {
+			t.Error("next cursor doesn't match the search it walks")
+		}
+	}
+
+	if want := []string{"a", "b", "c", "d", "e"}; !slices.Equal(seen, want) || pages != 3 {
+		t.Errorf("walked %v in %d pages, want %v in 3", seen, pages, want)
+	}
+
+	// one point in time for the whole walk, released at its end
+	if f.opened != 1 {
+		t.Errorf("opened %d points in time, want 1", f.opened)
+	}
+	if len(f.pits) != 0 {
+		t.Errorf("points in time %v still open after the last page", f.pits)
+	}
+}
+
+func TestExpiredCursor(t *testing.T) {
+	f, r := ensured(t)
+	f.search = walk(t, "a", "b", "c")
+	ctx := context.Background()
+
+	result, err := r.Search(ctx, product.NewSearch().WithPageSize(2).WithCursor(&product.Cursor{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursor, err := product.ParseCursor(result.NextCursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// keep_alive ran out between pages
+	f.pits = map[string]string{}
+
+	_, err = r.Search(ctx, product.NewSearch().WithPageSize(2).WithCursor(cursor))
+	if !errors.Is(err, product.ErrCursorExpired) {
+		t.Errorf("Search() with an expired cursor = %v, want ErrCursorExpired", err)
+	}
+}
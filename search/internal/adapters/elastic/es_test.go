@@ -0,0 +1,475 @@
+package elastic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeES is an Elasticsearch holding indices, aliases and documents in memory. It keeps
+// external versions the way ES does, deleted documents included, until gc is called,
+// which stands in for index.gc_deletes running out. Searches go to the search func,
+// those with a point in time only while it is open.
+type fakeES struct {
+	mu       sync.Mutex
+	indices  map[string]*fakeIndex
+	aliases  map[string][]string // alias to the indices behind it
+	pits     map[string]string   // open points in time to the index they read
+	opened   int                 // points in time opened so far
+	requests []esRequest
+
+	// search answers a search of index with the returned status and body.
+	search func(index string, body []byte) (int, interface{})
+}
+
+type fakeIndex struct {
+	body map[string]interface{} // as created
+	docs map[string]*fakeDoc
+}
+
+type fakeDoc struct {
+	version int64
+	source  json.RawMessage // nil once deleted
+}
+
+type esRequest struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Body   []byte
+}
+
+// newFakeES starts a fakeES and returns a repo for the products alias talking to it.
+// The repo's indices are not created yet; call EnsureIndex for that.
+func newFakeES(t *testing.T) (*fakeES, *repo) {
+	t.Helper()
+
+	f := &fakeES{indices: map[string]*fakeIndex{}, aliases: map[string][]string{}, pits: map[string]string{}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	client, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{srv.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, newRepo(client, "products")
+}
+
+// ensured returns a repo whose live index, created a while ago with the latest mapping,
+// and tombstones index exist.
+func ensured(t *testing.T) (*fakeES, *repo) {
+	t.Helper()
+	f, r := newFakeES(t)
+
+	body, err := json.Marshal(productIndex(latestMapping(), r.analysis))
+	if err != nil {
+		t.Fatal(err)
+	}
+	live := fmt.Sprintf("%s_v%d_20240101000000", r.idx, latestMapping())
+	f.createIndex(live, body)
+	f.aliases[r.idx] = []string{live}
+
+	if err = r.EnsureIndex(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return f, r
+}
+
+func (f *fakeES) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+
+	f.mu.Lock()
+	f.requests = append(f.requests, esRequest{Method: req.Method, Path: req.URL.Path, Query: req.URL.Query(), Body: body})
+	status, reply := f.route(req, body)
+	f.mu.Unlock()
+
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if req.Method != http.MethodHead {
+		_ = json.NewEncoder(w).Encode(reply)
+	}
+}
+
+func (f *fakeES) route(req *http.Request, body []byte) (int, interface{}) {
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	q := req.URL.Query()
+
+	switch {
+	case len(parts) == 2 && parts[0] == "_alias" && req.Method == http.MethodGet:
+		return f.getAlias(parts[1])
+	case len(parts) == 1 && parts[0] == "_aliases":
+		return f.updateAliases(body)
+	case len(parts) == 2 && parts[1] == "_pit" && req.Method == http.MethodPost:
+		return f.openPIT(parts[0])
+	case len(parts) == 1 && parts[0] == "_pit" && req.Method == http.MethodDelete:
+		return f.closePIT(body)
+	case len(parts) == 1 && parts[0] == "_search" && f.search != nil:
+		return f.searchPIT(body)
+	case len(parts) == 1 && req.Method == http.MethodHead:
+		if f.exists(parts[0]) {
+			return http.StatusOK, nil
+		}
+		return http.StatusNotFound, nil
+	case len(parts) == 1 && req.Method == http.MethodPut:
+		return f.createIndex(parts[0], body)
+	case len(parts) == 1 && req.Method == http.MethodDelete:
+		return f.deleteIndex(parts[0])
+	case len(parts) == 2 && parts[1] == "_mapping":
+		return f.mapping(parts[0])
+	case len(parts) == 2 && parts[1] == "_reload_search_analyzers" && req.Method == http.MethodPost:
+		return f.reloadAnalyzers(parts[0])
+	case len(parts) == 2 && parts[1] == "_mget":
+		return f.mget(parts[0], body)
+	case len(parts) == 2 && parts[1] == "_search" && f.search != nil:
+		return f.search(parts[0], body)
+	case len(parts) == 3 && parts[1] == "_doc":
+		switch req.Method {
+		case http.MethodGet:
+			return f.get(parts[0], parts[2])
+		case http.MethodPut, http.MethodPost:
+			return f.index(parts[0], parts[2], body, q)
+		case http.MethodDelete:
+			return f.delete(parts[0], parts[2], q)
+		}
+	}
+
+	return http.StatusBadRequest, esError("unsupported_operation_exception", req.Method+" "+req.URL.Path)
+}
+
+func (f *fakeES) openPIT(index string) (int, interface{}) {
+	if !f.exists(index) {
+		return http.StatusNotFound, esError("index_not_found_exception", "no such index ["+index+"]")
+	}
+	f.opened++
+	id := fmt.Sprintf("pit-%d", f.opened)
+	f.pits[id] = index
+	return http.StatusOK, map[string]interface{}{"id": id}
+}
+
+func (f *fakeES) closePIT(body []byte) (int, interface{}) {
+	var req struct {
+		ID string `json:"id"`
+	}
+	_ = json.Unmarshal(body, &req)
+	if _, ok := f.pits[req.ID]; !ok {
+		return http.StatusNotFound, map[string]interface{}{"succeeded": true, "num_freed": 0}
+	}
+	delete(f.pits, req.ID)
+	return http.StatusOK, map[string]interface{}{"succeeded": true, "num_freed": 1}
+}
+
+// searchPIT answers a search of a point in time, which fails once it is closed or expired.
+func (f *fakeES) searchPIT(body []byte) (int, interface{}) {
+	var req struct {
+		PIT struct {
+			ID string `json:"id"`
+		} `json:"pit"`
+	}
+	_ = json.Unmarshal(body, &req)
+	index, ok := f.pits[req.PIT.ID]
+	if !ok {
+		return http.StatusNotFound, esError("search_context_missing_exception", "no search context found for id ["+req.PIT.ID+"]")
+	}
+	return f.search(index, body)
+}
+
+func esError(kind, reason string) map[string]interface{} {
+	return map[string]interface{}{"error": map[string]interface{}{"type": kind, "reason": reason}}
+}
+
+func notFound(name string) (int, interface{}) {
+	return http.StatusNotFound, esError("index_not_found_exception", "no such index ["+name+"]")
+}
+
+func (f *fakeES) exists(name string) bool {
+	return f.indices[name] != nil || len(f.aliases[name]) > 0
+}
+
+// resolve returns the index a single-index request for name goes to.
+func (f *fakeES) resolve(name string) (*fakeIndex, bool) {
+	if behind := f.aliases[name]; len(behind) > 0 {
+		return f.indices[behind[0]], true
+	}
+	idx, ok := f.indices[name]
+	return idx, ok
+}
+
+// autoCreate resolves name like resolve, creating it as an index if it doesn't exist, as
+// ES does for document writes.
+func (f *fakeES) autoCreate(name string) *fakeIndex {
+	if idx, ok := f.resolve(name); ok {
+		return idx
+	}
+	idx := &fakeIndex{docs: map[string]*fakeDoc{}}
+	f.indices[name] = idx
+	return idx
+}
+
+func (f *fakeES) createIndex(name string, body []byte) (int, interface{}) {
+	if f.exists(name) {
+		return http.StatusBadRequest, esError("resource_already_exists_exception", "index ["+name+"] already exists")
+	}
+
+	idx := &fakeIndex{docs: map[string]*fakeDoc{}}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &idx.body); err != nil {
+			return http.StatusBadRequest, esError("parse_exception", err.Error())
+		}
+	}
+	f.indices[name] = idx
+	return http.StatusOK, map[string]interface{}{"acknowledged": true, "index": name}
+}
+
+// reloadAnalyzers reports, per index behind name, the analyzers using an updateable filter.
+func (f *fakeES) reloadAnalyzers(name string) (int, interface{}) {
+	names := f.aliases[name]
+	if len(names) == 0 && f.indices[name] != nil {
+		names = []string{name}
+	}
+	if len(names) == 0 {
+		return http.StatusNotFound, esError("index_not_found_exception", "no such index ["+name+"]")
+	}
+
+	details := []interface{}{}
+	for _, n := range names {
+		var body struct {
+			Settings struct {
+				Analysis struct {
+					Filter   map[string]struct{ Updateable bool }
+					Analyzer map[string]struct{ Filter []string }
+				}
+			}
+		}
+		b, _ := json.Marshal(f.indices[n].body)
+		_ = json.Unmarshal(b, &body)
+
+		reloaded := []string{}
+		for analyzer, a := range body.Settings.Analysis.Analyzer {
+			for _, filter := range a.Filter {
+				if body.Settings.Analysis.Filter[filter].Updateable {
+					reloaded = append(reloaded, analyzer)
+					break
+				}
+			}
+		}
+		details = append(details, map[string]interface{}{"index": n, "reloaded_analyzers": reloaded, "reloaded_node_ids": []string{"node-1"}})
+	}
+
+	return http.StatusOK, map[string]interface{}{"reload_details": details}
+}
+
+func (f *fakeES) deleteIndex(name string) (int, interface{}) {
+	if f.indices[name] == nil {
+		return notFound(name)
+	}
+	f.dropIndex(name)
+	return http.StatusOK, map[string]interface{}{"acknowledged": true}
+}
+
+func (f *fakeES) dropIndex(name string) {
+	delete(f.indices, name)
+	for alias, behind := range f.aliases {
+		f.aliases[alias] = slices.DeleteFunc(behind, func(i string) bool { return i == name })
+	}
+}
+
+func (f *fakeES) getAlias(name string) (int, interface{}) {
+	behind := f.aliases[name]
+	if len(behind) == 0 {
+		return http.StatusNotFound, map[string]interface{}{"error": "alias [" + name + "] missing", "status": 404}
+	}
+
+	reply := map[string]interface{}{}
+	for _, index := range behind {
+		reply[index] = map[string]interface{}{"aliases": map[string]interface{}{name: map[string]interface{}{}}}
+	}
+	return http.StatusOK, reply
+}
+
+func (f *fakeES) updateAliases(body []byte) (int, interface{}) {
+	var request struct {
+		Actions []map[string]map[string]string `json:"actions"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		return http.StatusBadRequest, esError("parse_exception", err.Error())
+	}
+
+	for _, action := range request.Actions {
+		for kind, args := range action {
+			if f.indices[args["index"]] == nil {
+				return notFound(args["index"])
+			}
+
+			switch kind {
+			case "add":
+				if f.indices[args["alias"]] != nil {
+					return http.StatusBadRequest, esError("invalid_alias_name_exception", "an index exists with the same name as the alias")
+				}
+				f.aliases[args["alias"]] = append(f.aliases[args["alias"]], args["index"])
+			case "remove":
+				f.aliases[args["alias"]] = slices.DeleteFunc(f.aliases[args["alias"]], func(i string) bool { return i == args["index"] })
+			case "remove_index":
+				f.dropIndex(args["index"])
+			}
+		}
+	}
+	return http.StatusOK, map[string]interface{}{"acknowledged": true}
+}
+
+func (f *fakeES) mapping(name string) (int, interface{}) {
+	names := f.aliases[name]
+	if f.indices[name] != nil {
+		names = []string{name}
+	}
+	if len(names) == 0 {
+		return notFound(name)
+	}
+
+	reply := map[string]interface{}{}
+	for _, index := range names {
+		reply[index] = map[string]interface{}{"mappings": f.indices[index].body["mappings"]}
+	}
+	return http.StatusOK, reply
+}
+
+func (f *fakeES) get(name, id string) (int, interface{}) {
+	idx, ok := f.resolve(name)
+	if !ok {
+		return notFound(name)
+	}
+
+	doc := idx.docs[id]
+	if doc == nil || doc.source == nil {
+		return http.StatusNotFound, map[string]interface{}{"_id": id, "found": false}
+	}
+	return http.StatusOK, map[string]interface{}{"_id": id, "_version": doc.version, "found": true, "_source": doc.source}
+}
+
+func (f *fakeES) mget(name string, body []byte) (int, interface{}) {
+	idx, ok := f.resolve(name)
+	if !ok {
+		return notFound(name)
+	}
+
+	var request struct {
+		IDs []string `json:"ids"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		return http.StatusBadRequest, esError("parse_exception", err.Error())
+	}
+
+	docs := make([]interface{}, len(request.IDs))
+	for i, id := range request.IDs {
+		if doc := idx.docs[id]; doc != nil && doc.source != nil {
+			docs[i] = map[string]interface{}{"_id": id, "found": true, "_source": doc.source}
+		} else {
+			docs[i] = map[string]interface{}{"_id": id, "found": false}
+		}
+	}
+	return http.StatusOK, map[string]interface{}{"docs": docs}
+}
+
+// conflict reports whether an external version write at q's version loses to doc.
+func conflict(doc *fakeDoc, q url.Values) (int64, bool) {
+	if q.Get("version_type") != externalVersion {
+		return 0, false
+	}
+	v, _ := strconv.ParseInt(q.Get("version"), 10, 64)
+	return v, doc != nil && v <= doc.version
+}
+
+func (f *fakeES) index(name, id string, body []byte, q url.Values) (int, interface{}) {
+	if _, ok := f.resolve(name); !ok && q.Get("require_alias") == "true" {
+		return http.StatusNotFound, esError("index_not_found_exception",
+			fmt.Sprintf("no such index [%s] and [require_alias] request flag is [true] and [%s] is not an alias", name, name))
+	}
+
+	idx := f.autoCreate(name)
+	v, lost := conflict(idx.docs[id], q)
+	if lost {
+		return http.StatusConflict, esError("version_conflict_engine_exception", "["+id+"]: version conflict")
+	}
+
+	idx.docs[id] = &fakeDoc{version: v, source: json.RawMessage(slices.Clone(body))}
+	return http.StatusCreated, map[string]interface{}{"_id": id, "_version": v, "result": "created"}
+}
+
+func (f *fakeES) delete(name, id string, q url.Values) (int, interface{}) {
+	idx := f.autoCreate(name)
+	doc := idx.docs[id]
+	v, lost := conflict(doc, q)
+	if lost {
+		return http.StatusConflict, esError("version_conflict_engine_exception", "["+id+"]: version conflict")
+	}
+
+	// the version of the delete is kept, like a live document's
+	idx.docs[id] = &fakeDoc{version: v}
+	if doc == nil || doc.source == nil {
+		return http.StatusNotFound, map[string]interface{}{"_id": id, "result": "not_found"}
+	}
+	return http.StatusOK, map[string]interface{}{"_id": id, "result": "deleted"}
+}
+
+// gc forgets the versions of deleted documents.
+func (f *fakeES) gc() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, idx := range f.indices {
+		for id, doc := range idx.docs {
+			if doc.source == nil {
+				delete(idx.docs, id)
+			}
+		}
+	}
+}
+
+// doc returns the version and source of the live document id in index or alias name.
+func (f *fakeES) doc(name, id string) (int64, json.RawMessage, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	idx, ok := f.resolve(name)
+	if !ok || idx.docs[id] == nil || idx.docs[id].source == nil {
+		return 0, nil, false
+	}
+	return idx.docs[id].version, idx.docs[id].source, true
+}
+
+// indexNames returns the concrete indices, sorted.
+func (f *fakeES) indexNames() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	names := make([]string, 0, len(f.indices))
+	for name := range f.indices {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// sent returns the requests made so far whose path ends in suffix.
+func (f *fakeES) sent(suffix string) []esRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var out []esRequest
+	for _, r := range f.requests {
+		if strings.HasSuffix(r.Path, suffix) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
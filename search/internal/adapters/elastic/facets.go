@@ -0,0 +1,141 @@
+package elastic
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"strings"
+
+	"github.com/ziliscite/cqrs_search/internal/domain/product"
+	"github.com/ziliscite/cqrs_search/pkg/esquery"
+)
+
+// maxCategoryFacets bounds the category buckets returned, most populated first.
+const maxCategoryFacets = 50
+
+// facetAggs builds the aggregations for req. Each facet is wrapped in a filter aggregation
+// holding the other facet's filter: the category counts are narrowed by price and the price
+// facets by category, while the name query applies to both.
+func facetAggs(req product.FacetRequest, categoryFilter, priceFilter esquery.Query) esquery.Aggregations {
+	aggs := esquery.Aggregations{}
+
+	if req.Categories {
+		aggs["categories"] = esquery.FilterAgg(orMatchAll(priceFilter)).
+			SubAgg("terms", esquery.TermsAgg("category").Size(maxCategoryFacets))
+	}
+
+	price := esquery.FilterAgg(orMatchAll(categoryFilter))
+	pricing := false
+	if len(req.PriceRanges) > 0 {
+		ranges := esquery.RangeAgg("price")
+		for _, r := range req.PriceRanges {
+			ranges.AddRange(r.From, r.To)
+		}
+		price.SubAgg("ranges", ranges)
+		pricing = true
+	} else if req.PriceInterval > 0 {
+		price.SubAgg("histogram", esquery.HistogramAgg("price", req.PriceInterval).MinDocCount(1))
+		pricing = true
+	}
+	if req.PriceStats {
+		price.SubAgg("stats", esquery.StatsAgg("price"))
+		pricing = true
+	}
+
+	if pricing {
+		aggs["price"] = price
+	}
+
+	return aggs
+}
+
+func orMatchAll(filter esquery.Query) esquery.Query {
+	if filter == nil {
+		return esquery.MatchAll()
+	}
+	return filter
+}
+
+// parseFacets reads the aggregations built by facetAggs. It returns nil when no facet was requested.
+func parseFacets(req product.FacetRequest, raw json.RawMessage) (*product.Facets, error) {
+	if req.Empty() {
+		return nil, nil
+	}
+
+	var aggs struct {
+		Categories struct {
+			Terms struct {
+				Buckets []struct {
+					Key      string `json:"key"`
+					DocCount int64  `json:"doc_count"`
+				} `json:"buckets"`
+			} `json:"terms"`
+		} `json:"categories"`
+		Price struct {
+			Ranges struct {
+				Buckets []struct {
+					From     *float64 `json:"from"`
+					To       *float64 `json:"to"`
+					DocCount int64    `json:"doc_count"`
+				} `json:"buckets"`
+			} `json:"ranges"`
+			Histogram struct {
+				Buckets []struct {
+					Key      float64 `json:"key"`
+					DocCount int64   `json:"doc_count"`
+				} `json:"buckets"`
+			} `json:"histogram"`
+			Stats struct {
+				Count int64    `json:"count"`
+				Min   *float64 `json:"min"`
+				Max   *float64 `json:"max"`
+				Avg   *float64 `json:"avg"`
+			} `json:"stats"`
+		} `json:"price"`
+	}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &aggs); err != nil {
+			return nil, err
+		}
+	}
+
+	facets := &product.Facets{}
+	if req.Categories {
+		facets.Categories = make([]product.CategoryCount, len(aggs.Categories.Terms.Buckets))
+		for i, b := range aggs.Categories.Terms.Buckets {
+			facets.Categories[i] = product.CategoryCount{Category: b.Key, Count: b.DocCount}
+		}
+	}
+
+	if len(req.PriceRanges) > 0 {
+		facets.PriceRanges = make([]product.PriceRangeCount, len(aggs.Price.Ranges.Buckets))
+		for i, b := range aggs.Price.Ranges.Buckets {
+			facets.PriceRanges[i] = product.PriceRangeCount{
+				PriceRange: product.PriceRange{From: b.From, To: b.To},
+				Count:      b.DocCount,
+			}
+		}
+	} else if req.PriceInterval > 0 {
+		facets.PriceHistogram = make([]product.PriceBucket, len(aggs.Price.Histogram.Buckets))
+		for i, b := range aggs.Price.Histogram.Buckets {
+			facets.PriceHistogram[i] = product.PriceBucket{From: b.Key, Count: b.DocCount}
+		}
+	}
+
+	if req.PriceStats {
+		s := aggs.Price.Stats
+		facets.Price = &product.PriceStats{Count: s.Count, Min: s.Min, Max: s.Max, Avg: s.Avg}
+	}
+
+	return facets, nil
+}
+
+// searchError describes a failed search, as product.ErrTooManyBuckets when the facets
+// asked for more buckets than the cluster's search.max_buckets.
+func searchError(what string, res *esapi.Response) error {
+	msg := res.String()
+	if strings.Contains(msg, "too_many_buckets_exception") {
+		return fmt.Errorf("%s: %w", what, product.ErrTooManyBuckets)
+	}
+	return fmt.Errorf("%s: %s", what, msg)
+}
@@ -0,0 +1,169 @@
+package elastic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"io"
+	"net/http"
+	"time"
+)
+
+// errIndexExists is returned by createIndex when the index is already there.
+var errIndexExists = errors.New("index already exists")
+
+// indexName returns a new concrete index name for mapping version behind alias,
+// e.g. product_v2_20250102150405.
+func indexName(alias string, version int) string {
+	return fmt.Sprintf("%s_v%d_%s", alias, version, time.Now().UTC().Format("20060102150405"))
+}
+
+func (r *repo) createIndex(ctx context.Context, name string, body map[string]interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal index mapping: %w", err)
+	}
+
+	req := esapi.IndicesCreateRequest{
+		Index: name,
+		Body:  bytes.NewReader(b),
+	}
+
+	res, err := req.Do(ctx, r.c)
+	if err != nil {
+		return fmt.Errorf("error creating index: %w", err)
+	}
+	defer res.Body.Close()
+
+	if !res.IsError() {
+		return nil
+	}
+
+	raw, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	var response struct {
+		Error struct {
+			Type string `json:"type"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(raw, &response) == nil && response.Error.Type == "resource_already_exists_exception" {
+		return fmt.Errorf("create %s: %w", name, errIndexExists)
+	}
+
+	return fmt.Errorf("index creation failed: [%d] %s", res.StatusCode, raw)
+}
+
+// aliasIndices returns the indices alias points at; none if the alias doesn't exist.
+func (r *repo) aliasIndices(ctx context.Context, alias string) ([]string, error) {
+	req := esapi.IndicesGetAliasRequest{
+		Name: []string{alias},
+	}
+
+	res, err := req.Do(ctx, r.c)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	if res.IsError() {
+		return nil, fmt.Errorf("error getting alias %s: %s", alias, res.String())
+	}
+
+	var response map[string]json.RawMessage
+	if err = json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+
+	indices := make([]string, 0, len(response))
+	for index := range response {
+		indices = append(indices, index)
+	}
+	return indices, nil
+}
+
+// indexExists reports whether name exists as an index or alias.
+func (r *repo) indexExists(ctx context.Context, name string) (bool, error) {
+	req := esapi.IndicesExistsRequest{
+		Index: []string{name},
+	}
+
+	res, err := req.Do(ctx, r.c)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("error checking index %s: %s", name, res.String())
+	}
+}
+
+func (r *repo) deleteIndex(ctx context.Context, name string) error {
+	req := esapi.IndicesDeleteRequest{
+		Index: []string{name},
+	}
+
+	res, err := req.Do(ctx, r.c)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() && res.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("error deleting index %s: %s", name, res.String())
+	}
+	return nil
+}
+
+type aliasAction map[string]interface{}
+
+func addAlias(index, alias string) aliasAction {
+	return aliasAction{"add": map[string]string{"index": index, "alias": alias}}
+}
+
+func removeAlias(index, alias string) aliasAction {
+	return aliasAction{"remove": map[string]string{"index": index, "alias": alias}}
+}
+
+// removeIndex deletes index as part of the alias update, so its name can be taken by an alias.
+func removeIndex(index string) aliasAction {
+	return aliasAction{"remove_index": map[string]string{"index": index}}
+}
+
+// updateAliases applies actions atomically: searches see either all of them or none.
+func (r *repo) updateAliases(ctx context.Context, actions ...aliasAction) error {
+	body, err := json.Marshal(map[string]interface{}{"actions": actions})
+	if err != nil {
+		return err
+	}
+
+	req := esapi.IndicesUpdateAliasesRequest{
+		Body: bytes.NewReader(body),
+	}
+
+	res, err := req.Do(ctx, r.c)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("error updating aliases: %s", res.String())
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package elastic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+)
+
+// mappings holds every version of the product index mapping, oldest first; version N is
+// mappings[N-1]. A released version is never edited: a change is appended as a new version
+// and rolled out with the migrate command, which reindexes into an index with the new mapping.
+var mappings = []map[string]interface{}{
+	// v1
+	{
+		"properties": map[string]interface{}{
+			"name": map[string]interface{}{
+				"type": "text",
+			},
+			"price": map[string]interface{}{
+				"type": "double",
+			},
+			"category": map[string]interface{}{
+				"type": "keyword",
+			},
+		},
+	},
+	// v2: id and version, so the index can be walked in ID order by reconciliation
+	{
+		"properties": map[string]interface{}{
+			"id": map[string]interface{}{
+				"type": "keyword",
+			},
+			"name": map[string]interface{}{
+				"type": "text",
+			},
+			"price": map[string]interface{}{
+				"type": "double",
+			},
+			"category": map[string]interface{}{
+				"type": "keyword",
+			},
+			"version": map[string]interface{}{
+				"type": "long",
+			},
+		},
+	},
+	// v3: name.suggest, for typeahead suggestions
+	{
+		"properties": map[string]interface{}{
+			"id": map[string]interface{}{
+				"type": "keyword",
+			},
+			"name": map[string]interface{}{
+				"type": "text",
+				"fields": map[string]interface{}{
+					"suggest": map[string]interface{}{
+						"type": "search_as_you_type",
+					},
+				},
+			},
+			"price": map[string]interface{}{
+				"type": "double",
+			},
+			"category": map[string]interface{}{
+				"type": "keyword",
+			},
+			"version": map[string]interface{}{
+				"type": "long",
+			},
+		},
+	},
+	// v4: name analysed with stemming, folding and search-time synonyms (see analysis.go)
+	{
+		"properties": map[string]interface{}{
+			"id": map[string]interface{}{
+				"type": "keyword",
+			},
+			"name": map[string]interface{}{
+				"type":            "text",
+				"analyzer":        "product_name",
+				"search_analyzer": "product_name_search",
+				"fields": map[string]interface{}{
+					"suggest": map[string]interface{}{
+						"type": "search_as_you_type",
+					},
+				},
+			},
+			"price": map[string]interface{}{
+				"type": "double",
+			},
+			"category": map[string]interface{}{
+				"type": "keyword",
+			},
+			"version": map[string]interface{}{
+				"type": "long",
+			},
+		},
+	},
+	// v5: name.keyword, so results can be sorted by name
+	{
+		"properties": map[string]interface{}{
+			"id": map[string]interface{}{
+				"type": "keyword",
+			},
+			"name": map[string]interface{}{
+				"type":            "text",
+				"analyzer":        "product_name",
+				"search_analyzer": "product_name_search",
+				"fields": map[string]interface{}{
+					"suggest": map[string]interface{}{
+						"type": "search_as_you_type",
+					},
+					"keyword": map[string]interface{}{
+						"type":         "keyword",
+						"normalizer":   "product_sort",
+						"ignore_above": 256,
+					},
+				},
+			},
+			"price": map[string]interface{}{
+				"type": "double",
+			},
+			"category": map[string]interface{}{
+				"type": "keyword",
+			},
+			"version": map[string]interface{}{
+				"type": "long",
+			},
+		},
+	},
+}
+
+// latestMapping is the mapping version new indices are created with.
+func latestMapping() int {
+	return len(mappings)
+}
+
+// productIndex returns the create-index body for mapping version, which is recorded
+// in the mapping's _meta so the deployed version can be read back.
+func productIndex(version int, analysis Analysis) map[string]interface{} {
+	m := map[string]interface{}{
+		"_meta": map[string]interface{}{
+			"mapping_version": version,
+		},
+	}
+	for k, v := range mappings[version-1] {
+		m[k] = v
+	}
+
+	settings := map[string]interface{}{
+		"number_of_shards":   1,
+		"number_of_replicas": 1,
+	}
+	if version >= analyzedMapping {
+		settings["analysis"] = analysis.settings()
+	}
+
+	return map[string]interface{}{
+		"settings": settings,
+		"mappings": m,
+	}
+}
+
+// mappingVersion returns the mapping version of the index or alias name. An index
+// created before mappings were versioned reports 0.
+func (r *repo) mappingVersion(ctx context.Context, name string) (int, error) {
+	req := esapi.IndicesGetMappingRequest{
+		Index: []string{name},
+	}
+
+	res, err := req.Do(ctx, r.c)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return 0, fmt.Errorf("error getting mapping of %s: %s", name, res.String())
+	}
+
+	var response map[string]struct {
+		Mappings struct {
+			Meta struct {
+				Version int `json:"mapping_version"`
+			} `json:"_meta"`
+		} `json:"mappings"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return 0, err
+	}
+
+	// an alias points at a single index outside of a swap
+	for _, index := range response {
+		return index.Mappings.Meta.Version, nil
+	}
+	return 0, fmt.Errorf("no mapping found for %s", name)
+}
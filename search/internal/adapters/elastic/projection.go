@@ -0,0 +1,398 @@
+package elastic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ziliscite/cqrs_search/internal/domain/product"
+	"github.com/ziliscite/cqrs_search/internal/ports"
+)
+
+// Rebuilds and migrations fill a fresh index, created with the latest mapping, behind the
+// staging alias while the consumer keeps running: a rebuild loads it from the product
+// service, a migration reindexes the live index into it. Live writes are mirrored into the
+// staging alias (see write.go), and since the load, the reindex and the live writes all use
+// external versions, whichever carries the later version wins regardless of the order they
+// land in. Events that arrive in the meantime are thereby replayed into the new index
+// before the alias is swapped.
+
+func NewProjection(client *elasticsearch.Client, index string, analysis Analysis) (ports.Projection, error) {
+	r := newRepo(client, index)
+	r.analysis = analysis
+	if err := r.EnsureIndex(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *repo) Versions(ctx context.Context) (int, int, error) {
+	deployed, err := r.mappingVersion(ctx, r.idx)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return deployed, latestMapping(), nil
+}
+
+func (r *repo) Prepare(ctx context.Context) (string, error) {
+	building, err := r.aliasIndices(ctx, r.staging)
+	if err != nil {
+		return "", err
+	}
+
+	if len(building) > 0 {
+		return "", fmt.Errorf("a rebuild is already in progress into %v; drop it before starting another", building)
+	}
+
+	name := indexName(r.idx, latestMapping())
+	if err = r.createIndex(ctx, name, productIndex(latestMapping(), r.analysis)); err != nil {
+		return "", err
+	}
+
+	if err = r.updateAliases(ctx, addAlias(name, r.staging)); err != nil {
+		return "", err
+	}
+
+	return name, nil
+}
+
+func (r *repo) Load(ctx context.Context, index string, products []product.Product) (int, error) {
+	if len(products) == 0 {
+		return 0, nil
+	}
+
+	deleted, err := r.buriedAll(ctx, products)
+	if err != nil {
+		return 0, err
+	}
+
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+
+	var batched int
+	for i := range products {
+		p := &products[i]
+		if deleted[p.ID()] >= p.Version() {
+			continue
+		}
+
+		action := map[string]interface{}{
+			"index": map[string]interface{}{
+				"_index":       index,
+				"_id":          p.ID(),
+				"version":      p.Version(),
+				"version_type": externalVersion,
+			},
+		}
+
+		if err = enc.Encode(action); err != nil {
+			return 0, err
+		}
+		if err = enc.Encode(p); err != nil {
+			return 0, err
+		}
+		batched++
+	}
+
+	if batched == 0 {
+		return 0, nil
+	}
+
+	req := esapi.BulkRequest{
+		Body: &body,
+	}
+
+	res, err := req.Do(ctx, r.c)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return 0, fmt.Errorf("bulk index error: %s", res.String())
+	}
+
+	var response struct {
+		Items []map[string]struct {
+			ID     string          `json:"_id"`
+			Status int             `json:"status"`
+			Error  json.RawMessage `json:"error"`
+		} `json:"items"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return 0, err
+	}
+
+	indexed := 0
+	for _, item := range response.Items {
+		for _, result := range item {
+			switch {
+			case result.Status == http.StatusConflict:
+				// a live write already put a later version in place
+			case result.Status >= http.StatusBadRequest:
+				return indexed, fmt.Errorf("bulk index %s failed: %s", result.ID, result.Error)
+			default:
+				indexed++
+			}
+		}
+	}
+
+	return indexed, nil
+}
+
+// buriedAll returns the tombstone versions of products, keyed by ID. Products that
+// were never deleted are absent.
+func (r *repo) buriedAll(ctx context.Context, products []product.Product) (map[string]int64, error) {
+	ids := make([]string, len(products))
+	for i := range products {
+		ids[i] = products[i].ID()
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"ids": ids})
+	if err != nil {
+		return nil, err
+	}
+
+	req := esapi.MgetRequest{
+		Index: r.tombstones,
+		Body:  bytes.NewReader(body),
+	}
+
+	res, err := req.Do(ctx, r.c)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, fmt.Errorf("error getting tombstones: %s", res.String())
+	}
+
+	var response struct {
+		Docs []struct {
+			Found  bool      `json:"found"`
+			Source tombstone `json:"_source"`
+		} `json:"docs"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+
+	deleted := make(map[string]int64)
+	for _, doc := range response.Docs {
+		if doc.Found {
+			deleted[doc.Source.ID] = doc.Source.Version
+		}
+	}
+	return deleted, nil
+}
+
+func (r *repo) Reindex(ctx context.Context, index string) (int, error) {
+	// allow for clock skew between the instances writing tombstones
+	started := time.Now().UTC().Add(-time.Minute)
+
+	body, err := json.Marshal(map[string]interface{}{
+		"conflicts": "proceed", // a conflict means a mirrored live write got there first
+		"source": map[string]interface{}{
+			"index": r.idx,
+		},
+		"dest": map[string]interface{}{
+			"index":        index,
+			"version_type": externalVersion,
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	wait := true
+	req := esapi.ReindexRequest{
+		Body:              bytes.NewReader(body),
+		WaitForCompletion: &wait,
+	}
+
+	res, err := req.Do(ctx, r.c)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return 0, fmt.Errorf("reindex error: %s", res.String())
+	}
+
+	var response struct {
+		Created  int               `json:"created"`
+		Updated  int               `json:"updated"`
+		Failures []json.RawMessage `json:"failures"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return 0, err
+	}
+
+	if len(response.Failures) > 0 {
+		return 0, fmt.Errorf("reindex failed for %d documents, first: %s", len(response.Failures), response.Failures[0])
+	}
+
+	// a document deleted during the reindex may have been copied after its delete was mirrored
+	if err = r.sweep(ctx, index, started); err != nil {
+		return 0, err
+	}
+
+	return response.Created + response.Updated, nil
+}
+
+// sweepPage is how many tombstones sweep reads at a time.
+const sweepPage = 1000
+
+// sweep applies to index every delete recorded since the given time, paging through the
+// tombstones in id order so none are left out however many there are.
+func (r *repo) sweep(ctx context.Context, index string, since time.Time) error {
+	var after string
+	for {
+		page, err := r.buriedSince(ctx, since, after)
+		if err != nil {
+			return err
+		}
+
+		for _, t := range page {
+			v := int(t.Version)
+			del := esapi.DeleteRequest{
+				Index:       index,
+				DocumentID:  t.ID,
+				Version:     &v,
+				VersionType: externalVersion,
+			}
+
+			// gone already, or recreated after the delete: both are fine
+			if err = r.mirror(ctx, del); err != nil {
+				return err
+			}
+		}
+
+		if len(page) < sweepPage {
+			return nil
+		}
+		after = page[len(page)-1].ID
+	}
+}
+
+// buriedSince returns up to sweepPage tombstones recorded since the given time, with IDs after after.
+func (r *repo) buriedSince(ctx context.Context, since time.Time, after string) ([]tombstone, error) {
+	search := map[string]interface{}{
+		"size": sweepPage,
+		"query": map[string]interface{}{
+			"range": map[string]interface{}{
+				"deleted_at": map[string]interface{}{"gte": since},
+			},
+		},
+		"sort": []interface{}{map[string]interface{}{"id": "asc"}},
+	}
+	if after != "" {
+		search["search_after"] = []string{after}
+	}
+
+	body, err := json.Marshal(search)
+	if err != nil {
+		return nil, err
+	}
+
+	req := esapi.SearchRequest{
+		Index: []string{r.tombstones},
+		Body:  bytes.NewReader(body),
+	}
+
+	res, err := req.Do(ctx, r.c)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, fmt.Errorf("error searching tombstones: %s", res.String())
+	}
+
+	var response struct {
+		Hits struct {
+			Hits []struct {
+				Source tombstone `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+
+	page := make([]tombstone, len(response.Hits.Hits))
+	for i, hit := range response.Hits.Hits {
+		page[i] = hit.Source
+	}
+
+	return page, nil
+}
+
+func (r *repo) Promote(ctx context.Context, index string) error {
+	refresh := esapi.IndicesRefreshRequest{
+		Index: []string{index},
+	}
+
+	res, err := refresh.Do(ctx, r.c)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("error refreshing index %s: %s", index, res.String())
+	}
+
+	live, err := r.aliasIndices(ctx, r.idx)
+	if err != nil {
+		return err
+	}
+
+	actions := []aliasAction{removeAlias(index, r.staging)}
+	for _, old := range live {
+		actions = append(actions, removeAlias(old, r.idx))
+	}
+
+	if len(live) == 0 {
+		legacy, err := r.indexExists(ctx, r.idx)
+		if err != nil {
+			return err
+		}
+
+		if legacy {
+			// the pre-alias index goes in the same step, freeing its name for the alias
+			actions = append(actions, removeIndex(r.idx))
+		}
+	}
+
+	if err = r.updateAliases(ctx, append(actions, addAlias(index, r.idx))...); err != nil {
+		return err
+	}
+
+	for _, old := range live {
+		if old == index {
+			continue
+		}
+
+		if err = r.deleteIndex(ctx, old); err != nil {
+			log.Printf("failed to delete replaced index %s: %v", old, err)
+		}
+	}
+
+	return nil
+}
+
+func (r *repo) Drop(ctx context.Context, index string) error {
+	return r.deleteIndex(ctx, index)
+}
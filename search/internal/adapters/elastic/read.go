@@ -1,83 +1,36 @@
 package elastic
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/elastic/go-elasticsearch/v8/esapi"
-	"io"
 	"log"
-	"strings"
+	"net/http"
 
 	"github.com/ziliscite/cqrs_search/internal/domain/product"
+	"github.com/ziliscite/cqrs_search/pkg/esquery"
 )
 
-func (r *repo) Search(ctx context.Context, opts *product.Search) ([]product.Product, error) {
-	log.Printf("query: %s, %s", opts.Name(), opts.Category())
+func (r *repo) Search(ctx context.Context, opts *product.Search) (*product.Result, error) {
+	log.Printf("query: %s, %v", opts.Name(), opts.Categories())
 
-	// Build bool query
-	boolQuery := map[string]interface{}{"bool": map[string]interface{}{
-		"must":   []interface{}{},
-		"filter": []interface{}{},
-	}}
-
-	// match name
-	if opts.Name() != "" {
-		boolQuery["bool"].(map[string]interface{})["must"] = append(
-			boolQuery["bool"].(map[string]interface{})["must"].([]interface{}),
-			map[string]interface{}{"match": map[string]interface{}{"name": opts.Name()}},
-		)
-	}
-
-	// term category
-	if opts.Category() != "" {
-		boolQuery["bool"].(map[string]interface{})["filter"] = append(
-			boolQuery["bool"].(map[string]interface{})["filter"].([]interface{}),
-			map[string]interface{}{"term": map[string]interface{}{"category": opts.Category()}},
-		)
-	}
-
-	// price range
-	minPrice, maxPrice := opts.PriceRange()
-	if minPrice != nil || maxPrice != nil {
-		rangeQ := map[string]interface{}{"range": map[string]interface{}{"price": map[string]interface{}{}}}
-		if minPrice != nil {
-			rangeQ["range"].(map[string]interface{})["price"].(map[string]interface{})["gte"] = *minPrice
-		}
-		if maxPrice != nil {
-			rangeQ["range"].(map[string]interface{})["price"].(map[string]interface{})["lte"] = *maxPrice
-		}
-		boolQuery["bool"].(map[string]interface{})["filter"] = append(
-			boolQuery["bool"].(map[string]interface{})["filter"].([]interface{}),
-			rangeQ,
-		)
+	if opts.Cursor() != nil {
+		return r.searchAfter(ctx, opts)
 	}
 
 	// marshal query
-	query, err := json.Marshal(map[string]interface{}{"query": boolQuery})
+	body := offsetBody(opts)
+	query, err := json.Marshal(body)
 	if err != nil {
 		return nil, err
 	}
 
-	// pagination
-	size := opts.PageSize()
-	from := opts.Offset()
-
-	// sort
-	field, by := opts.SortBy()
-	var sortOpts []string
-	if field != "" {
-		sortOpts = []string{fmt.Sprintf("%s:%s", field, by)}
-	}
-
 	log.Printf("query: %s", string(query))
 	req := esapi.SearchRequest{
-		Index:          []string{r.idx},
-		Body:           io.NopCloser(strings.NewReader(string(query))),
-		From:           &from,
-		Size:           &size,
-		Sort:           sortOpts, // will only be non-empty if field != ""
-		TrackTotalHits: true,
+		Index: []string{r.idx},
+		Body:  bytes.NewReader(query),
 	}
 
 	// execute search
@@ -88,29 +41,223 @@ func (r *repo) Search(ctx context.Context, opts *product.Search) ([]product.Prod
 	defer res.Body.Close()
 
 	if res.IsError() {
-		return nil, fmt.Errorf("error getting document: %s", res.String())
+		return nil, searchError("error searching products", res)
 	}
 
 	log.Printf("response: %s", res.String())
 
 	// parse hits
 	var esResp struct {
-		Hits struct {
-			Hits []struct {
-				Source product.Product `json:"_source"`
-			} `json:"hits"`
+		Aggregations json.RawMessage `json:"aggregations"`
+		Hits         struct {
+			Total struct {
+				Value int64 `json:"value"`
+			} `json:"total"`
+			Hits []hit `json:"hits"`
 		} `json:"hits"`
 	}
 	if err = json.NewDecoder(res.Body).Decode(&esResp); err != nil {
 		return nil, err
 	}
 
-	prods := make([]product.Product, len(esResp.Hits.Hits))
-	for i, h := range esResp.Hits.Hits {
-		log.Printf("product: %v", h.Source)
-		prods[i] = h.Source
+	result := product.NewResult(opts, toHits(esResp.Hits.Hits), esResp.Hits.Total.Value)
+	if result.Facets, err = parseFacets(opts.Facets(), esResp.Aggregations); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// sortFields maps the fields results can be sorted by to the index fields sorted on.
+var sortFields = map[string]string{
+	"name":     "name.keyword",
+	"price":    "price",
+	"category": "category",
+}
+
+// sortClauses orders by keys, falling back to relevance when there are none. Indices
+// older than name.keyword sort every name as missing rather than failing.
+func sortClauses(keys []product.Sort) []*esquery.SortField {
+	if len(keys) == 0 {
+		return []*esquery.SortField{esquery.SortBy("_score", "desc")}
+	}
+
+	clauses := make([]*esquery.SortField, 0, len(keys))
+	for _, k := range keys {
+		clauses = append(clauses, esquery.SortBy(sortFields[k.Field], k.Order).UnmappedType("keyword"))
+	}
+	return clauses
+}
+
+// offsetBody builds the request for a page of opts found by offset.
+func offsetBody(opts *product.Search) *esquery.SearchRequest {
+	body := searchBody(opts).From(opts.Offset()).Size(opts.PageSize()).TrackTotalHits(true)
+
+	// sort, by relevance unless asked otherwise
+	if len(opts.Sort()) > 0 {
+		body.Sort(sortClauses(opts.Sort())...)
+	}
+	return body
+}
+
+// searchBody builds the query for opts. With facets, the category and price filters move to
+// post_filter, so they narrow the hits but not the aggregations, each of which applies every
+// filter but its own.
+func searchBody(opts *product.Search) *esquery.SearchRequest {
+	query := esquery.Bool()
+
+	// match name, tolerating typos
+	if opts.Name() != "" {
+		query.Must(esquery.MultiMatch(opts.Name(), "name").Fuzziness("AUTO"))
+	}
+
+	// the rest of a q= expression, which scores like the name
+	if e := opts.Query(); e != nil {
+		query.Must(exprQuery(e))
+	}
+
+	// excluded categories and ids narrow the facets too
+	if excluded := opts.ExcludedCategories(); len(excluded) > 0 {
+		query.MustNot(esquery.Terms("category", values(excluded)...))
+	}
+	if ids := opts.IDs(); len(ids) > 0 {
+		query.Filter(esquery.Terms("id", values(ids)...))
+	}
+
+	// term category, or terms for any of several
+	var categoryFilter esquery.Query
+	switch categories := opts.Categories(); len(categories) {
+	case 0:
+	case 1:
+		categoryFilter = esquery.Term("category", categories[0])
+	default:
+		categoryFilter = esquery.Terms("category", values(categories)...)
+	}
+
+	// price range, and any of the price ranges
+	price := esquery.Bool()
+	minPrice, maxPrice := opts.PriceRange()
+	if minPrice != nil || maxPrice != nil {
+		bounds := esquery.Range("price")
+		if minPrice != nil {
+			bounds.Gte(*minPrice)
+		}
+		if maxPrice != nil {
+			bounds.Lte(*maxPrice)
+		}
+		price.Filter(bounds)
+	}
+	if ranges := opts.PriceRanges(); len(ranges) > 0 {
+		anyOf := esquery.Bool().MinimumShouldMatch(1)
+		for _, r := range ranges {
+			bounds := esquery.Range("price")
+			if r.From != nil {
+				bounds.Gte(*r.From)
+			}
+			if r.To != nil {
+				bounds.Lt(*r.To)
+			}
+			anyOf.Should(bounds)
+		}
+		price.Filter(anyOf)
+	}
+	var priceFilter esquery.Query
+	if !price.Empty() {
+		priceFilter = price
+	}
+
+	body := esquery.Search()
+	if opts.Facets().Empty() {
+		body.Query(query.Filter(categoryFilter, priceFilter))
+	} else {
+		body.Query(query)
+		if filter := esquery.Bool().Filter(categoryFilter, priceFilter); !filter.Empty() {
+			body.PostFilter(filter)
+		}
+		for name, agg := range facetAggs(opts.Facets(), categoryFilter, priceFilter) {
+			body.Aggregation(name, agg)
+		}
+	}
+
+	// names are user content: fragments are HTML-escaped, so the tags are the only markup
+	if hl := opts.Highlight(); hl != nil {
+		body.Highlight(esquery.Highlight(hl.PreTag, hl.PostTag).Encoder("html").Field("name", hl.FragmentSize))
 	}
-	return prods, nil
+
+	return body
+}
+
+func values(vs []string) []interface{} {
+	out := make([]interface{}, len(vs))
+	for i, v := range vs {
+		out[i] = v
+	}
+	return out
+}
+
+// exprQuery translates a parsed expression clause by clause; user input only ever reaches
+// Elasticsearch as the text or value of a clause, never as query syntax of its own.
+func exprQuery(e product.Expr) esquery.Query {
+	switch e := e.(type) {
+	case product.Match:
+		if e.Phrase {
+			return esquery.MatchPhrase("name", e.Text)
+		}
+		return esquery.MultiMatch(e.Text, "name").Fuzziness("AUTO")
+	case product.Term:
+		return esquery.Term(e.Field, e.Value)
+	case product.Range:
+		r := esquery.Range(e.Field)
+		if e.From != nil {
+			if e.IncludeFrom {
+				r.Gte(*e.From)
+			} else {
+				r.Gt(*e.From)
+			}
+		}
+		if e.To != nil {
+			if e.IncludeTo {
+				r.Lte(*e.To)
+			} else {
+				r.Lt(*e.To)
+			}
+		}
+		return r
+	case product.Not:
+		return esquery.Bool().MustNot(exprQuery(e.Expr))
+	case product.And:
+		b := esquery.Bool()
+		for _, c := range e {
+			b.Must(exprQuery(c))
+		}
+		return b
+	case product.Or:
+		b := esquery.Bool().MinimumShouldMatch(1)
+		for _, c := range e {
+			b.Should(exprQuery(c))
+		}
+		return b
+	}
+	return esquery.MatchAll()
+}
+
+// hit is a search hit as returned by Elasticsearch.
+type hit struct {
+	Source    product.Product     `json:"_source"`
+	Score     *float64            `json:"_score"`
+	Highlight map[string][]string `json:"highlight"`
+	Sort      []json.RawMessage   `json:"sort"`
+}
+
+func toHits(hits []hit) []product.Hit {
+	out := make([]product.Hit, len(hits))
+	for i := range hits {
+		out[i] = product.Hit{
+			Product:   &hits[i].Source,
+			Score:     hits[i].Score,
+			Highlight: hits[i].Highlight,
+		}
+	}
+	return out
 }
 
 func (r *repo) GetByID(ctx context.Context, id string) (*product.Product, error) {
@@ -125,6 +272,11 @@ func (r *repo) GetByID(ctx context.Context, id string) (*product.Product, error)
 	}
 	defer res.Body.Close()
 
+	// not indexed yet, or deleted
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
 	if res.IsError() {
 		return nil, fmt.Errorf("error getting document: %s", res.String())
 	}
@@ -138,3 +290,20 @@ func (r *repo) GetByID(ctx context.Context, id string) (*product.Product, error)
 
 	return &response.Source, nil
 }
+
+func (r *repo) AppliedVersion(ctx context.Context, id string) (int64, error) {
+	p, err := r.GetByID(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted, err := r.buried(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+
+	if p != nil && p.Version() > deleted {
+		return p.Version(), nil
+	}
+	return deleted, nil
+}
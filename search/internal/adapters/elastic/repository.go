@@ -1,31 +1,47 @@
 package elastic
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
-	"fmt"
+	"errors"
 	"github.com/elastic/go-elasticsearch/v8"
-	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"log"
+	"net/http"
 
 	"github.com/ziliscite/cqrs_search/internal/ports"
 )
 
-func NewESClient(host, port string) (*elasticsearch.Client, error) {
+func NewESClient(host, port string, transport http.RoundTripper) (*elasticsearch.Client, error) {
 	cfg := elasticsearch.Config{
 		Addresses: []string{"http://" + host + ":" + port},
+		Transport: transport,
 	}
 
 	return elasticsearch.NewClient(cfg)
 }
 
+// repo reads and writes through the idx alias, so the index behind it can be rebuilt
+// and swapped without downtime (see projection.go).
 type repo struct {
-	c   *elasticsearch.Client
-	idx string
+	c          *elasticsearch.Client
+	idx        string // alias of the live index
+	staging    string // alias of an index being rebuilt, if any
+	tombstones string // index of deleted products, see tombstone.go
+
+	analysis Analysis // for the indices this repo creates
 }
 
-func NewRepository(client *elasticsearch.Client, index string) (ports.Repository, error) {
-	r := &repo{c: client, idx: index}
+func newRepo(client *elasticsearch.Client, index string) *repo {
+	return &repo{
+		c:          client,
+		idx:        index,
+		staging:    index + "_next",
+		tombstones: index + "_tombstones",
+	}
+}
+
+func NewRepository(client *elasticsearch.Client, index string, analysis Analysis) (ports.Repository, error) {
+	r := newRepo(client, index)
+	r.analysis = analysis
 	if err := r.EnsureIndex(context.Background()); err != nil {
 		return nil, err
 	}
@@ -33,46 +49,37 @@ func NewRepository(client *elasticsearch.Client, index string) (ports.Repository
 	return r, nil
 }
 
+// EnsureIndex creates an index with the latest mapping behind the alias on first start.
+// An existing index is never changed here; one with an older mapping, or one created under
+// the alias name itself before aliases were used, is left in place until migrate replaces it.
 func (r *repo) EnsureIndex(ctx context.Context) error {
-	mapping := map[string]interface{}{
-		"settings": map[string]interface{}{
-			"number_of_shards":   1,
-			"number_of_replicas": 1,
-		},
-		"mappings": map[string]interface{}{
-			"properties": map[string]interface{}{
-				"name": map[string]interface{}{
-					"type": "text",
-				},
-				"price": map[string]interface{}{
-					"type": "double",
-				},
-				"category": map[string]interface{}{
-					"type": "keyword",
-				},
-			},
-		},
-	}
-
-	body, err := json.Marshal(mapping)
+	exists, err := r.indexExists(ctx, r.idx)
 	if err != nil {
-		return fmt.Errorf("failed to marshal index mapping: %w", err)
+		return err
 	}
 
-	req := esapi.IndicesCreateRequest{
-		Index: r.idx,
-		Body:  bytes.NewReader(body),
-	}
+	if !exists {
+		name := indexName(r.idx, latestMapping())
+		if err = r.createIndex(ctx, name, productIndex(latestMapping(), r.analysis)); err != nil {
+			return err
+		}
 
-	res, err := req.Do(ctx, r.c)
-	if err != nil {
-		return fmt.Errorf("error creating index: %w", err)
+		if err = r.updateAliases(ctx, addAlias(name, r.idx)); err != nil {
+			return err
+		}
+	} else {
+		deployed, err := r.mappingVersion(ctx, r.idx)
+		if err != nil {
+			return err
+		}
+
+		if deployed < latestMapping() {
+			log.Printf("index %s has mapping v%d, latest is v%d; run migrate to upgrade it", r.idx, deployed, latestMapping())
+		}
 	}
-	defer res.Body.Close()
 
-	if res.IsError() && res.StatusCode != 400 {
-		// If it already exists, you might get a 400; you can ignore or handle specifically
-		return fmt.Errorf("index creation failed: %s", res.String())
+	if err = r.createIndex(ctx, r.tombstones, tombstoneMapping); err != nil && !errors.Is(err, errIndexExists) {
+		return err
 	}
 	return nil
 }
@@ -0,0 +1,91 @@
+package elastic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+
+	"github.com/ziliscite/cqrs_search/internal/domain/product"
+	"github.com/ziliscite/cqrs_search/internal/ports"
+)
+
+// scanMapping is the first mapping version with a sortable id field.
+const scanMapping = 2
+
+func NewIndexStore(client *elasticsearch.Client, index string) ports.IndexStore {
+	return newRepo(client, index)
+}
+
+func (r *repo) Scan(ctx context.Context, after string, limit int) ([]product.Product, string, error) {
+	if after == "" {
+		deployed, err := r.mappingVersion(ctx, r.idx)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if deployed < scanMapping {
+			return nil, "", fmt.Errorf("index %s has mapping v%d, scanning needs v%d; run migrate first", r.idx, deployed, scanMapping)
+		}
+	}
+
+	search := map[string]interface{}{
+		"size":  limit,
+		"query": map[string]interface{}{"match_all": map[string]interface{}{}},
+		"sort":  []interface{}{map[string]interface{}{"id": "asc"}},
+	}
+	if after != "" {
+		search["search_after"] = []string{after}
+	}
+
+	body, err := json.Marshal(search)
+	if err != nil {
+		return nil, "", err
+	}
+
+	req := esapi.SearchRequest{
+		Index: []string{r.idx},
+		Body:  bytes.NewReader(body),
+	}
+
+	res, err := req.Do(ctx, r.c)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, "", fmt.Errorf("error scanning index: %s", res.String())
+	}
+
+	var response struct {
+		Hits struct {
+			Hits []struct {
+				Source product.Product `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return nil, "", err
+	}
+
+	products := make([]product.Product, len(response.Hits.Hits))
+	for i, h := range response.Hits.Hits {
+		products[i] = h.Source
+	}
+
+	var next string
+	if len(products) == limit {
+		next = products[len(products)-1].ID()
+	}
+
+	return products, next, nil
+}
+
+// Overwrite goes through the same path as event writes, tombstone check and staging mirror
+// included, but with external_gte, which unlike external accepts a write at the stored version.
+func (r *repo) Overwrite(ctx context.Context, p *product.Product) error {
+	return r.index(ctx, p, "external_gte")
+}
@@ -0,0 +1,151 @@
+package elastic
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"github.com/ziliscite/cqrs_search/internal/domain/product"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// golden compares v, as indented JSON, with testdata/<name>.golden.json, rewriting the
+// file instead when run with -update.
+func golden(t *testing.T, name string, v interface{}) {
+	t.Helper()
+
+	got, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, '\n')
+
+	path := filepath.Join("testdata", name+".golden.json")
+	if *update {
+		if err = os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("body differs from %s:\n%s", path, got)
+	}
+}
+
+func price(v float64) *float64 { return &v }
+
+func query(t *testing.T, q string) product.Expr {
+	t.Helper()
+	e, err := product.ParseQuery(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func sorted(t *testing.T, raw string) []product.Sort {
+	t.Helper()
+	keys, err := product.ParseSort(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestSearchBody(t *testing.T) {
+	tests := []struct {
+		name string
+		opts func(t *testing.T) *product.Search
+		pit  string // if set, the body is for a cursor walk read from this point in time
+	}{
+		{"match_all", func(*testing.T) *product.Search {
+			return product.NewSearch()
+		}, ""},
+		{"name", func(*testing.T) *product.Search {
+			return product.NewSearch().WithName("trail shoe")
+		}, ""},
+		{"query", func(t *testing.T) *product.Search {
+			return product.NewSearch().WithQuery(query(t, `(name:"trail shoe" OR name:boot) AND NOT category:sale AND price:{10 TO *]`))
+		}, ""},
+		{"query_lifted", func(t *testing.T) *product.Search {
+			return product.NewSearch().WithQuery(query(t, `category:shoes price:[10 TO 100] price:{0 TO 500}`))
+		}, ""},
+		{"category", func(*testing.T) *product.Search {
+			return product.NewSearch().WithCategory("shoes")
+		}, ""},
+		{"categories", func(*testing.T) *product.Search {
+			return product.NewSearch().WithCategory("shoes", "boots")
+		}, ""},
+		{"excluded_categories", func(*testing.T) *product.Search {
+			return product.NewSearch().WithName("shoe").WithExcludedCategory("sale", "clearance")
+		}, ""},
+		{"ids", func(*testing.T) *product.Search {
+			return product.NewSearch().WithIDs("b", "a")
+		}, ""},
+		{"min_max", func(*testing.T) *product.Search {
+			return product.NewSearch().WithMinPrice(10).WithMaxPrice(100)
+		}, ""},
+		{"price_ranges", func(*testing.T) *product.Search {
+			return product.NewSearch().WithMaxPrice(500).WithPriceRanges(
+				product.PriceRange{To: price(10)},
+				product.PriceRange{From: price(50), To: price(100)},
+				product.PriceRange{From: price(200)},
+			)
+		}, ""},
+		{"facets", func(*testing.T) *product.Search {
+			return product.NewSearch().WithName("shoe").WithCategory("shoes").WithMinPrice(10).WithFacets(product.FacetRequest{
+				Categories:  true,
+				PriceRanges: []product.PriceRange{{To: price(50)}, {From: price(50)}},
+				PriceStats:  true,
+			})
+		}, ""},
+		{"facets_histogram", func(*testing.T) *product.Search {
+			return product.NewSearch().WithPriceRanges(product.PriceRange{From: price(10), To: price(20)}).WithFacets(product.FacetRequest{
+				Categories:    true,
+				PriceInterval: 25,
+			})
+		}, ""},
+		{"highlight", func(*testing.T) *product.Search {
+			return product.NewSearch().WithName("shoe").WithHighlight(product.NewHighlight("<b>", "</b>", 50))
+		}, ""},
+		{"sort", func(t *testing.T) *product.Search {
+			return product.NewSearch().WithCategory("shoes").WithSort(sorted(t, "-price,name")...)
+		}, ""},
+		{"offset", func(*testing.T) *product.Search {
+			return product.NewSearch().WithName("shoe").WithPage(3).WithPageSize(25)
+		}, ""},
+		{"cursor_start", func(t *testing.T) *product.Search {
+			return product.NewSearch().WithName("shoe").WithPageSize(10).WithCursor(&product.Cursor{})
+		}, "pit-1"},
+		{"cursor_after", func(t *testing.T) *product.Search {
+			return product.NewSearch().WithCategory("shoes").WithSort(sorted(t, "-price")...).WithPageSize(10).WithCursor(&product.Cursor{
+				PIT:   "pit-1",
+				After: []json.RawMessage{json.RawMessage(`79.9`), json.RawMessage(`"0195f0c4-7a1e-7cc1-9f4b-3b2f1c7e8a10"`)},
+				Seen:  10,
+			})
+		}, "pit-1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts(t)
+			if errs := opts.Validate(); len(errs) > 0 {
+				t.Fatalf("invalid search: %v", errs)
+			}
+
+			body := offsetBody(opts)
+			if tt.pit != "" {
+				body = cursorBody(opts, tt.pit)
+			}
+
+			golden(t, tt.name, body)
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package elastic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+
+	"github.com/ziliscite/cqrs_search/internal/domain/product"
+	"github.com/ziliscite/cqrs_search/pkg/esquery"
+)
+
+// Suggest matches the prefix against the name.suggest subfield added in mapping v3. Its
+// shingle subfields rank names whose words appear in the typed order higher; the last
+// word typed matches as a prefix.
+func (r *repo) Suggest(ctx context.Context, s *product.Suggest) ([]product.Suggestion, error) {
+	query := esquery.Bool().Must(
+		esquery.MultiMatch(s.Prefix(), "name.suggest", "name.suggest._2gram", "name.suggest._3gram").Type("bool_prefix"),
+	)
+	if s.Category() != "" {
+		query.Filter(esquery.Term("category", s.Category()))
+	}
+
+	body, err := json.Marshal(esquery.Search().
+		Size(s.Limit()).
+		Query(query).
+		SourceIncludes("id", "name", "category"))
+	if err != nil {
+		return nil, err
+	}
+
+	req := esapi.SearchRequest{
+		Index: []string{r.idx},
+		Body:  bytes.NewReader(body),
+	}
+
+	res, err := req.Do(ctx, r.c)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, fmt.Errorf("error suggesting products: %s", res.String())
+	}
+
+	var response struct {
+		Hits struct {
+			Hits []struct {
+				ID     string  `json:"_id"`
+				Score  float64 `json:"_score"`
+				Source struct {
+					Name     string `json:"name"`
+					Category string `json:"category"`
+				} `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+
+	suggestions := make([]product.Suggestion, len(response.Hits.Hits))
+	for i, h := range response.Hits.Hits {
+		suggestions[i] = product.Suggestion{
+			ID:       h.ID,
+			Name:     h.Source.Name,
+			Category: h.Source.Category,
+			Score:    h.Score,
+		}
+	}
+
+	return suggestions, nil
+}
@@ -0,0 +1,97 @@
+package elastic
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/ziliscite/cqrs_search/internal/domain/product"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestSuggestRequest(t *testing.T) {
+	tests := []struct {
+		name             string
+		prefix, category string
+		limit            int
+		filter           interface{} // the category filter sent, if any
+		size             float64
+	}{
+		{"prefix", "trail sh", "", 0, nil, product.DefaultSuggestLimit},
+		{"in a category", "trail sh", "Shoes", 5, []interface{}{map[string]interface{}{"term": map[string]interface{}{"category": "Shoes"}}}, 5},
+		{"limit capped", "trail sh", "", 100, nil, product.MaxSuggestLimit},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, r := ensured(t)
+
+			var sent map[string]interface{}
+			f.search = func(index string, body []byte) (int, interface{}) {
+				if index != "products" {
+					t.Errorf("searched %s, want the products alias", index)
+				}
+				_ = json.Unmarshal(body, &sent)
+				return http.StatusOK, map[string]interface{}{"hits": map[string]interface{}{"hits": []interface{}{}}}
+			}
+
+			s, err := product.NewSuggest(tt.prefix, tt.category, tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = r.Suggest(context.Background(), s); err != nil {
+				t.Fatal(err)
+			}
+
+			if sent["size"] != tt.size {
+				t.Errorf("size %v, want %v", sent["size"], tt.size)
+			}
+
+			boolQuery := sent["query"].(map[string]interface{})["bool"].(map[string]interface{})
+			// the last word typed matches as a prefix, the ones before it whole
+			want := []interface{}{map[string]interface{}{"multi_match": map[string]interface{}{
+				"query":  tt.prefix,
+				"type":   "bool_prefix",
+				"fields": []interface{}{"name.suggest", "name.suggest._2gram", "name.suggest._3gram"},
+			}}}
+			if !reflect.DeepEqual(boolQuery["must"], want) {
+				t.Errorf("must %v, want %v", boolQuery["must"], want)
+			}
+			if !reflect.DeepEqual(boolQuery["filter"], tt.filter) {
+				t.Errorf("filter %v, want %v", boolQuery["filter"], tt.filter)
+			}
+		})
+	}
+}
+
+func TestSuggestResults(t *testing.T) {
+	f, r := ensured(t)
+	f.search = func(string, []byte) (int, interface{}) {
+		return http.StatusOK, map[string]interface{}{"hits": map[string]interface{}{"hits": []interface{}{
+			map[string]interface{}{"_id": "b", "_score": 3.5, "_source": map[string]interface{}{"name": "Trail Shoe", "category": "Shoes"}},
+			map[string]interface{}{"_id": "a", "_score": 1.5, "_source": map[string]interface{}{"name": "Trail Shoelaces", "category": "Accessories"}},
+		}}}
+	}
+
+	s, _ := product.NewSuggest("trail sh", "", 0)
+	got, err := r.Suggest(context.Background(), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// in the order ranked
+	want := []product.Suggestion{
+		{ID: "b", Name: "Trail Shoe", Category: "Shoes", Score: 3.5},
+		{ID: "a", Name: "Trail Shoelaces", Category: "Accessories", Score: 1.5},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Suggest() = %+v, want %+v", got, want)
+	}
+
+	f.search = func(string, []byte) (int, interface{}) {
+		return http.StatusBadRequest, esError("search_phase_execution_exception", "all shards failed")
+	}
+	if _, err = r.Suggest(context.Background(), s); err == nil {
+		t.Error("Suggest() = nil error for a failed search")
+	}
+}
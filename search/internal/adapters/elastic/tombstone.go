@@ -0,0 +1,101 @@
+package elastic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"net/http"
+	"time"
+)
+
+// Deleted products leave a tombstone carrying the version of the delete. ES forgets the
+// version of a deleted document after index.gc_deletes (60s by default), so without it a
+// create or update delivered late would bring the product back.
+
+var tombstoneMapping = map[string]interface{}{
+	"settings": map[string]interface{}{
+		"number_of_shards":   1,
+		"number_of_replicas": 1,
+	},
+	"mappings": map[string]interface{}{
+		"properties": map[string]interface{}{
+			"id": map[string]interface{}{
+				"type": "keyword",
+			},
+			"version": map[string]interface{}{
+				"type": "long",
+			},
+			"deleted_at": map[string]interface{}{
+				"type": "date",
+			},
+		},
+	},
+}
+
+type tombstone struct {
+	ID        string    `json:"id"`
+	Version   int64     `json:"version"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// bury records the deletion of id at version. An older tombstone never replaces a newer one.
+func (r *repo) bury(ctx context.Context, id string, version int64) error {
+	body, err := json.Marshal(tombstone{ID: id, Version: version, DeletedAt: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+
+	v := int(version)
+	req := esapi.IndexRequest{
+		Index:       r.tombstones,
+		DocumentID:  id,
+		Body:        bytes.NewReader(body),
+		Version:     &v,
+		VersionType: externalVersion,
+	}
+
+	res, err := req.Do(ctx, r.c)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// a conflict means a later delete is already recorded
+	if res.IsError() && res.StatusCode != http.StatusConflict {
+		return fmt.Errorf("error writing tombstone: %s", res.String())
+	}
+	return nil
+}
+
+// buried returns the version at which id was deleted, or 0 if it never was.
+func (r *repo) buried(ctx context.Context, id string) (int64, error) {
+	req := esapi.GetRequest{
+		Index:      r.tombstones,
+		DocumentID: id,
+	}
+
+	res, err := req.Do(ctx, r.c)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return 0, nil
+	}
+
+	if res.IsError() {
+		return 0, fmt.Errorf("error getting tombstone: %s", res.String())
+	}
+
+	var response struct {
+		Source tombstone `json:"_source"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return 0, err
+	}
+
+	return response.Source.Version, nil
+}
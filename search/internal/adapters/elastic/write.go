@@ -7,21 +7,50 @@ import (
 	"fmt"
 	"github.com/elastic/go-elasticsearch/v8/esapi"
 	"log"
+	"net/http"
 
 	"github.com/ziliscite/cqrs_search/internal/domain/product"
 )
 
+// externalVersion makes ES only accept a write whose version is greater than the stored one.
+const externalVersion = "external"
+
 func (r *repo) Create(ctx context.Context, p *product.Product) error {
+	log.Printf("create product: %s %s %s $%.2f", p.ID(), p.Name(), p.Category(), p.Price())
+	return r.index(ctx, p, externalVersion)
+}
+
+// Update replaces the whole document rather than using the _update API, which doesn't support
+// external versions. That also makes it an upsert, so an update arriving before its create still lands.
+func (r *repo) Update(ctx context.Context, p *product.Product) error {
+	return r.index(ctx, p, externalVersion)
+}
+
+// index writes p to the live index and mirrors it to the staging one, unless the product
+// was deleted at or after p's version. versionType decides which stored versions p may replace.
+func (r *repo) index(ctx context.Context, p *product.Product, versionType string) error {
+	deleted, err := r.buried(ctx, p.ID())
+	if err != nil {
+		return err
+	}
+
+	if deleted >= p.Version() {
+		return fmt.Errorf("index %s at version %d, deleted at %d: %w", p.ID(), p.Version(), deleted, product.ErrStale)
+	}
+
 	body, err := json.Marshal(p)
 	if err != nil {
 		return err
 	}
 
+	version := int(p.Version())
 	req := esapi.IndexRequest{
-		Index:      r.idx,
-		DocumentID: p.ID(),
-		Body:       bytes.NewReader(body),
-		Refresh:    "true",
+		Index:       r.idx,
+		DocumentID:  p.ID(),
+		Body:        bytes.NewReader(body),
+		Version:     &version,
+		VersionType: versionType,
+		Refresh:     "true",
 	}
 
 	res, err := req.Do(ctx, r.c)
@@ -30,25 +59,39 @@ func (r *repo) Create(ctx context.Context, p *product.Product) error {
 	}
 	defer res.Body.Close()
 
-	log.Printf("create product: %s %s %s $%.2f", p.ID(), p.Name(), p.Category(), p.Price())
 	log.Printf("index response: %s", res.String())
 
+	if res.StatusCode == http.StatusConflict {
+		return fmt.Errorf("index %s at version %d: %w", p.ID(), p.Version(), product.ErrStale)
+	}
+
 	if res.IsError() {
 		return fmt.Errorf("index error: %s", res.String())
 	}
-	return nil
-}
 
-func (r *repo) Update(ctx context.Context, p *product.Product) error {
-	body, _ := json.Marshal(map[string]interface{}{
-		"doc": p,
+	return r.mirror(ctx, esapi.IndexRequest{
+		Index:        r.staging,
+		DocumentID:   p.ID(),
+		Body:         bytes.NewReader(body),
+		Version:      &version,
+		VersionType:  versionType,
+		RequireAlias: &requireAlias,
 	})
+}
 
-	req := esapi.UpdateRequest{
-		Index:      r.idx,
-		DocumentID: p.ID(),
-		Body:       bytes.NewReader(body),
-		Refresh:    "true",
+// Delete leaves a tombstone and removes the document. Deleting a document that is already gone succeeds.
+func (r *repo) Delete(ctx context.Context, id string, version int64) error {
+	if err := r.bury(ctx, id, version); err != nil {
+		return err
+	}
+
+	v := int(version)
+	req := esapi.DeleteRequest{
+		Index:       r.idx,
+		DocumentID:  id,
+		Version:     &v,
+		VersionType: externalVersion,
+		Refresh:     "true",
 	}
 
 	res, err := req.Do(ctx, r.c)
@@ -57,27 +100,47 @@ func (r *repo) Update(ctx context.Context, p *product.Product) error {
 	}
 	defer res.Body.Close()
 
-	if res.IsError() {
-		return fmt.Errorf("error updating document: %s", res.String())
+	if res.StatusCode == http.StatusConflict {
+		return fmt.Errorf("delete %s at version %d: %w", id, version, product.ErrStale)
 	}
-	return nil
-}
 
-func (r *repo) Delete(ctx context.Context, id string) error {
-	req := esapi.DeleteRequest{
-		Index:      r.idx,
-		DocumentID: id,
-		Refresh:    "true",
+	if res.IsError() && res.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("error deleting document: %s", res.String())
+	}
+
+	// the delete API can't require an alias, and deleting from a missing index creates it
+	building, err := r.aliasIndices(ctx, r.staging)
+	if err != nil {
+		return err
 	}
 
+	if len(building) == 0 {
+		return nil
+	}
+
+	return r.mirror(ctx, esapi.DeleteRequest{
+		Index:       r.staging,
+		DocumentID:  id,
+		Version:     &v,
+		VersionType: externalVersion,
+	})
+}
+
+// requireAlias stops a mirrored index request from creating the staging alias as an index
+// when no rebuild is running. Deletes have no such flag, so Delete checks for the alias instead.
+var requireAlias = true
+
+// mirror applies a write to the index being rebuilt, if any, so it doesn't miss events
+// that arrive while it is loaded. Missing the staging alias or losing to a later version is fine.
+func (r *repo) mirror(ctx context.Context, req esapi.Request) error {
 	res, err := req.Do(ctx, r.c)
 	if err != nil {
 		return err
 	}
 	defer res.Body.Close()
 
-	if res.IsError() {
-		return fmt.Errorf("error deleting document: %s", res.String())
+	if res.IsError() && res.StatusCode != http.StatusNotFound && res.StatusCode != http.StatusConflict {
+		return fmt.Errorf("error mirroring write to %s: %s", r.staging, res.String())
 	}
 	return nil
 }
@@ -0,0 +1,237 @@
+package elastic
+
+import (
+	"context"
+	"errors"
+	"github.com/ziliscite/cqrs_search/internal/domain/product"
+	"slices"
+	"testing"
+)
+
+func shoe(t *testing.T, id string, version int64) *product.Product {
+	t.Helper()
+	p, err := product.New("Trail Shoe", "shoes", 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetID(id)
+	p.SetVersion(version)
+	return p
+}
+
+func TestWritesUseExternalVersions(t *testing.T) {
+	f, r := ensured(t)
+	ctx := context.Background()
+
+	if err := r.Create(ctx, shoe(t, "a", 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Update(ctx, shoe(t, "a", 3)); err != nil {
+		t.Fatal(err)
+	}
+
+	// delivered late: an older version never replaces a newer one
+	if err := r.Update(ctx, shoe(t, "a", 2)); !errors.Is(err, product.ErrStale) {
+		t.Errorf("Update() at an older version = %v, want ErrStale", err)
+	}
+	if err := r.Create(ctx, shoe(t, "a", 1)); !errors.Is(err, product.ErrStale) {
+		t.Errorf("Create() redelivered = %v, want ErrStale", err)
+	}
+	if v, _, _ := f.doc("products", "a"); v != 3 {
+		t.Errorf("indexed version %d, want 3", v)
+	}
+
+	// an update arriving before its create still lands
+	if err := r.Update(ctx, shoe(t, "b", 2)); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, ok := f.doc("products", "b"); !ok || v != 2 {
+		t.Errorf("b indexed at version %d (found %v), want 2", v, ok)
+	}
+}
+
+func TestDeleteLeavesATombstone(t *testing.T) {
+	f, r := ensured(t)
+	ctx := context.Background()
+
+	if err := r.Create(ctx, shoe(t, "a", 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Delete(ctx, "a", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, ok := f.doc("products", "a"); ok {
+		t.Error("document still indexed after its delete")
+	}
+	if deleted, err := r.buried(ctx, "a"); err != nil || deleted != 2 {
+		t.Errorf("buried() = %d, %v, want the delete's version 2", deleted, err)
+	}
+	if applied, err := r.AppliedVersion(ctx, "a"); err != nil || applied != 2 {
+		t.Errorf("AppliedVersion() = %d, %v, want 2", applied, err)
+	}
+	if deleted, err := r.buried(ctx, "never-deleted"); err != nil || deleted != 0 {
+		t.Errorf("buried() of a live product = %d, %v, want 0", deleted, err)
+	}
+}
+
+func TestTombstonesOutliveDeletedVersions(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(ctx context.Context, r *repo) error
+		stale bool // whether the write must be refused, leaving the product deleted
+	}{
+		{"late create", func(ctx context.Context, r *repo) error {
+			return r.Create(ctx, shoe(t, "a", 1))
+		}, true},
+		{"late update", func(ctx context.Context, r *repo) error {
+			return r.Update(ctx, shoe(t, "a", 2))
+		}, true},
+		{"update at the delete's version", func(ctx context.Context, r *repo) error {
+			return r.Update(ctx, shoe(t, "a", 3))
+		}, true},
+		{"recreated afterwards", func(ctx context.Context, r *repo) error {
+			return r.Update(ctx, shoe(t, "a", 4))
+		}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, r := ensured(t)
+			ctx := context.Background()
+
+			if err := r.Create(ctx, shoe(t, "a", 1)); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Delete(ctx, "a", 3); err != nil {
+				t.Fatal(err)
+			}
+
+			// ES has forgotten the delete's version by the time the write arrives
+			f.gc()
+
+			err := tt.write(ctx, r)
+			_, _, indexed := f.doc("products", "a")
+			if tt.stale {
+				if !errors.Is(err, product.ErrStale) {
+					t.Errorf("write = %v, want ErrStale", err)
+				}
+				if indexed {
+					t.Error("write brought the deleted product back")
+				}
+			} else if err != nil || !indexed {
+				t.Errorf("write = %v (indexed %v), want the recreated product indexed", err, indexed)
+			}
+		})
+	}
+}
+
+func TestRepeatDeletes(t *testing.T) {
+	tests := []struct {
+		name    string
+		gc      bool  // whether ES forgot the first delete before the second
+		version int64 // of the second delete
+		want    error
+		buried  int64
+	}{
+		{"redelivered", false, 3, product.ErrStale, 3},
+		{"redelivered after gc", true, 3, nil, 3},
+		{"older, after gc", true, 2, nil, 3},
+		{"newer", false, 5, nil, 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, r := ensured(t)
+			ctx := context.Background()
+
+			if err := r.Create(ctx, shoe(t, "a", 1)); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Delete(ctx, "a", 3); err != nil {
+				t.Fatal(err)
+			}
+			if tt.gc {
+				f.gc()
+			}
+
+			// the delete handler skips ErrStale, so either way the repeat is harmless
+			if err := r.Delete(ctx, "a", tt.version); !errors.Is(err, tt.want) {
+				t.Errorf("Delete() = %v, want %v", err, tt.want)
+			}
+			if deleted, err := r.buried(ctx, "a"); err != nil || deleted != tt.buried {
+				t.Errorf("buried() = %d, %v, want %d: an older tombstone never replaces a newer one", deleted, err, tt.buried)
+			}
+		})
+	}
+}
+
+func TestDeleteOfAnUnknownProductSucceeds(t *testing.T) {
+	_, r := ensured(t)
+
+	if err := r.Delete(context.Background(), "never-indexed", 1); err != nil {
+		t.Errorf("Delete() = %v, want nil", err)
+	}
+	if deleted, err := r.buried(context.Background(), "never-indexed"); err != nil || deleted != 1 {
+		t.Errorf("buried() = %d, %v, want 1: a create delivered after the delete is still refused", deleted, err)
+	}
+}
+
+func TestDeleteLosesToALaterUpdate(t *testing.T) {
+	f, r := ensured(t)
+	ctx := context.Background()
+
+	if err := r.Update(ctx, shoe(t, "a", 5)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Delete(ctx, "a", 3); !errors.Is(err, product.ErrStale) {
+		t.Errorf("Delete() at an older version = %v, want ErrStale", err)
+	}
+
+	if v, _, ok := f.doc("products", "a"); !ok || v != 5 {
+		t.Errorf("indexed version %d (found %v), want 5", v, ok)
+	}
+	if applied, err := r.AppliedVersion(ctx, "a"); err != nil || applied != 5 {
+		t.Errorf("AppliedVersion() = %d, %v, want 5", applied, err)
+	}
+}
+
+func TestWritesOnlyReachStagingDuringARebuild(t *testing.T) {
+	f, r := ensured(t)
+	ctx := context.Background()
+	live := f.indexNames()
+
+	if err := r.Create(ctx, shoe(t, "a", 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Delete(ctx, "a", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Delete(ctx, "never-indexed", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := f.indexNames(); !slices.Equal(got, live) {
+		t.Fatalf("indices %v after writes with no rebuild running, want %v", got, live)
+	}
+
+	// a rebuild can still start: the staging alias wasn't taken by an index
+	building, err := r.Prepare(ctx)
+	if err != nil {
+		t.Fatalf("Prepare() = %v", err)
+	}
+
+	if err = r.Create(ctx, shoe(t, "b", 1)); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, ok := f.doc(building, "b"); !ok || v != 1 {
+		t.Errorf("create mirrored at version %d (found %v), want 1", v, ok)
+	}
+
+	if err = r.Delete(ctx, "b", 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := f.doc(building, "b"); ok {
+		t.Error("delete not mirrored to the index being rebuilt")
+	}
+}
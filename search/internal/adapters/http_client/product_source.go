@@ -0,0 +1,86 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ziliscite/cqrs_search/internal/domain/product"
+	"github.com/ziliscite/cqrs_search/internal/ports"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// productSource reads products from the product service's export endpoint.
+type productSource struct {
+	hc   *http.Client
+	base string
+}
+
+func NewProductSource(hc *http.Client, baseURL string) ports.ProductSource {
+	return &productSource{
+		hc:   hc,
+		base: strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+func (s *productSource) Export(ctx context.Context, after string, limit int) ([]product.Product, string, error) {
+	q := url.Values{}
+	q.Set("limit", strconv.Itoa(limit))
+	if after != "" {
+		q.Set("after", after)
+	}
+
+	page, err := s.export(ctx, q)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return page.Items, page.Next, nil
+}
+
+func (s *productSource) Lookup(ctx context.Context, ids []string) ([]product.Product, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	q := url.Values{}
+	q.Set("ids", strings.Join(ids, ","))
+
+	page, err := s.export(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	return page.Items, nil
+}
+
+type exportPage struct {
+	Items []product.Product `json:"items"`
+	Next  string            `json:"next"`
+}
+
+func (s *productSource) export(ctx context.Context, q url.Values) (*exportPage, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.base+"/products/export?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("product export failed: %s", res.Status)
+	}
+
+	var page exportPage
+	if err = json.NewDecoder(res.Body).Decode(&page); err != nil {
+		return nil, err
+	}
+
+	return &page, nil
+}
@@ -1,43 +1,101 @@
 package handler
 
 import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"expvar"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/ziliscite/cqrs_search/internal/application"
+	"github.com/ziliscite/cqrs_search/internal/application/command"
 	"github.com/ziliscite/cqrs_search/internal/application/query"
 	"github.com/ziliscite/cqrs_search/internal/domain/product"
 	"github.com/ziliscite/cqrs_search/internal/ports"
+	"math"
 	"net/http"
 	"strconv"
+	"strings"
 )
 
 type handler struct {
-	q  *application.Query
-	en *gin.Engine
+	q   *application.Query
+	rec *application.Reconciler
+	rl  command.ReloadAnalyzersHandler
+	en  *gin.Engine
+	srv *http.Server
+
+	reconcileBatch int
+	adminToken     string
 }
 
-func NewHandler(app *application.Query) ports.Handler {
+// NewHandler serves the search API. The admin API requires adminToken as a bearer token,
+// and is disabled if it is empty.
+func NewHandler(app *application.Query, rec *application.Reconciler, reload command.ReloadAnalyzersHandler, reconcileBatch int, adminToken string) ports.Handler {
 	r := gin.New()
 	r.Use(gin.Logger())
 	r.Use(gin.Recovery())
 	return &handler{
-		q:  app,
-		en: r,
+		q:              app,
+		rec:            rec,
+		rl:             reload,
+		en:             r,
+		srv:            &http.Server{Handler: r},
+		reconcileBatch: reconcileBatch,
+		adminToken:     adminToken,
 	}
 }
 
+// Run serves HTTP on addr until Shutdown is called.
 func (h *handler) Run(addr string) error {
 	h.setupRoutes()
-	return h.en.Run(addr)
+
+	h.srv.Addr = addr
+	if err := h.srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Shutdown stops accepting connections and waits for in-flight requests to finish, or ctx to be done.
+func (h *handler) Shutdown(ctx context.Context) error {
+	return h.srv.Shutdown(ctx)
 }
 
 func (h *handler) setupRoutes() {
 	h.en.GET("/products", h.SearchProduct)
+	h.en.GET("/products/suggest", h.SuggestProducts)
 	h.en.GET("/products/:id", h.GetProduct)
 
 	// health check
 	h.en.GET("/health", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"status": "ok"})
 	})
+
+	admin := h.en.Group("/admin", h.requireAdmin)
+	admin.GET("/reconcile", h.ReconcileReport)
+	admin.POST("/reconcile", h.Reconcile)
+	admin.POST("/analyzers/reload", h.ReloadAnalyzers)
+
+	// expvar metrics; admin only, as they include the command line, flags and all
+	admin.GET("/debug/vars", gin.WrapH(expvar.Handler()))
+}
+
+// requireAdmin rejects requests without the admin token in an "Authorization: Bearer" header.
+func (h *handler) requireAdmin(c *gin.Context) {
+	if h.adminToken == "" {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin API is disabled"})
+		return
+	}
+
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(h.adminToken)) != 1 {
+		c.Header("WWW-Authenticate", "Bearer")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid admin token"})
+		return
+	}
+
+	c.Next()
 }
 
 func (h *handler) GetProduct(c *gin.Context) {
@@ -48,11 +106,31 @@ func (h *handler) GetProduct(c *gin.Context) {
 		return
 	}
 
+	// read-your-writes: ?min_version=, or the token returned by the product service
+	var minVersion int64
+	if v := c.Query("min_version"); v != "" {
+		var err error
+		if minVersion, err = strconv.ParseInt(v, 10, 64); err != nil || minVersion <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid min_version param"})
+			return
+		}
+	} else {
+		tok, ok := h.token(c)
+		if c.IsAborted() {
+			return
+		}
+
+		// a token for another product says nothing about this one
+		if ok && tok.ID == id {
+			minVersion = tok.Version
+		}
+	}
+
 	// get product
-	q := query.NewGetProduct(id)
+	q := query.NewGetProduct(id, minVersion)
 	p, err := h.q.Get.Handle(c, q)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		h.queryError(c, err)
 		return
 	}
 
@@ -66,29 +144,108 @@ func (h *handler) GetProduct(c *gin.Context) {
 
 func (h *handler) SearchProduct(c *gin.Context) {
 	// extract query parameters
-	search := h.extractQueryParams(c)
+	search, errs := h.extractQueryParams(c)
+	if len(errs) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"errors": errs})
+		return
+	}
+
+	var token *product.Token
+	if tok, ok := h.token(c); ok {
+		token = &tok
+	} else if c.IsAborted() {
+		return
+	}
 
 	// get products
-	q := query.NewSearchProduct(search)
-	products, err := h.q.Search.Handle(c, q)
+	q := query.NewSearchProduct(search, token)
+	result, err := h.q.Search.Handle(c, q)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		h.queryError(c, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, products)
+	c.JSON(http.StatusOK, result)
 }
 
-func (h *handler) extractQueryParams(c *gin.Context) *product.Search {
+// SuggestProducts completes a partly typed product name: ?q=, optionally scoped by ?category= and capped by ?limit=.
+func (h *handler) SuggestProducts(c *gin.Context) {
+	var limit int
+	if l := c.Query("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit param"})
+			return
+		}
+	}
+
+	suggest, err := product.NewSuggest(c.Query("q"), c.Query("category"), limit)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	suggestions, err := h.q.Suggest.Handle(c, query.NewSuggestProducts(suggest))
+	if err != nil {
+		h.queryError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"suggestions": suggestions})
+}
+
+// token reads the X-Consistency-Token header. A malformed token aborts the request with 400.
+func (h *handler) token(c *gin.Context) (product.Token, bool) {
+	v := c.GetHeader("X-Consistency-Token")
+	if v == "" {
+		return product.Token{}, false
+	}
+
+	tok, err := product.ParseToken(v)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return product.Token{}, false
+	}
+
+	return tok, true
+}
+
+// queryError responds to a failed query. An index that hasn't caught up with the
+// requested version is reported as unavailable, rather than serving stale data.
+func (h *handler) queryError(c *gin.Context, err error) {
+	if errors.Is(err, query.ErrNotCaughtUp) {
+		c.Header("Retry-After", "1")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+
+	if errors.Is(err, product.ErrTooManyBuckets) {
+		c.JSON(http.StatusBadRequest, gin.H{"errors": gin.H{"price_interval": err.Error()}})
+		return
+	}
+
+	// the walk has to start over
+	if errors.Is(err, product.ErrCursorExpired) {
+		c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
+
+// extractQueryParams builds the search the query parameters describe, along with a
+// message per parameter that is malformed or out of range.
+func (h *handler) extractQueryParams(c *gin.Context) (*product.Search, map[string]string) {
 	search := product.NewSearch()
+	errs := make(map[string]string)
 
 	// Extracting query parameters
 	name := c.Query("name")
-	category := c.Query("category")
 	minPrice := c.Query("min_price")
 	maxPrice := c.Query("max_price")
 	page := c.Query("page")
 	pageSize := c.Query("page_size")
+	sort := c.Query("sort")
 	sortField := c.Query("sort_field")
 	sortAsc := c.Query("sort_asc")
 
@@ -97,40 +254,281 @@ func (h *handler) extractQueryParams(c *gin.Context) *product.Search {
 		search.WithName(name)
 	}
 
-	if category != "" {
-		search.WithCategory(category)
+	// ?category=a&category=b matches either; ids and price_range also take comma separated lists
+	search.WithCategory(c.QueryArray("category")...)
+	search.WithExcludedCategory(c.QueryArray("exclude_category")...)
+	search.WithIDs(splitQueryArray(c, "ids")...)
+
+	for _, r := range splitQueryArray(c, "price_range") {
+		if pr, err := parsePriceRange(r); err == nil {
+			search.WithPriceRanges(pr)
+		} else {
+			errs["price_range"] = err.Error()
+		}
 	}
 
 	if minPrice != "" {
-		if minPriceFloat, err := strconv.ParseFloat(minPrice, 64); err == nil {
+		if minPriceFloat, ok := parsePrice(minPrice); ok {
 			search.WithMinPrice(minPriceFloat)
+		} else {
+			errs["min_price"] = "must be a number"
 		}
 	}
 	if maxPrice != "" {
-		if maxPriceFloat, err := strconv.ParseFloat(maxPrice, 64); err == nil {
+		if maxPriceFloat, ok := parsePrice(maxPrice); ok {
 			search.WithMaxPrice(maxPriceFloat)
+		} else {
+			errs["max_price"] = "must be a number"
 		}
 	}
 
 	if page != "" {
 		if pageInt, err := strconv.Atoi(page); err == nil {
 			search.WithPage(pageInt)
+		} else {
+			errs["page"] = "must be an integer"
 		}
 	}
 	if pageSize != "" {
 		if pageSizeInt, err := strconv.Atoi(pageSize); err == nil {
 			search.WithPageSize(pageSizeInt)
+		} else {
+			errs["page_size"] = "must be an integer"
+		}
+	}
+
+	// ?sort=-price,name; sort_field and sort_asc (descending unless true) predate it
+	switch {
+	case sort != "" && sortField != "":
+		errs["sort"] = "cannot be combined with sort_field"
+	case sort != "":
+		if keys, err := product.ParseSort(sort); err == nil {
+			search.WithSort(keys...)
+		} else {
+			errs["sort"] = err.Error()
+		}
+	case sortField != "":
+		asc := false
+		if sortAsc != "" {
+			var err error
+			if asc, err = strconv.ParseBool(sortAsc); err != nil {
+				errs["sort_asc"] = "must be true or false"
+			}
+		}
+		if !asc {
+			sortField = "-" + sortField
+		}
+		if keys, err := product.ParseSort(sortField); err == nil && len(keys) == 1 {
+			search.WithSort(keys...)
+		} else {
+			errs["sort_field"] = fmt.Sprintf("must be one of %s", strings.Join(product.SortFields, ", "))
 		}
 	}
 
-	if sortField != "" {
-		search.WithSortField(sortField)
+	// ?highlight=true, optionally with highlight_pre, highlight_post and fragment_size
+	if v := c.Query("highlight"); v != "" {
+		hl, err := strconv.ParseBool(v)
+		if err != nil {
+			errs["highlight"] = "must be true or false"
+		}
+
+		var fragmentSize int
+		if v := c.Query("fragment_size"); v != "" {
+			if fragmentSize, err = strconv.Atoi(v); err != nil || fragmentSize <= 0 {
+				errs["fragment_size"] = "must be a positive integer"
+			}
+		}
+
+		if hl {
+			search.WithHighlight(product.NewHighlight(c.Query("highlight_pre"), c.Query("highlight_post"), fragmentSize))
+		}
+	}
+
+	// ?q=category:shoes price:[10 TO 50] -refurbished "running shoe"
+	if q := c.Query("q"); q != "" {
+		if e, err := product.ParseQuery(q); err == nil {
+			search.WithQuery(e)
+		} else {
+			errs["q"] = err.Error()
+		}
+	}
+
+	if facets := c.Query("facets"); facets != "" {
+		search.WithFacets(facetRequest(facets, c.Query("price_ranges"), c.Query("price_interval"), errs))
+	}
+
+	// ?cursor= with no value starts a cursor walk; the next_cursor of each page continues it
+	if v, ok := c.GetQuery("cursor"); ok {
+		cursor := &product.Cursor{}
+		if v != "" {
+			var err error
+			if cursor, err = product.ParseCursor(v); err != nil {
+				errs["cursor"] = "invalid cursor"
+			}
+		}
+
+		if _, ok := errs["cursor"]; !ok {
+			if cursor.Matches(search) {
+				search.WithCursor(cursor)
+			} else {
+				errs["cursor"] = "cursor was issued for a different search"
+			}
+		}
+	}
+
+	for param, msg := range search.Validate() {
+		if _, ok := errs[param]; !ok {
+			errs[param] = msg
+		}
 	}
-	if sortAsc != "" {
-		if asc, err := strconv.ParseBool(sortAsc); err == nil {
-			search.WithSortAsc(asc)
+
+	return search, errs
+}
+
+// splitQueryArray reads every value of the query parameter key, splitting comma separated lists.
+func splitQueryArray(c *gin.Context, key string) []string {
+	var out []string
+	for _, v := range c.QueryArray(key) {
+		for _, part := range strings.Split(v, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				out = append(out, part)
+			}
 		}
 	}
+	return out
+}
+
+// defaultPriceInterval is the histogram bucket width when the price facet is requested without ranges or an interval.
+const defaultPriceInterval = 10
+
+// facetRequest reads ?facets=category,price,price_stats. The price facet counts the
+// ranges in ?price_ranges=0-10,10-50,50- if given, or else buckets ?price_interval wide.
+// Malformed parameters are recorded in errs.
+func facetRequest(facets, ranges, interval string, errs map[string]string) product.FacetRequest {
+	var req product.FacetRequest
+	for _, f := range strings.Split(facets, ",") {
+		switch f = strings.TrimSpace(f); f {
+		case "category":
+			req.Categories = true
+		case "price":
+			// ranges or an interval given are used or refused, never swapped for the default
+			if ranges != "" {
+				for _, r := range strings.Split(ranges, ",") {
+					pr, err := parsePriceRange(strings.TrimSpace(r))
+					if err != nil {
+						errs["price_ranges"] = err.Error()
+						req.PriceRanges = nil
+						break
+					}
+					req.PriceRanges = append(req.PriceRanges, pr)
+				}
+				continue
+			}
+
+			if interval == "" {
+				req.PriceInterval = defaultPriceInterval
+				continue
+			}
+			v, err := strconv.ParseFloat(interval, 64)
+			if err != nil || v <= 0 {
+				errs["price_interval"] = "must be a positive number"
+				continue
+			}
+			req.PriceInterval = v
+		case "price_stats":
+			req.PriceStats = true
+		default:
+			errs["facets"] = fmt.Sprintf("unknown facet %q, must be one of category, price, price_stats", f)
+		}
+	}
+
+	return req
+}
+
+// parsePriceRange parses "<from>-<to>", where either end may be left empty.
+func parsePriceRange(s string) (product.PriceRange, error) {
+	invalid := fmt.Errorf("invalid range %q, want <from>-<to>", s)
+
+	from, to, ok := strings.Cut(s, "-")
+	if !ok || (from == "" && to == "") {
+		return product.PriceRange{}, invalid
+	}
+
+	var r product.PriceRange
+	if from != "" {
+		v, ok := parsePrice(from)
+		if !ok {
+			return product.PriceRange{}, invalid
+		}
+		r.From = &v
+	}
+	if to != "" {
+		v, ok := parsePrice(to)
+		if !ok {
+			return product.PriceRange{}, invalid
+		}
+		r.To = &v
+	}
+
+	return r, nil
+}
+
+// parsePrice parses a finite number; ParseFloat also accepts "NaN" and "Inf".
+func parsePrice(s string) (float64, bool) {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, false
+	}
+	return v, true
+}
+
+// Reconcile starts a reconciliation run; ?repair=true also fixes the drift it finds.
+func (h *handler) Reconcile(c *gin.Context) {
+	var repair bool
+	if v := c.Query("repair"); v != "" {
+		var err error
+		if repair, err = strconv.ParseBool(v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid repair param"})
+			return
+		}
+	}
+
+	cmd, err := command.NewReconcile(repair, h.reconcileBatch)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err = h.rec.Start(cmd); err != nil {
+		if errors.Is(err, application.ErrReconcileRunning) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"status": "started"})
+}
+
+// ReconcileReport returns the report of the last reconciliation run.
+func (h *handler) ReconcileReport(c *gin.Context) {
+	last := h.rec.Last()
+	if last == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no reconciliation has run yet", "running": h.rec.Running()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"running": h.rec.Running(), "report": last})
+}
+
+// ReloadAnalyzers applies the current synonyms file to the live index.
+func (h *handler) ReloadAnalyzers(c *gin.Context) {
+	reloaded, err := h.rl.Handle(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
-	return search
+	c.JSON(http.StatusOK, gin.H{"reloaded_analyzers": reloaded})
 }
@@ -0,0 +1,515 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/ziliscite/cqrs_search/internal/application"
+	"github.com/ziliscite/cqrs_search/internal/domain/product"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// newTestHandler returns a handler with its routes set up and no backing services, for
+// requests that are answered before any is used.
+func newTestHandler(adminToken string) *handler {
+	h := NewHandler(nil, nil, nil, 100, adminToken).(*handler)
+	h.setupRoutes()
+	return h
+}
+
+// fakeRepo is a read repository over products held in memory, with every product
+// applied at the versions in applied, by ID.
+type fakeRepo struct {
+	mu       sync.Mutex
+	products map[string]*product.Product
+	applied  map[string]int64
+	polled   map[string]int // AppliedVersion calls by ID
+
+	searches []*product.Search
+	result   *product.Result
+	err      error // returned by Search
+
+	suggests    []*product.Suggest
+	suggestions []product.Suggestion
+}
+
+func newFakeRepo() *fakeRepo {
+	return &fakeRepo{
+		products: map[string]*product.Product{},
+		applied:  map[string]int64{},
+		polled:   map[string]int{},
+		result:   &product.Result{Items: []product.Hit{}},
+	}
+}
+
+func (r *fakeRepo) add(t *testing.T, id string, version int64) {
+	t.Helper()
+	p, err := product.New("Trail Shoe", "shoes", 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetID(id)
+	p.SetVersion(version)
+	r.products[id] = p
+	r.applied[id] = version
+}
+
+func (r *fakeRepo) Search(_ context.Context, opts *product.Search) (*product.Result, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.searches = append(r.searches, opts)
+	return r.result, r.err
+}
+
+func (r *fakeRepo) GetByID(_ context.Context, id string) (*product.Product, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.products[id], nil
+}
+
+func (r *fakeRepo) Suggest(_ context.Context, s *product.Suggest) ([]product.Suggestion, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.suggests = append(r.suggests, s)
+	return r.suggestions, nil
+}
+
+func (r *fakeRepo) AppliedVersion(_ context.Context, id string) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.polled[id]++
+	return r.applied[id], nil
+}
+
+// noCache misses every read.
+type noCache struct{}
+
+func (noCache) Get(context.Context, string) (*product.Result, error) { return nil, nil }
+
+func (noCache) Set(context.Context, string, *product.Result, ...string) error { return nil }
+
+type noSuggestionCache struct{}
+
+func (noSuggestionCache) Get(context.Context, string) ([]product.Suggestion, bool, error) {
+	return nil, false, nil
+}
+
+func (noSuggestionCache) Set(context.Context, string, []product.Suggestion) error { return nil }
+
+// newQueryHandler returns a handler answering queries from repo, without a cache; reads
+// with a consistency token wait up to wait.
+func newQueryHandler(repo *fakeRepo, wait time.Duration) *handler {
+	h := NewHandler(application.NewQuery(repo, noCache{}, noSuggestionCache{}, wait), nil, nil, 100, "").(*handler)
+	h.setupRoutes()
+	return h
+}
+
+func serve(h *handler, method, target string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	h.en.ServeHTTP(w, req)
+	return w
+}
+
+func TestAdminRoutesRequireTheToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string // the handler's admin token
+		header string // the request's Authorization header
+		want   int
+	}{
+		{"disabled", "", "Bearer anything", http.StatusForbidden},
+		{"no header", "s3cret", "", http.StatusUnauthorized},
+		{"wrong token", "s3cret", "Bearer guess", http.StatusUnauthorized},
+		{"not a bearer token", "s3cret", "Basic s3cret", http.StatusUnauthorized},
+		{"token", "s3cret", "Bearer s3cret", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(tt.token)
+
+			header := http.Header{}
+			if tt.header != "" {
+				header.Set("Authorization", tt.header)
+			}
+
+			w := serve(h, http.MethodGet, "/admin/debug/vars", header)
+			if w.Code != tt.want {
+				t.Fatalf("GET /admin/debug/vars: status %d, want %d", w.Code, tt.want)
+			}
+			if tt.want == http.StatusOK && !strings.Contains(w.Body.String(), `"cmdline"`) {
+				t.Errorf("GET /admin/debug/vars: body %s, want the expvar variables", w.Body)
+			}
+		})
+	}
+}
+
+func TestDebugVarsAreNotPublic(t *testing.T) {
+	h := newTestHandler("s3cret")
+
+	if w := serve(h, http.MethodGet, "/debug/vars", nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET /debug/vars: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+// freeAddr returns a loopback address nothing is listening on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+	return addr
+}
+
+// waitServing waits until GET url answers, failing the test after a few seconds.
+func waitServing(t *testing.T, url string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if res, err := http.Get(url); err == nil {
+			_ = res.Body.Close()
+			return
+		}
+	}
+	t.Fatalf("%s never answered", url)
+}
+
+func TestShutdownWaitsForInFlightRequests(t *testing.T) {
+	h := NewHandler(nil, nil, nil, 100, "").(*handler)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	h.en.GET("/slow", func(c *gin.Context) {
+		close(started)
+		<-release
+		c.String(http.StatusOK, "done")
+	})
+
+	addr := freeAddr(t)
+	ran := make(chan error, 1)
+	go func() { ran <- h.Run(addr) }()
+	waitServing(t, "http://"+addr+"/health")
+
+	type response struct {
+		status int
+		err    error
+	}
+	slow := make(chan response, 1)
+	go func() {
+		res, err := http.Get("http://" + addr + "/slow")
+		if err != nil {
+			slow <- response{err: err}
+			return
+		}
+		_ = res.Body.Close()
+		slow <- response{status: res.StatusCode}
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- h.Shutdown(context.Background()) }()
+
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown() = %v with a request in flight, want it to wait", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if r := <-slow; r.err != nil || r.status != http.StatusOK {
+		t.Errorf("in-flight request: status %d, error %v; want it to complete", r.status, r.err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown() = %v", err)
+	}
+	if err := <-ran; err != nil {
+		t.Errorf("Run() = %v after Shutdown, want nil", err)
+	}
+
+	if res, err := http.Get("http://" + addr + "/health"); err == nil {
+		_ = res.Body.Close()
+		t.Error("server still accepting connections after Shutdown")
+	}
+}
+
+func TestShutdownGivesUpWithItsContext(t *testing.T) {
+	h := NewHandler(nil, nil, nil, 100, "").(*handler)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	h.en.GET("/slow", func(c *gin.Context) {
+		close(started)
+		<-release
+	})
+
+	addr := freeAddr(t)
+	go func() { _ = h.Run(addr) }()
+	waitServing(t, "http://"+addr+"/health")
+
+	go func() {
+		if res, err := http.Get("http://" + addr + "/slow"); err == nil {
+			_ = res.Body.Close()
+		}
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := h.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown() = %v with a request stuck in flight, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestConsistencyToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		token  string
+		status int
+		polled map[string]int // AppliedVersion calls by ID
+	}{
+		{"get, caught up", "/products/a", "a:3", http.StatusOK, map[string]int{"a": 1}},
+		{"get, behind", "/products/a", "a:4", http.StatusServiceUnavailable, nil},
+		{"get, token for another product", "/products/a", "b:9", http.StatusOK, map[string]int{}},
+		{"get, malformed token", "/products/a", "a:latest", http.StatusBadRequest, map[string]int{}},
+		{"get, min_version wins over the token", "/products/a?min_version=2", "a:9", http.StatusOK, map[string]int{"a": 1}},
+		{"search, caught up", "/products", "a:3", http.StatusOK, map[string]int{"a": 1}},
+		{"search, behind", "/products", "b:2", http.StatusServiceUnavailable, nil},
+		{"search, malformed token", "/products", "b", http.StatusBadRequest, map[string]int{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newFakeRepo()
+			repo.add(t, "a", 3)
+			repo.add(t, "b", 1)
+			h := newQueryHandler(repo, 30*time.Millisecond)
+
+			w := serve(h, http.MethodGet, tt.target, http.Header{"X-Consistency-Token": {tt.token}})
+			if w.Code != tt.status {
+				t.Fatalf("status %d (%s), want %d", w.Code, w.Body, tt.status)
+			}
+
+			if tt.status == http.StatusServiceUnavailable {
+				if w.Header().Get("Retry-After") == "" {
+					t.Error("503 without Retry-After")
+				}
+				if len(repo.searches) > 0 {
+					t.Error("searched an index that hasn't caught up")
+				}
+				return
+			}
+			if w.Header().Get("Retry-After") != "" {
+				t.Errorf("Retry-After set on a %d", w.Code)
+			}
+
+			for id, n := range tt.polled {
+				if repo.polled[id] != n {
+					t.Errorf("polled %s %d times, want %d", id, repo.polled[id], n)
+				}
+			}
+			if len(tt.polled) == 0 && len(repo.polled) > 0 {
+				t.Errorf("polled %v, want no wait", repo.polled)
+			}
+		})
+	}
+}
+
+func TestSearchCursors(t *testing.T) {
+	walked := product.NewSearch().WithCategory("shoes").WithPageSize(10)
+	next := (&product.Cursor{}).Next(walked, "pit-1", []json.RawMessage{[]byte(`"a"`)}, 10).String()
+
+	tests := []struct {
+		name   string
+		target string
+		err    error // from the repository
+		status int
+		error  string // for 400s, the cursor param's message
+	}{
+		{"start a walk", "/products?category=shoes&page_size=10&cursor=", nil, http.StatusOK, ""},
+		{"continue it", "/products?category=shoes&page_size=10&cursor=" + next, nil, http.StatusOK, ""},
+		{"another page number", "/products?category=shoes&page_size=10&page=3&cursor=" + next, nil, http.StatusOK, ""},
+		{"another search", "/products?category=boots&page_size=10&cursor=" + next, nil, http.StatusBadRequest, "cursor was issued for a different search"},
+		{"another page size", "/products?category=shoes&page_size=20&cursor=" + next, nil, http.StatusBadRequest, "cursor was issued for a different search"},
+		{"malformed", "/products?category=shoes&page_size=10&cursor=abc", nil, http.StatusBadRequest, "invalid cursor"},
+		{"expired", "/products?category=shoes&page_size=10&cursor=" + next, product.ErrCursorExpired, http.StatusGone, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newFakeRepo()
+			repo.err = tt.err
+			h := newQueryHandler(repo, time.Second)
+
+			w := serve(h, http.MethodGet, tt.target, nil)
+			if w.Code != tt.status {
+				t.Fatalf("status %d (%s), want %d", w.Code, w.Body, tt.status)
+			}
+
+			if tt.status == http.StatusBadRequest {
+				var body struct {
+					Errors map[string]string `json:"errors"`
+				}
+				if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+					t.Fatal(err)
+				}
+				if body.Errors["cursor"] != tt.error {
+					t.Errorf("cursor error %q, want %q", body.Errors["cursor"], tt.error)
+				}
+				if len(repo.searches) > 0 {
+					t.Error("searched with a cursor that was refused")
+				}
+				return
+			}
+
+			if len(repo.searches) != 1 || repo.searches[0].Cursor() == nil {
+				t.Errorf("searches %v, want one walking a cursor", repo.searches)
+			}
+		})
+	}
+}
+
+func TestParsePriceRange(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string // as PriceRange.String formats it, empty when invalid
+	}{
+		{"10-50", "10.00-50.00"},
+		{"0-10", "0.00-10.00"},
+		{"50-", "50.00-"},
+		{"-10", "-10.00"},
+		{"9.99-19.99", "9.99-19.99"},
+		{"-", ""},
+		{"", ""},
+		{"10", ""},
+		{"ten-20", ""},
+		{"10-twenty", ""},
+		{"NaN-10", ""},
+		{"10-Inf", ""},
+		{"-5-10", ""},
+	}
+
+	for _, tt := range tests {
+		r, err := parsePriceRange(tt.in)
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("parsePriceRange(%q) = %s, want an error", tt.in, r)
+		case tt.want != "" && err != nil:
+			t.Errorf("parsePriceRange(%q) = %v", tt.in, err)
+		case tt.want != "" && r.String() != tt.want:
+			t.Errorf("parsePriceRange(%q) = %s, want %s", tt.in, r, tt.want)
+		}
+	}
+}
+
+func TestFacetRequest(t *testing.T) {
+	tests := []struct {
+		name                     string
+		facets, ranges, interval string
+		categories, stats        bool
+		wantRanges               []string
+		wantInterval             float64
+		errs                     []string // params with an error
+	}{
+		{name: "category", facets: "category", categories: true},
+		{name: "price defaults to a histogram", facets: "price", wantInterval: defaultPriceInterval},
+		{name: "price interval", facets: "price", interval: "25", wantInterval: 25},
+		{name: "price ranges", facets: "price", ranges: "0-10, 10-50,50-", wantRanges: []string{"0.00-10.00", "10.00-50.00", "50.00-"}},
+		{name: "ranges win over an interval", facets: "price", ranges: "0-10", interval: "25", wantRanges: []string{"0.00-10.00"}},
+		{name: "everything", facets: "category, price,price_stats", categories: true, stats: true, wantInterval: defaultPriceInterval},
+		{name: "ranges without the price facet", facets: "category", ranges: "bogus", categories: true},
+		{name: "unknown facet", facets: "category,colour", categories: true, errs: []string{"facets"}},
+		{name: "malformed interval", facets: "price", interval: "wide", errs: []string{"price_interval"}},
+		{name: "non-positive interval", facets: "price", interval: "0", errs: []string{"price_interval"}},
+		{name: "malformed range", facets: "price", ranges: "0-10,cheap", errs: []string{"price_ranges"}},
+		{name: "only malformed ranges", facets: "price", ranges: "cheap", errs: []string{"price_ranges"}},
+		{name: "empty range", facets: "price", ranges: "0-10,", errs: []string{"price_ranges"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := map[string]string{}
+			req := facetRequest(tt.facets, tt.ranges, tt.interval, errs)
+
+			var params []string
+			for p := range errs {
+				params = append(params, p)
+			}
+			if !slices.Equal(params, tt.errs) {
+				t.Fatalf("errors %v, want them for %v", errs, tt.errs)
+			}
+
+			if req.Categories != tt.categories || req.PriceStats != tt.stats {
+				t.Errorf("categories %v, stats %v, want %v, %v", req.Categories, req.PriceStats, tt.categories, tt.stats)
+			}
+			var ranges []string
+			for _, r := range req.PriceRanges {
+				ranges = append(ranges, r.String())
+			}
+			if !slices.Equal(ranges, tt.wantRanges) {
+				t.Errorf("price ranges %v, want %v", ranges, tt.wantRanges)
+			}
+			// a refused price facet never falls back to the histogram
+			if req.PriceInterval != tt.wantInterval {
+				t.Errorf("price interval %v, want %v", req.PriceInterval, tt.wantInterval)
+			}
+		})
+	}
+}
+
+func TestFacetErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		err    error // from the repository
+		param  string
+	}{
+		{"malformed range", "/products?facets=price&price_ranges=0-10,cheap", nil, "price_ranges"},
+		{"interval below the minimum", "/products?facets=price&price_interval=0.5", nil, "price_interval"},
+		{"too many buckets", "/products?facets=price&price_interval=1", fmt.Errorf("error searching: %w", product.ErrTooManyBuckets), "price_interval"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newFakeRepo()
+			repo.err = tt.err
+			h := newQueryHandler(repo, time.Second)
+
+			w := serve(h, http.MethodGet, tt.target, nil)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("status %d (%s), want 400", w.Code, w.Body)
+			}
+
+			var body struct {
+				Errors map[string]string `json:"errors"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Errors[tt.param] == "" {
+				t.Errorf("errors %v, want one for %s", body.Errors, tt.param)
+			}
+			if tt.err == nil && len(repo.searches) > 0 {
+				t.Error("searched with facets that were refused")
+			}
+		})
+	}
+}
@@ -0,0 +1,271 @@
+// Package memory provides an in-process message bus for tests, standing in for a broker.
+package memory
+
+import (
+	"context"
+	"errors"
+	"github.com/ziliscite/cqrs_search/internal/ports"
+	"slices"
+	"sync"
+)
+
+// ErrClosed is returned when publishing on, or subscribing to, a closed Bus.
+var ErrClosed = errors.New("bus is closed")
+
+// Bus fans published events out to every subscription. It implements ports.Subscriber,
+// and its Publish matches the product service's publisher, so it can stand in for both ends.
+type Bus struct {
+	mu     sync.Mutex // guards subs and closed; never held while sending
+	subs   []*subscription
+	closed bool
+	buffer int
+}
+
+// NewBus returns a bus whose subscriptions queue up to buffer undelivered messages.
+func NewBus(buffer int) *Bus {
+	return &Bus{buffer: buffer}
+}
+
+// Publish queues payload on every subscription, blocking while a subscription's queue is full.
+// A subscription that ends while Publish waits on it is skipped.
+func (b *Bus) Publish(ctx context.Context, payload []byte, event string) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return ErrClosed
+	}
+	subs := append([]*subscription(nil), b.subs...)
+	b.mu.Unlock()
+
+	for _, sub := range subs {
+		m := &message{sub: sub, event: event, body: payload}
+		if err := sub.send(ctx, m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *Bus) Subscribe(ctx context.Context) (<-chan ports.Message, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, ErrClosed
+	}
+
+	sub := &subscription{
+		out:     make(chan ports.Message),
+		buffer:  max(b.buffer, 1), // an unbuffered bus still holds the message being handed over
+		changed: make(chan struct{}),
+		ended:   make(chan struct{}),
+	}
+	b.subs = append(b.subs, sub)
+	go sub.pump()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			b.unsubscribe(sub)
+		case <-sub.ended:
+		}
+	}()
+
+	return sub.out, nil
+}
+
+func (b *Bus) unsubscribe(sub *subscription) {
+	b.mu.Lock()
+	for i, s := range b.subs {
+		if s == sub {
+			b.subs = append(b.subs[:i], b.subs[i+1:]...)
+			break
+		}
+	}
+	b.mu.Unlock()
+
+	sub.end(true)
+}
+
+// Close ends every subscription. Messages a subscription already holds are still delivered,
+// and one is closed only once every message it delivered has been settled, as those may be requeued.
+func (b *Bus) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	subs := b.subs
+	b.subs = nil
+	b.mu.Unlock()
+
+	for _, sub := range subs {
+		sub.end(false)
+	}
+
+	return nil
+}
+
+// subscription is one subscriber's queue of undelivered messages, which pump hands out in
+// order. A requeued message goes back to the head, ahead of those not yet delivered.
+type subscription struct {
+	out    chan ports.Message
+	buffer int
+
+	mu        sync.Mutex
+	queue     []*message
+	unsettled int           // delivered but neither acked nor nacked
+	changed   chan struct{} // closed and replaced whenever the queue or state changes
+	closed    bool          // no more messages are taken
+	abandoned bool          // the subscriber is gone, so queued messages are dropped
+	ended     chan struct{} // closed once closed is set
+}
+
+// notify wakes everyone waiting on a change. Callers hold mu.
+func (sub *subscription) notify() {
+	close(sub.changed)
+	sub.changed = make(chan struct{})
+}
+
+// send queues m, blocking while the queue is full, unless the subscription ends or ctx is done first.
+func (sub *subscription) send(ctx context.Context, m *message) error {
+	for {
+		sub.mu.Lock()
+		if sub.closed {
+			sub.mu.Unlock()
+			return nil
+		}
+		if len(sub.queue) < sub.buffer {
+			sub.queue = append(sub.queue, m)
+			sub.notify()
+			sub.mu.Unlock()
+			return nil
+		}
+		changed := sub.changed
+		sub.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// requeue puts m back at the head of the queue, even if it is full, so it is redelivered
+// before anything published after it.
+func (sub *subscription) requeue(m *message) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	if sub.abandoned {
+		return
+	}
+	sub.queue = append([]*message{m}, sub.queue...)
+	sub.notify()
+}
+
+// pump delivers the head of the queue, starting over whenever the queue changes while it
+// waits for the subscriber. Once the subscription is closed, drained and settled, or
+// abandoned, it closes out.
+func (sub *subscription) pump() {
+	defer close(sub.out)
+
+	for {
+		sub.mu.Lock()
+		if sub.abandoned || (sub.closed && len(sub.queue) == 0 && sub.unsettled == 0) {
+			sub.mu.Unlock()
+			return
+		}
+		var head *message
+		if len(sub.queue) > 0 {
+			head = sub.queue[0]
+		}
+		changed := sub.changed
+		sub.mu.Unlock()
+
+		if head == nil {
+			<-changed
+			continue
+		}
+
+		select {
+		case sub.out <- head:
+			sub.delivered(head)
+		case <-changed:
+		}
+	}
+}
+
+func (sub *subscription) delivered(m *message) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	if i := slices.Index(sub.queue, m); i >= 0 {
+		sub.queue = slices.Delete(sub.queue, i, i+1)
+		sub.unsettled++
+		sub.notify()
+	}
+}
+
+func (sub *subscription) settled() {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	sub.unsettled--
+	sub.notify()
+}
+
+// end stops the subscription taking messages, dropping those it holds if abandon is set.
+func (sub *subscription) end(abandon bool) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	if !sub.closed {
+		sub.closed = true
+		close(sub.ended)
+	}
+	if abandon {
+		sub.abandoned = true
+		sub.queue = nil
+	}
+	sub.notify()
+}
+
+type message struct {
+	sub   *subscription
+	event string
+	body  []byte
+
+	redelivered bool
+	once        sync.Once // settles the message once, however often it is acked or nacked
+}
+
+func (m *message) Event() string {
+	return m.event
+}
+
+func (m *message) Body() []byte {
+	return m.body
+}
+
+func (m *message) Redelivered() bool {
+	return m.redelivered
+}
+
+func (m *message) Ack() error {
+	m.once.Do(m.sub.settled)
+	return nil
+}
+
+func (m *message) Nack(requeue bool) error {
+	m.once.Do(func() {
+		if requeue {
+			m.sub.requeue(&message{sub: m.sub, event: m.event, body: m.body, redelivered: true})
+		}
+		m.sub.settled()
+	})
+	return nil
+}
@@ -0,0 +1,213 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"github.com/ziliscite/cqrs_search/internal/ports"
+	"testing"
+	"time"
+)
+
+func publish(t *testing.T, b *Bus, bodies ...string) {
+	t.Helper()
+	for _, body := range bodies {
+		if err := b.Publish(context.Background(), []byte(body), "update"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func receive(t *testing.T, in <-chan ports.Message) ports.Message {
+	t.Helper()
+	select {
+	case m, ok := <-in:
+		if !ok {
+			t.Fatal("subscription closed")
+		}
+		return m
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message delivered")
+		return nil
+	}
+}
+
+func bodies(t *testing.T, in <-chan ports.Message, n int) []string {
+	t.Helper()
+	got := make([]string, n)
+	for i := range got {
+		got[i] = string(receive(t, in).Body())
+	}
+	return got
+}
+
+func TestBusDeliversInPublishOrder(t *testing.T) {
+	b := NewBus(8)
+	in, err := b.Subscribe(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publish(t, b, "1", "2", "3")
+
+	if got := bodies(t, in, 3); got[0] != "1" || got[1] != "2" || got[2] != "3" {
+		t.Errorf("delivered %v, want 1, 2, 3", got)
+	}
+}
+
+func TestBusFansOutToEverySubscription(t *testing.T) {
+	b := NewBus(8)
+	first, _ := b.Subscribe(context.Background())
+	second, _ := b.Subscribe(context.Background())
+
+	publish(t, b, "1")
+
+	for _, in := range []<-chan ports.Message{first, second} {
+		if m := receive(t, in); string(m.Body()) != "1" || m.Event() != "update" {
+			t.Errorf("delivered %s %s, want update 1", m.Event(), m.Body())
+		}
+	}
+}
+
+func TestBusRequeuesAheadOfLaterMessages(t *testing.T) {
+	b := NewBus(8)
+	in, _ := b.Subscribe(context.Background())
+
+	publish(t, b, "1", "2", "3")
+
+	first := receive(t, in)
+	if first.Redelivered() {
+		t.Error("first delivery is marked redelivered")
+	}
+	if err := first.Nack(true); err != nil {
+		t.Fatal(err)
+	}
+
+	again := receive(t, in)
+	if string(again.Body()) != "1" || !again.Redelivered() {
+		t.Errorf("after requeueing 1, delivered %s (redelivered %v), want 1 redelivered", again.Body(), again.Redelivered())
+	}
+	if got := bodies(t, in, 2); got[0] != "2" || got[1] != "3" {
+		t.Errorf("then delivered %v, want 2, 3", got)
+	}
+}
+
+func TestBusRequeuesIntoAFullQueue(t *testing.T) {
+	b := NewBus(1)
+	in, _ := b.Subscribe(context.Background())
+
+	publish(t, b, "1")
+	first := receive(t, in)
+	publish(t, b, "2") // fills the queue
+
+	// the requeue doesn't wait for room, as the caller may be the one draining the queue
+	if err := first.Nack(true); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := bodies(t, in, 2); got[0] != "1" || got[1] != "2" {
+		t.Errorf("delivered %v, want 1, 2", got)
+	}
+}
+
+func TestBusDropsNackedMessagesWithoutRequeue(t *testing.T) {
+	b := NewBus(8)
+	in, _ := b.Subscribe(context.Background())
+
+	publish(t, b, "1", "2")
+	if err := receive(t, in).Nack(false); err != nil {
+		t.Fatal(err)
+	}
+
+	if m := receive(t, in); string(m.Body()) != "2" {
+		t.Errorf("delivered %s, want 2", m.Body())
+	}
+}
+
+func TestBusPublishBlocksWhileTheQueueIsFull(t *testing.T) {
+	b := NewBus(1)
+	in, _ := b.Subscribe(context.Background())
+
+	publish(t, b, "1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	// the pump holds 1 out for the subscriber, so the queue is still full
+	if err := b.Publish(ctx, []byte("2"), "update"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("publish into a full queue: %v, want it to block until ctx is done", err)
+	}
+
+	receive(t, in)
+	publish(t, b, "2")
+	if m := receive(t, in); string(m.Body()) != "2" {
+		t.Errorf("delivered %s, want 2", m.Body())
+	}
+}
+
+func TestBusCloseDeliversWhatItHolds(t *testing.T) {
+	b := NewBus(8)
+	in, _ := b.Subscribe(context.Background())
+
+	publish(t, b, "1", "2")
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	first, second := receive(t, in), receive(t, in)
+	if string(first.Body()) != "1" || string(second.Body()) != "2" {
+		t.Errorf("delivered %s, %s after Close, want 1, 2", first.Body(), second.Body())
+	}
+
+	// a delivery requeued after Close is still redelivered
+	_ = first.Ack()
+	_ = second.Nack(true)
+	again := receive(t, in)
+	if string(again.Body()) != "2" || !again.Redelivered() {
+		t.Errorf("after requeueing 2, delivered %s (redelivered %v), want 2 redelivered", again.Body(), again.Redelivered())
+	}
+
+	// the subscription closes once everything it delivered is settled
+	_ = again.Ack()
+	select {
+	case m, ok := <-in:
+		if ok {
+			t.Errorf("delivered %s once drained and settled, want the subscription closed", m.Body())
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("subscription still open once drained and settled")
+	}
+
+	if err := b.Publish(context.Background(), []byte("3"), "update"); !errors.Is(err, ErrClosed) {
+		t.Errorf("publish after Close: %v, want ErrClosed", err)
+	}
+	if _, err := b.Subscribe(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Errorf("subscribe after Close: %v, want ErrClosed", err)
+	}
+}
+
+func TestBusReleasesPublishersWhenASubscriberLeaves(t *testing.T) {
+	b := NewBus(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	in, _ := b.Subscribe(ctx)
+
+	publish(t, b, "1")
+
+	published := make(chan error, 1)
+	go func() { published <- b.Publish(context.Background(), []byte("2"), "update") }()
+
+	// the subscriber goes away without draining
+	cancel()
+
+	select {
+	case err := <-published:
+		if err != nil {
+			t.Errorf("publish to a departed subscriber: %v, want it skipped", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("publish still blocked on a departed subscriber")
+	}
+
+	for range in {
+		// drained or dropped, the subscription closes
+	}
+}
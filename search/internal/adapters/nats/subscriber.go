@@ -0,0 +1,153 @@
+package nats
+
+import (
+	"context"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/ziliscite/cqrs_search/internal/domain/product"
+	"github.com/ziliscite/cqrs_search/internal/ports"
+	"github.com/ziliscite/cqrs_search/pkg/natsjs"
+	"sync"
+)
+
+type subscriber struct {
+	cons jetstream.Consumer
+
+	mu  sync.Mutex
+	sub *subscription // running subscription, if any
+}
+
+// NewSubscriber creates (or updates) the durable consumer on stream, filtered by the binding patterns.
+func NewSubscriber(ctx context.Context, js jetstream.JetStream, stream, durable string, bindings []string, prefetch int) (ports.Subscriber, error) {
+	subjects := make([]string, len(bindings))
+	for i, b := range bindings {
+		subjects[i] = natsjs.Subject(b)
+	}
+
+	if _, err := natsjs.EnsureStream(ctx, js, stream, []string{"product.>"}); err != nil {
+		return nil, err
+	}
+
+	cons, err := js.CreateOrUpdateConsumer(ctx, stream, jetstream.ConsumerConfig{
+		Durable:        durable,
+		FilterSubjects: subjects,
+		AckPolicy:      jetstream.AckExplicitPolicy,
+		MaxAckPending:  prefetch,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &subscriber{cons: cons}, nil
+}
+
+func (s *subscriber) Subscribe(ctx context.Context) (<-chan ports.Message, error) {
+	sub := &subscription{
+		out:  make(chan ports.Message),
+		stop: make(chan struct{}),
+	}
+
+	cc, err := s.cons.Consume(sub.deliver)
+	if err != nil {
+		return nil, err
+	}
+	sub.cc = cc
+
+	s.mu.Lock()
+	s.sub = sub
+	s.mu.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-cc.Closed():
+		case <-sub.stop:
+		}
+		sub.close()
+	}()
+
+	return sub.out, nil
+}
+
+// Close stops the running subscription; messages already handed out can still be acknowledged.
+func (s *subscriber) Close() error {
+	s.mu.Lock()
+	sub := s.sub
+	s.sub = nil
+	s.mu.Unlock()
+
+	if sub != nil {
+		sub.close()
+	}
+	return nil
+}
+
+type subscription struct {
+	cc jetstream.ConsumeContext
+
+	mu     sync.RWMutex // held for reading while delivering, so out is never closed mid-send
+	out    chan ports.Message
+	stop   chan struct{}
+	once   sync.Once
+	closed bool
+}
+
+func (s *subscription) deliver(msg jetstream.Msg) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		_ = msg.Nak()
+		return
+	}
+
+	select {
+	case s.out <- &message{msg: msg}:
+	case <-s.stop:
+		_ = msg.Nak()
+	}
+}
+
+func (s *subscription) close() {
+	s.once.Do(func() {
+		s.cc.Stop()
+		close(s.stop) // releases a pending deliver before taking the write lock
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.closed = true
+		close(s.out)
+	})
+}
+
+// message adapts a JetStream message to ports.Message.
+type message struct {
+	msg jetstream.Msg
+}
+
+// Event resolves the event from the subject, falling back to the event_type header.
+func (m *message) Event() string {
+	if event, ok := product.EventFromKey(m.msg.Subject()); ok {
+		return event
+	}
+	return m.msg.Headers().Get("event_type")
+}
+
+func (m *message) Body() []byte {
+	return m.msg.Data()
+}
+
+func (m *message) Redelivered() bool {
+	meta, err := m.msg.Metadata()
+	return err == nil && meta.NumDelivered > 1
+}
+
+func (m *message) Ack() error {
+	return m.msg.Ack()
+}
+
+func (m *message) Nack(requeue bool) error {
+	if requeue {
+		return m.msg.Nak()
+	}
+	return m.msg.Term()
+}
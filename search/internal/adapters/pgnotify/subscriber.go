@@ -0,0 +1,386 @@
+// Package pgnotify receives product events from the product service's product_events
+// table: it LISTENs for the sequence numbers of new events and reads them in order, and
+// after a reconnect catches up on what it missed from the last sequence number it saw.
+package pgnotify
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/ziliscite/cqrs_search/internal/ports"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// catchUpBatch bounds the events read per query.
+	catchUpBatch = 500
+	// pollInterval is how long to wait for a notification before checking for events anyway.
+	pollInterval = 30 * time.Second
+	// reconnectDelay is how long to wait before listening again after a failure.
+	reconnectDelay = 2 * time.Second
+)
+
+type subscriber struct {
+	db       *pgxpool.Pool
+	channel  string
+	consumer string // name the committed offset is stored under
+
+	mu     sync.Mutex
+	cancel context.CancelFunc // stops the running subscription, if any
+}
+
+// NewSubscriber subscribes to events published on channel. The sequence number of the
+// last event processed is stored in product_event_offsets under consumer; the table is
+// created by the product service's migrations.
+func NewSubscriber(ctx context.Context, db *pgxpool.Pool, channel, consumer string) (ports.Subscriber, error) {
+	var exists bool
+	if err := db.QueryRow(ctx, `
+		SELECT to_regclass('product_event_offsets') IS NOT NULL
+	`).Scan(&exists); err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		return nil, errors.New("product_event_offsets does not exist; run the product service's migrations")
+	}
+
+	return &subscriber{
+		db:       db,
+		channel:  channel,
+		consumer: consumer,
+	}, nil
+}
+
+func (s *subscriber) Subscribe(ctx context.Context) (<-chan ports.Message, error) {
+	var committed int64
+	if err := s.db.QueryRow(ctx, `
+		SELECT COALESCE((SELECT seq FROM product_event_offsets WHERE consumer = $1), 0)
+	`, s.consumer,
+	).Scan(&committed); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	s.mu.Lock()
+	s.cancel = cancel
+	s.mu.Unlock()
+
+	sub := &subscription{
+		s:       s,
+		offsets: newOffsets(committed),
+		out:     make(chan ports.Message),
+		wake:    make(chan struct{}, 1),
+	}
+
+	go sub.run(ctx)
+	return sub.out, nil
+}
+
+// Close stops the running subscription; messages already handed out can still be acknowledged.
+func (s *subscriber) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cancel != nil {
+		s.cancel()
+		s.cancel = nil
+	}
+	return nil
+}
+
+type subscription struct {
+	s       *subscriber
+	offsets *offsets
+
+	out  chan ports.Message
+	wake chan struct{} // signalled when a requeue rewinds the subscription
+
+	delivered int64 // the highest sequence number delivered; events up to it are redeliveries
+}
+
+func (sub *subscription) run(ctx context.Context) {
+	defer close(sub.out)
+
+	// the last event delivered; ahead of the committed offset while events are in flight
+	last := sub.offsets.committed()
+	for ctx.Err() == nil {
+		var err error
+		if last, err = sub.listen(ctx, last); err != nil && ctx.Err() == nil {
+			log.Printf("event subscription failed, reconnecting: %v", err)
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(reconnectDelay):
+			}
+		}
+	}
+}
+
+// listen delivers the events after last, then each new one as it is announced, until
+// ctx is done or the connection fails. It returns the last event delivered.
+func (sub *subscription) listen(ctx context.Context, last int64) (int64, error) {
+	pooled, err := sub.s.db.Acquire(ctx)
+	if err != nil {
+		return last, err
+	}
+
+	// taken out of the pool for good, so its LISTEN state isn't handed to anyone else
+	conn := pooled.Hijack()
+	defer conn.Close(context.Background())
+
+	if _, err = conn.Exec(ctx, "LISTEN "+quote(sub.s.channel)); err != nil {
+		return last, err
+	}
+
+	for {
+		// listening before reading means an event committed meanwhile is either read or announced
+		if last, err = sub.catchUp(ctx, last); err != nil {
+			return last, err
+		}
+
+		waitCtx, cancel := context.WithTimeout(ctx, pollInterval)
+		go func() {
+			select {
+			case <-sub.wake:
+				cancel() // a requeued event is waiting
+			case <-waitCtx.Done():
+			}
+		}()
+		_, err = conn.WaitForNotification(waitCtx)
+		cancel()
+
+		if ctx.Err() != nil {
+			return last, nil
+		}
+		if err != nil && waitCtx.Err() == nil {
+			return last, err
+		}
+	}
+}
+
+// catchUp delivers every event after last, in sequence order, and returns the last one
+// delivered. A requeue rewinds it to the requeued event, which is delivered again
+// followed by every event after it.
+func (sub *subscription) catchUp(ctx context.Context, last int64) (int64, error) {
+	for {
+		if to, ok := sub.offsets.rewound(); ok && to < last {
+			last = to
+		}
+
+		rows, err := sub.s.db.Query(ctx, `
+			SELECT seq, event, payload FROM product_events
+			WHERE seq > $1
+			ORDER BY seq
+			LIMIT $2
+		`, last, catchUpBatch,
+		)
+		if err != nil {
+			return last, err
+		}
+
+		var batch []*message
+		for rows.Next() {
+			m := &message{sub: sub}
+			if err = rows.Scan(&m.seq, &m.event, &m.body); err != nil {
+				rows.Close()
+				return last, err
+			}
+			m.redelivered = m.seq <= sub.delivered
+			batch = append(batch, m)
+		}
+		if err = rows.Err(); err != nil {
+			return last, err
+		}
+
+		rewound := false
+		for _, m := range batch {
+			if sub.offsets.rewinding() {
+				rewound = true
+				break
+			}
+
+			sub.offsets.track(m)
+			if !sub.deliver(ctx, m) {
+				return last, ctx.Err()
+			}
+			last, sub.delivered = m.seq, max(sub.delivered, m.seq)
+		}
+
+		if !rewound && len(batch) < catchUpBatch {
+			return last, nil
+		}
+	}
+}
+
+func (sub *subscription) deliver(ctx context.Context, m *message) bool {
+	select {
+	case sub.out <- m:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// requeue rewinds the subscription to m, so m and every event after it are delivered
+// again in order, rather than m arriving after events that followed it. Later events
+// already handed out may be processed twice; their event IDs let the consumer skip them.
+func (sub *subscription) requeue(m *message) {
+	sub.offsets.rewind(m.seq)
+
+	select {
+	case sub.wake <- struct{}{}:
+	default: // already signalled
+	}
+}
+
+// settle marks m as processed and stores the new offset if it moved.
+func (sub *subscription) settle(m *message) error {
+	committed, moved := sub.offsets.done(m)
+	if !moved {
+		return nil
+	}
+
+	_, err := sub.s.db.Exec(context.Background(), `
+		INSERT INTO product_event_offsets (consumer, seq) VALUES ($1, $2)
+		ON CONFLICT (consumer) DO UPDATE SET seq = GREATEST(product_event_offsets.seq, EXCLUDED.seq)
+	`, sub.s.consumer, committed,
+	)
+	return err
+}
+
+// offsets tracks delivered events to find the committed offset: the highest sequence
+// number below which every event has been processed. Events are settled out of order by
+// the consumer's workers, so an event only moves the offset once those before it are done.
+type offsets struct {
+	mu       sync.Mutex
+	offset   int64
+	inFlight []*message // delivered, in sequence order
+	settled  map[*message]bool
+	rewindTo int64 // the event to deliver after, once a requeue rewinds; -1 if none is pending
+}
+
+func newOffsets(committed int64) *offsets {
+	return &offsets{offset: committed, settled: make(map[*message]bool), rewindTo: -1}
+}
+
+func (o *offsets) committed() int64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.offset
+}
+
+func (o *offsets) track(m *message) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.inFlight = append(o.inFlight, m)
+}
+
+// done settles m. Settling a delivery a rewind has since superseded changes nothing.
+func (o *offsets) done(m *message) (int64, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if !o.tracked(m) {
+		return o.offset, false
+	}
+	o.settled[m] = true
+
+	moved := false
+	for len(o.inFlight) > 0 && o.settled[o.inFlight[0]] {
+		o.offset = o.inFlight[0].seq
+		delete(o.settled, o.inFlight[0])
+		o.inFlight = o.inFlight[1:]
+		moved = true
+	}
+	return o.offset, moved
+}
+
+func (o *offsets) tracked(m *message) bool {
+	for _, f := range o.inFlight {
+		if f == m {
+			return true
+		}
+	}
+	return false
+}
+
+// rewind forgets the deliveries of seq and every event after it, which will be delivered again.
+func (o *offsets) rewind(seq int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for i, m := range o.inFlight {
+		if m.seq >= seq {
+			for _, dropped := range o.inFlight[i:] {
+				delete(o.settled, dropped)
+			}
+			o.inFlight = o.inFlight[:i]
+			break
+		}
+	}
+
+	if o.rewindTo < 0 || seq-1 < o.rewindTo {
+		o.rewindTo = seq - 1
+	}
+}
+
+// rewinding reports whether a rewind is waiting to be applied.
+func (o *offsets) rewinding() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.rewindTo >= 0
+}
+
+// rewound returns the event to deliver after, if a rewind is waiting, and clears it.
+func (o *offsets) rewound() (int64, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	to := o.rewindTo
+	o.rewindTo = -1
+	return to, to >= 0
+}
+
+// message adapts a stored event to ports.Message.
+type message struct {
+	sub   *subscription
+	seq   int64
+	event string
+	body  []byte
+
+	redelivered bool
+}
+
+func (m *message) Event() string {
+	return m.event
+}
+
+func (m *message) Body() []byte {
+	return m.body
+}
+
+func (m *message) Redelivered() bool {
+	return m.redelivered
+}
+
+func (m *message) Ack() error {
+	return m.sub.settle(m)
+}
+
+func (m *message) Nack(requeue bool) error {
+	if !requeue {
+		// dropped, like a rejected message on a broker
+		return m.sub.settle(m)
+	}
+
+	m.sub.requeue(m)
+	return nil
+}
+
+// quote quotes a channel name for LISTEN, which doesn't take parameters.
+func quote(ident string) string {
+	return `"` + strings.ReplaceAll(ident, `"`, `""`) + `"`
+}
@@ -0,0 +1,74 @@
+package pgnotify
+
+import "testing"
+
+func deliver(o *offsets, seqs ...int64) []*message {
+	ms := make([]*message, len(seqs))
+	for i, seq := range seqs {
+		ms[i] = &message{seq: seq}
+		o.track(ms[i])
+	}
+	return ms
+}
+
+func TestOffsetsMoveOnlyPastSettledPrefix(t *testing.T) {
+	o := newOffsets(10)
+	ms := deliver(o, 11, 12, 13)
+
+	if offset, moved := o.done(ms[1]); moved || offset != 10 {
+		t.Errorf("settling 12 first: offset %d, moved %v, want 10, false", offset, moved)
+	}
+	if offset, moved := o.done(ms[0]); !moved || offset != 12 {
+		t.Errorf("settling 11: offset %d, moved %v, want 12, true", offset, moved)
+	}
+	if offset, moved := o.done(ms[2]); !moved || offset != 13 {
+		t.Errorf("settling 13: offset %d, moved %v, want 13, true", offset, moved)
+	}
+}
+
+func TestOffsetsRewind(t *testing.T) {
+	o := newOffsets(10)
+	ms := deliver(o, 11, 12, 13)
+
+	// 12 is requeued while 13, handed out after it, is still being processed
+	o.rewind(12)
+
+	if !o.rewinding() {
+		t.Fatal("rewind is not pending")
+	}
+	if to, ok := o.rewound(); !ok || to != 11 {
+		t.Fatalf("rewound() = %d, %v, want 11, true", to, ok)
+	}
+	if _, ok := o.rewound(); ok {
+		t.Error("rewind still pending after being applied")
+	}
+
+	// the superseded delivery of 13 settling doesn't move the offset past 12
+	if offset, moved := o.done(ms[2]); moved || offset != 10 {
+		t.Errorf("settling superseded 13: offset %d, moved %v, want 10, false", offset, moved)
+	}
+	if offset, moved := o.done(ms[0]); !moved || offset != 11 {
+		t.Errorf("settling 11: offset %d, moved %v, want 11, true", offset, moved)
+	}
+
+	again := deliver(o, 12, 13)
+	if offset, moved := o.done(again[1]); moved || offset != 11 {
+		t.Errorf("settling redelivered 13 first: offset %d, moved %v, want 11, false", offset, moved)
+	}
+	if offset, moved := o.done(again[0]); !moved || offset != 13 {
+		t.Errorf("settling redelivered 12: offset %d, moved %v, want 13, true", offset, moved)
+	}
+}
+
+func TestOffsetsRewindKeepsEarliest(t *testing.T) {
+	o := newOffsets(0)
+	deliver(o, 1, 2, 3, 4)
+
+	o.rewind(3)
+	o.rewind(2)
+	o.rewind(4)
+
+	if to, ok := o.rewound(); !ok || to != 1 {
+		t.Errorf("rewound() = %d, %v, want 1, true", to, ok)
+	}
+}
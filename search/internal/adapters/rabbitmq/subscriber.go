@@ -0,0 +1,155 @@
+package rabbitmq
+
+import (
+	"context"
+	"fmt"
+	"github.com/rabbitmq/amqp091-go"
+	"github.com/ziliscite/cqrs_search/internal/domain/product"
+	"github.com/ziliscite/cqrs_search/internal/ports"
+	"github.com/ziliscite/cqrs_search/pkg/rabbit"
+	"sync"
+)
+
+const consumerTag = "product_event"
+
+type subscriber struct {
+	c        *rabbit.Client
+	q        string
+	prefetch int
+
+	mu sync.Mutex
+	ch *amqp091.Channel // channel of the running subscription, if any
+}
+
+// LegacyRoute is the direct exchange and routing key events were consumed from before topic
+// routing. While set, the queue's binding to it is removed at startup, so events the product
+// service still publishes there during the migration aren't received twice.
+type LegacyRoute struct {
+	Exchange   string
+	RoutingKey string // e.g. "product_event"
+}
+
+func NewSubscriber(c *rabbit.Client, exchange string, kind rabbit.ExchangeType, queue string, bindings []string, legacy LegacyRoute, prefetch int) (ports.Subscriber, error) {
+	if legacy.Exchange != "" && legacy.Exchange == exchange {
+		return nil, fmt.Errorf("legacy exchange %q must differ from the exchange consumed from", exchange)
+	}
+
+	ch, err := c.Channel()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Put(ch)
+
+	// product
+	if err = c.CreateExchange(ch, exchange, kind, true, false); err != nil {
+		return nil, err
+	}
+
+	// product_queue
+	if err = c.CreateQueue(ch, queue, true, false); err != nil {
+		return nil, err
+	}
+
+	// product.*
+	for _, binding := range bindings {
+		if err = c.CreateBinding(ch, queue, binding, exchange); err != nil {
+			return nil, err
+		}
+	}
+
+	// product_exchange; declared first, as unbinding from a missing exchange fails
+	if legacy.Exchange != "" {
+		if err = c.CreateExchange(ch, legacy.Exchange, rabbit.ExchangeDirect, true, false); err != nil {
+			return nil, err
+		}
+		if err = c.RemoveBinding(ch, queue, legacy.RoutingKey, legacy.Exchange); err != nil {
+			return nil, err
+		}
+	}
+
+	return &subscriber{
+		c:        c,
+		q:        queue,
+		prefetch: prefetch,
+	}, nil
+}
+
+func (s *subscriber) Subscribe(ctx context.Context) (<-chan ports.Message, error) {
+	ch, err := s.c.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	// bounds the unacknowledged deliveries spread across the consumer's workers
+	if err = ch.Qos(s.prefetch, 0, false); err != nil {
+		s.c.Put(ch)
+		return nil, err
+	}
+
+	deliveries, err := s.c.Consume(ctx, ch, s.q, consumerTag, false)
+	if err != nil {
+		s.c.Put(ch)
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.ch = ch
+	s.mu.Unlock()
+
+	msgs := make(chan ports.Message)
+	go func() {
+		defer close(msgs)
+		for d := range deliveries {
+			msgs <- &message{d: d}
+		}
+	}()
+
+	return msgs, nil
+}
+
+// Close cancels the running subscription; deliveries already handed out can still be acknowledged.
+func (s *subscriber) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ch == nil {
+		return nil
+	}
+
+	err := s.ch.Cancel(consumerTag, false)
+	s.c.Put(s.ch)
+	s.ch = nil
+	return err
+}
+
+// message adapts an AMQP delivery to ports.Message.
+type message struct {
+	d amqp091.Delivery
+}
+
+// Event resolves the event from the routing key, falling back to the legacy
+// event_type header for messages published before topic routing.
+func (m *message) Event() string {
+	if event, ok := product.EventFromKey(m.d.RoutingKey); ok {
+		return event
+	}
+
+	event, _ := m.d.Headers["event_type"].(string)
+	return event
+}
+
+func (m *message) Body() []byte {
+	return m.d.Body
+}
+
+func (m *message) Redelivered() bool {
+	return m.d.Redelivered
+}
+
+func (m *message) Ack() error {
+	return m.d.Ack(false)
+}
+
+func (m *message) Nack(requeue bool) error {
+	return m.d.Nack(false, requeue)
+}
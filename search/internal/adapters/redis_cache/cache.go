@@ -41,8 +41,8 @@ func NewCacher(client *redis.Client, timeToLive time.Duration) ports.Cacher {
 	}
 }
 
-// Get retrieves products from cache by key.
-func (c *cacher) Get(ctx context.Context, key string) ([]product.Product, error) {
+// Get retrieves a search result from cache by key.
+func (c *cacher) Get(ctx context.Context, key string) (*product.Result, error) {
 	raw, err := c.client.Get(ctx, key).Result()
 	if errors.Is(err, redis.Nil) {
 		return nil, nil // cache miss
@@ -53,19 +53,23 @@ func (c *cacher) Get(ctx context.Context, key string) ([]product.Product, error)
 	if raw == "" || raw == "{}" || raw == "[]" {
 		return nil, nil // cache miss
 	}
+	// entries cached before results had an envelope hold a bare list of products
+	if raw[0] == '[' {
+		return nil, nil // cache miss
+	}
 
 	log.Printf("cache hit: %s, raw: %s", key, raw)
-	var products []product.Product
-	if err = json.Unmarshal([]byte(raw), &products); err != nil {
+	var result product.Result
+	if err = json.Unmarshal([]byte(raw), &result); err != nil {
 		return nil, err
 	}
-	return products, nil
+	return &result, nil
 }
 
-// Set stores products under key and registers tags (product IDs) for invalidation.
-func (c *cacher) Set(ctx context.Context, key string, products []product.Product, tags ...string) error {
-	// Serialize products
-	data, err := json.Marshal(products)
+// Set stores a search result under key and registers tags (product IDs) for invalidation.
+func (c *cacher) Set(ctx context.Context, key string, result *product.Result, tags ...string) error {
+	// Serialize the result
+	data, err := json.Marshal(result)
 	if err != nil {
 		return err
 	}
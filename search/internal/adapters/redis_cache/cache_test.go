@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/ziliscite/cqrs_search/internal/domain/product"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCachedResultsKeepTheirEnvelope(t *testing.T) {
+	_, client := newFakeRedis(t)
+	c := NewCacher(client, time.Minute)
+	ctx := context.Background()
+
+	p, err := product.New("Trail Shoe", "shoes", 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetID("a")
+	p.SetVersion(2)
+
+	score, low := 1.5, 50.0
+	want := &product.Result{
+		Items:    []product.Hit{{Product: p, Score: &score, Highlight: map[string][]string{"name": {"<em>Trail</em> Shoe"}}}},
+		Total:    41,
+		Page:     3,
+		PageSize: 20,
+		HasNext:  true,
+		Filters:  product.Filters{Categories: []string{"shoes"}, MinPrice: &low},
+		Facets:   &product.Facets{Categories: []product.CategoryCount{{Category: "shoes", Count: 41}}},
+	}
+
+	if err = c.Set(ctx, "products:result|page=3", want, product.ProductTag("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := c.Get(ctx, "products:result|page=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		gj, _ := json.Marshal(got)
+		wj, _ := json.Marshal(want)
+		t.Errorf("Get() = %s, want %s", gj, wj)
+	}
+}
+
+func TestCachedEntriesWithoutAnEnvelopeAreMisses(t *testing.T) {
+	for name, raw := range map[string]string{
+		"legacy product list": `[{"id":"a","name":"Trail Shoe","price":80,"category":"shoes","version":1}]`,
+		"empty list":          `[]`,
+		"empty object":        `{}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, client := newFakeRedis(t)
+			c := NewCacher(client, time.Minute)
+			ctx := context.Background()
+
+			// written by a release that cached bare product lists
+			if err := client.Set(ctx, "products:result|page=1", raw, time.Minute).Err(); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := c.Get(ctx, "products:result|page=1")
+			if err != nil || got != nil {
+				t.Errorf("Get() = %+v, %v, want a miss so the search runs and recaches it", got, err)
+			}
+		})
+	}
+}
+
+func TestCorruptCachedResults(t *testing.T) {
+	_, client := newFakeRedis(t)
+	c := NewCacher(client, time.Minute)
+	ctx := context.Background()
+
+	if err := client.Set(ctx, "products:result|page=1", `{"items":`, time.Minute).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ctx, "products:result|page=1"); err == nil {
+		t.Error("Get() of a truncated entry = nil error")
+	}
+}
@@ -0,0 +1,38 @@
+package cache
+
+import (
+	"context"
+	"github.com/redis/go-redis/v9"
+	"github.com/ziliscite/cqrs_search/internal/ports"
+	"time"
+)
+
+// eventLog records processed event IDs in Redis, each expiring after ttl.
+// The TTL only has to outlive the broker's redelivery window.
+type eventLog struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+func NewEventLog(client *redis.Client, ttl time.Duration) ports.EventLog {
+	return &eventLog{
+		client: client,
+		ttl:    ttl,
+	}
+}
+
+func (l *eventLog) Seen(ctx context.Context, eventID string) (bool, error) {
+	n, err := l.client.Exists(ctx, eventKey(eventID)).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (l *eventLog) MarkSeen(ctx context.Context, eventID string) error {
+	return l.client.Set(ctx, eventKey(eventID), 1, l.ttl).Err()
+}
+
+func eventKey(eventID string) string {
+	return "event:" + eventID
+}
@@ -0,0 +1,50 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestEventLog(t *testing.T) {
+	f, client := newFakeRedis(t)
+	log := NewEventLog(client, 24*time.Hour)
+	ctx := context.Background()
+
+	seen, err := log.Seen(ctx, "evt-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seen {
+		t.Error("an event never marked is seen")
+	}
+
+	if err = log.MarkSeen(ctx, "evt-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if seen, err = log.Seen(ctx, "evt-1"); err != nil || !seen {
+		t.Errorf("Seen() = %v, %v after MarkSeen, want true", seen, err)
+	}
+	if seen, err = log.Seen(ctx, "evt-2"); err != nil || seen {
+		t.Errorf("Seen() = %v, %v for another event, want false", seen, err)
+	}
+
+	// entries only have to outlive the broker's redelivery window
+	if got := f.ttl("event:evt-1"); got != 24*time.Hour {
+		t.Errorf("entry expires after %s, want 24h", got)
+	}
+}
+
+func TestEventLogReportsRedisErrors(t *testing.T) {
+	_, client := newFakeRedis(t)
+	log := NewEventLog(client, time.Hour)
+	_ = client.Close()
+
+	if _, err := log.Seen(context.Background(), "evt-1"); err == nil {
+		t.Error("Seen() on a closed client succeeded, want its error")
+	}
+	if err := log.MarkSeen(context.Background(), "evt-1"); err == nil {
+		t.Error("MarkSeen() on a closed client succeeded, want its error")
+	}
+}
@@ -0,0 +1,300 @@
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"io"
+	"net"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a Redis server holding strings and sets in memory, speaking just enough
+// RESP2 for the commands the cache adapters send.
+type fakeRedis struct {
+	mu      sync.Mutex
+	strings map[string]string
+	sets    map[string]map[string]bool
+	ttls    map[string]time.Duration // expiry as last set; keys aren't actually expired
+	calls   []string                 // commands run, upper-cased, e.g. "SMEMBERS"
+}
+
+// newFakeRedis starts a fakeRedis and returns a client connected to it.
+func newFakeRedis(t *testing.T) (*fakeRedis, *redis.Client) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeRedis{strings: map[string]string{}, sets: map[string]map[string]bool{}, ttls: map[string]time.Duration{}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+
+	client := redis.NewClient(&redis.Options{Addr: l.Addr().String(), Protocol: 2, DisableIdentity: true})
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = l.Close()
+	})
+	return f, client
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+
+	var queued [][]string // commands of an open MULTI
+	inMulti := false
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+
+		switch name := strings.ToUpper(args[0]); {
+		case name == "MULTI":
+			inMulti, queued = true, nil
+			writeReply(w, status("OK"))
+		case name == "EXEC":
+			replies := make([]interface{}, len(queued))
+			for i, cmd := range queued {
+				replies[i] = f.run(cmd)
+			}
+			inMulti = false
+			writeReply(w, replies)
+		case inMulti:
+			queued = append(queued, args)
+			writeReply(w, status("QUEUED"))
+		default:
+			writeReply(w, f.run(args))
+		}
+
+		if err = w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+type status string
+
+type redisError string
+
+// run executes a command and returns its reply: a status, redisError, int64, string, nil
+// (a null bulk string) or []interface{} of those.
+func (f *fakeRedis) run(args []string) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	name := strings.ToUpper(args[0])
+	f.calls = append(f.calls, name)
+
+	switch name {
+	case "PING":
+		return status("PONG")
+	case "GET":
+		if v, ok := f.strings[args[1]]; ok {
+			return v
+		}
+		return nil
+	case "SET":
+		f.delete(args[1])
+		f.strings[args[1]] = args[2]
+		if len(args) == 5 {
+			n, _ := strconv.Atoi(args[4])
+			switch strings.ToUpper(args[3]) {
+			case "EX":
+				f.ttls[args[1]] = time.Duration(n) * time.Second
+			case "PX":
+				f.ttls[args[1]] = time.Duration(n) * time.Millisecond
+			}
+		}
+		return status("OK")
+	case "EXISTS":
+		var n int64
+		for _, k := range args[1:] {
+			if f.exists(k) {
+				n++
+			}
+		}
+		return n
+	case "DEL":
+		var n int64
+		for _, k := range args[1:] {
+			if f.exists(k) {
+				n++
+			}
+			f.delete(k)
+		}
+		return n
+	case "TYPE":
+		switch {
+		case f.sets[args[1]] != nil:
+			return status("set")
+		case f.exists(args[1]):
+			return status("string")
+		}
+		return status("none")
+	case "SADD":
+		set := f.sets[args[1]]
+		if set == nil {
+			set = map[string]bool{}
+			f.sets[args[1]] = set
+		}
+		var n int64
+		for _, m := range args[2:] {
+			if !set[m] {
+				set[m] = true
+				n++
+			}
+		}
+		return n
+	case "SMEMBERS":
+		var members []interface{}
+		for _, m := range sortedKeys(f.sets[args[1]]) {
+			members = append(members, m)
+		}
+		return members
+	case "EXPIRE":
+		if !f.exists(args[1]) {
+			return int64(0)
+		}
+		n, _ := strconv.Atoi(args[2])
+		f.ttls[args[1]] = time.Duration(n) * time.Second
+		return int64(1)
+	case "SCAN":
+		// the whole keyspace in one page
+		pattern := "*"
+		for i := 2; i+1 < len(args); i += 2 {
+			if strings.ToUpper(args[i]) == "MATCH" {
+				pattern = args[i+1]
+			}
+		}
+		var keys []interface{}
+		for _, k := range f.keys() {
+			if ok, _ := path.Match(pattern, k); ok {
+				keys = append(keys, k)
+			}
+		}
+		return []interface{}{"0", keys}
+	}
+
+	return redisError("ERR unknown command '" + args[0] + "'")
+}
+
+func (f *fakeRedis) exists(key string) bool {
+	_, ok := f.strings[key]
+	return ok || f.sets[key] != nil
+}
+
+func (f *fakeRedis) delete(key string) {
+	delete(f.strings, key)
+	delete(f.sets, key)
+	delete(f.ttls, key)
+}
+
+func (f *fakeRedis) keys() []string {
+	keys := sortedKeys(f.sets)
+	for k := range f.strings {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// has reports whether key holds a value.
+func (f *fakeRedis) has(key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.exists(key)
+}
+
+func (f *fakeRedis) ttl(key string) time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.ttls[key]
+}
+
+func (f *fakeRedis) members(key string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return sortedKeys(f.sets[key])
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil // inline command
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = readLine(r); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimPrefix(line, "$"))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+func writeReply(w *bufio.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case status:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case redisError:
+		fmt.Fprintf(w, "-%s\r\n", v)
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case nil:
+		fmt.Fprint(w, "$-1\r\n")
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, e := range v {
+			writeReply(w, e)
+		}
+	}
+}
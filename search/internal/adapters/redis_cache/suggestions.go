@@ -0,0 +1,48 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"github.com/ziliscite/cqrs_search/internal/domain/product"
+	"github.com/ziliscite/cqrs_search/internal/ports"
+	"time"
+)
+
+// suggestionCache stores suggestions as JSON, each entry expiring after ttl.
+type suggestionCache struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+func NewSuggestionCache(client *redis.Client, ttl time.Duration) ports.SuggestionCache {
+	return &suggestionCache{
+		client: client,
+		ttl:    ttl,
+	}
+}
+
+func (c *suggestionCache) Get(ctx context.Context, key string) ([]product.Suggestion, bool, error) {
+	raw, err := c.client.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil // cache miss
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	var suggestions []product.Suggestion
+	if err = json.Unmarshal(raw, &suggestions); err != nil {
+		return nil, false, err
+	}
+	return suggestions, true, nil
+}
+
+func (c *suggestionCache) Set(ctx context.Context, key string, suggestions []product.Suggestion) error {
+	data, err := json.Marshal(suggestions)
+	if err != nil {
+		return err
+	}
+	return c.client.Set(ctx, key, data, c.ttl).Err()
+}
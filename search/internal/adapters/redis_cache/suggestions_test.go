@@ -0,0 +1,65 @@
+package cache
+
+import (
+	"context"
+	"github.com/ziliscite/cqrs_search/internal/domain/product"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSuggestionCache(t *testing.T) {
+	f, client := newFakeRedis(t)
+	c := NewSuggestionCache(client, time.Minute)
+	ctx := context.Background()
+
+	lapt, err := product.NewSuggest("Lapt", "Electronics", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, ok, err := c.Get(ctx, lapt.Key()); err != nil || ok || got != nil {
+		t.Fatalf("Get() before Set = %v, %v, %v, want a miss", got, ok, err)
+	}
+
+	want := []product.Suggestion{
+		{ID: "a", Name: "Laptop Stand", Category: "Electronics", Score: 2.5},
+		{ID: "b", Name: "Laptop Sleeve", Category: "Electronics", Score: 1.25},
+	}
+	if err = c.Set(ctx, lapt.Key(), want); err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok, err := c.Get(ctx, lapt.Key())
+	if err != nil || !ok || !reflect.DeepEqual(got, want) {
+		t.Errorf("Get() = %v, %v, %v, want %v", got, ok, err, want)
+	}
+	if ttl := f.ttl(lapt.Key()); ttl != time.Minute {
+		t.Errorf("entry expires after %s, want 1m", ttl)
+	}
+
+	// another category's suggestions are another entry
+	other, _ := product.NewSuggest("lapt", "Office", 5)
+	if _, ok, _ = c.Get(ctx, other.Key()); ok {
+		t.Error("Get() for another category hit the cached suggestions")
+	}
+	same, _ := product.NewSuggest("LAPT", "Electronics", 5)
+	if _, ok, _ = c.Get(ctx, same.Key()); !ok {
+		t.Error("Get() for the prefix in another case missed")
+	}
+}
+
+func TestSuggestionCacheKeepsEmptyLists(t *testing.T) {
+	_, client := newFakeRedis(t)
+	c := NewSuggestionCache(client, time.Minute)
+	ctx := context.Background()
+
+	// a prefix nothing completes is worth caching too
+	if err := c.Set(ctx, "suggest:q=zzz|limit=10", []product.Suggestion{}); err != nil {
+		t.Fatal(err)
+	}
+	got, ok, err := c.Get(ctx, "suggest:q=zzz|limit=10")
+	if err != nil || !ok || len(got) != 0 {
+		t.Errorf("Get() = %v, %v, %v, want a hit with no suggestions", got, ok, err)
+	}
+}
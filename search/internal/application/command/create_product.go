@@ -14,9 +14,10 @@ type CreateProductEvent struct {
 	Name     string
 	Category string
 	Price    float64
+	Version  int64
 }
 
-func NewCreateProduct(id, name, category string, price float64) (CreateProductEvent, Errs) {
+func NewCreateProduct(id, name, category string, price float64, version int64) (CreateProductEvent, Errs) {
 	var cp CreateProductEvent
 
 	errs := make(map[string]error)
@@ -36,6 +37,10 @@ func NewCreateProduct(id, name, category string, price float64) (CreateProductEv
 		errs["price"] = errors.New("product price must be greater than zero")
 	}
 
+	if version <= 0 {
+		errs["version"] = errors.New("product version must be greater than zero")
+	}
+
 	if len(errs) > 0 {
 		return cp, errs
 	}
@@ -44,6 +49,7 @@ func NewCreateProduct(id, name, category string, price float64) (CreateProductEv
 	cp.Name = name
 	cp.Category = category
 	cp.Price = price
+	cp.Version = version
 
 	return cp, nil
 }
@@ -67,30 +73,23 @@ func (h *createProductHandler) Handle(ctx context.Context, cmd CreateProductEven
 		return fmt.Errorf("failed to create product: %w", err)
 	}
 	p.SetID(cmd.ID)
+	p.SetVersion(cmd.Version)
 
 	log.Printf("product: %s %s %s $%.2f", p.ID(), p.Name(), p.Category(), p.Price())
 	if err = h.repo.Create(ctx, p); err != nil {
+		if errors.Is(err, product.ErrStale) {
+			// a newer version is already indexed, nothing to invalidate
+			log.Printf("skipping stale create: %v", err)
+			staleEvents.Add(1)
+			return nil
+		}
 		return fmt.Errorf("failed to create product: %w", err)
 	}
 
-	// Invalidate all search-result caches
-	if err = h.ch.InvalidateByKey(ctx, "products:search"); err != nil {
-		return fmt.Errorf("failed to invalidate search cache: %w", err)
-	}
-
-	// Invalidate all tag caches that may be affected by this product
-	tags := p.Tags()
-	if err = h.ch.InvalidateByTags(ctx, tags); err != nil {
+	// Invalidate all tag, paging, sort, min, max caches that may be affected by this product
+	if err = broadInvalidation(p).apply(ctx, h.ch); err != nil {
 		return err
 	}
 
-	// Invalidate all paging, sort, min, max caches
-	patterns := []string{"tag:paging:*", "tag:sort:*", "tag:min:*", "tag:max:*"}
-	for _, tag := range patterns {
-		if err = h.ch.InvalidateTagsByPattern(ctx, tag); err != nil {
-			return err
-		}
-	}
-
 	return nil
 }
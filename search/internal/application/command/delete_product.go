@@ -4,20 +4,30 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/ziliscite/cqrs_search/internal/domain/product"
 	"github.com/ziliscite/cqrs_search/internal/ports"
+	"log"
 )
 
 type DeleteProduct struct {
-	ID string
+	ID      string
+	Version int64
+
+	Last *product.Product // state the product was deleted in, if the event carried it
 }
 
-func NewDeleteProduct(id string) (DeleteProduct, error) {
+func NewDeleteProduct(id string, version int64) (DeleteProduct, error) {
 	var dp DeleteProduct
 	if id == "" {
 		return dp, errors.New("id is required")
 	}
 
+	if version <= 0 {
+		return dp, errors.New("version must be greater than zero")
+	}
+
 	dp.ID = id
+	dp.Version = version
 	return dp, nil
 }
 
@@ -35,7 +45,13 @@ func NewDeleteProductHandler(repo ports.WriteRepository, cache ports.CacheInvali
 }
 
 func (h *deleteProductHandler) Handle(ctx context.Context, cmd DeleteProduct) error {
-	if err := h.repo.Delete(ctx, cmd.ID); err != nil {
+	if err := h.repo.Delete(ctx, cmd.ID, cmd.Version); err != nil {
+		if errors.Is(err, product.ErrStale) {
+			// the product was recreated or changed after this delete
+			log.Printf("skipping stale delete: %v", err)
+			staleEvents.Add(1)
+			return nil
+		}
 		return err
 	}
 
@@ -43,5 +59,5 @@ func (h *deleteProductHandler) Handle(ctx context.Context, cmd DeleteProduct) er
 		return err
 	}
 
-	return nil
+	return deleteInvalidation(cmd.ID, cmd.Last).apply(ctx, h.ch)
 }
@@ -0,0 +1,79 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"github.com/ziliscite/cqrs_search/internal/domain/product"
+	"github.com/ziliscite/cqrs_search/internal/ports"
+)
+
+// invalidation is the set of cached search results a change can have made stale.
+type invalidation struct {
+	tags     []string
+	patterns []string // tag patterns, for results whose membership can't be known from a tag
+}
+
+// broadInvalidation covers any result the product can have entered or left, for events
+// that don't say what they changed.
+func broadInvalidation(p *product.Product) invalidation {
+	return invalidation{
+		tags:     p.Tags(),
+		patterns: []string{"tag:paging:*", "tag:sort:*", "tag:min:*", "tag:max:*", "tag:range:*"},
+	}
+}
+
+// updateInvalidation covers the results that showed the product, and those whose filter or
+// order depends on a changed field. Without the previous state it falls back to broadInvalidation.
+func updateInvalidation(p, prev *product.Product, changed []string) invalidation {
+	if prev == nil {
+		return broadInvalidation(p)
+	}
+
+	inv := invalidation{tags: []string{product.ProductTag(p.ID())}}
+	for _, field := range changed {
+		switch field {
+		case "category":
+			inv.tags = append(inv.tags, product.CategoryTag(prev.Category()), product.CategoryTag(p.Category()), product.CategoryFacetTag, product.QueryTag)
+			inv.patterns = append(inv.patterns, "tag:sort:category-*")
+		case "name":
+			// any name search may match the new name
+			inv.tags = append(inv.tags, product.QueryTag)
+			inv.patterns = append(inv.patterns, "tag:name:*", "tag:sort:name-*")
+		case "price":
+			inv.tags = append(inv.tags, product.PriceFacetTag, product.QueryTag)
+			inv.patterns = append(inv.patterns, "tag:min:*", "tag:max:*", "tag:range:*", "tag:sort:price-*")
+		default:
+			return broadInvalidation(p)
+		}
+	}
+
+	return inv
+}
+
+// deleteInvalidation covers the results that showed the product, every facet count, and the
+// later pages of any listing it was in, which shift up once it is gone. Its last state narrows
+// the filtered listings down, but paged, sorted and price-filtered ones can't be told apart.
+func deleteInvalidation(id string, last *product.Product) invalidation {
+	inv := invalidation{
+		tags:     []string{product.ProductTag(id), product.CategoryFacetTag, product.PriceFacetTag, product.QueryTag},
+		patterns: []string{"tag:paging:*", "tag:sort:*", "tag:min:*", "tag:max:*", "tag:range:*"},
+	}
+	if last != nil {
+		inv.tags = append(inv.tags, product.CategoryTag(last.Category()), product.NameTag(last.Name()))
+	}
+	return inv
+}
+
+func (inv invalidation) apply(ctx context.Context, ch ports.CacheInvalidator) error {
+	if err := ch.InvalidateByTags(ctx, inv.tags); err != nil {
+		return fmt.Errorf("failed to invalidate cache tags: %w", err)
+	}
+
+	for _, pattern := range inv.patterns {
+		if err := ch.InvalidateTagsByPattern(ctx, pattern); err != nil {
+			return fmt.Errorf("failed to invalidate cache tags %s: %w", pattern, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,35 @@
+package command
+
+import "expvar"
+
+// staleEvents counts events skipped because a newer version of the product was already applied.
+var staleEvents = expvar.NewInt("search_stale_events_total")
+
+var (
+	reconcileRuns     = expvar.NewInt("search_reconcile_runs_total")
+	reconcileRepaired = expvar.NewInt("search_reconcile_repaired_total")
+	reconcileFailed   = expvar.NewInt("search_reconcile_failed_total")
+	// drift found by the last reconciliation run, by kind
+	reconcileDrift = expvar.NewMap("search_reconcile_drift")
+	// unix time the last reconciliation run finished
+	reconcileLastRun = expvar.NewInt("search_reconcile_last_run_timestamp")
+)
+
+func recordReconcile(r *ReconcileReport) {
+	reconcileRuns.Add(1)
+	reconcileRepaired.Add(int64(r.Repaired))
+	reconcileFailed.Add(int64(r.Failed))
+
+	for kind, d := range map[string]Drift{
+		"missing":    r.Missing,
+		"extra":      r.Extra,
+		"stale":      r.Stale,
+		"mismatched": r.Mismatched,
+	} {
+		v := new(expvar.Int)
+		v.Set(int64(d.Count))
+		reconcileDrift.Set(kind, v)
+	}
+
+	reconcileLastRun.Set(r.FinishedAt.Unix())
+}
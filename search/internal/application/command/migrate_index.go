@@ -0,0 +1,63 @@
+package command
+
+import (
+	"context"
+	"github.com/ziliscite/cqrs_search/internal/ports"
+	"log"
+)
+
+// MigrateIndexHandler moves the search index to the latest mapping version: it reindexes the
+// live index into a new one while live writes go to both, then swaps the alias over.
+type MigrateIndexHandler interface {
+	Handle(ctx context.Context) error
+}
+
+type migrateIndexHandler struct {
+	proj ports.Projection
+	ch   ports.CacheInvalidator
+}
+
+func NewMigrateIndexHandler(proj ports.Projection, cache ports.CacheInvalidator) MigrateIndexHandler {
+	return &migrateIndexHandler{proj: proj, ch: cache}
+}
+
+func (h *migrateIndexHandler) Handle(ctx context.Context) (err error) {
+	deployed, latest, err := h.proj.Versions(ctx)
+	if err != nil {
+		return err
+	}
+
+	if deployed >= latest {
+		log.Printf("index is at mapping v%d, nothing to migrate", deployed)
+		return nil
+	}
+
+	index, err := h.proj.Prepare(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("migrating from mapping v%d to v%d into %s", deployed, latest, index)
+
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		if dropErr := h.proj.Drop(context.WithoutCancel(ctx), index); dropErr != nil {
+			log.Printf("failed to drop %s: %v", index, dropErr)
+		}
+	}()
+
+	n, err := h.proj.Reindex(ctx, index)
+	if err != nil {
+		return err
+	}
+	log.Printf("reindexed %d products", n)
+
+	if err = h.proj.Promote(ctx, index); err != nil {
+		return err
+	}
+	log.Printf("promoted %s", index)
+
+	return h.ch.InvalidateTagsByPattern(ctx, "tag:*")
+}
@@ -0,0 +1,87 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"github.com/ziliscite/cqrs_search/internal/ports"
+	"log"
+)
+
+type RebuildProjection struct {
+	BatchSize int
+}
+
+func NewRebuildProjection(batchSize int) (RebuildProjection, error) {
+	var rp RebuildProjection
+	if batchSize <= 0 {
+		return rp, errors.New("batch size must be greater than zero")
+	}
+
+	rp.BatchSize = batchSize
+	return rp, nil
+}
+
+// RebuildProjectionHandler repopulates the search index from the product service and
+// swaps it in for the live one, while live events keep being applied.
+type RebuildProjectionHandler interface {
+	Handle(ctx context.Context, cmd RebuildProjection) error
+}
+
+type rebuildProjectionHandler struct {
+	src  ports.ProductSource
+	proj ports.Projection
+	ch   ports.CacheInvalidator
+}
+
+func NewRebuildProjectionHandler(src ports.ProductSource, proj ports.Projection, cache ports.CacheInvalidator) RebuildProjectionHandler {
+	return &rebuildProjectionHandler{src: src, proj: proj, ch: cache}
+}
+
+func (h *rebuildProjectionHandler) Handle(ctx context.Context, cmd RebuildProjection) (err error) {
+	index, err := h.proj.Prepare(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("rebuilding into %s", index)
+
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		if dropErr := h.proj.Drop(context.WithoutCancel(ctx), index); dropErr != nil {
+			log.Printf("failed to drop %s: %v", index, dropErr)
+		}
+	}()
+
+	var after string
+	var exported, indexed int
+	for {
+		products, next, err := h.src.Export(ctx, after, cmd.BatchSize)
+		if err != nil {
+			return err
+		}
+
+		n, err := h.proj.Load(ctx, index, products)
+		if err != nil {
+			return err
+		}
+
+		exported += len(products)
+		indexed += n
+		log.Printf("loaded %d/%d products", indexed, exported)
+
+		if next == "" {
+			break
+		}
+		after = next
+	}
+
+	if err = h.proj.Promote(ctx, index); err != nil {
+		return err
+	}
+	log.Printf("promoted %s with %d products", index, indexed)
+
+	// every cached search may have been answered by the old index
+	return h.ch.InvalidateTagsByPattern(ctx, "tag:*")
+}
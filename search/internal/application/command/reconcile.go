@@ -0,0 +1,274 @@
+package command
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/ziliscite/cqrs_search/internal/domain/product"
+	"github.com/ziliscite/cqrs_search/internal/ports"
+	"log"
+	"strconv"
+	"time"
+)
+
+// confirmBatch bounds how many suspected differences are re-read at once.
+const confirmBatch = 100
+
+// sampleSize bounds the product IDs listed per kind of drift in a report.
+const sampleSize = 20
+
+type Reconcile struct {
+	Repair    bool // fix the differences found, not just report them
+	BatchSize int
+}
+
+func NewReconcile(repair bool, batchSize int) (Reconcile, error) {
+	var rc Reconcile
+	if batchSize <= 0 {
+		return rc, errors.New("batch size must be greater than zero")
+	}
+
+	rc.Repair = repair
+	rc.BatchSize = batchSize
+	return rc, nil
+}
+
+// Drift counts products of one kind of difference, with a sample of their IDs.
+type Drift struct {
+	Count int      `json:"count"`
+	IDs   []string `json:"ids,omitempty"`
+}
+
+func (d *Drift) add(id string) {
+	d.Count++
+	if len(d.IDs) < sampleSize {
+		d.IDs = append(d.IDs, id)
+	}
+}
+
+type ReconcileReport struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Repair     bool      `json:"repair"`
+	Checked    int       `json:"checked"`
+	Missing    Drift     `json:"missing"`    // in the product service, not indexed
+	Extra      Drift     `json:"extra"`      // indexed, no longer in the product service
+	Stale      Drift     `json:"stale"`      // indexed at an older version
+	Mismatched Drift     `json:"mismatched"` // indexed at the same or a later version, with different content
+	Repaired   int       `json:"repaired"`
+	Failed     int       `json:"failed"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// ReconcileHandler walks the product service and the search index side by side in ID order
+// and reports where they disagree, optionally repairing the index from the product service.
+//
+// Both sides are read page by page while events keep being applied, so a difference found
+// by the walk is re-read from both sides before it is counted; one that has settled in the
+// meantime was just an event in flight.
+type ReconcileHandler interface {
+	Handle(ctx context.Context, cmd Reconcile) (ReconcileReport, error)
+}
+
+type reconcileHandler struct {
+	src  ports.ProductSource
+	idx  ports.IndexStore
+	repo ports.Repository
+	ch   ports.CacheInvalidator
+}
+
+func NewReconcileHandler(src ports.ProductSource, idx ports.IndexStore, repo ports.Repository, cache ports.CacheInvalidator) ReconcileHandler {
+	return &reconcileHandler{src: src, idx: idx, repo: repo, ch: cache}
+}
+
+func (h *reconcileHandler) Handle(ctx context.Context, cmd Reconcile) (ReconcileReport, error) {
+	report := ReconcileReport{StartedAt: time.Now().UTC(), Repair: cmd.Repair}
+
+	err := h.walk(ctx, cmd, &report)
+	report.FinishedAt = time.Now().UTC()
+	if err != nil {
+		report.Error = err.Error()
+	}
+
+	recordReconcile(&report)
+	return report, err
+}
+
+func (h *reconcileHandler) walk(ctx context.Context, cmd Reconcile, report *ReconcileReport) error {
+	source := &cursor{fetch: h.src.Export, limit: cmd.BatchSize}
+	index := &cursor{fetch: h.idx.Scan, limit: cmd.BatchSize}
+
+	var suspects []string
+	for {
+		s, err := source.peek(ctx)
+		if err != nil {
+			return err
+		}
+
+		i, err := index.peek(ctx)
+		if err != nil {
+			return err
+		}
+
+		if s == nil && i == nil {
+			break
+		}
+
+		switch {
+		case i == nil || (s != nil && s.ID() < i.ID()):
+			suspects = append(suspects, s.ID())
+			source.pop()
+		case s == nil || i.ID() < s.ID():
+			suspects = append(suspects, i.ID())
+			index.pop()
+		default:
+			if !same(s, i) {
+				suspects = append(suspects, s.ID())
+			}
+			source.pop()
+			index.pop()
+		}
+		report.Checked++
+
+		if len(suspects) >= confirmBatch {
+			if err = h.confirm(ctx, cmd, suspects, report); err != nil {
+				return err
+			}
+			suspects = suspects[:0]
+		}
+	}
+
+	return h.confirm(ctx, cmd, suspects, report)
+}
+
+// confirm re-reads the suspected products from both sides, records those that still
+// differ and repairs them if asked to.
+func (h *reconcileHandler) confirm(ctx context.Context, cmd Reconcile, ids []string, report *ReconcileReport) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	current, err := h.src.Lookup(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	truth := make(map[string]*product.Product, len(current))
+	for i := range current {
+		truth[current[i].ID()] = &current[i]
+	}
+
+	for _, id := range ids {
+		indexed, err := h.repo.GetByID(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		var (
+			repair func() error
+			inv    invalidation // the cached searches the repair can change
+		)
+		want := truth[id]
+		switch {
+		case want == nil && indexed == nil:
+			continue
+		case want == nil:
+			report.Extra.add(id)
+			// the product service doesn't know the delete's version; one past the indexed one removes it
+			repair = func() error { return h.repo.Delete(ctx, id, indexed.Version()+1) }
+			inv = deleteInvalidation(id, indexed)
+		case indexed == nil:
+			report.Missing.add(id)
+			repair = func() error { return h.repo.Create(ctx, want) }
+			inv = broadInvalidation(want)
+		case indexed.Version() < want.Version():
+			report.Stale.add(id)
+			repair = func() error { return h.repo.Update(ctx, want) }
+			inv = updateInvalidation(want, indexed, changed(indexed, want))
+		case !same(want, indexed):
+			report.Mismatched.add(id)
+			repair = func() error { return h.idx.Overwrite(ctx, want) }
+			inv = updateInvalidation(want, indexed, changed(indexed, want))
+		default:
+			continue
+		}
+
+		if !cmd.Repair {
+			continue
+		}
+
+		if err = repair(); err != nil {
+			log.Printf("failed to repair %s: %v", id, err)
+			report.Failed++
+			continue
+		}
+		report.Repaired++
+
+		if err = h.ch.InvalidateByKey(ctx, fmt.Sprintf("product:%s", id)); err != nil {
+			log.Printf("failed to invalidate %s: %v", id, err)
+		}
+
+		if err = inv.apply(ctx, h.ch); err != nil {
+			log.Printf("failed to invalidate searches affected by %s: %v", id, err)
+		}
+	}
+
+	return nil
+}
+
+// same reports whether a and b are at the same version with the same content.
+func same(a, b *product.Product) bool {
+	return a.Version() == b.Version() && checksum(a) == checksum(b)
+}
+
+// changed lists the fields whose values differ between prev and p, like an update event's.
+func changed(prev, p *product.Product) []string {
+	var fields []string
+	if prev.Name() != p.Name() {
+		fields = append(fields, "name")
+	}
+	if prev.Price() != p.Price() {
+		fields = append(fields, "price")
+	}
+	if prev.Category() != p.Category() {
+		fields = append(fields, "category")
+	}
+	return fields
+}
+
+func checksum(p *product.Product) [sha256.Size]byte {
+	return sha256.Sum256([]byte(p.Name() + "\x00" + p.Category() + "\x00" + strconv.FormatFloat(p.Price(), 'f', -1, 64)))
+}
+
+// cursor reads pages of products in ID order from fetch, one product at a time.
+type cursor struct {
+	fetch func(ctx context.Context, after string, limit int) ([]product.Product, string, error)
+	limit int
+
+	page    []product.Product
+	next    string
+	started bool
+}
+
+// peek returns the current product, or nil once there are no more.
+func (c *cursor) peek(ctx context.Context) (*product.Product, error) {
+	for len(c.page) == 0 {
+		if c.started && c.next == "" {
+			return nil, nil
+		}
+
+		page, next, err := c.fetch(ctx, c.next, c.limit)
+		if err != nil {
+			return nil, err
+		}
+
+		c.page, c.next, c.started = page, next, true
+	}
+
+	return &c.page[0], nil
+}
+
+func (c *cursor) pop() {
+	c.page = c.page[1:]
+}
@@ -0,0 +1,456 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ziliscite/cqrs_search/internal/domain/product"
+	"slices"
+	"sort"
+	"testing"
+)
+
+func item(t *testing.T, id, name, category string, price float64, version int64) product.Product {
+	t.Helper()
+	p, err := product.New(name, category, price)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetID(id)
+	p.SetVersion(version)
+	return *p
+}
+
+// page returns up to limit of products, which are in ID order, after the given ID, and the
+// cursor of the next page, like ports.ProductSource.Export.
+func page(products []product.Product, after string, limit int) ([]product.Product, string) {
+	i := sort.Search(len(products), func(i int) bool { return products[i].ID() > after })
+	end := min(i+limit, len(products))
+
+	next := ""
+	if end < len(products) {
+		next = products[end-1].ID()
+	}
+	return slices.Clone(products[i:end]), next
+}
+
+// fakeSource is the product service: products is what an export walks, current what a
+// lookup sees, which lets a test change a product while the walk is under way.
+type fakeSource struct {
+	products []product.Product
+	current  []product.Product // defaults to products
+	lookups  [][]string
+}
+
+func (s *fakeSource) Export(_ context.Context, after string, limit int) ([]product.Product, string, error) {
+	p, next := page(s.products, after, limit)
+	return p, next, nil
+}
+
+func (s *fakeSource) Lookup(_ context.Context, ids []string) ([]product.Product, error) {
+	s.lookups = append(s.lookups, slices.Clone(ids))
+
+	current := s.current
+	if current == nil {
+		current = s.products
+	}
+
+	var found []product.Product
+	for _, p := range current {
+		if slices.Contains(ids, p.ID()) {
+			found = append(found, p)
+		}
+	}
+	return found, nil
+}
+
+// fakeIndex is the search index, both as the walk scans it and as the repair writes to it.
+type fakeIndex struct {
+	scanned []product.Product           // what a scan walks
+	docs    map[string]*product.Product // what GetByID sees
+	writes  []string                    // "create a@1", "update a@2", "delete a@3", "overwrite a@2"
+	fail    error                       // returned by every write, if set
+}
+
+func newFakeIndex(products ...product.Product) *fakeIndex {
+	idx := &fakeIndex{scanned: products, docs: map[string]*product.Product{}}
+	for i := range products {
+		idx.docs[products[i].ID()] = &products[i]
+	}
+	return idx
+}
+
+func (x *fakeIndex) Scan(_ context.Context, after string, limit int) ([]product.Product, string, error) {
+	p, next := page(x.scanned, after, limit)
+	return p, next, nil
+}
+
+func (x *fakeIndex) write(kind string, p *product.Product) error {
+	x.writes = append(x.writes, fmt.Sprintf("%s %s@%d", kind, p.ID(), p.Version()))
+	return x.fail
+}
+
+func (x *fakeIndex) Overwrite(_ context.Context, p *product.Product) error {
+	return x.write("overwrite", p)
+}
+
+func (x *fakeIndex) Create(_ context.Context, p *product.Product) error { return x.write("create", p) }
+
+func (x *fakeIndex) Update(_ context.Context, p *product.Product) error { return x.write("update", p) }
+
+func (x *fakeIndex) Delete(_ context.Context, id string, version int64) error {
+	x.writes = append(x.writes, fmt.Sprintf("delete %s@%d", id, version))
+	return x.fail
+}
+
+func (x *fakeIndex) GetByID(_ context.Context, id string) (*product.Product, error) {
+	return x.docs[id], nil
+}
+
+func (x *fakeIndex) Search(context.Context, *product.Search) (*product.Result, error) {
+	return nil, errors.New("not used by reconciliation")
+}
+
+func (x *fakeIndex) Suggest(context.Context, *product.Suggest) ([]product.Suggestion, error) {
+	return nil, errors.New("not used by reconciliation")
+}
+
+func (x *fakeIndex) AppliedVersion(context.Context, string) (int64, error) {
+	return 0, errors.New("not used by reconciliation")
+}
+
+// fakeCache records what was invalidated.
+type fakeCache struct {
+	keys     []string
+	tags     []string
+	patterns []string
+}
+
+func (c *fakeCache) InvalidateByKey(_ context.Context, key string) error {
+	c.keys = append(c.keys, key)
+	return nil
+}
+
+func (c *fakeCache) InvalidateByTags(_ context.Context, tags []string) error {
+	c.tags = append(c.tags, tags...)
+	return nil
+}
+
+func (c *fakeCache) InvalidateTagsByPattern(_ context.Context, pattern string) error {
+	c.patterns = append(c.patterns, pattern)
+	return nil
+}
+
+func reconcile(t *testing.T, src *fakeSource, idx *fakeIndex, ch *fakeCache, repair bool, batch int) ReconcileReport {
+	t.Helper()
+
+	cmd, err := NewReconcile(repair, batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := NewReconcileHandler(src, idx, idx, ch).Handle(context.Background(), cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestCursorPages(t *testing.T) {
+	products := []product.Product{
+		item(t, "a", "Shoe", "shoes", 10, 1),
+		item(t, "b", "Shoe", "shoes", 10, 1),
+		item(t, "c", "Shoe", "shoes", 10, 1),
+		item(t, "d", "Shoe", "shoes", 10, 1),
+		item(t, "e", "Shoe", "shoes", 10, 1),
+	}
+
+	tests := []struct {
+		name   string
+		limit  int
+		fetch  func(after string, limit int) ([]product.Product, string)
+		afters []string // cursors fetched with
+		want   []string
+	}{
+		{"pages", 2, func(after string, limit int) ([]product.Product, string) {
+			return page(products, after, limit)
+		}, []string{"", "b", "d"}, []string{"a", "b", "c", "d", "e"}},
+		{"one page", 10, func(after string, limit int) ([]product.Product, string) {
+			return page(products, after, limit)
+		}, []string{""}, []string{"a", "b", "c", "d", "e"}},
+		{"empty", 2, func(string, int) ([]product.Product, string) {
+			return nil, ""
+		}, []string{""}, nil},
+		{"an empty page with more to come", 2, func(after string, limit int) ([]product.Product, string) {
+			// e.g. every product on the page was filtered out
+			if after == "" {
+				return nil, "b"
+			}
+			return page(products, after, limit)
+		}, []string{"", "b", "d"}, []string{"c", "d", "e"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var afters []string
+			c := &cursor{limit: tt.limit, fetch: func(_ context.Context, after string, limit int) ([]product.Product, string, error) {
+				if limit != tt.limit {
+					t.Errorf("fetched %d, want the cursor's limit %d", limit, tt.limit)
+				}
+				afters = append(afters, after)
+				p, next := tt.fetch(after, limit)
+				return p, next, nil
+			}}
+
+			var got []string
+			for {
+				p, err := c.peek(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if p == nil {
+					break
+				}
+				got = append(got, p.ID())
+				c.pop()
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("walked %v, want %v", got, tt.want)
+			}
+			if !slices.Equal(afters, tt.afters) {
+				t.Errorf("fetched after %q, want %q", afters, tt.afters)
+			}
+
+			// the end is sticky: nothing more is fetched
+			if p, err := c.peek(context.Background()); p != nil || err != nil {
+				t.Errorf("peek() past the end = %v, %v", p, err)
+			}
+			if len(afters) != len(tt.afters) {
+				t.Errorf("fetched again past the end")
+			}
+		})
+	}
+}
+
+func TestCursorReportsFetchErrors(t *testing.T) {
+	failed := errors.New("product service unavailable")
+	c := &cursor{limit: 2, fetch: func(context.Context, string, int) ([]product.Product, string, error) {
+		return nil, "", failed
+	}}
+
+	if _, err := c.peek(context.Background()); !errors.Is(err, failed) {
+		t.Errorf("peek() = %v, want %v", err, failed)
+	}
+}
+
+func TestReconcileClassifiesDrift(t *testing.T) {
+	tests := []struct {
+		name     string
+		source   []product.Product
+		index    []product.Product
+		checked  int
+		missing  []string
+		extra    []string
+		stale    []string
+		mismatch []string
+	}{
+		{
+			name:    "in sync",
+			source:  []product.Product{item(t, "a", "Shoe", "shoes", 10, 1), item(t, "b", "Boot", "boots", 20, 3)},
+			index:   []product.Product{item(t, "a", "Shoe", "shoes", 10, 1), item(t, "b", "Boot", "boots", 20, 3)},
+			checked: 2,
+		},
+		{
+			name:    "interleaved",
+			source:  []product.Product{item(t, "a", "Shoe", "shoes", 10, 1), item(t, "c", "Sock", "socks", 5, 1), item(t, "e", "Hat", "hats", 15, 1)},
+			index:   []product.Product{item(t, "b", "Boot", "boots", 20, 1), item(t, "c", "Sock", "socks", 5, 1), item(t, "d", "Cap", "hats", 12, 1)},
+			checked: 5,
+			missing: []string{"a", "e"},
+			extra:   []string{"b", "d"},
+		},
+		{
+			name:    "index empty",
+			source:  []product.Product{item(t, "a", "Shoe", "shoes", 10, 1), item(t, "b", "Boot", "boots", 20, 1)},
+			checked: 2,
+			missing: []string{"a", "b"},
+		},
+		{
+			name:    "source empty",
+			index:   []product.Product{item(t, "a", "Shoe", "shoes", 10, 1)},
+			checked: 1,
+			extra:   []string{"a"},
+		},
+		{
+			name:    "stale",
+			source:  []product.Product{item(t, "a", "Shoe", "shoes", 12, 2)},
+			index:   []product.Product{item(t, "a", "Shoe", "shoes", 10, 1)},
+			checked: 1,
+			stale:   []string{"a"},
+		},
+		{
+			name:     "same version, different content",
+			source:   []product.Product{item(t, "a", "Shoe", "shoes", 12, 2)},
+			index:    []product.Product{item(t, "a", "Shoe", "shoes", 10, 2)},
+			checked:  1,
+			mismatch: []string{"a"},
+		},
+		{
+			name:     "indexed ahead, different content",
+			source:   []product.Product{item(t, "a", "Shoe", "shoes", 12, 2)},
+			index:    []product.Product{item(t, "a", "Shoe", "shoes", 10, 3)},
+			checked:  1,
+			mismatch: []string{"a"},
+		},
+	}
+
+	for _, tt := range tests {
+		for _, batch := range []int{1, 2, 100} {
+			t.Run(fmt.Sprintf("%s/batch %d", tt.name, batch), func(t *testing.T) {
+				idx := newFakeIndex(tt.index...)
+				report := reconcile(t, &fakeSource{products: tt.source}, idx, &fakeCache{}, false, batch)
+
+				if report.Checked != tt.checked {
+					t.Errorf("checked %d, want %d", report.Checked, tt.checked)
+				}
+				for kind, d := range map[string]struct {
+					got  Drift
+					want []string
+				}{
+					"missing":    {report.Missing, tt.missing},
+					"extra":      {report.Extra, tt.extra},
+					"stale":      {report.Stale, tt.stale},
+					"mismatched": {report.Mismatched, tt.mismatch},
+				} {
+					if d.got.Count != len(d.want) || !slices.Equal(d.got.IDs, d.want) {
+						t.Errorf("%s %d %v, want %v", kind, d.got.Count, d.got.IDs, d.want)
+					}
+				}
+
+				if len(idx.writes) > 0 {
+					t.Errorf("wrote %v without repair", idx.writes)
+				}
+			})
+		}
+	}
+}
+
+func TestReconcileIgnoresDriftThatSettles(t *testing.T) {
+	// the walk sees a at version 2 in the product service and version 1 indexed, but by
+	// the time it is re-read the event has landed; b was created and indexed meanwhile
+	src := &fakeSource{
+		products: []product.Product{item(t, "a", "Shoe", "shoes", 12, 2)},
+		current:  []product.Product{item(t, "a", "Shoe", "shoes", 12, 2), item(t, "b", "Boot", "boots", 20, 1)},
+	}
+	idx := newFakeIndex(item(t, "a", "Shoe", "shoes", 10, 1), item(t, "b", "Boot", "boots", 20, 1))
+	applied := item(t, "a", "Shoe", "shoes", 12, 2)
+	idx.docs["a"] = &applied
+
+	report := reconcile(t, src, idx, &fakeCache{}, true, 10)
+
+	if report.Stale.Count+report.Extra.Count+report.Missing.Count+report.Mismatched.Count != 0 {
+		t.Errorf("report %+v, want no drift once both sides are re-read", report)
+	}
+	if len(idx.writes) > 0 {
+		t.Errorf("repaired %v, want nothing", idx.writes)
+	}
+	if len(src.lookups) != 1 || !slices.Equal(src.lookups[0], []string{"a", "b"}) {
+		t.Errorf("looked up %v, want the suspects a and b", src.lookups)
+	}
+}
+
+func TestReconcileConfirmsInBatches(t *testing.T) {
+	var source []product.Product
+	for i := range confirmBatch + 5 {
+		source = append(source, item(t, fmt.Sprintf("p%04d", i), "Shoe", "shoes", 10, 1))
+	}
+	src := &fakeSource{products: source}
+
+	report := reconcile(t, src, newFakeIndex(), &fakeCache{}, false, 50)
+
+	if report.Missing.Count != confirmBatch+5 || len(report.Missing.IDs) != sampleSize {
+		t.Errorf("missing %d with %d sampled, want %d with %d", report.Missing.Count, len(report.Missing.IDs), confirmBatch+5, sampleSize)
+	}
+	if len(src.lookups) != 2 || len(src.lookups[0]) != confirmBatch || len(src.lookups[1]) != 5 {
+		t.Errorf("looked up %d batches, want %d then 5 suspects", len(src.lookups), confirmBatch)
+	}
+}
+
+func TestReconcileRepairs(t *testing.T) {
+	tests := []struct {
+		name     string
+		source   []product.Product
+		index    []product.Product
+		write    string
+		tags     []string // invalidated, besides the product's key
+		patterns []string
+	}{
+		{
+			name:     "extra: deleted one past the indexed version",
+			index:    []product.Product{item(t, "a", "Shoe", "shoes", 10, 4)},
+			write:    "delete a@5",
+			tags:     []string{product.ProductTag("a"), product.CategoryFacetTag, product.PriceFacetTag, product.QueryTag, product.CategoryTag("shoes"), product.NameTag("Shoe")},
+			patterns: []string{"tag:paging:*", "tag:sort:*", "tag:min:*", "tag:max:*", "tag:range:*"},
+		},
+		{
+			name:     "missing",
+			source:   []product.Product{item(t, "a", "Shoe", "shoes", 10, 1)},
+			write:    "create a@1",
+			tags:     []string{product.ProductTag("a"), product.CategoryTag("shoes"), product.NameTag("Shoe")},
+			patterns: []string{"tag:paging:*", "tag:sort:*", "tag:min:*", "tag:max:*", "tag:range:*"},
+		},
+		{
+			name:     "stale",
+			source:   []product.Product{item(t, "a", "Shoe", "boots", 10, 2)},
+			index:    []product.Product{item(t, "a", "Shoe", "shoes", 10, 1)},
+			write:    "update a@2",
+			tags:     []string{product.ProductTag("a"), product.CategoryTag("shoes"), product.CategoryTag("boots"), product.CategoryFacetTag, product.QueryTag},
+			patterns: []string{"tag:sort:category-*"},
+		},
+		{
+			name:     "mismatched",
+			source:   []product.Product{item(t, "a", "Shoe", "shoes", 12, 2)},
+			index:    []product.Product{item(t, "a", "Shoe", "shoes", 10, 2)},
+			write:    "overwrite a@2",
+			tags:     []string{product.ProductTag("a"), product.PriceFacetTag, product.QueryTag},
+			patterns: []string{"tag:min:*", "tag:max:*", "tag:range:*", "tag:sort:price-*"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idx, ch := newFakeIndex(tt.index...), &fakeCache{}
+			report := reconcile(t, &fakeSource{products: tt.source}, idx, ch, true, 10)
+
+			if report.Repaired != 1 || report.Failed != 0 {
+				t.Errorf("repaired %d, failed %d, want 1 and 0", report.Repaired, report.Failed)
+			}
+			if !slices.Equal(idx.writes, []string{tt.write}) {
+				t.Errorf("wrote %v, want [%s]", idx.writes, tt.write)
+			}
+			if !slices.Equal(ch.keys, []string{"product:a"}) {
+				t.Errorf("invalidated keys %v, want [product:a]", ch.keys)
+			}
+			if !slices.Equal(ch.tags, tt.tags) {
+				t.Errorf("invalidated tags %v, want %v", ch.tags, tt.tags)
+			}
+			if !slices.Equal(ch.patterns, tt.patterns) {
+				t.Errorf("invalidated patterns %v, want %v", ch.patterns, tt.patterns)
+			}
+		})
+	}
+}
+
+func TestReconcileCountsFailedRepairs(t *testing.T) {
+	idx, ch := newFakeIndex(item(t, "a", "Shoe", "shoes", 10, 1)), &fakeCache{}
+	idx.fail = errors.New("elasticsearch unavailable")
+
+	report := reconcile(t, &fakeSource{products: []product.Product{item(t, "b", "Boot", "boots", 20, 1)}}, idx, ch, true, 10)
+
+	if report.Repaired != 0 || report.Failed != 2 {
+		t.Errorf("repaired %d, failed %d, want 0 and 2", report.Repaired, report.Failed)
+	}
+	if len(ch.keys)+len(ch.tags)+len(ch.patterns) > 0 {
+		t.Errorf("invalidated %v %v %v after failed repairs, want nothing", ch.keys, ch.tags, ch.patterns)
+	}
+}
@@ -0,0 +1,38 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"github.com/ziliscite/cqrs_search/internal/ports"
+	"log"
+)
+
+// ReloadAnalyzersHandler applies an edited synonyms file to the live index. Cached search
+// results were matched with the old synonyms, so they are dropped.
+type ReloadAnalyzersHandler interface {
+	Handle(ctx context.Context) ([]string, error)
+}
+
+type reloadAnalyzersHandler struct {
+	an ports.Analyzers
+	ch ports.CacheInvalidator
+}
+
+func NewReloadAnalyzersHandler(analyzers ports.Analyzers, cache ports.CacheInvalidator) ReloadAnalyzersHandler {
+	return &reloadAnalyzersHandler{an: analyzers, ch: cache}
+}
+
+func (h *reloadAnalyzersHandler) Handle(ctx context.Context) ([]string, error) {
+	reloaded, err := h.an.ReloadSearchAnalyzers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("reloaded search analyzers %v", reloaded)
+
+	// every cached search result is tagged with its page
+	if err = h.ch.InvalidateTagsByPattern(ctx, "tag:paging:*"); err != nil {
+		return nil, fmt.Errorf("failed to invalidate search cache: %w", err)
+	}
+
+	return reloaded, nil
+}
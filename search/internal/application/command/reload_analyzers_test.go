@@ -0,0 +1,62 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+)
+
+// fakeAnalyzers reloads the analyzers in reloaded, or fails with err.
+type fakeAnalyzers struct {
+	reloaded []string
+	err      error
+}
+
+func (a *fakeAnalyzers) ReloadSearchAnalyzers(context.Context) ([]string, error) {
+	return a.reloaded, a.err
+}
+
+// failingCache is a cache invalidator that is down.
+type failingCache struct {
+	fakeCache
+	err error
+}
+
+func (c *failingCache) InvalidateTagsByPattern(context.Context, string) error {
+	return c.err
+}
+
+func TestReloadAnalyzersDropsCachedResults(t *testing.T) {
+	ch := &fakeCache{}
+	h := NewReloadAnalyzersHandler(&fakeAnalyzers{reloaded: []string{"product_name_search"}}, ch)
+
+	got, err := h.Handle(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, []string{"product_name_search"}) {
+		t.Errorf("Handle() = %v, want the reloaded analyzers", got)
+	}
+	// results matched with the old synonyms
+	if !slices.Equal(ch.patterns, []string{"tag:paging:*"}) {
+		t.Errorf("invalidated %v, want every cached search result", ch.patterns)
+	}
+}
+
+func TestReloadAnalyzersErrors(t *testing.T) {
+	failed := errors.New("elasticsearch unavailable")
+	ch := &fakeCache{}
+	if _, err := NewReloadAnalyzersHandler(&fakeAnalyzers{err: failed}, ch).Handle(context.Background()); !errors.Is(err, failed) {
+		t.Errorf("Handle() = %v, want the reload's error", err)
+	}
+	if len(ch.patterns) > 0 {
+		t.Error("cache dropped though nothing was reloaded")
+	}
+
+	down := errors.New("redis unavailable")
+	_, err := NewReloadAnalyzersHandler(&fakeAnalyzers{reloaded: []string{"product_name_search"}}, &failingCache{err: down}).Handle(context.Background())
+	if !errors.Is(err, down) {
+		t.Errorf("Handle() = %v, want the cache's error: results from the old synonyms would linger", err)
+	}
+}
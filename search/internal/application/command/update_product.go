@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/ziliscite/cqrs_search/internal/domain/product"
+	"log"
 
 	"github.com/ziliscite/cqrs_search/internal/ports"
 )
@@ -14,9 +15,13 @@ type UpdateProductEvent struct {
 	Name     string
 	Category string
 	Price    float64
+	Version  int64
+
+	Previous *product.Product // state the update replaced, if the event carried it
+	Changed  []string         // fields that differ from Previous
 }
 
-func NewUpdateProduct(id, name, category string, price float64) (UpdateProductEvent, Errs) {
+func NewUpdateProduct(id, name, category string, price float64, version int64) (UpdateProductEvent, Errs) {
 	var up UpdateProductEvent
 
 	errs := make(map[string]error)
@@ -36,6 +41,10 @@ func NewUpdateProduct(id, name, category string, price float64) (UpdateProductEv
 		errs["price"] = errors.New("product price must be greater than zero")
 	}
 
+	if version <= 0 {
+		errs["version"] = errors.New("product version must be greater than zero")
+	}
+
 	if len(errs) > 0 {
 		return up, errs
 	}
@@ -44,6 +53,7 @@ func NewUpdateProduct(id, name, category string, price float64) (UpdateProductEv
 	up.Name = name
 	up.Category = category
 	up.Price = price
+	up.Version = version
 
 	return up, nil
 }
@@ -70,8 +80,15 @@ func (h *updateProductHandler) Handle(ctx context.Context, cmd UpdateProductEven
 		return fmt.Errorf("failed to create product: %w", err)
 	}
 	p.SetID(cmd.ID)
+	p.SetVersion(cmd.Version)
 
 	if err = h.repo.Update(ctx, p); err != nil {
+		if errors.Is(err, product.ErrStale) {
+			// a newer version is already indexed, nothing to invalidate
+			log.Printf("skipping stale update: %v", err)
+			staleEvents.Add(1)
+			return nil
+		}
 		return err
 	}
 
@@ -79,5 +96,5 @@ func (h *updateProductHandler) Handle(ctx context.Context, cmd UpdateProductEven
 		return err
 	}
 
-	return nil
+	return updateInvalidation(p, cmd.Previous, cmd.Changed).apply(ctx, h.ch)
 }
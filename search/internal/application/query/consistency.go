@@ -0,0 +1,57 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"github.com/ziliscite/cqrs_search/internal/domain/product"
+	"github.com/ziliscite/cqrs_search/internal/ports"
+	"time"
+)
+
+// ErrNotCaughtUp is returned when the index doesn't reach a read's consistency token in time.
+var ErrNotCaughtUp = errors.New("search index has not caught up with the requested version")
+
+const (
+	pollMin = 10 * time.Millisecond
+	pollMax = 200 * time.Millisecond
+)
+
+// consistency waits for the index to apply the write a token stands for.
+type consistency struct {
+	repo ports.ReadRepository
+	wait time.Duration // longest a read waits before giving up
+}
+
+// await returns once tok's product has reached tok's version in the index, or
+// ErrNotCaughtUp if it hasn't within c.wait. A nil tok returns at once.
+func (c consistency) await(ctx context.Context, tok *product.Token) error {
+	if tok == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.wait)
+	defer cancel()
+
+	poll := pollMin
+	for {
+		applied, err := c.repo.AppliedVersion(ctx, tok.ID)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ErrNotCaughtUp
+			}
+			return err
+		}
+
+		if applied >= tok.Version {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ErrNotCaughtUp
+		case <-time.After(poll):
+		}
+
+		poll = min(poll*2, pollMax)
+	}
+}
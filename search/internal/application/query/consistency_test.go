@@ -0,0 +1,226 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"github.com/ziliscite/cqrs_search/internal/domain/product"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRepo is a read repository whose index applies the versions in applied, one per
+// AppliedVersion call, staying at the last.
+type fakeRepo struct {
+	mu      sync.Mutex
+	applied []int64
+	err     error
+	polls   []time.Time
+
+	searches int
+	result   *product.Result
+
+	suggests    []*product.Suggest
+	suggestions []product.Suggestion
+}
+
+func (r *fakeRepo) AppliedVersion(context.Context, string) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.polls = append(r.polls, time.Now())
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	v := r.applied[0]
+	if len(r.applied) > 1 {
+		r.applied = r.applied[1:]
+	}
+	return v, nil
+}
+
+func (r *fakeRepo) Search(context.Context, *product.Search) (*product.Result, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.searches++
+	return r.result, nil
+}
+
+func (r *fakeRepo) GetByID(_ context.Context, id string) (*product.Product, error) {
+	p, err := product.New("Trail Shoe", "shoes", 80)
+	if err != nil {
+		return nil, err
+	}
+	p.SetID(id)
+	return p, nil
+}
+
+func (r *fakeRepo) Suggest(_ context.Context, s *product.Suggest) ([]product.Suggestion, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.suggests = append(r.suggests, s)
+	return r.suggestions, nil
+}
+
+func TestAwait(t *testing.T) {
+	tests := []struct {
+		name    string
+		tok     *product.Token
+		applied []int64
+		polls   int
+		want    error
+	}{
+		{"no token", nil, []int64{0}, 0, nil},
+		{"caught up", &product.Token{ID: "a", Version: 3}, []int64{3}, 1, nil},
+		{"ahead", &product.Token{ID: "a", Version: 3}, []int64{5}, 1, nil},
+		{"catches up", &product.Token{ID: "a", Version: 3}, []int64{1, 2, 3}, 3, nil},
+		{"deleted at a later version", &product.Token{ID: "a", Version: 3}, []int64{0, 4}, 2, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &fakeRepo{applied: tt.applied}
+			c := consistency{repo: repo, wait: 5 * time.Second}
+
+			if err := c.await(context.Background(), tt.tok); !errors.Is(err, tt.want) {
+				t.Errorf("await() = %v, want %v", err, tt.want)
+			}
+			if len(repo.polls) != tt.polls {
+				t.Errorf("polled %d times, want %d", len(repo.polls), tt.polls)
+			}
+		})
+	}
+}
+
+func TestAwaitBacksOff(t *testing.T) {
+	repo := &fakeRepo{applied: []int64{1}}
+	c := consistency{repo: repo, wait: 500 * time.Millisecond}
+
+	started := time.Now()
+	if err := c.await(context.Background(), &product.Token{ID: "a", Version: 2}); !errors.Is(err, ErrNotCaughtUp) {
+		t.Fatalf("await() = %v, want ErrNotCaughtUp", err)
+	}
+	if waited := time.Since(started); waited < c.wait {
+		t.Errorf("gave up after %s, want the full %s", waited, c.wait)
+	}
+
+	// 10, 20, 40, 80, 160, then 200ms apart: 7 polls in 500ms, where a fixed 10ms would make 50
+	if n := len(repo.polls); n < 3 || n > 8 {
+		t.Errorf("polled %d times in %s, want the interval doubling up to %s", n, c.wait, pollMax)
+	}
+	for i := 2; i < len(repo.polls); i++ {
+		prev, gap := repo.polls[i-1].Sub(repo.polls[i-2]), repo.polls[i].Sub(repo.polls[i-1])
+		if gap < prev && gap < pollMax {
+			t.Errorf("poll %d came %s after the last, sooner than the %s before it", i, gap, prev)
+		}
+	}
+}
+
+func TestAwaitErrors(t *testing.T) {
+	failed := errors.New("elasticsearch unavailable")
+	c := consistency{repo: &fakeRepo{err: failed}, wait: time.Second}
+
+	if err := c.await(context.Background(), &product.Token{ID: "a", Version: 1}); !errors.Is(err, failed) {
+		t.Errorf("await() = %v, want the repository's error", err)
+	}
+
+	// the caller giving up isn't the index falling behind, but reads the same to the client
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c = consistency{repo: &fakeRepo{applied: []int64{0}}, wait: time.Second}
+	if err := c.await(ctx, &product.Token{ID: "a", Version: 1}); !errors.Is(err, ErrNotCaughtUp) {
+		t.Errorf("await() with a cancelled context = %v, want ErrNotCaughtUp", err)
+	}
+}
+
+func TestGetProductAwaitsMinVersion(t *testing.T) {
+	repo := &fakeRepo{applied: []int64{1, 2}}
+	h := NewGetProductHandler(repo, time.Second)
+
+	p, err := h.Handle(context.Background(), NewGetProduct("a", 2))
+	if err != nil || p == nil {
+		t.Fatalf("Handle() = %v, %v", p, err)
+	}
+	if len(repo.polls) != 2 {
+		t.Errorf("polled %d times, want until version 2 was applied", len(repo.polls))
+	}
+
+	repo = &fakeRepo{applied: []int64{1}}
+	h = NewGetProductHandler(repo, 20*time.Millisecond)
+	if _, err = h.Handle(context.Background(), NewGetProduct("a", 2)); !errors.Is(err, ErrNotCaughtUp) {
+		t.Errorf("Handle() = %v, want ErrNotCaughtUp", err)
+	}
+
+	if _, err = h.Handle(context.Background(), NewGetProduct("b", 0)); err != nil {
+		t.Errorf("Handle() without a min version = %v", err)
+	}
+}
+
+// fakeCache is a search result cache holding one entry under any key.
+type fakeCache struct {
+	cached *product.Result
+	gets   int
+	sets   int
+}
+
+func (c *fakeCache) Get(context.Context, string) (*product.Result, error) {
+	c.gets++
+	return c.cached, nil
+}
+
+func (c *fakeCache) Set(context.Context, string, *product.Result, ...string) error {
+	c.sets++
+	return nil
+}
+
+func TestSearchWithATokenBypassesTheCache(t *testing.T) {
+	cached, fresh := &product.Result{Total: 1}, &product.Result{Total: 2}
+
+	tests := []struct {
+		name     string
+		tok      *product.Token
+		want     *product.Result
+		gets     int
+		searches int
+	}{
+		{"without a token", nil, cached, 1, 0},
+		{"with a token", &product.Token{ID: "a", Version: 2}, fresh, 0, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &fakeRepo{applied: []int64{2}, result: fresh}
+			ch := &fakeCache{cached: cached}
+			h := NewSearchProductHandler(repo, ch, time.Second)
+
+			got, err := h.Handle(context.Background(), NewSearchProduct(product.NewSearch(), tt.tok))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Handle() = %+v, want %+v", got, tt.want)
+			}
+			if ch.gets != tt.gets || repo.searches != tt.searches {
+				t.Errorf("read the cache %d and the index %d times, want %d and %d", ch.gets, repo.searches, tt.gets, tt.searches)
+			}
+			// the fresh result still refreshes the cache for later reads
+			if tt.tok != nil && ch.sets != 1 {
+				t.Errorf("cached %d times, want the fresh result cached", ch.sets)
+			}
+		})
+	}
+}
+
+func TestSearchWithATokenFailsWhenNotCaughtUp(t *testing.T) {
+	repo := &fakeRepo{applied: []int64{1}, result: &product.Result{}}
+	h := NewSearchProductHandler(repo, &fakeCache{}, 20*time.Millisecond)
+
+	_, err := h.Handle(context.Background(), NewSearchProduct(product.NewSearch(), &product.Token{ID: "a", Version: 2}))
+	if !errors.Is(err, ErrNotCaughtUp) {
+		t.Errorf("Handle() = %v, want ErrNotCaughtUp", err)
+	}
+	if repo.searches != 0 {
+		t.Error("searched an index that hasn't caught up")
+	}
+}
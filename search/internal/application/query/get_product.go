@@ -4,15 +4,18 @@ import (
 	"context"
 	"github.com/ziliscite/cqrs_search/internal/domain/product"
 	"github.com/ziliscite/cqrs_search/internal/ports"
+	"time"
 )
 
 type GetProduct struct {
-	ID string
+	ID         string
+	MinVersion int64 // if set, the product must have reached this version
 }
 
-func NewGetProduct(id string) GetProduct {
+func NewGetProduct(id string, minVersion int64) GetProduct {
 	return GetProduct{
-		ID: id,
+		ID:         id,
+		MinVersion: minVersion,
 	}
 }
 
@@ -22,14 +25,22 @@ type GetProductHandler interface {
 
 type getProductHandler struct {
 	repo ports.ReadRepository
+	cons consistency
 }
 
-func NewGetProductHandler(repo ports.ReadRepository) GetProductHandler {
+func NewGetProductHandler(repo ports.ReadRepository, wait time.Duration) GetProductHandler {
 	return &getProductHandler{
 		repo: repo,
+		cons: consistency{repo: repo, wait: wait},
 	}
 }
 
 func (h *getProductHandler) Handle(ctx context.Context, query GetProduct) (*product.Product, error) {
+	if query.MinVersion > 0 {
+		if err := h.cons.await(ctx, &product.Token{ID: query.ID, Version: query.MinVersion}); err != nil {
+			return nil, err
+		}
+	}
+
 	return h.repo.GetByID(ctx, query.ID)
 }
@@ -6,66 +6,85 @@ import (
 	"github.com/ziliscite/cqrs_search/internal/domain/product"
 	"github.com/ziliscite/cqrs_search/internal/ports"
 	"log"
+	"time"
 )
 
 type SearchProduct struct {
 	search *product.Search
+	token  *product.Token // if set, results must reflect this write
 }
 
-func NewSearchProduct(search *product.Search) SearchProduct {
+func NewSearchProduct(search *product.Search, token *product.Token) SearchProduct {
 	return SearchProduct{
 		search: search,
+		token:  token,
 	}
 }
 
 type SearchProductHandler interface {
-	Handle(ctx context.Context, query SearchProduct) ([]product.Product, error)
+	Handle(ctx context.Context, query SearchProduct) (*product.Result, error)
 }
 
 type searchProductHandler struct {
 	repo ports.ReadRepository
 	ch   ports.CacheWriteReader
+	cons consistency
 }
 
-func NewSearchProductHandler(repo ports.ReadRepository, cacher ports.CacheWriteReader) SearchProductHandler {
+func NewSearchProductHandler(repo ports.ReadRepository, cacher ports.CacheWriteReader, wait time.Duration) SearchProductHandler {
 	return &searchProductHandler{
 		repo: repo,
 		ch:   cacher,
+		cons: consistency{repo: repo, wait: wait},
 	}
 }
 
-func (h *searchProductHandler) Handle(ctx context.Context, query SearchProduct) ([]product.Product, error) {
+func (h *searchProductHandler) Handle(ctx context.Context, query SearchProduct) (*product.Result, error) {
 	key, tags := query.search.Key()
 
-	// check cache
-	cached, err := h.ch.Get(ctx, key)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get cached products: %w", err)
+	if err := h.cons.await(ctx, query.token); err != nil {
+		return nil, err
 	}
 
-	// if hit, return
-	if cached != nil && len(cached) > 0 {
-		log.Printf("hit cache: %s", key)
-		return cached, nil
+	// cursor pages read from a point in time of their own and aren't cached
+	cacheable := query.search.Cursor() == nil
+
+	// a cached result may predate the token's write, so it is only trusted without one
+	if cacheable && query.token == nil {
+		cached, err := h.ch.Get(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get cached products: %w", err)
+		}
+
+		// if hit, return
+		if cached != nil {
+			log.Printf("hit cache: %s", key)
+			return cached, nil
+		}
 	}
 
 	// cache miss, search
 	log.Printf("miss cache: %s", key)
-	products, err := h.repo.Search(ctx, query.search)
+	result, err := h.repo.Search(ctx, query.search)
 	if err != nil {
 		return nil, fmt.Errorf("failed to search products: %w", err)
 	}
 
+	if !cacheable {
+		return result, nil
+	}
+
 	// add more tags
-	for _, p := range products {
+	for _, hit := range result.Items {
+		p := hit.Product
 		log.Printf("product: %s %s %s $%.2f", p.ID(), p.Name(), p.Category(), p.Price())
-		tags = append(tags, fmt.Sprintf("tag:product:%s", p.ID()))
+		tags = append(tags, product.ProductTag(p.ID()))
 	}
 
 	// set cache
-	if err = h.ch.Set(ctx, key, products, tags...); err != nil {
+	if err = h.ch.Set(ctx, key, result, tags...); err != nil {
 		return nil, fmt.Errorf("failed to cache products: %w", err)
 	}
 
-	return products, nil
+	return result, nil
 }
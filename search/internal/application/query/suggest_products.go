@@ -0,0 +1,57 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"github.com/ziliscite/cqrs_search/internal/domain/product"
+	"github.com/ziliscite/cqrs_search/internal/ports"
+	"log"
+)
+
+type SuggestProducts struct {
+	suggest *product.Suggest
+}
+
+func NewSuggestProducts(suggest *product.Suggest) SuggestProducts {
+	return SuggestProducts{suggest: suggest}
+}
+
+type SuggestProductsHandler interface {
+	Handle(ctx context.Context, query SuggestProducts) ([]product.Suggestion, error)
+}
+
+type suggestProductsHandler struct {
+	repo ports.ReadRepository
+	ch   ports.SuggestionCache
+}
+
+func NewSuggestProductsHandler(repo ports.ReadRepository, cache ports.SuggestionCache) SuggestProductsHandler {
+	return &suggestProductsHandler{
+		repo: repo,
+		ch:   cache,
+	}
+}
+
+func (h *suggestProductsHandler) Handle(ctx context.Context, query SuggestProducts) ([]product.Suggestion, error) {
+	key := query.suggest.Key()
+
+	cached, ok, err := h.ch.Get(ctx, key)
+	if err != nil {
+		// suggestions are best effort; a cache outage shouldn't take them down
+		log.Printf("failed to get cached suggestions: %v", err)
+	}
+	if ok {
+		return cached, nil
+	}
+
+	suggestions, err := h.repo.Suggest(ctx, query.suggest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to suggest products: %w", err)
+	}
+
+	if err = h.ch.Set(ctx, key, suggestions); err != nil {
+		log.Printf("failed to cache suggestions: %v", err)
+	}
+
+	return suggestions, nil
+}
@@ -0,0 +1,87 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"github.com/ziliscite/cqrs_search/internal/domain/product"
+	"testing"
+)
+
+// fakeSuggestionCache holds suggestions by key, failing every call with err if set.
+type fakeSuggestionCache struct {
+	entries map[string][]product.Suggestion
+	err     error
+}
+
+func (c *fakeSuggestionCache) Get(_ context.Context, key string) ([]product.Suggestion, bool, error) {
+	if c.err != nil {
+		return nil, false, c.err
+	}
+	s, ok := c.entries[key]
+	return s, ok, nil
+}
+
+func (c *fakeSuggestionCache) Set(_ context.Context, key string, s []product.Suggestion) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.entries[key] = s
+	return nil
+}
+
+func suggest(t *testing.T, prefix, category string, limit int) SuggestProducts {
+	t.Helper()
+	s, err := product.NewSuggest(prefix, category, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewSuggestProducts(s)
+}
+
+func TestSuggestionsAreCachedPerRequest(t *testing.T) {
+	repo := &fakeRepo{suggestions: []product.Suggestion{{ID: "a", Name: "Laptop Stand", Category: "Electronics", Score: 1}}}
+	ch := &fakeSuggestionCache{entries: map[string][]product.Suggestion{}}
+	h := NewSuggestProductsHandler(repo, ch)
+	ctx := context.Background()
+
+	requests := []struct {
+		query    SuggestProducts
+		suggests int // repository calls so far
+	}{
+		{suggest(t, "lapt", "", 0), 1},
+		{suggest(t, "LAPT ", "", 0), 1}, // the prefix matches in any case
+		{suggest(t, "lapt", "Electronics", 0), 2},
+		{suggest(t, "lapt", "Electronics", 5), 3},
+		{suggest(t, "lapt", "Electronics", 5), 3},
+		{suggest(t, "lapto", "", 0), 4},
+	}
+
+	for i, r := range requests {
+		got, err := h.Handle(ctx, r.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 || got[0].ID != "a" {
+			t.Errorf("request %d: Handle() = %+v", i, got)
+		}
+		if len(repo.suggests) != r.suggests {
+			t.Errorf("request %d: asked the index %d times, want %d", i, len(repo.suggests), r.suggests)
+		}
+	}
+
+	// the index is asked with the request's scope and limit
+	scoped := repo.suggests[1]
+	if scoped.Category() != "Electronics" || scoped.Limit() != product.DefaultSuggestLimit {
+		t.Errorf("suggested in %q up to %d, want Electronics up to %d", scoped.Category(), scoped.Limit(), product.DefaultSuggestLimit)
+	}
+}
+
+func TestSuggestionsSurviveACacheOutage(t *testing.T) {
+	repo := &fakeRepo{suggestions: []product.Suggestion{{ID: "a"}}}
+	h := NewSuggestProductsHandler(repo, &fakeSuggestionCache{err: errors.New("redis unavailable")})
+
+	got, err := h.Handle(context.Background(), suggest(t, "lapt", "", 0))
+	if err != nil || len(got) != 1 {
+		t.Errorf("Handle() = %+v, %v, want suggestions straight from the index", got, err)
+	}
+}
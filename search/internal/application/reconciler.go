@@ -0,0 +1,103 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"github.com/ziliscite/cqrs_search/internal/application/command"
+	"log"
+	"sync"
+	"time"
+)
+
+var ErrReconcileRunning = errors.New("reconciliation is already running")
+
+// Reconciler runs reconciliation one at a time, on demand or on a schedule, and keeps
+// the report of the last run.
+type Reconciler struct {
+	h   command.ReconcileHandler
+	ctx context.Context // the service's lifetime; runs are cancelled with it
+
+	mu      sync.Mutex
+	running bool
+	last    *command.ReconcileReport
+}
+
+// NewReconciler returns a Reconciler whose runs stop once ctx, the service's lifetime, is done.
+func NewReconciler(ctx context.Context, h command.ReconcileHandler) *Reconciler {
+	return &Reconciler{h: h, ctx: ctx}
+}
+
+// Start runs cmd in the background, or returns ErrReconcileRunning if a run is in progress.
+// The run outlives the request that started it, but not the service.
+func (r *Reconciler) Start(cmd command.Reconcile) error {
+	if !r.acquire() {
+		return ErrReconcileRunning
+	}
+
+	go r.run(cmd)
+	return nil
+}
+
+// Schedule runs cmd every interval until the service stops, skipping a tick while a run is in progress.
+func (r *Reconciler) Schedule(interval time.Duration, cmd command.Reconcile) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+			if r.acquire() {
+				r.run(cmd)
+			}
+		}
+	}
+}
+
+// Last returns the report of the last finished run, or nil if there hasn't been one. The
+// report of a run that failed carries its error.
+func (r *Reconciler) Last() *command.ReconcileReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.last
+}
+
+// Running reports whether a run is in progress.
+func (r *Reconciler) Running() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.running
+}
+
+func (r *Reconciler) acquire() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.running {
+		return false
+	}
+	r.running = true
+	return true
+}
+
+func (r *Reconciler) run(cmd command.Reconcile) {
+	report, err := r.h.Handle(r.ctx, cmd)
+	if err != nil {
+		log.Printf("reconciliation failed: %v", err)
+
+		// counts of a failed run only cover the products checked before it stopped
+		report.Error = err.Error()
+		if report.FinishedAt.IsZero() {
+			report.FinishedAt = time.Now().UTC()
+		}
+	} else {
+		log.Printf("reconciliation checked %d products: %d missing, %d extra, %d stale, %d mismatched, %d repaired",
+			report.Checked, report.Missing.Count, report.Extra.Count, report.Stale.Count, report.Mismatched.Count, report.Repaired)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.running = false
+	r.last = &report
+}
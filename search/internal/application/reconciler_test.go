@@ -0,0 +1,142 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"github.com/ziliscite/cqrs_search/internal/application/command"
+	"testing"
+	"time"
+)
+
+// handlerFunc is a command.ReconcileHandler running a func.
+type handlerFunc func(ctx context.Context, cmd command.Reconcile) (command.ReconcileReport, error)
+
+func (f handlerFunc) Handle(ctx context.Context, cmd command.Reconcile) (command.ReconcileReport, error) {
+	return f(ctx, cmd)
+}
+
+// wait waits until no run is in progress.
+func wait(t *testing.T, r *Reconciler) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if !r.Running() {
+			return
+		}
+	}
+	t.Fatal("reconciliation never finished")
+}
+
+func TestReconcilerKeepsTheLastReport(t *testing.T) {
+	r := NewReconciler(context.Background(), handlerFunc(func(context.Context, command.Reconcile) (command.ReconcileReport, error) {
+		return command.ReconcileReport{Checked: 3, Repair: true}, nil
+	}))
+
+	if r.Last() != nil {
+		t.Fatal("Last() before any run, want nil")
+	}
+
+	if err := r.Start(command.Reconcile{Repair: true, BatchSize: 10}); err != nil {
+		t.Fatal(err)
+	}
+	wait(t, r)
+
+	last := r.Last()
+	if last == nil || last.Checked != 3 || last.Error != "" {
+		t.Errorf("Last() = %+v, want the run's report", last)
+	}
+}
+
+func TestReconcilerRecordsFailures(t *testing.T) {
+	failed := errors.New("product service unavailable")
+	r := NewReconciler(context.Background(), handlerFunc(func(context.Context, command.Reconcile) (command.ReconcileReport, error) {
+		// failed before the walk started, with nothing counted
+		return command.ReconcileReport{}, failed
+	}))
+
+	if err := r.Start(command.Reconcile{BatchSize: 10}); err != nil {
+		t.Fatal(err)
+	}
+	wait(t, r)
+
+	last := r.Last()
+	if last == nil {
+		t.Fatal("Last() = nil after a failed run, want its report")
+	}
+	if last.Error != failed.Error() {
+		t.Errorf("report error %q, want %q", last.Error, failed)
+	}
+	if last.FinishedAt.IsZero() {
+		t.Error("failed run has no finish time")
+	}
+}
+
+func TestReconcilerRunsOneAtATime(t *testing.T) {
+	release := make(chan struct{})
+	r := NewReconciler(context.Background(), handlerFunc(func(context.Context, command.Reconcile) (command.ReconcileReport, error) {
+		<-release
+		return command.ReconcileReport{}, nil
+	}))
+
+	if err := r.Start(command.Reconcile{BatchSize: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Start(command.Reconcile{BatchSize: 10}); !errors.Is(err, ErrReconcileRunning) {
+		t.Errorf("Start() during a run = %v, want ErrReconcileRunning", err)
+	}
+	if !r.Running() {
+		t.Error("Running() = false during a run")
+	}
+
+	close(release)
+	wait(t, r)
+
+	if err := r.Start(command.Reconcile{BatchSize: 10}); err != nil {
+		t.Errorf("Start() after the run = %v", err)
+	}
+	wait(t, r)
+}
+
+func TestReconcilerRunsStopWithTheService(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	r := NewReconciler(ctx, handlerFunc(func(ctx context.Context, _ command.Reconcile) (command.ReconcileReport, error) {
+		<-ctx.Done()
+		return command.ReconcileReport{}, ctx.Err()
+	}))
+
+	// started by a request that has long finished
+	if err := r.Start(command.Reconcile{BatchSize: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	stop()
+	wait(t, r)
+
+	if last := r.Last(); last == nil || last.Error != context.Canceled.Error() {
+		t.Errorf("Last() = %+v, want the run cancelled", last)
+	}
+}
+
+func TestReconcilerScheduleStopsWithTheService(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	runs := make(chan struct{}, 10)
+	r := NewReconciler(ctx, handlerFunc(func(context.Context, command.Reconcile) (command.ReconcileReport, error) {
+		runs <- struct{}{}
+		return command.ReconcileReport{}, nil
+	}))
+
+	scheduled := make(chan struct{})
+	go func() {
+		r.Schedule(time.Millisecond, command.Reconcile{BatchSize: 10})
+		close(scheduled)
+	}()
+
+	<-runs
+	<-runs
+	stop()
+
+	select {
+	case <-scheduled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Schedule() still running after the service stopped")
+	}
+}
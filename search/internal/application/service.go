@@ -4,6 +4,7 @@ import (
 	"github.com/ziliscite/cqrs_search/internal/application/command"
 	"github.com/ziliscite/cqrs_search/internal/application/query"
 	"github.com/ziliscite/cqrs_search/internal/ports"
+	"time"
 )
 
 type Command struct {
@@ -21,14 +22,18 @@ func NewCommand(repo ports.WriteRepository, cacher ports.CacheInvalidator) *Comm
 }
 
 type Query struct {
-	Get    query.GetProductHandler
-	Search query.SearchProductHandler
+	Get     query.GetProductHandler
+	Search  query.SearchProductHandler
+	Suggest query.SuggestProductsHandler
 }
 
-func NewQuery(repo ports.ReadRepository, cacher ports.CacheWriteReader) *Query {
+// NewQuery builds the query handlers; reads carrying a consistency token wait up to
+// consistencyWait for the index to catch up.
+func NewQuery(repo ports.ReadRepository, cacher ports.CacheWriteReader, suggestions ports.SuggestionCache, consistencyWait time.Duration) *Query {
 	return &Query{
-		Get:    query.NewGetProductHandler(repo),
-		Search: query.NewSearchProductHandler(repo, cacher),
+		Get:     query.NewGetProductHandler(repo, consistencyWait),
+		Search:  query.NewSearchProductHandler(repo, cacher, consistencyWait),
+		Suggest: query.NewSuggestProductsHandler(repo, suggestions),
 	}
 }
 
@@ -37,9 +42,9 @@ type Service struct {
 	Query   *Query
 }
 
-func NewService(repo ports.Repository, cacher ports.Cacher) Service {
+func NewService(repo ports.Repository, cacher ports.Cacher, suggestions ports.SuggestionCache, consistencyWait time.Duration) Service {
 	return Service{
 		Command: NewCommand(repo, cacher),
-		Query:   NewQuery(repo, cacher),
+		Query:   NewQuery(repo, cacher, suggestions, consistencyWait),
 	}
 }
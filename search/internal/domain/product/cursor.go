@@ -0,0 +1,89 @@
+package product
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+	// ErrCursorExpired is returned when the point in time a cursor reads from has been closed or timed out.
+	ErrCursorExpired = errors.New("cursor has expired")
+)
+
+// Cursor is a position in a deep, stable walk through the results of one search. The walk
+// reads from a point in time of the index, so products indexed meanwhile don't shift it.
+type Cursor struct {
+	PIT   string            `json:"pit,omitempty"`   // unset until the walk has started
+	After []json.RawMessage `json:"after,omitempty"` // sort values of the last hit served
+	Seen  int64             `json:"seen"`            // hits served so far
+	Query string            `json:"query,omitempty"` // fingerprint of the search being walked
+}
+
+// ParseCursor decodes a cursor handed out with a previous page.
+func ParseCursor(s string) (*Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var c Cursor
+	if err = json.Unmarshal(b, &c); err != nil || c.PIT == "" || len(c.After) == 0 {
+		return nil, ErrInvalidCursor
+	}
+
+	return &c, nil
+}
+
+// String encodes the cursor opaquely, so clients don't come to depend on its contents.
+func (c *Cursor) String() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Started reports whether the cursor continues a walk, rather than asking to start one.
+func (c *Cursor) Started() bool {
+	return c.PIT != ""
+}
+
+// Matches reports whether the cursor was handed out for a search with the same filters, order and page size as s.
+func (c *Cursor) Matches(s *Search) bool {
+	return !c.Started() || c.Query == s.fingerprint()
+}
+
+// Next returns the cursor following a page of n hits, the last of which sorted by after.
+func (c *Cursor) Next(s *Search, pit string, after []json.RawMessage, n int) *Cursor {
+	return &Cursor{
+		PIT:   pit,
+		After: after,
+		Seen:  c.Seen + int64(n),
+		Query: s.fingerprint(),
+	}
+}
+
+// fingerprint identifies what a search matches and in which order, leaving out which page it is on.
+func (s *Search) fingerprint() string {
+	_, size := s.pagination()
+	minPrice, maxPrice := s.PriceRange()
+
+	raw := fmt.Sprintf("%s|%s|%s|%d", normalize(s.Name()), strings.Join(s.filterKey(), "|"), sortKey(s.Sort()), size)
+	if minPrice != nil {
+		raw += fmt.Sprintf("|min=%.2f", *minPrice)
+	}
+	if maxPrice != nil {
+		raw += fmt.Sprintf("|max=%.2f", *maxPrice)
+	}
+	if ranges := s.PriceRanges(); len(ranges) > 0 {
+		raw += "|ranges=" + priceRangesKey(ranges)
+	}
+	if s.Query() != nil {
+		raw += "|q=" + s.Query().String()
+	}
+
+	sum := sha1.Sum([]byte(raw))
+	return base64.RawURLEncoding.EncodeToString(sum[:8])
+}
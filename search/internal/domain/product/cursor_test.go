@@ -0,0 +1,114 @@
+package product
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func started(s *Search) *Cursor {
+	return (&Cursor{}).Next(s, "pit-1", []json.RawMessage{[]byte(`80`), []byte(`"a"`)}, 10)
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	want := started(NewSearch().WithName("shoe"))
+
+	got, err := ParseCursor(want.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseCursor(String()) = %+v, want %+v", got, want)
+	}
+	if !got.Started() || got.Seen != 10 {
+		t.Errorf("cursor %+v, want a started walk 10 hits in", got)
+	}
+	if (&Cursor{}).Started() {
+		t.Error("an empty cursor continues a walk")
+	}
+}
+
+func TestParseCursorErrors(t *testing.T) {
+	encode := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+
+	for name, raw := range map[string]string{
+		"empty":          "",
+		"not base64":     "a cursor",
+		"not json":       encode("pit-1"),
+		"no pit":         encode(`{"after":[1],"seen":1}`),
+		"no sort values": encode(`{"pit":"pit-1","seen":1}`),
+		"wrong types":    encode(`{"pit":1,"after":[1]}`),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if c, err := ParseCursor(raw); !errors.Is(err, ErrInvalidCursor) {
+				t.Errorf("ParseCursor(%q) = %+v, %v, want ErrInvalidCursor", raw, c, err)
+			}
+		})
+	}
+}
+
+func TestCursorMatches(t *testing.T) {
+	sorts := func(raw string) []Sort {
+		keys, err := ParseSort(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return keys
+	}
+	base := func() *Search {
+		return NewSearch().WithName("shoe").WithCategory("shoes").WithMinPrice(10).WithSort(sorts("-price")...).WithPageSize(10)
+	}
+	c := started(base())
+
+	tests := []struct {
+		name   string
+		search *Search
+		want   bool
+	}{
+		{"same search", base(), true},
+		{"another page number", base().WithPage(4), true},
+		{"equivalent filters", NewSearch().WithName(" Shoe ").WithCategory("shoes", "shoes").WithMinPrice(10).WithSort(sorts("-price")...).WithPageSize(10), true},
+		{"another name", base().WithName("boot"), false},
+		{"another category", base().WithCategory("boots"), false},
+		{"another price", base().WithMaxPrice(50), false},
+		{"another order", base().WithSort(sorts("price")...), false},
+		{"another page size", base().WithPageSize(20), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.Matches(tt.search); got != tt.want {
+				t.Errorf("Matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// starting a walk fits any search
+	if !(&Cursor{}).Matches(base().WithName("boot")) {
+		t.Error("an empty cursor doesn't match")
+	}
+}
+
+func TestTamperedCursorDoesNotMatch(t *testing.T) {
+	s := NewSearch().WithCategory("shoes").WithPageSize(10)
+	c := started(NewSearch().WithCategory("boots").WithPageSize(10))
+
+	// a client swapping in the fingerprint of the search it wants to walk instead
+	var fields map[string]any
+	b, _ := base64.RawURLEncoding.DecodeString(c.String())
+	if err := json.Unmarshal(b, &fields); err != nil {
+		t.Fatal(err)
+	}
+	fields["query"] = "shoes"
+	b, _ = json.Marshal(fields)
+
+	tampered, err := ParseCursor(base64.RawURLEncoding.EncodeToString(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tampered.Matches(s) {
+		t.Error("a cursor with an edited fingerprint matches")
+	}
+}
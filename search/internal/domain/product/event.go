@@ -0,0 +1,15 @@
+package product
+
+// events maps the routing keys products are published under (AMQP topics, NATS subjects)
+// onto the events they carry.
+var events = map[string]string{
+	"product.created": "create",
+	"product.updated": "update",
+	"product.deleted": "delete",
+}
+
+// EventFromKey returns the event published under the routing key, e.g. "update" for "product.updated".
+func EventFromKey(key string) (string, bool) {
+	event, ok := events[key]
+	return event, ok
+}
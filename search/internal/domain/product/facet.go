@@ -0,0 +1,109 @@
+package product
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// MinPriceInterval is the narrowest price histogram bucket. Narrower ones add little and
+// can ask for more buckets than Elasticsearch allows.
+const MinPriceInterval = 1
+
+// ErrTooManyBuckets is returned when a facet would need more buckets than the cluster allows.
+var ErrTooManyBuckets = errors.New("facets need too many buckets, use a wider price_interval")
+
+// Facet tags mark cached results carrying facets, whose counts move when any matching
+// product changes the faceted field, even if the product isn't on the page.
+const (
+	CategoryFacetTag = "tag:facet:category"
+	PriceFacetTag    = "tag:facet:price"
+)
+
+// FacetRequest selects the aggregations computed alongside a search. Each facet counts
+// the products matching every filter but its own, so a selected category or price range
+// still shows what the others hold.
+type FacetRequest struct {
+	Categories    bool         // product count per category
+	PriceRanges   []PriceRange // product count per price range
+	PriceInterval float64      // product count per price bucket of this width, when no ranges are given
+	PriceStats    bool         // min, max and average price
+}
+
+// Empty reports whether no facet is requested.
+func (f FacetRequest) Empty() bool {
+	return !f.Categories && len(f.PriceRanges) == 0 && f.PriceInterval <= 0 && !f.PriceStats
+}
+
+func (f FacetRequest) pricing() bool {
+	return len(f.PriceRanges) > 0 || f.PriceInterval > 0 || f.PriceStats
+}
+
+// key identifies the request in a cache key, e.g. "cat,ranges=0-10;10-,stats".
+func (f FacetRequest) key() string {
+	var parts []string
+	if f.Categories {
+		parts = append(parts, "cat")
+	}
+	if len(f.PriceRanges) > 0 {
+		ranges := make([]string, len(f.PriceRanges))
+		for i, r := range f.PriceRanges {
+			ranges[i] = r.String()
+		}
+		parts = append(parts, "ranges="+strings.Join(ranges, ";"))
+	} else if f.PriceInterval > 0 {
+		parts = append(parts, fmt.Sprintf("interval=%.2f", f.PriceInterval))
+	}
+	if f.PriceStats {
+		parts = append(parts, "stats")
+	}
+	return strings.Join(parts, ",")
+}
+
+// PriceRange is a bucket of prices from From (inclusive) to To (exclusive); either end may be open.
+type PriceRange struct {
+	From *float64 `json:"from,omitempty"`
+	To   *float64 `json:"to,omitempty"`
+}
+
+// String formats the range as "<from>-<to>", leaving an open end empty, e.g. "10.00-" for 10 and up.
+func (r PriceRange) String() string {
+	var from, to string
+	if r.From != nil {
+		from = fmt.Sprintf("%.2f", *r.From)
+	}
+	if r.To != nil {
+		to = fmt.Sprintf("%.2f", *r.To)
+	}
+	return from + "-" + to
+}
+
+// Facets are the aggregations computed for a FacetRequest.
+type Facets struct {
+	Categories     []CategoryCount   `json:"categories,omitempty"`
+	PriceRanges    []PriceRangeCount `json:"price_ranges,omitempty"`
+	PriceHistogram []PriceBucket     `json:"price_histogram,omitempty"`
+	Price          *PriceStats       `json:"price,omitempty"`
+}
+
+type CategoryCount struct {
+	Category string `json:"category"`
+	Count    int64  `json:"count"`
+}
+
+type PriceRangeCount struct {
+	PriceRange
+	Count int64 `json:"count"`
+}
+
+type PriceBucket struct {
+	From  float64 `json:"from"` // the bucket spans the request's interval from here
+	Count int64   `json:"count"`
+}
+
+type PriceStats struct {
+	Count int64    `json:"count"`
+	Min   *float64 `json:"min"` // unset when nothing matches
+	Max   *float64 `json:"max"`
+	Avg   *float64 `json:"avg"`
+}
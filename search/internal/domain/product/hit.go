@@ -0,0 +1,51 @@
+package product
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// Hit is a product found by a search, with why and how well it matched.
+type Hit struct {
+	Product   *Product            `json:"product"`
+	Score     *float64            `json:"score,omitempty"`     // unset when sorted by a field rather than relevance
+	Highlight map[string][]string `json:"highlight,omitempty"` // matching fragments by field, when requested
+}
+
+// Highlight asks for the fragments of each hit's name that matched, with matches wrapped in PreTag and PostTag.
+type Highlight struct {
+	PreTag       string
+	PostTag      string
+	FragmentSize int // characters per fragment
+}
+
+const (
+	DefaultHighlightPreTag       = "<em>"
+	DefaultHighlightPostTag      = "</em>"
+	DefaultHighlightFragmentSize = 150
+)
+
+// NewHighlight fills in the defaults for unset values.
+func NewHighlight(preTag, postTag string, fragmentSize int) *Highlight {
+	if preTag == "" {
+		preTag = DefaultHighlightPreTag
+	}
+	if postTag == "" {
+		postTag = DefaultHighlightPostTag
+	}
+	if fragmentSize <= 0 {
+		fragmentSize = DefaultHighlightFragmentSize
+	}
+
+	return &Highlight{
+		PreTag:       preTag,
+		PostTag:      postTag,
+		FragmentSize: fragmentSize,
+	}
+}
+
+// key identifies the highlighting in a cache key. Tags are escaped but not normalised:
+// "<EM>" and "<em>" produce different fragments.
+func (h *Highlight) key() string {
+	return fmt.Sprintf("%s,%s,%d", url.QueryEscape(h.PreTag), url.QueryEscape(h.PostTag), h.FragmentSize)
+}
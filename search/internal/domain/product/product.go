@@ -6,6 +6,9 @@ import (
 	"github.com/google/uuid"
 )
 
+// ErrStale is returned when a write carries a version older than the one already stored.
+var ErrStale = errors.New("stale product version")
+
 type ID string
 
 func NewID() ID {
@@ -21,6 +24,7 @@ type Product struct {
 	name     string
 	price    float64
 	category string
+	version  int64 // version assigned by the product service
 }
 
 func New(name, category string, price float64) (*Product, error) {
@@ -64,11 +68,20 @@ func (p *Product) Category() string {
 	return p.category
 }
 
+func (p *Product) Version() int64 {
+	return p.version
+}
+
+func (p *Product) SetVersion(version int64) {
+	p.version = version
+}
+
+// Tags returns the cache tags of the searches this product matches exactly, in the form Search.Key tags them.
 func (p *Product) Tags() []string {
 	return []string{
-		"tag:product:" + p.ID(),
-		"tag:category:" + p.Category(),
-		"tag:name:" + p.Name(),
+		ProductTag(p.ID()),
+		CategoryTag(p.Category()),
+		NameTag(p.Name()),
 	}
 }
 
@@ -78,11 +91,13 @@ func (p *Product) MarshalJSON() ([]byte, error) {
 		Name     string  `json:"name"`
 		Price    float64 `json:"price"`
 		Category string  `json:"category"`
+		Version  int64   `json:"version"`
 	}{
 		ID:       p.id,
 		Name:     p.name,
 		Price:    p.price,
 		Category: p.category,
+		Version:  p.version,
 	})
 }
 
@@ -93,6 +108,7 @@ func (p *Product) UnmarshalJSON(data []byte) error {
 		Name     string  `json:"name"`
 		Price    float64 `json:"price"`
 		Category string  `json:"category"`
+		Version  int64   `json:"version"`
 	}
 
 	// Unmarshal into the temporary struct
@@ -105,6 +121,7 @@ func (p *Product) UnmarshalJSON(data []byte) error {
 	p.name = temp.Name
 	p.price = temp.Price
 	p.category = temp.Category
+	p.version = temp.Version
 
 	return nil
 }
@@ -0,0 +1,509 @@
+package product
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Expr is a parsed search expression, see ParseQuery. Its String form parses back to it.
+type Expr interface {
+	String() string
+}
+
+// Match matches Text against product names, as the name filter does; a Phrase matches its
+// words in order.
+type Match struct {
+	Text   string
+	Phrase bool
+}
+
+// Term matches products whose Field is exactly Value.
+type Term struct {
+	Field string
+	Value string
+}
+
+// Range matches products whose Field lies between From and To; a nil bound is open.
+type Range struct {
+	Field       string
+	From, To    *float64
+	IncludeFrom bool
+	IncludeTo   bool
+}
+
+// Not matches products Expr doesn't.
+type Not struct {
+	Expr Expr
+}
+
+// And matches products every expression matches.
+type And []Expr
+
+// Or matches products any expression matches.
+type Or []Expr
+
+func (m Match) String() string {
+	if m.Phrase || strings.ContainsAny(m.Text, " \t\r\n()[]{}:\"") || strings.HasPrefix(m.Text, "-") || keyword(m.Text) {
+		return "name:" + quote(m.Text)
+	}
+	return "name:" + m.Text
+}
+
+func (t Term) String() string {
+	return t.Field + ":" + quote(t.Value)
+}
+
+// quote makes a phrase of s, escaping what the lexer unescapes.
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func (r Range) String() string {
+	open, end := "{", "}"
+	if r.IncludeFrom {
+		open = "["
+	}
+	if r.IncludeTo {
+		end = "]"
+	}
+	return fmt.Sprintf("%s:%s%s TO %s%s", r.Field, open, bound(r.From), bound(r.To), end)
+}
+
+func bound(v *float64) string {
+	if v == nil {
+		return "*"
+	}
+	return strconv.FormatFloat(*v, 'f', -1, 64)
+}
+
+func (n Not) String() string {
+	return "-" + group(n.Expr)
+}
+
+func (a And) String() string {
+	return join(a, " AND ")
+}
+
+func (o Or) String() string {
+	return join(o, " OR ")
+}
+
+func join(exprs []Expr, op string) string {
+	parts := make([]string, len(exprs))
+	for i, e := range exprs {
+		parts[i] = group(e)
+	}
+	return strings.Join(parts, op)
+}
+
+// group parenthesises compound expressions, so String keeps their precedence.
+func group(e Expr) string {
+	switch e.(type) {
+	case And, Or:
+		return "(" + e.String() + ")"
+	}
+	return e.String()
+}
+
+// SyntaxError reports where a query failed to parse.
+type SyntaxError struct {
+	Pos int // byte offset into the query, from 0
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Msg, e.Pos)
+}
+
+const (
+	// MaxQueryLength bounds the length of a query in bytes.
+	MaxQueryLength = 1024
+	// maxQueryClauses bounds how many terms, phrases and ranges a query holds.
+	maxQueryClauses = 32
+)
+
+// ParseQuery parses a search expression such as
+//
+//	category:shoes price:[10 TO 50] -refurbished "running shoe"
+//
+// Bare words and "quoted phrases" match the name; name:, category: and price: restrict a
+// term to a field. Prices take a number or a range, [ and ] including the bound and { and }
+// excluding it, with * for an open end. A leading - or NOT negates a term or (group); terms
+// side by side must all match, unless joined by OR, which binds looser than AND.
+func ParseQuery(q string) (Expr, error) {
+	if len(q) > MaxQueryLength {
+		return nil, &SyntaxError{Pos: MaxQueryLength, Msg: fmt.Sprintf("query is longer than %d bytes", MaxQueryLength)}
+	}
+
+	p := &parser{lex: lexer{src: q}}
+	p.next()
+	if p.err != nil {
+		return nil, p.err
+	}
+	if p.tok.kind == tokEOF {
+		return nil, &SyntaxError{Pos: 0, Msg: "empty query"}
+	}
+
+	e, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.unexpected()
+	}
+	return e, nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokPhrase
+	tokColon
+	tokMinus
+	tokLParen
+	tokRParen
+	tokLBracket
+	tokRBracket
+	tokLBrace
+	tokRBrace
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+type lexer struct {
+	src string
+	pos int
+}
+
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.src) && isSpace(l.src[l.pos]) {
+		l.pos++
+	}
+	if l.pos == len(l.src) {
+		return token{kind: tokEOF, pos: l.pos}, nil
+	}
+
+	start := l.pos
+	single := map[byte]tokenKind{
+		':': tokColon, '(': tokLParen, ')': tokRParen,
+		'[': tokLBracket, ']': tokRBracket, '{': tokLBrace, '}': tokRBrace,
+	}
+	c := l.src[l.pos]
+	if kind, ok := single[c]; ok {
+		l.pos++
+		return token{kind: kind, text: string(c), pos: start}, nil
+	}
+
+	switch {
+	case c == '-':
+		l.pos++
+		return token{kind: tokMinus, text: "-", pos: start}, nil
+	case c == '"':
+		var b strings.Builder
+		for l.pos++; l.pos < len(l.src); l.pos++ {
+			switch l.src[l.pos] {
+			case '\\':
+				if l.pos+1 < len(l.src) {
+					l.pos++
+				}
+			case '"':
+				l.pos++
+				return token{kind: tokPhrase, text: b.String(), pos: start}, nil
+			}
+			b.WriteByte(l.src[l.pos])
+		}
+		return token{}, &SyntaxError{Pos: start, Msg: "unterminated phrase"}
+	}
+
+	for l.pos < len(l.src) && !isSpace(l.src[l.pos]) && !strings.ContainsRune(":()[]{}\"", rune(l.src[l.pos])) {
+		l.pos++
+	}
+	return token{kind: tokWord, text: l.src[start:l.pos], pos: start}, nil
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// keyword reports whether a word is an operator rather than a term.
+func keyword(w string) bool {
+	return w == "AND" || w == "OR" || w == "NOT" || w == "TO"
+}
+
+type parser struct {
+	lex     lexer
+	tok     token
+	err     error
+	clauses int
+}
+
+func (p *parser) next() {
+	if p.err != nil {
+		return
+	}
+	p.tok, p.err = p.lex.next()
+}
+
+func (p *parser) unexpected() error {
+	if p.err != nil {
+		return p.err
+	}
+	if p.tok.kind == tokEOF {
+		return &SyntaxError{Pos: p.tok.pos, Msg: "unexpected end of query"}
+	}
+	return &SyntaxError{Pos: p.tok.pos, Msg: fmt.Sprintf("unexpected %q", p.tok.text)}
+}
+
+func (p *parser) isWord(w string) bool {
+	return p.err == nil && p.tok.kind == tokWord && p.tok.text == w
+}
+
+// or := and ("OR" and)*
+func (p *parser) or() (Expr, error) {
+	e, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+
+	exprs := Or{e}
+	for p.isWord("OR") {
+		p.next()
+		if e, err = p.and(); err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, e)
+	}
+
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return exprs, nil
+}
+
+// and := unary (["AND"] unary)*
+func (p *parser) and() (Expr, error) {
+	e, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+
+	exprs := And{e}
+	for p.err == nil && p.tok.kind != tokEOF && p.tok.kind != tokRParen && !p.isWord("OR") {
+		if p.isWord("AND") {
+			p.next()
+		}
+		if e, err = p.unary(); err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, e)
+	}
+
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return exprs, nil
+}
+
+// unary := ("-" | "NOT") unary | primary
+func (p *parser) unary() (Expr, error) {
+	if p.err == nil && (p.tok.kind == tokMinus || p.isWord("NOT")) {
+		p.next()
+		e, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return Not{Expr: e}, nil
+	}
+	return p.primary()
+}
+
+// primary := "(" or ")" | field ":" value | word | phrase
+func (p *parser) primary() (Expr, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	switch p.tok.kind {
+	case tokLParen:
+		open := p.tok.pos
+		p.next()
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.err != nil {
+			return nil, p.err
+		}
+		if p.tok.kind != tokRParen {
+			return nil, &SyntaxError{Pos: open, Msg: "unclosed \"(\""}
+		}
+		p.next()
+		return e, nil
+	case tokPhrase:
+		tok := p.tok
+		p.next()
+		return p.match(tok, tok.text, true)
+	case tokWord:
+		if keyword(p.tok.text) {
+			return nil, p.unexpected()
+		}
+		tok := p.tok
+		p.next()
+		if p.err != nil || p.tok.kind != tokColon {
+			return p.match(tok, tok.text, false)
+		}
+		p.next()
+		return p.field(tok)
+	}
+
+	return nil, p.unexpected()
+}
+
+func (p *parser) match(at token, text string, phrase bool) (Expr, error) {
+	if strings.TrimSpace(text) == "" {
+		return nil, &SyntaxError{Pos: at.pos, Msg: "empty phrase"}
+	}
+	if err := p.clause(at); err != nil {
+		return nil, err
+	}
+	return Match{Text: text, Phrase: phrase}, nil
+}
+
+func (p *parser) clause(at token) error {
+	if p.clauses++; p.clauses > maxQueryClauses {
+		return &SyntaxError{Pos: at.pos, Msg: fmt.Sprintf("query holds more than %d terms", maxQueryClauses)}
+	}
+	return nil
+}
+
+// field parses the value of name:, category: or price:.
+func (p *parser) field(name token) (Expr, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	value := p.tok
+	switch name.text {
+	case "name":
+		if value.kind != tokWord && value.kind != tokPhrase {
+			return nil, &SyntaxError{Pos: value.pos, Msg: "name takes a word or a phrase"}
+		}
+		p.next()
+		return p.match(value, value.text, value.kind == tokPhrase)
+	case "category":
+		if value.kind != tokWord && value.kind != tokPhrase {
+			return nil, &SyntaxError{Pos: value.pos, Msg: "category takes a word or a phrase"}
+		}
+		p.next()
+		if err := p.clause(value); err != nil {
+			return nil, err
+		}
+		return Term{Field: "category", Value: value.text}, nil
+	case "price":
+		if err := p.clause(value); err != nil {
+			return nil, err
+		}
+		if value.kind == tokLBracket || value.kind == tokLBrace {
+			return p.priceRange()
+		}
+		v, err := p.number()
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			return nil, &SyntaxError{Pos: value.pos, Msg: "price takes a number or a range"}
+		}
+		return Range{Field: "price", From: v, To: v, IncludeFrom: true, IncludeTo: true}, nil
+	}
+
+	return nil, &SyntaxError{Pos: name.pos, Msg: fmt.Sprintf("unknown field %q, must be one of name, category, price", name.text)}
+}
+
+// priceRange := ("[" | "{") bound "TO" bound ("]" | "}")
+func (p *parser) priceRange() (Expr, error) {
+	r := Range{Field: "price", IncludeFrom: p.tok.kind == tokLBracket}
+	open := p.tok.pos
+	p.next()
+
+	var err error
+	if r.From, err = p.number(); err != nil {
+		return nil, err
+	}
+	if !p.isWord("TO") {
+		return nil, p.expected("TO")
+	}
+	p.next()
+	if r.To, err = p.number(); err != nil {
+		return nil, err
+	}
+
+	if p.err != nil {
+		return nil, p.err
+	}
+	switch p.tok.kind {
+	case tokRBracket:
+		r.IncludeTo = true
+	case tokRBrace:
+	default:
+		return nil, p.expected("\"]\" or \"}\"")
+	}
+	p.next()
+
+	if r.From != nil && r.To != nil && *r.From > *r.To {
+		return nil, &SyntaxError{Pos: open, Msg: "range starts after it ends"}
+	}
+	return r, nil
+}
+
+// number parses a price, or * for none.
+func (p *parser) number() (*float64, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	tok := p.tok
+	if tok.kind == tokWord && tok.text == "*" {
+		p.next()
+		return nil, nil
+	}
+
+	text := tok.text
+	if tok.kind == tokMinus {
+		p.next()
+		if p.err != nil || p.tok.kind != tokWord {
+			return nil, p.expected("a number")
+		}
+		text += p.tok.text
+	} else if tok.kind != tokWord {
+		return nil, p.expected("a number")
+	}
+
+	// ParseFloat takes "NaN" and "Inf" too, which no price matches or bounds
+	v, err := strconv.ParseFloat(text, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil, &SyntaxError{Pos: tok.pos, Msg: fmt.Sprintf("%q is not a number", text)}
+	}
+	p.next()
+	return &v, nil
+}
+
+func (p *parser) expected(what string) error {
+	if p.err != nil {
+		return p.err
+	}
+	if p.tok.kind == tokEOF {
+		return &SyntaxError{Pos: p.tok.pos, Msg: "expected " + what + ", found end of query"}
+	}
+	return &SyntaxError{Pos: p.tok.pos, Msg: fmt.Sprintf("expected %s, found %q", what, p.tok.text)}
+}
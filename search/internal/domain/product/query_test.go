@@ -0,0 +1,176 @@
+package product
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func num(v float64) *float64 { return &v }
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		q    string
+		want Expr
+	}{
+		{"shoe", Match{Text: "shoe"}},
+		{`"trail shoe"`, Match{Text: "trail shoe", Phrase: true}},
+		{`"say \"hi\""`, Match{Text: `say "hi"`, Phrase: true}},
+		{"name:boot", Match{Text: "boot"}},
+		{`name:"ankle boot"`, Match{Text: "ankle boot", Phrase: true}},
+		{"category:shoes", Term{Field: "category", Value: "shoes"}},
+		{`category:"running shoes"`, Term{Field: "category", Value: "running shoes"}},
+		{"price:10", Range{Field: "price", From: num(10), To: num(10), IncludeFrom: true, IncludeTo: true}},
+		{"price:-2.5", Range{Field: "price", From: num(-2.5), To: num(-2.5), IncludeFrom: true, IncludeTo: true}},
+		{"price:[10 TO 50]", Range{Field: "price", From: num(10), To: num(50), IncludeFrom: true, IncludeTo: true}},
+		{"price:{10 TO 50}", Range{Field: "price", From: num(10), To: num(50)}},
+		{"price:[10 TO *}", Range{Field: "price", From: num(10), IncludeFrom: true}},
+		{"price:{* TO 50]", Range{Field: "price", To: num(50), IncludeTo: true}},
+		{"shoe boot", And{Match{Text: "shoe"}, Match{Text: "boot"}}},
+		{"shoe AND boot", And{Match{Text: "shoe"}, Match{Text: "boot"}}},
+		{"shoe OR boot", Or{Match{Text: "shoe"}, Match{Text: "boot"}}},
+		{"-sale", Not{Expr: Match{Text: "sale"}}},
+		{"NOT category:sale", Not{Expr: Term{Field: "category", Value: "sale"}}},
+		{"--sale", Not{Expr: Not{Expr: Match{Text: "sale"}}}},
+		// OR binds looser than AND
+		{"a b OR c", Or{And{Match{Text: "a"}, Match{Text: "b"}}, Match{Text: "c"}}},
+		{"a OR b c", Or{Match{Text: "a"}, And{Match{Text: "b"}, Match{Text: "c"}}}},
+		{"a (b OR c)", And{Match{Text: "a"}, Or{Match{Text: "b"}, Match{Text: "c"}}}},
+		{"-(a OR b) category:shoes", And{Not{Expr: Or{Match{Text: "a"}, Match{Text: "b"}}}, Term{Field: "category", Value: "shoes"}}},
+		// words run up to a space or a reserved character, so a hyphen inside one stays
+		{"t-shirt", Match{Text: "t-shirt"}},
+		{"  shoe\t", Match{Text: "shoe"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.q, func(t *testing.T) {
+			got, err := ParseQuery(tt.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseQuery(%q) = %#v, want %#v", tt.q, got, tt.want)
+			}
+
+			// String parses back to the same expression
+			again, err := ParseQuery(got.String())
+			if err != nil {
+				t.Fatalf("ParseQuery(%q), from String: %v", got.String(), err)
+			}
+			if !reflect.DeepEqual(again, got) {
+				t.Errorf("ParseQuery(%q) = %#v, want %#v", got.String(), again, got)
+			}
+		})
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	tests := []struct {
+		q   string
+		pos int
+		msg string
+	}{
+		{"", 0, "empty query"},
+		{"   ", 0, "empty query"},
+		{`shoe "trail`, 5, "unterminated phrase"},
+		{`""`, 0, "empty phrase"},
+		{"shoe (boot", 5, `unclosed "("`},
+		{"shoe)", 4, `unexpected ")"`},
+		{"shoe AND", 8, "unexpected end of query"},
+		{"OR shoe", 0, `unexpected "OR"`},
+		{"shoe OR OR boot", 8, `unexpected "OR"`},
+		{"colour:red", 0, `unknown field "colour"`},
+		{"name:(shoe)", 5, "name takes a word or a phrase"},
+		{"category:", 9, "category takes a word or a phrase"},
+		{"price:cheap", 6, `"cheap" is not a number`},
+		{"price:*", 6, "price takes a number or a range"},
+		{"price:NaN", 6, `"NaN" is not a number`},
+		{"price:Inf", 6, `"Inf" is not a number`},
+		{"price:[-Inf TO 5]", 7, `"-Inf" is not a number`},
+		{"price:[0 TO infinity]", 12, `"infinity" is not a number`},
+		{"price:[1e400 TO *]", 7, `"1e400" is not a number`},
+		{"price:[10 50]", 10, `expected TO, found "50"`},
+		{"price:[10 TO 50", 15, `expected "]" or "}", found end of query`},
+		{"shoe price:[50 TO 10]", 11, "range starts after it ends"},
+		{strings.Repeat("a ", maxQueryClauses) + "b", 2 * maxQueryClauses, "more than 32 terms"},
+		{strings.Repeat("a", MaxQueryLength+1), MaxQueryLength, "longer than 1024 bytes"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.q, func(t *testing.T) {
+			_, err := ParseQuery(tt.q)
+
+			var syntax *SyntaxError
+			if !errors.As(err, &syntax) {
+				t.Fatalf("ParseQuery(%q) error = %v, want a SyntaxError", tt.q, err)
+			}
+			if syntax.Pos != tt.pos || !strings.Contains(syntax.Msg, tt.msg) {
+				t.Errorf("ParseQuery(%q) error = %q at %d, want %q at %d", tt.q, syntax.Msg, syntax.Pos, tt.msg, tt.pos)
+			}
+		})
+	}
+}
+
+func TestWithQueryLiftsFilters(t *testing.T) {
+	tests := []struct {
+		name       string
+		search     func() *Search
+		q          string
+		query      Expr // what is left of q
+		categories []string
+		min, max   *float64
+	}{
+		{"category", NewSearch, "category:shoes trail",
+			Match{Text: "trail"}, []string{"shoes"}, nil, nil},
+		{"inclusive range", NewSearch, "price:[10 TO 50] trail",
+			Match{Text: "trail"}, nil, num(10), num(50)},
+		{"half open inclusive range", NewSearch, "price:[10 TO *}",
+			nil, nil, num(10), nil},
+		{"exact price", NewSearch, "price:20",
+			nil, nil, num(20), num(20)},
+		{"everything lifted", NewSearch, "category:shoes AND price:[10 TO 50]",
+			nil, []string{"shoes"}, num(10), num(50)},
+		{"exclusive range is kept", NewSearch, "price:{10 TO 50]",
+			Range{Field: "price", From: num(10), To: num(50), IncludeTo: true}, nil, nil, nil},
+		{"second category is kept", NewSearch, "category:shoes category:boots",
+			Term{Field: "category", Value: "boots"}, []string{"shoes"}, nil, nil},
+		{"category filter already set", func() *Search { return NewSearch().WithCategory("boots") }, "category:shoes",
+			Term{Field: "category", Value: "shoes"}, []string{"boots"}, nil, nil},
+		{"price bound already set", func() *Search { return NewSearch().WithMinPrice(5) }, "price:[10 TO 50]",
+			Range{Field: "price", From: num(10), To: num(50), IncludeFrom: true, IncludeTo: true}, nil, num(5), nil},
+		{"alternatives are kept", NewSearch, "category:shoes OR category:boots",
+			Or{Term{Field: "category", Value: "shoes"}, Term{Field: "category", Value: "boots"}}, nil, nil, nil},
+		{"negations are kept", NewSearch, "-category:sale shoe",
+			And{Not{Expr: Term{Field: "category", Value: "sale"}}, Match{Text: "shoe"}}, nil, nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := ParseQuery(tt.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s := tt.search().WithQuery(e)
+
+			if !reflect.DeepEqual(s.Query(), tt.query) {
+				t.Errorf("query = %#v, want %#v", s.Query(), tt.query)
+			}
+			if !reflect.DeepEqual(s.Categories(), tt.categories) {
+				t.Errorf("categories = %v, want %v", s.Categories(), tt.categories)
+			}
+			min, max := s.PriceRange()
+			if !reflect.DeepEqual(min, tt.min) || !reflect.DeepEqual(max, tt.max) {
+				t.Errorf("price range = %v to %v, want %v to %v", deref(min), deref(max), deref(tt.min), deref(tt.max))
+			}
+		})
+	}
+}
+
+func deref(v *float64) interface{} {
+	if v == nil {
+		return nil
+	}
+	return *v
+}
@@ -0,0 +1,64 @@
+package product
+
+// Result is one page of search results, with what clients need to page through the rest.
+type Result struct {
+	Items    []Hit `json:"items"`
+	Total    int64 `json:"total"`          // matching products across all pages
+	Page     int   `json:"page,omitempty"` // unset when paging with a cursor
+	PageSize int   `json:"page_size"`
+	HasNext  bool  `json:"has_next"`
+
+	NextCursor string `json:"next_cursor,omitempty"` // set when paging with a cursor and there is a next page
+
+	Sort    []Sort  `json:"sort,omitempty"` // unset when ordered by relevance
+	Filters Filters `json:"filters"`
+
+	Facets *Facets `json:"facets,omitempty"` // set when facets were requested
+}
+
+// Filters are the filters a search applied.
+type Filters struct {
+	Name              string       `json:"name,omitempty"`
+	Categories        []string     `json:"categories,omitempty"`
+	ExcludeCategories []string     `json:"exclude_categories,omitempty"`
+	IDs               []string     `json:"ids,omitempty"`
+	MinPrice          *float64     `json:"min_price,omitempty"`
+	MaxPrice          *float64     `json:"max_price,omitempty"`
+	PriceRanges       []PriceRange `json:"price_ranges,omitempty"`
+	Query             string       `json:"q,omitempty"` // what a q= expression matches beyond the other filters
+}
+
+// NewResult wraps the page of items s found, out of total matches.
+func NewResult(s *Search, items []Hit, total int64) *Result {
+	if items == nil {
+		items = []Hit{}
+	}
+
+	page, size := s.pagination()
+	r := &Result{
+		Items:    items,
+		Total:    total,
+		Page:     page,
+		PageSize: size,
+		HasNext:  int64((page-1)*size+len(items)) < total,
+	}
+
+	r.Sort = s.Sort()
+
+	if c := s.Cursor(); c != nil {
+		r.Page = 0
+		r.HasNext = c.Seen+int64(len(items)) < total
+	}
+
+	r.Filters.Name = s.Name()
+	r.Filters.Categories = s.Categories()
+	r.Filters.ExcludeCategories = s.ExcludedCategories()
+	r.Filters.IDs = s.IDs()
+	r.Filters.MinPrice, r.Filters.MaxPrice = s.PriceRange()
+	r.Filters.PriceRanges = s.PriceRanges()
+	if q := s.Query(); q != nil {
+		r.Filters.Query = q.String()
+	}
+
+	return r
+}
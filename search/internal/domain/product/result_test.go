@@ -0,0 +1,110 @@
+package product
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// envelope decodes a result as a client sees it.
+func envelope(t *testing.T, r *Result) map[string]any {
+	t.Helper()
+	b, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]any
+	if err = json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestResultPaging(t *testing.T) {
+	hits := func(n int) []Hit {
+		h := make([]Hit, n)
+		for i := range h {
+			h[i] = Hit{Product: &Product{id: "a"}}
+		}
+		return h
+	}
+
+	tests := []struct {
+		name    string
+		search  *Search
+		items   int
+		total   int64
+		page    int
+		size    int
+		hasNext bool
+	}{
+		{"defaults", NewSearch(), 20, 45, 1, 20, true},
+		{"middle page", NewSearch().WithPage(2).WithPageSize(20), 20, 45, 2, 20, true},
+		{"last page", NewSearch().WithPage(3).WithPageSize(20), 5, 45, 3, 20, false},
+		{"exactly full", NewSearch().WithPage(2).WithPageSize(10), 10, 20, 2, 10, false},
+		{"nothing found", NewSearch(), 0, 0, 1, 20, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewResult(tt.search, hits(tt.items), tt.total)
+			if r.Page != tt.page || r.PageSize != tt.size || r.HasNext != tt.hasNext || r.Total != tt.total {
+				t.Errorf("NewResult() = page %d, size %d, has next %v, total %d, want %d, %d, %v, %d",
+					r.Page, r.PageSize, r.HasNext, r.Total, tt.page, tt.size, tt.hasNext, tt.total)
+			}
+		})
+	}
+}
+
+func TestResultEnvelope(t *testing.T) {
+	sorts, err := ParseSort("-price")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSearch().WithName("shoe").WithCategory("shoes").WithMinPrice(10).WithSort(sorts...)
+
+	m := envelope(t, NewResult(s, nil, 0))
+
+	// an empty page still lists its items, so clients needn't check for null
+	if items, ok := m["items"].([]any); !ok || len(items) != 0 {
+		t.Errorf("items = %#v, want []", m["items"])
+	}
+	for _, key := range []string{"total", "page", "page_size", "has_next", "filters", "sort"} {
+		if _, ok := m[key]; !ok {
+			t.Errorf("envelope has no %q: %v", key, m)
+		}
+	}
+	for _, key := range []string{"next_cursor", "facets"} {
+		if _, ok := m[key]; ok {
+			t.Errorf("envelope has %q though it wasn't asked for", key)
+		}
+	}
+
+	want := map[string]any{"name": "shoe", "categories": []any{"shoes"}, "min_price": 10.0}
+	if !reflect.DeepEqual(m["filters"], want) {
+		t.Errorf("filters = %v, want %v", m["filters"], want)
+	}
+	if got := m["sort"]; !reflect.DeepEqual(got, []any{map[string]any{"field": "price", "order": "desc"}}) {
+		t.Errorf("sort = %v", got)
+	}
+}
+
+func TestCursorResultEnvelope(t *testing.T) {
+	s := NewSearch().WithPageSize(2).WithCursor(&Cursor{PIT: "pit", After: []json.RawMessage{[]byte(`1`)}, Seen: 4})
+	r := NewResult(s, []Hit{{Product: &Product{id: "a"}}, {Product: &Product{id: "b"}}}, 7)
+	r.NextCursor = "next"
+
+	m := envelope(t, r)
+	if _, ok := m["page"]; ok {
+		t.Error("a cursor page has a page number")
+	}
+	// 4 seen before and 2 now, out of 7
+	if m["has_next"] != true || m["next_cursor"] != "next" {
+		t.Errorf("has_next %v, next_cursor %v, want another page", m["has_next"], m["next_cursor"])
+	}
+
+	s = s.WithCursor(&Cursor{PIT: "pit", After: []json.RawMessage{[]byte(`1`)}, Seen: 5})
+	if r = NewResult(s, []Hit{{Product: &Product{id: "a"}}, {Product: &Product{id: "b"}}}, 7); r.HasNext {
+		t.Error("has_next on the last cursor page")
+	}
+}
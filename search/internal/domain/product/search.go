@@ -3,24 +3,46 @@ package product
 import (
 	"crypto/sha1"
 	"fmt"
+	"math"
 	"net/url"
+	"slices"
 	"strings"
 )
 
 type Search struct {
-	name     string // match a query on name
-	category string // term filter on category
+	name string // match a query on name
 
-	minPrice *float64 // range filter
-	maxPrice *float64
+	categories        []string // terms filter on category: any of
+	excludeCategories []string // terms filter on category: none of
+	ids               []string // terms filter on id: any of
+
+	minPrice    *float64 // range filter
+	maxPrice    *float64
+	priceRanges []PriceRange // on top of min and max: any of
 
 	page     int // pagination: page number (1-based)
 	pageSize int // pagination: items per page
 
-	sortField string // e.g. "price"
-	sortAsc   bool   // true = asc, false = desc
+	sort []Sort // e.g. price descending, then name; empty = by relevance
+
+	cursor *Cursor // if set, pages with search_after instead of page and offset
+
+	query Expr // what a q= expression leaves once its filters are lifted out; nil = none
+
+	facets    FacetRequest
+	highlight *Highlight // if set, hits carry the fragments of their name that matched
 }
 
+const (
+	// MaxPageSize bounds how many results one page holds.
+	MaxPageSize = 100
+	// MaxResultWindow bounds how deep offset paging reaches (Elasticsearch's
+	// index.max_result_window); cursor paging has no such limit.
+	MaxResultWindow = 10000
+	// MaxFilterValues bounds how many values a multi-value filter holds.
+	MaxFilterValues = 100
+)
+
 func NewSearch() *Search {
 	return &Search{
 		page:     1,  // default page
@@ -33,8 +55,21 @@ func (s *Search) WithName(name string) *Search {
 	return s
 }
 
-func (s *Search) WithCategory(category string) *Search {
-	s.category = category
+// WithCategory adds categories the products may be in.
+func (s *Search) WithCategory(categories ...string) *Search {
+	s.categories = append(s.categories, categories...)
+	return s
+}
+
+// WithExcludedCategory adds categories the products may not be in.
+func (s *Search) WithExcludedCategory(categories ...string) *Search {
+	s.excludeCategories = append(s.excludeCategories, categories...)
+	return s
+}
+
+// WithIDs adds products the search may return; it returns only those once any are added.
+func (s *Search) WithIDs(ids ...string) *Search {
+	s.ids = append(s.ids, ids...)
 	return s
 }
 
@@ -48,6 +83,12 @@ func (s *Search) WithMaxPrice(maxPrice float64) *Search {
 	return s
 }
 
+// WithPriceRanges adds price ranges the products may lie in, besides lying between the min and max price.
+func (s *Search) WithPriceRanges(ranges ...PriceRange) *Search {
+	s.priceRanges = append(s.priceRanges, ranges...)
+	return s
+}
+
 func (s *Search) WithPage(page int) *Search {
 	s.page = page
 	return s
@@ -58,13 +99,73 @@ func (s *Search) WithPageSize(pageSize int) *Search {
 	return s
 }
 
-func (s *Search) WithSortField(sort string) *Search {
-	s.sortField = sort
+func (s *Search) WithSort(keys ...Sort) *Search {
+	s.sort = keys
 	return s
 }
 
-func (s *Search) WithSortAsc(asc bool) *Search {
-	s.sortAsc = asc
+// WithQuery narrows the search to products e matches. Where e requires a category or a price
+// bound the search doesn't set yet, those become its filters; the rest is kept as the query.
+func (s *Search) WithQuery(e Expr) *Search {
+	conjuncts, ok := e.(And)
+	if !ok {
+		conjuncts = And{e}
+	}
+
+	var rest And
+	for _, c := range conjuncts {
+		if !s.lift(c) {
+			rest = append(rest, c)
+		}
+	}
+
+	switch len(rest) {
+	case 0:
+		s.query = nil
+	case 1:
+		s.query = rest[0]
+	default:
+		s.query = rest
+	}
+	return s
+}
+
+// lift sets the filter e stands for, if there is one and it is unset.
+func (s *Search) lift(e Expr) bool {
+	switch e := e.(type) {
+	case Term:
+		if e.Field == "category" && len(s.categories) == 0 {
+			s.categories = []string{e.Value}
+			return true
+		}
+	case Range:
+		if e.Field != "price" || (e.From != nil && (!e.IncludeFrom || s.minPrice != nil)) || (e.To != nil && (!e.IncludeTo || s.maxPrice != nil)) {
+			return false
+		}
+		if e.From != nil {
+			s.WithMinPrice(*e.From)
+		}
+		if e.To != nil {
+			s.WithMaxPrice(*e.To)
+		}
+		return true
+	}
+	return false
+}
+
+// WithCursor switches the search to cursor paging; an empty cursor starts a new walk.
+func (s *Search) WithCursor(cursor *Cursor) *Search {
+	s.cursor = cursor
+	return s
+}
+
+func (s *Search) WithFacets(facets FacetRequest) *Search {
+	s.facets = facets
+	return s
+}
+
+func (s *Search) WithHighlight(highlight *Highlight) *Search {
+	s.highlight = highlight
 	return s
 }
 
@@ -72,8 +173,19 @@ func (s *Search) Name() string {
 	return s.name
 }
 
-func (s *Search) Category() string {
-	return s.category
+// Categories returns the categories the products may be in, without duplicates and in canonical order.
+func (s *Search) Categories() []string {
+	return canonical(s.categories)
+}
+
+// ExcludedCategories returns the categories the products may not be in, without duplicates and in canonical order.
+func (s *Search) ExcludedCategories() []string {
+	return canonical(s.excludeCategories)
+}
+
+// IDs returns the products the search may return, without duplicates and in canonical order.
+func (s *Search) IDs() []string {
+	return canonical(s.ids)
 }
 
 // PriceRange returns (minPrice, maxPrice)
@@ -81,6 +193,20 @@ func (s *Search) PriceRange() (*float64, *float64) {
 	return s.minPrice, s.maxPrice
 }
 
+// PriceRanges returns the ranges the products may lie in, without duplicates and in canonical order.
+func (s *Search) PriceRanges() []PriceRange {
+	seen := make(map[string]bool, len(s.priceRanges))
+	var out []PriceRange
+	for _, r := range s.priceRanges {
+		if k := r.String(); !seen[k] {
+			seen[k] = true
+			out = append(out, r)
+		}
+	}
+	slices.SortFunc(out, func(a, b PriceRange) int { return strings.Compare(a.String(), b.String()) })
+	return out
+}
+
 func (s *Search) Page() int {
 	return s.page
 }
@@ -94,50 +220,132 @@ func (s *Search) Pagination() (int, int) {
 	return s.Page(), s.PageSize()
 }
 
+// Cursor returns the cursor being paged with, or nil for offset paging.
+func (s *Search) Cursor() *Cursor {
+	return s.cursor
+}
+
+// Query returns what the search matches beyond its filters, or nil.
+func (s *Search) Query() Expr {
+	return s.query
+}
+
+func (s *Search) Facets() FacetRequest {
+	return s.facets
+}
+
+func (s *Search) Highlight() *Highlight {
+	return s.highlight
+}
+
 // Offset returns offset
 func (s *Search) Offset() int {
 	return (s.page - 1) * s.pageSize
 }
 
-// SortBy returns (sortField, sortDir)
-func (s *Search) SortBy() (string, string) {
-	sortDir := "asc"
-	if !s.sortAsc {
-		sortDir = "desc"
+// Sort returns the keys results are ordered by, most significant first; none means by relevance.
+func (s *Search) Sort() []Sort {
+	return s.sort
+}
+
+// Validate checks the search can be run, returning a message per invalid parameter.
+func (s *Search) Validate() map[string]string {
+	errs := make(map[string]string)
+
+	if s.page < 1 {
+		errs["page"] = "must be at least 1"
+	}
+	if s.pageSize < 1 || s.pageSize > MaxPageSize {
+		errs["page_size"] = fmt.Sprintf("must be between 1 and %d", MaxPageSize)
+	}
+	if s.cursor == nil && len(errs) == 0 && s.page*s.pageSize > MaxResultWindow {
+		errs["page"] = fmt.Sprintf("offset paging reaches the first %d results only, page further with a cursor", MaxResultWindow)
+	}
+
+	if s.minPrice != nil && !(*s.minPrice >= 0 && !math.IsInf(*s.minPrice, 1)) {
+		errs["min_price"] = "must be a non-negative number"
+	}
+	if s.maxPrice != nil && !(*s.maxPrice >= 0 && !math.IsInf(*s.maxPrice, 1)) {
+		errs["max_price"] = "must be a non-negative number"
+	}
+	if s.minPrice != nil && s.maxPrice != nil && *s.minPrice > *s.maxPrice {
+		errs["min_price"] = "must not be greater than max_price"
+	}
+	for _, r := range s.priceRanges {
+		if r.From != nil && r.To != nil && *r.From >= *r.To {
+			errs["price_range"] = fmt.Sprintf("range %s is empty", r)
+		}
+	}
+
+	// also rejects NaN
+	if iv := s.facets.PriceInterval; iv != 0 && !(iv >= MinPriceInterval && !math.IsInf(iv, 1)) {
+		errs["price_interval"] = fmt.Sprintf("must be a number of at least %d", MinPriceInterval)
+	}
+
+	for param, values := range map[string]int{
+		"category":         len(s.Categories()),
+		"exclude_category": len(s.ExcludedCategories()),
+		"ids":              len(s.IDs()),
+		"price_range":      len(s.PriceRanges()),
+	} {
+		if values > MaxFilterValues {
+			errs[param] = fmt.Sprintf("must hold at most %d values", MaxFilterValues)
+		}
+	}
+
+	for _, k := range s.sort {
+		if !sortable(k.Field) || (k.Order != "asc" && k.Order != "desc") {
+			errs["sort"] = fmt.Sprintf("cannot sort by %q", k.String())
+		}
 	}
 
-	return s.sortField, sortDir
+	return errs
+}
+
+// pagination returns (page, pageSize), falling back to the defaults for unset values.
+func (s *Search) pagination() (int, int) {
+	page, size := s.Pagination()
+	if page <= 0 {
+		page = 1
+	}
+	if size <= 0 {
+		size = 20
+	}
+	return page, size
 }
 
 // Key builds a consistent Redis key for a product search and return tags that can be used to invalidate the cache.
-// E.g. "products:all|name=foo|cat=bar|sort=name-asc|page=1|size=20|min=10.00|max=20.00"
+// Equivalent searches share a key: multi-value filters are deduplicated and ordered canonically.
+// E.g. "products:result|name=foo|cat=bar,baz|sort=-price,name|page=1|size=20|min=10.00|max=20.00"
 func (s *Search) Key() (string, []string) {
 	var tags []string
-	parts := []string{"products:all"}
+	parts := []string{"products:result"} // cached as a Result; "products:all" held bare item lists
 
 	// normalized filters
 	if name := normalize(s.Name()); name != "" {
-		tags = append(tags, "tag:name:"+name)
+		tags = append(tags, NameTag(s.Name()))
 		parts = append(parts, "name="+name)
 	}
-	if cat := normalize(s.Category()); cat != "" {
-		tags = append(tags, "tag:category:"+cat)
-		parts = append(parts, "cat="+cat)
+	for _, cat := range s.Categories() {
+		tags = append(tags, CategoryTag(cat))
 	}
-	if field, order := s.SortBy(); field != "" {
-		tags = append(tags, "tag:sort:"+field+"-"+order) // e.g. "tag:sort:price-asc"
-		parts = append(parts, fmt.Sprintf("sort=%s-%s", field, order))
+	// a product moving into an excluded category leaves the result
+	for _, cat := range s.ExcludedCategories() {
+		tags = append(tags, CategoryTag(cat))
 	}
-
-	// pagination
-	page, size := s.Pagination()
-	if page <= 0 {
-		page = 1
+	for _, id := range s.IDs() {
+		tags = append(tags, ProductTag(id))
 	}
-	if size <= 0 {
-		size = 20
+	parts = append(parts, s.filterKey()...)
+	if len(s.sort) > 0 {
+		for _, k := range s.sort {
+			tags = append(tags, "tag:sort:"+k.Field+"-"+k.Order) // e.g. "tag:sort:price-asc"
+		}
+		parts = append(parts, "sort="+sortKey(s.sort))
 	}
 
+	// pagination
+	page, size := s.pagination()
 	tags = append(tags, "tag:paging:"+fmt.Sprintf("%d-%d", page, size)) // e.g. "tag:paging:1-20"
 	parts = append(parts, fmt.Sprintf("page=%d", page), fmt.Sprintf("size=%d", size))
 
@@ -151,6 +359,33 @@ func (s *Search) Key() (string, []string) {
 		tags = append(tags, "tag:max:"+fmt.Sprintf("%.2f", *maxPrice)) // e.g. "tag:max:20.00"
 		parts = append(parts, fmt.Sprintf("max=%.2f", *maxPrice))
 	}
+	for _, r := range s.PriceRanges() {
+		tags = append(tags, PriceRangeTag(r)) // e.g. "tag:range:10.00-20.00"
+	}
+	if ranges := s.PriceRanges(); len(ranges) > 0 {
+		parts = append(parts, "ranges="+priceRangesKey(ranges))
+	}
+
+	// the expression reads fields of any product, so any change may affect it
+	if s.query != nil {
+		tags = append(tags, QueryTag)
+		parts = append(parts, "q="+url.QueryEscape(s.query.String()))
+	}
+
+	// facets
+	if !s.facets.Empty() {
+		parts = append(parts, "facets="+s.facets.key())
+		if s.facets.Categories {
+			tags = append(tags, CategoryFacetTag)
+		}
+		if s.facets.pricing() {
+			tags = append(tags, PriceFacetTag)
+		}
+	}
+
+	if s.highlight != nil {
+		parts = append(parts, "hl="+s.highlight.key())
+	}
 
 	// join with '|'
 	raw := strings.Join(parts, "|")
@@ -161,6 +396,73 @@ func (s *Search) Key() (string, []string) {
 	return raw, tags
 }
 
+// filterKey identifies the multi-value filters, e.g. ["cat=bar,baz", "ids=1,2"].
+// Values are escaped rather than normalized, since their filters match them exactly.
+func (s *Search) filterKey() []string {
+	var parts []string
+	for _, f := range []struct {
+		name   string
+		values []string
+	}{
+		{"cat", s.Categories()},
+		{"xcat", s.ExcludedCategories()},
+		{"ids", s.IDs()},
+	} {
+		if len(f.values) == 0 {
+			continue
+		}
+		escaped := make([]string, len(f.values))
+		for i, v := range f.values {
+			escaped[i] = url.QueryEscape(v)
+		}
+		parts = append(parts, f.name+"="+strings.Join(escaped, ","))
+	}
+	return parts
+}
+
+func priceRangesKey(ranges []PriceRange) string {
+	keys := make([]string, len(ranges))
+	for i, r := range ranges {
+		keys[i] = r.String()
+	}
+	return strings.Join(keys, ";")
+}
+
+// canonical trims values and drops blanks and duplicates, in sorted order.
+func canonical(values []string) []string {
+	var out []string
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	slices.Sort(out)
+	return slices.Compact(out)
+}
+
+// QueryTag tags cached results of searches with a q= expression.
+const QueryTag = "tag:query"
+
+// ProductTag tags cached results that contain the product.
+func ProductTag(id string) string {
+	return "tag:product:" + id
+}
+
+// CategoryTag tags cached results filtered by category.
+func CategoryTag(category string) string {
+	return "tag:category:" + normalize(category)
+}
+
+// PriceRangeTag tags cached results filtered by the price range r.
+func PriceRangeTag(r PriceRange) string {
+	return "tag:range:" + r.String()
+}
+
+// NameTag tags cached results matching name.
+func NameTag(name string) string {
+	return "tag:name:" + normalize(name)
+}
+
 func normalize(val string) string {
 	v := strings.TrimSpace(strings.ToLower(val))
 	return url.QueryEscape(v)
@@ -0,0 +1,246 @@
+package product
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestKeyIsStableAcrossEquivalentSearches(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b *Search
+	}{
+		{"category order",
+			NewSearch().WithCategory("b").WithCategory("a"),
+			NewSearch().WithCategory("a", "b")},
+		{"category duplicates and blanks",
+			NewSearch().WithCategory("shoes", " ", "boots", "shoes", " boots "),
+			NewSearch().WithCategory("boots", "shoes")},
+		{"excluded category order",
+			NewSearch().WithExcludedCategory("sale", "clearance", "sale"),
+			NewSearch().WithExcludedCategory("clearance", "sale")},
+		{"id order",
+			NewSearch().WithIDs("3", "1", "2"),
+			NewSearch().WithIDs("1", "2", "3")},
+		{"id duplicates and blanks",
+			NewSearch().WithIDs("2", "", "1", "2"),
+			NewSearch().WithIDs("1", "2")},
+		{"price range order",
+			NewSearch().WithPriceRanges(PriceRange{From: num(50)}, PriceRange{To: num(10)}, PriceRange{From: num(10), To: num(50)}),
+			NewSearch().WithPriceRanges(PriceRange{From: num(10), To: num(50)}, PriceRange{To: num(10)}, PriceRange{From: num(50)})},
+		{"price range duplicates",
+			NewSearch().WithPriceRanges(PriceRange{To: num(10)}, PriceRange{To: num(10.001)}, PriceRange{To: num(10)}),
+			NewSearch().WithPriceRanges(PriceRange{To: num(10)})},
+		{"name case and spaces",
+			NewSearch().WithName("  Trail Shoe "),
+			NewSearch().WithName("trail shoe")},
+		{"default pagination",
+			NewSearch(),
+			NewSearch().WithPage(1).WithPageSize(20)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, aTags := tt.a.Key()
+			b, bTags := tt.b.Key()
+			if a != b {
+				t.Errorf("keys differ:\n%s\n%s", a, b)
+			}
+
+			slices.Sort(aTags)
+			slices.Sort(bTags)
+			if !slices.Equal(slices.Compact(aTags), slices.Compact(bTags)) {
+				t.Errorf("tags differ:\n%v\n%v", aTags, bTags)
+			}
+		})
+	}
+}
+
+func TestKeyTellsDifferentSearchesApart(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b *Search
+	}{
+		{"category case", NewSearch().WithCategory("Shoes"), NewSearch().WithCategory("shoes")},
+		{"comma in a category", NewSearch().WithCategory("a,b"), NewSearch().WithCategory("a", "b")},
+		{"included or excluded", NewSearch().WithCategory("sale"), NewSearch().WithExcludedCategory("sale")},
+		{"page", NewSearch().WithPage(1), NewSearch().WithPage(2)},
+		{"sort order", NewSearch().WithSort(Sort{"price", "asc"}, Sort{"name", "asc"}), NewSearch().WithSort(Sort{"name", "asc"}, Sort{"price", "asc"})},
+		{"min or max", NewSearch().WithMinPrice(10), NewSearch().WithMaxPrice(10)},
+		{"open end of a range", NewSearch().WithPriceRanges(PriceRange{From: num(10)}), NewSearch().WithPriceRanges(PriceRange{To: num(10)})},
+		{"highlight", NewSearch().WithName("shoe"), NewSearch().WithName("shoe").WithHighlight(NewHighlight("", "", 0))},
+		{"highlight tags", NewSearch().WithHighlight(NewHighlight("<b>", "</b>", 0)), NewSearch().WithHighlight(NewHighlight("<B>", "</B>", 0))},
+		{"facets", NewSearch(), NewSearch().WithFacets(FacetRequest{Categories: true})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, _ := tt.a.Key()
+			b, _ := tt.b.Key()
+			if a == b {
+				t.Errorf("both searches have key %s", a)
+			}
+		})
+	}
+}
+
+func TestKey(t *testing.T) {
+	key, _ := NewSearch().WithName("Shoe").WithCategory("b", "a").WithMinPrice(10).WithPage(2).Key()
+	if want := "products:result|name=shoe|cat=a,b|page=2|size=20|min=10.00"; key != want {
+		t.Errorf("key = %q, want %q", key, want)
+	}
+}
+
+func TestKeyTags(t *testing.T) {
+	s := NewSearch().
+		WithName("Trail Shoe").
+		WithCategory("shoes", "Boots").
+		WithExcludedCategory("sale").
+		WithIDs("2", "1").
+		WithMinPrice(10).
+		WithMaxPrice(100).
+		WithPriceRanges(PriceRange{From: num(50)}, PriceRange{To: num(20)}).
+		WithSort(Sort{"price", "desc"}, Sort{"name", "asc"}).
+		WithPage(2).
+		WithPageSize(10).
+		WithQuery(Match{Text: "trail"}).
+		WithFacets(FacetRequest{Categories: true, PriceStats: true})
+
+	_, tags := s.Key()
+
+	want := []string{
+		NameTag("Trail Shoe"),
+		CategoryTag("Boots"),
+		CategoryTag("shoes"),
+		CategoryTag("sale"),
+		ProductTag("1"),
+		ProductTag("2"),
+		"tag:sort:price-desc",
+		"tag:sort:name-asc",
+		"tag:paging:2-10",
+		"tag:min:10.00",
+		"tag:max:100.00",
+		PriceRangeTag(PriceRange{To: num(20)}),
+		PriceRangeTag(PriceRange{From: num(50)}),
+		QueryTag,
+		CategoryFacetTag,
+		PriceFacetTag,
+	}
+	if !slices.Equal(tags, want) {
+		t.Errorf("tags = %v\nwant   %v", tags, want)
+	}
+
+	for tag, want := range map[string]string{
+		NameTag("Trail Shoe"):                    "tag:name:trail+shoe",
+		CategoryTag("Boots"):                     "tag:category:boots",
+		ProductTag("1"):                          "tag:product:1",
+		PriceRangeTag(PriceRange{To: num(20)}):   "tag:range:-20.00",
+		PriceRangeTag(PriceRange{From: num(50)}): "tag:range:50.00-",
+	} {
+		if tag != want {
+			t.Errorf("tag %q, want %q", tag, want)
+		}
+	}
+}
+
+func TestLongKeyIsHashed(t *testing.T) {
+	long := NewSearch().WithName(strings.Repeat("shoe ", 30))
+
+	key, tags := long.Key()
+	if !regexp.MustCompile(`^[0-9a-f]{40}$`).MatchString(key) {
+		t.Errorf("key = %q, want a sha1 hex digest", key)
+	}
+	if !slices.Contains(tags, NameTag(strings.Repeat("shoe ", 30))) {
+		t.Errorf("tags %v lack the name tag: hashing the key must keep them", tags)
+	}
+
+	// equivalent long searches still share a key, and different ones don't
+	again, _ := NewSearch().WithName(strings.ToUpper(strings.Repeat("shoe ", 30))).Key()
+	if again != key {
+		t.Errorf("equivalent searches hashed to %q and %q", key, again)
+	}
+	other, _ := NewSearch().WithName(strings.Repeat("boot ", 30)).Key()
+	if other == key {
+		t.Errorf("different searches both hashed to %q", key)
+	}
+
+	// right at the limit the key is kept as is
+	short := NewSearch().WithName("x")
+	raw, _ := short.Key()
+	padded := NewSearch().WithName(strings.Repeat("x", 1+128-len(raw)))
+	if k, _ := padded.Key(); len(k) != 128 || !strings.HasPrefix(k, "products:result|") {
+		t.Errorf("128-byte key = %q, want it unhashed", k)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	many := func(n int) []string {
+		values := make([]string, n)
+		for i := range values {
+			values[i] = fmt.Sprint(i)
+		}
+		return values
+	}
+	ranges := func(n int) []PriceRange {
+		r := make([]PriceRange, n)
+		for i := range r {
+			r[i] = PriceRange{From: num(float64(i)), To: num(float64(i) + 1)}
+		}
+		return r
+	}
+
+	tests := []struct {
+		name   string
+		search *Search
+		errs   []string // params with an error, sorted
+	}{
+		{"defaults", NewSearch(), nil},
+		{"page 0", NewSearch().WithPage(0), []string{"page"}},
+		{"page size 0", NewSearch().WithPageSize(0), []string{"page_size"}},
+		{"page size at the max", NewSearch().WithPageSize(MaxPageSize), nil},
+		{"page size over the max", NewSearch().WithPageSize(MaxPageSize + 1), []string{"page_size"}},
+		{"last page in the window", NewSearch().WithPageSize(100).WithPage(MaxResultWindow / 100), nil},
+		{"past the window", NewSearch().WithPageSize(100).WithPage(MaxResultWindow/100 + 1), []string{"page"}},
+		{"past the window with a cursor", NewSearch().WithPageSize(100).WithPage(MaxResultWindow/100 + 1).WithCursor(&Cursor{}), nil},
+		{"free prices", NewSearch().WithMinPrice(0).WithMaxPrice(0), nil},
+		{"negative min", NewSearch().WithMinPrice(-1), []string{"min_price"}},
+		{"infinite max", NewSearch().WithMaxPrice(math.Inf(1)), []string{"max_price"}},
+		{"NaN min", NewSearch().WithMinPrice(math.NaN()), []string{"min_price"}},
+		{"min over max", NewSearch().WithMinPrice(50).WithMaxPrice(10), []string{"min_price"}},
+		{"open ranges", NewSearch().WithPriceRanges(PriceRange{To: num(10)}, PriceRange{From: num(10)}), nil},
+		{"empty range", NewSearch().WithPriceRanges(PriceRange{From: num(10), To: num(10)}), []string{"price_range"}},
+		{"inverted range", NewSearch().WithPriceRanges(PriceRange{From: num(20), To: num(10)}), []string{"price_range"}},
+		{"price interval", NewSearch().WithFacets(FacetRequest{PriceInterval: MinPriceInterval}), nil},
+		{"price interval too small", NewSearch().WithFacets(FacetRequest{PriceInterval: 0.5}), []string{"price_interval"}},
+		{"NaN price interval", NewSearch().WithFacets(FacetRequest{PriceInterval: math.NaN()}), []string{"price_interval"}},
+		{"categories at the max", NewSearch().WithCategory(many(MaxFilterValues)...), nil},
+		{"too many categories", NewSearch().WithCategory(many(MaxFilterValues + 1)...), []string{"category"}},
+		{"too many exclusions", NewSearch().WithExcludedCategory(many(MaxFilterValues + 1)...), []string{"exclude_category"}},
+		{"too many ids", NewSearch().WithIDs(many(MaxFilterValues + 1)...), []string{"ids"}},
+		{"too many ranges", NewSearch().WithPriceRanges(ranges(MaxFilterValues + 1)...), []string{"price_range"}},
+		{"duplicates count once", NewSearch().WithCategory(append(many(MaxFilterValues), many(MaxFilterValues)...)...), nil},
+		{"sort", NewSearch().WithSort(Sort{Field: "price", Order: "desc"}), nil},
+		{"unsortable field", NewSearch().WithSort(Sort{Field: "id", Order: "asc"}), []string{"sort"}},
+		{"unknown order", NewSearch().WithSort(Sort{Field: "price", Order: "up"}), []string{"sort"}},
+		{"several", NewSearch().WithPage(0).WithMinPrice(-1).WithSort(Sort{Field: "id"}), []string{"min_price", "page", "sort"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := tt.search.Validate()
+
+			var params []string
+			for p := range errs {
+				params = append(params, p)
+			}
+			slices.Sort(params)
+			if !slices.Equal(params, tt.errs) {
+				t.Errorf("Validate() = %v, want errors for %v", errs, tt.errs)
+			}
+		})
+	}
+}
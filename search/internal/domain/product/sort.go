@@ -0,0 +1,77 @@
+package product
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SortFields are the fields results can be sorted by.
+var SortFields = []string{"name", "price", "category"}
+
+// maxSortKeys bounds how many keys one search sorts by.
+const maxSortKeys = 3
+
+// Sort is one key results are ordered by.
+type Sort struct {
+	Field string `json:"field"`
+	Order string `json:"order"` // asc or desc
+}
+
+// ParseSort parses a comma separated list of sort keys, each a field ascending or, with a
+// leading "-", descending, e.g. "-price,name".
+func ParseSort(raw string) ([]Sort, error) {
+	var keys []Sort
+	seen := map[string]bool{}
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			return nil, fmt.Errorf("empty sort key in %q", raw)
+		}
+
+		key := Sort{Field: part, Order: "asc"}
+		if strings.HasPrefix(part, "-") {
+			key = Sort{Field: part[1:], Order: "desc"}
+		}
+
+		if !sortable(key.Field) {
+			return nil, fmt.Errorf("cannot sort by %q, must be one of %s", key.Field, strings.Join(SortFields, ", "))
+		}
+		if seen[key.Field] {
+			return nil, fmt.Errorf("%q is sorted by more than once", key.Field)
+		}
+		seen[key.Field] = true
+
+		keys = append(keys, key)
+	}
+
+	if len(keys) > maxSortKeys {
+		return nil, fmt.Errorf("at most %d sort keys are allowed", maxSortKeys)
+	}
+	return keys, nil
+}
+
+// String formats the key as ParseSort reads it, e.g. "-price".
+func (s Sort) String() string {
+	if s.Order == "desc" {
+		return "-" + s.Field
+	}
+	return s.Field
+}
+
+func sortable(field string) bool {
+	for _, f := range SortFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// sortKey joins keys as ParseSort reads them, e.g. "-price,name".
+func sortKey(keys []Sort) string {
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = k.String()
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,56 @@
+package product
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseSort(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want []Sort
+	}{
+		{"price", []Sort{{"price", "asc"}}},
+		{"-price", []Sort{{"price", "desc"}}},
+		{"-price,name", []Sort{{"price", "desc"}, {"name", "asc"}}},
+		{" name , -category ", []Sort{{"name", "asc"}, {"category", "desc"}}},
+		{"name,price,category", []Sort{{"name", "asc"}, {"price", "asc"}, {"category", "asc"}}},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseSort(tt.raw)
+		if err != nil {
+			t.Errorf("ParseSort(%q) = %v", tt.raw, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("ParseSort(%q) = %v, want %v", tt.raw, got, tt.want)
+		}
+
+		// the keys format back the way they were parsed
+		if again, err := ParseSort(sortKey(got)); err != nil || !slices.Equal(again, got) {
+			t.Errorf("ParseSort(%q) = %v, %v, want %v read back", sortKey(got), again, err, got)
+		}
+	}
+}
+
+func TestParseSortErrors(t *testing.T) {
+	for name, raw := range map[string]string{
+		"empty":            "",
+		"empty key":        "price,,name",
+		"trailing comma":   "price,",
+		"bare minus":       "-",
+		"unsortable field": "id",
+		"unknown field":    "-colour",
+		"case":             "Price",
+		"repeated":         "price,-price",
+		"too many keys":    "name,price,category,name",
+		"double minus":     "--price",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if got, err := ParseSort(raw); err == nil {
+				t.Errorf("ParseSort(%q) = %v, want an error", raw, got)
+			}
+		})
+	}
+}
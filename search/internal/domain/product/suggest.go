@@ -0,0 +1,70 @@
+package product
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	DefaultSuggestLimit = 10
+	MaxSuggestLimit     = 25
+)
+
+// Suggest asks for product names completing what a user has typed so far.
+type Suggest struct {
+	prefix   string
+	category string // if set, only products in this category are suggested
+	limit    int
+}
+
+func NewSuggest(prefix, category string, limit int) (*Suggest, error) {
+	prefix = strings.TrimSpace(prefix)
+	if prefix == "" {
+		return nil, errors.New("suggest query is required")
+	}
+
+	if limit <= 0 {
+		limit = DefaultSuggestLimit
+	}
+	if limit > MaxSuggestLimit {
+		limit = MaxSuggestLimit
+	}
+
+	return &Suggest{
+		prefix:   prefix,
+		category: strings.TrimSpace(category),
+		limit:    limit,
+	}, nil
+}
+
+func (s *Suggest) Prefix() string {
+	return s.prefix
+}
+
+func (s *Suggest) Category() string {
+	return s.category
+}
+
+func (s *Suggest) Limit() int {
+	return s.limit
+}
+
+// Key builds the Redis key suggestions are cached under, e.g. "suggest:q=lapt|cat=Electronics|limit=10".
+// The prefix is matched case-insensitively, but the category filter is an exact term, so it keeps its case.
+func (s *Suggest) Key() string {
+	key := "suggest:q=" + normalize(s.prefix)
+	if s.category != "" {
+		key += "|cat=" + url.QueryEscape(s.category)
+	}
+	return key + fmt.Sprintf("|limit=%d", s.limit)
+}
+
+// Suggestion is a product whose name completes a Suggest prefix, ranked by Score.
+type Suggestion struct {
+	ID       string  `json:"id"`
+	Name     string  `json:"name"`
+	Category string  `json:"category"`
+	Score    float64 `json:"score"`
+}
@@ -0,0 +1,80 @@
+package product
+
+import "testing"
+
+func TestNewSuggest(t *testing.T) {
+	tests := []struct {
+		name             string
+		prefix, category string
+		limit            int
+		wantPrefix       string
+		wantCategory     string
+		wantLimit        int
+	}{
+		{"defaults", "lapt", "", 0, "lapt", "", DefaultSuggestLimit},
+		{"trimmed", "  lapt ", " Electronics ", 5, "lapt", "Electronics", 5},
+		{"negative limit", "lapt", "", -3, "lapt", "", DefaultSuggestLimit},
+		{"limit capped", "lapt", "", MaxSuggestLimit + 1, "lapt", "", MaxSuggestLimit},
+		{"limit at the cap", "lapt", "", MaxSuggestLimit, "lapt", "", MaxSuggestLimit},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewSuggest(tt.prefix, tt.category, tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.Prefix() != tt.wantPrefix || s.Category() != tt.wantCategory || s.Limit() != tt.wantLimit {
+				t.Errorf("NewSuggest() = %q, %q, %d, want %q, %q, %d",
+					s.Prefix(), s.Category(), s.Limit(), tt.wantPrefix, tt.wantCategory, tt.wantLimit)
+			}
+		})
+	}
+
+	for _, prefix := range []string{"", "   "} {
+		if _, err := NewSuggest(prefix, "", 0); err == nil {
+			t.Errorf("NewSuggest(%q) = nil error, want the prefix required", prefix)
+		}
+	}
+}
+
+func TestSuggestKey(t *testing.T) {
+	key := func(prefix, category string, limit int) string {
+		s, err := NewSuggest(prefix, category, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.Key()
+	}
+
+	if got, want := key("Lapt", "Electronics", 0), "suggest:q=lapt|cat=Electronics|limit=10"; got != want {
+		t.Errorf("Key() = %q, want %q", got, want)
+	}
+
+	// the prefix matches case-insensitively, so its case shares an entry
+	same := [][2]string{
+		{key("lapt", "", 0), key(" LAPT ", "", 0)},
+		{key("lapt", "", 0), key("lapt", "", DefaultSuggestLimit)},
+		{key("lapt", "", MaxSuggestLimit), key("lapt", "", 100)},
+	}
+	for _, p := range same {
+		if p[0] != p[1] {
+			t.Errorf("keys %q and %q differ, want them shared", p[0], p[1])
+		}
+	}
+
+	// the category is an exact term, and each limit returns a different list
+	different := [][2]string{
+		{key("lapt", "", 0), key("lapto", "", 0)},
+		{key("lapt", "", 0), key("lapt", "Electronics", 0)},
+		{key("lapt", "Electronics", 0), key("lapt", "electronics", 0)},
+		{key("lapt", "", 5), key("lapt", "", 10)},
+		// escaped, so a prefix can't pass for a category
+		{key("lapt|cat=Electronics", "", 0), key("lapt", "Electronics", 0)},
+	}
+	for _, p := range different {
+		if p[0] == p[1] {
+			t.Errorf("suggestions %q share a key with another request", p[0])
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package product
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Token identifies the version a write in the product service left a product at, as
+// "<id>:<version>". A read given a token must reflect at least that version.
+type Token struct {
+	ID      string
+	Version int64
+}
+
+func ParseToken(s string) (Token, error) {
+	id, v, ok := strings.Cut(s, ":")
+	if !ok || id == "" {
+		return Token{}, errors.New("consistency token must be <id>:<version>")
+	}
+
+	version, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || version <= 0 {
+		return Token{}, errors.New("consistency token version must be a positive integer")
+	}
+
+	return Token{ID: id, Version: version}, nil
+}
+
+func (t Token) String() string {
+	return t.ID + ":" + strconv.FormatInt(t.Version, 10)
+}
@@ -0,0 +1,43 @@
+package product
+
+import "testing"
+
+func TestParseToken(t *testing.T) {
+	tests := []struct {
+		in    string
+		want  Token
+		valid bool
+	}{
+		{"42:3", Token{ID: "42", Version: 3}, true},
+		{"0b1c-9f:12", Token{ID: "0b1c-9f", Version: 12}, true},
+		// only the first colon separates the version
+		{"a:b:3", Token{}, false},
+		{"", Token{}, false},
+		{"42", Token{}, false},
+		{":3", Token{}, false},
+		{"42:", Token{}, false},
+		{"42:0", Token{}, false},
+		{"42:-1", Token{}, false},
+		{"42:three", Token{}, false},
+		{"42:3.5", Token{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseToken(tt.in)
+			if !tt.valid {
+				if err == nil {
+					t.Errorf("ParseToken(%q) = %+v, want an error", tt.in, got)
+				}
+				return
+			}
+
+			if err != nil || got != tt.want {
+				t.Errorf("ParseToken(%q) = %+v, %v, want %+v", tt.in, got, err, tt.want)
+			}
+			if s := got.String(); s != tt.in {
+				t.Errorf("String() = %q, want %q", s, tt.in)
+			}
+		})
+	}
+}
@@ -0,0 +1,10 @@
+package ports
+
+import "context"
+
+// Analyzers manages the analysis of the live index.
+type Analyzers interface {
+	// ReloadSearchAnalyzers reloads the updateable search analyzers, such as synonyms,
+	// and returns the ones reloaded.
+	ReloadSearchAnalyzers(ctx context.Context) ([]string, error)
+}
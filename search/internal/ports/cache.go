@@ -6,11 +6,11 @@ import (
 )
 
 type CacheReader interface {
-	Get(ctx context.Context, key string) ([]product.Product, error)
+	Get(ctx context.Context, key string) (*product.Result, error)
 }
 
 type CacheWriter interface {
-	Set(ctx context.Context, key string, products []product.Product, tags ...string) error
+	Set(ctx context.Context, key string, result *product.Result, tags ...string) error
 }
 
 type CacheWriteReader interface {
@@ -3,7 +3,8 @@ package ports
 import "context"
 
 type Consumer interface {
-	Consume() error
+	// Consume processes events until ctx is done, then waits for in-flight events to finish.
+	Consume(ctx context.Context) error
 	CreateProduct(ctx context.Context, payload []byte) error
 	UpdateProduct(ctx context.Context, payload []byte) error
 	DeleteProduct(ctx context.Context, payload []byte) error
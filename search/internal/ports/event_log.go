@@ -0,0 +1,9 @@
+package ports
+
+import "context"
+
+// EventLog remembers which events have been applied, so redelivered events can be skipped.
+type EventLog interface {
+	Seen(ctx context.Context, eventID string) (bool, error)
+	MarkSeen(ctx context.Context, eventID string) error
+}
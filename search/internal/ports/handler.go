@@ -1,9 +1,17 @@
 package ports
 
-import "github.com/gin-gonic/gin"
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+)
 
 type Handler interface {
 	Run(addr string) error
+	Shutdown(ctx context.Context) error
 	GetProduct(c *gin.Context)
 	SearchProduct(c *gin.Context)
+	SuggestProducts(c *gin.Context)
+	Reconcile(c *gin.Context)
+	ReconcileReport(c *gin.Context)
+	ReloadAnalyzers(c *gin.Context)
 }
@@ -0,0 +1,44 @@
+package ports
+
+import (
+	"context"
+	"github.com/ziliscite/cqrs_search/internal/domain/product"
+)
+
+// ProductSource pages through every product in the system of record, in ID order.
+type ProductSource interface {
+	// Export returns up to limit products after the given ID, and the cursor of the
+	// next page, which is empty once there are no more products.
+	Export(ctx context.Context, after string, limit int) ([]product.Product, string, error)
+	// Lookup returns the products among ids that exist.
+	Lookup(ctx context.Context, ids []string) ([]product.Product, error)
+}
+
+// IndexStore is the search index as seen by reconciliation.
+type IndexStore interface {
+	// Scan returns up to limit indexed products after the given ID, in ID order, and the
+	// cursor of the next page, which is empty once there are no more products.
+	Scan(ctx context.Context, after string, limit int) ([]product.Product, string, error)
+	// Overwrite indexes p even if a document with the same version is stored, to repair
+	// its content. A later version, or a delete at or after its version, is still kept.
+	Overwrite(ctx context.Context, p *product.Product) error
+}
+
+// Projection builds a new search index, with the latest mapping, and swaps it in for the live one.
+type Projection interface {
+	// Versions returns the mapping version of the live index and the latest version available.
+	// An index created before mappings were versioned reports 0.
+	Versions(ctx context.Context) (deployed, latest int, err error)
+	// Prepare creates an empty index and mirrors live writes into it until it is promoted or dropped.
+	Prepare(ctx context.Context) (string, error)
+	// Load indexes products into index, skipping deleted products and ones a live write
+	// has already moved past. It returns how many were indexed.
+	Load(ctx context.Context, index string, products []product.Product) (int, error)
+	// Reindex copies the live index into index, keeping document versions. It returns how
+	// many documents were copied.
+	Reindex(ctx context.Context, index string) (int, error)
+	// Promote atomically points the live alias at index and deletes the index it replaced.
+	Promote(ctx context.Context, index string) error
+	// Drop deletes an index that won't be promoted.
+	Drop(ctx context.Context, index string) error
+}
@@ -6,14 +6,21 @@ import (
 )
 
 type ReadRepository interface {
-	Search(ctx context.Context, opts *product.Search) ([]product.Product, error)
+	Search(ctx context.Context, opts *product.Search) (*product.Result, error)
 	GetByID(ctx context.Context, id string) (*product.Product, error)
+	// Suggest returns the products whose names best complete the prefix, best first.
+	Suggest(ctx context.Context, s *product.Suggest) ([]product.Suggestion, error)
+	// AppliedVersion returns the latest version of id the index has applied, a delete
+	// included, or 0 if it has seen none.
+	AppliedVersion(ctx context.Context, id string) (int64, error)
 }
 
+// WriteRepository applies product changes using the product's version as an external version,
+// so a write older than the stored document fails with product.ErrStale instead of overwriting it.
 type WriteRepository interface {
 	Create(ctx context.Context, product *product.Product) error
 	Update(ctx context.Context, product *product.Product) error
-	Delete(ctx context.Context, id string) error
+	Delete(ctx context.Context, id string, version int64) error
 }
 
 type Repository interface {
@@ -0,0 +1,24 @@
+package ports
+
+import "context"
+
+// Message is a product event delivered by a Subscriber. Every message must be
+// either acknowledged or negatively acknowledged exactly once.
+type Message interface {
+	// Event returns the carried event: "create", "update" or "delete".
+	Event() string
+	Body() []byte
+	// Redelivered reports whether the message has been delivered before.
+	Redelivered() bool
+	Ack() error
+	// Nack rejects the message; if requeue is set it will be delivered again.
+	Nack(requeue bool) error
+}
+
+// Subscriber delivers product events from a message transport.
+type Subscriber interface {
+	// Subscribe starts delivering messages. The channel is closed once ctx is done
+	// or the subscription ends.
+	Subscribe(ctx context.Context) (<-chan Message, error)
+	Close() error
+}
@@ -0,0 +1,14 @@
+package ports
+
+import (
+	"context"
+	"github.com/ziliscite/cqrs_search/internal/domain/product"
+)
+
+// SuggestionCache holds typeahead suggestions briefly. Entries aren't invalidated by
+// product changes; they expire soon enough not to matter.
+type SuggestionCache interface {
+	// Get returns the suggestions cached under key, and false on a miss.
+	Get(ctx context.Context, key string) ([]product.Suggestion, bool, error)
+	Set(ctx context.Context, key string, suggestions []product.Suggestion) error
+}
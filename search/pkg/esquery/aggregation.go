@@ -0,0 +1,149 @@
+package esquery
+
+import "encoding/json"
+
+// Aggregation is an aggregation definition, e.g. {"stats": {"field": "price"}}.
+type Aggregation interface {
+	Source() map[string]interface{}
+}
+
+// Aggregations are named aggregations, as held by a search or a bucket aggregation.
+type Aggregations map[string]Aggregation
+
+func (a Aggregations) Source() map[string]interface{} {
+	m := make(map[string]interface{}, len(a))
+	for name, agg := range a {
+		m[name] = agg.Source()
+	}
+	return m
+}
+
+func (a Aggregations) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.Source())
+}
+
+// withSubAggs adds the sub-aggregations, if any, to the definition of a bucket aggregation.
+func withSubAggs(def map[string]interface{}, subs Aggregations) map[string]interface{} {
+	if len(subs) > 0 {
+		def["aggs"] = subs.Source()
+	}
+	return def
+}
+
+// FilterAggregation narrows the documents its sub-aggregations see to those filter matches.
+type FilterAggregation struct {
+	filter Query
+	subs   Aggregations
+}
+
+func FilterAgg(filter Query) *FilterAggregation {
+	return &FilterAggregation{filter: filter, subs: Aggregations{}}
+}
+
+func (a *FilterAggregation) SubAgg(name string, agg Aggregation) *FilterAggregation {
+	a.subs[name] = agg
+	return a
+}
+
+func (a *FilterAggregation) Source() map[string]interface{} {
+	return withSubAggs(map[string]interface{}{"filter": a.filter.Source()}, a.subs)
+}
+
+// TermsAggregation buckets documents per value of a field, most populated first.
+type TermsAggregation struct {
+	field string
+	size  int
+	subs  Aggregations
+}
+
+func TermsAgg(field string) *TermsAggregation {
+	return &TermsAggregation{field: field, subs: Aggregations{}}
+}
+
+// Size bounds the buckets returned; Elasticsearch defaults to 10.
+func (a *TermsAggregation) Size(n int) *TermsAggregation {
+	a.size = n
+	return a
+}
+
+func (a *TermsAggregation) SubAgg(name string, agg Aggregation) *TermsAggregation {
+	a.subs[name] = agg
+	return a
+}
+
+func (a *TermsAggregation) Source() map[string]interface{} {
+	terms := map[string]interface{}{"field": a.field}
+	if a.size > 0 {
+		terms["size"] = a.size
+	}
+	return withSubAggs(map[string]interface{}{"terms": terms}, a.subs)
+}
+
+// RangeAggregation buckets documents per range of a numeric field, in the order added.
+type RangeAggregation struct {
+	field  string
+	ranges []interface{}
+}
+
+func RangeAgg(field string) *RangeAggregation {
+	return &RangeAggregation{field: field}
+}
+
+// AddRange adds a bucket from from (inclusive) to to (exclusive); nil leaves an end open.
+func (a *RangeAggregation) AddRange(from, to *float64) *RangeAggregation {
+	bucket := map[string]interface{}{}
+	if from != nil {
+		bucket["from"] = *from
+	}
+	if to != nil {
+		bucket["to"] = *to
+	}
+	a.ranges = append(a.ranges, bucket)
+	return a
+}
+
+func (a *RangeAggregation) Source() map[string]interface{} {
+	ranges := a.ranges
+	if ranges == nil {
+		ranges = []interface{}{}
+	}
+	return map[string]interface{}{"range": map[string]interface{}{"field": a.field, "ranges": ranges}}
+}
+
+// HistogramAggregation buckets documents per fixed-width interval of a numeric field.
+type HistogramAggregation struct {
+	field       string
+	interval    float64
+	minDocCount *int
+}
+
+func HistogramAgg(field string, interval float64) *HistogramAggregation {
+	return &HistogramAggregation{field: field, interval: interval}
+}
+
+// MinDocCount leaves out buckets holding fewer documents; Elasticsearch defaults to 0.
+func (a *HistogramAggregation) MinDocCount(n int) *HistogramAggregation {
+	a.minDocCount = &n
+	return a
+}
+
+func (a *HistogramAggregation) Source() map[string]interface{} {
+	h := map[string]interface{}{"field": a.field, "interval": a.interval}
+	if a.minDocCount != nil {
+		h["min_doc_count"] = *a.minDocCount
+	}
+	return map[string]interface{}{"histogram": h}
+}
+
+type statsAggregation struct {
+	field string
+}
+
+// StatsAgg computes the count, min, max, average and sum of a numeric field.
+func StatsAgg(field string) Aggregation {
+	return statsAggregation{field: field}
+}
+
+func (a statsAggregation) Source() map[string]interface{} {
+	return map[string]interface{}{"stats": map[string]interface{}{"field": a.field}}
+}
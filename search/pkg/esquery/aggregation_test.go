@@ -0,0 +1,34 @@
+package esquery
+
+import "testing"
+
+func TestAggregations(t *testing.T) {
+	from, to := 10.0, 50.0
+
+	tests := []struct {
+		name string
+		agg  Aggregation
+		want string
+	}{
+		{"terms", TermsAgg("category"), `{"terms":{"field":"category"}}`},
+		{"terms with size", TermsAgg("category").Size(50), `{"terms":{"field":"category","size":50}}`},
+		{"range", RangeAgg("price").AddRange(nil, &from).AddRange(&from, &to).AddRange(&to, nil),
+			`{"range":{"field":"price","ranges":[{"to":10},{"from":10,"to":50},{"from":50}]}}`},
+		{"range without buckets", RangeAgg("price"), `{"range":{"field":"price","ranges":[]}}`},
+		{"histogram", HistogramAgg("price", 25), `{"histogram":{"field":"price","interval":25}}`},
+		{"histogram with min_doc_count", HistogramAgg("price", 2.5).MinDocCount(1),
+			`{"histogram":{"field":"price","interval":2.5,"min_doc_count":1}}`},
+		{"stats", StatsAgg("price"), `{"stats":{"field":"price"}}`},
+		{"filter with sub-aggregations", FilterAgg(Term("category", "shoes")).
+			SubAgg("stats", StatsAgg("price")).
+			SubAgg("categories", TermsAgg("category").SubAgg("prices", HistogramAgg("price", 10))),
+			`{"aggs":{"categories":{"aggs":{"prices":{"histogram":{"field":"price","interval":10}}},"terms":{"field":"category"}},` +
+				`"stats":{"stats":{"field":"price"}}},"filter":{"term":{"category":"shoes"}}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			marshals(t, tt.agg.Source(), tt.want)
+		})
+	}
+}
@@ -0,0 +1,408 @@
+// Package esquery is a typed subset of the Elasticsearch query DSL, covering what the
+// search service sends: compound and leaf queries, aggregations, sorting and highlighting.
+//
+// Every part builds the JSON it stands for with Source, and marshals to it, so a search
+// body can be assembled from typed parts and compared as JSON without a cluster.
+package esquery
+
+import "encoding/json"
+
+// Query is a query clause, e.g. {"term": {"category": "shoes"}}.
+type Query interface {
+	Source() map[string]interface{}
+}
+
+// sources builds the clauses of qs, leaving out nil ones.
+func sources(qs []Query) []interface{} {
+	out := make([]interface{}, 0, len(qs))
+	for _, q := range qs {
+		if q != nil {
+			out = append(out, q.Source())
+		}
+	}
+	return out
+}
+
+// BoolQuery combines clauses: documents must match every must and filter clause, none of
+// the must_not clauses and, if there are no must clauses, at least one should clause.
+// Filter and must_not clauses don't score.
+type BoolQuery struct {
+	must, filter, should, mustNot []Query
+	minimumShouldMatch            *int
+}
+
+func Bool() *BoolQuery {
+	return &BoolQuery{}
+}
+
+func (q *BoolQuery) Must(qs ...Query) *BoolQuery {
+	q.must = appendQueries(q.must, qs)
+	return q
+}
+
+func (q *BoolQuery) Filter(qs ...Query) *BoolQuery {
+	q.filter = appendQueries(q.filter, qs)
+	return q
+}
+
+func (q *BoolQuery) Should(qs ...Query) *BoolQuery {
+	q.should = appendQueries(q.should, qs)
+	return q
+}
+
+func (q *BoolQuery) MustNot(qs ...Query) *BoolQuery {
+	q.mustNot = appendQueries(q.mustNot, qs)
+	return q
+}
+
+func (q *BoolQuery) MinimumShouldMatch(n int) *BoolQuery {
+	q.minimumShouldMatch = &n
+	return q
+}
+
+// Empty reports whether the query has no clauses, and so matches every document.
+func (q *BoolQuery) Empty() bool {
+	return len(q.must) == 0 && len(q.filter) == 0 && len(q.should) == 0 && len(q.mustNot) == 0
+}
+
+func (q *BoolQuery) Source() map[string]interface{} {
+	b := map[string]interface{}{}
+	for name, clauses := range map[string][]Query{
+		"must":     q.must,
+		"filter":   q.filter,
+		"should":   q.should,
+		"must_not": q.mustNot,
+	} {
+		if len(clauses) > 0 {
+			b[name] = sources(clauses)
+		}
+	}
+	if q.minimumShouldMatch != nil {
+		b["minimum_should_match"] = *q.minimumShouldMatch
+	}
+	return map[string]interface{}{"bool": b}
+}
+
+func (q *BoolQuery) MarshalJSON() ([]byte, error) {
+	return json.Marshal(q.Source())
+}
+
+func appendQueries(to []Query, qs []Query) []Query {
+	for _, q := range qs {
+		if q != nil {
+			to = append(to, q)
+		}
+	}
+	return to
+}
+
+type matchAllQuery struct{}
+
+// MatchAll matches every document.
+func MatchAll() Query {
+	return matchAllQuery{}
+}
+
+func (matchAllQuery) Source() map[string]interface{} {
+	return map[string]interface{}{"match_all": map[string]interface{}{}}
+}
+
+func (q matchAllQuery) MarshalJSON() ([]byte, error) {
+	return json.Marshal(q.Source())
+}
+
+// MatchQuery matches the analysed text against one field.
+type MatchQuery struct {
+	field, text string
+	operator    string
+	fuzziness   string
+}
+
+func Match(field, text string) *MatchQuery {
+	return &MatchQuery{field: field, text: text}
+}
+
+// Operator sets whether "or" (the default) or "and" every term must match.
+func (q *MatchQuery) Operator(op string) *MatchQuery {
+	q.operator = op
+	return q
+}
+
+// Fuzziness sets the edit distance allowed per term, e.g. "AUTO".
+func (q *MatchQuery) Fuzziness(f string) *MatchQuery {
+	q.fuzziness = f
+	return q
+}
+
+func (q *MatchQuery) Source() map[string]interface{} {
+	m := map[string]interface{}{"query": q.text}
+	if q.operator != "" {
+		m["operator"] = q.operator
+	}
+	if q.fuzziness != "" {
+		m["fuzziness"] = q.fuzziness
+	}
+	return map[string]interface{}{"match": map[string]interface{}{q.field: m}}
+}
+
+func (q *MatchQuery) MarshalJSON() ([]byte, error) {
+	return json.Marshal(q.Source())
+}
+
+type matchPhraseQuery struct {
+	field, text string
+}
+
+// MatchPhrase matches the analysed text against one field, its terms adjacent and in order.
+func MatchPhrase(field, text string) Query {
+	return matchPhraseQuery{field: field, text: text}
+}
+
+func (q matchPhraseQuery) Source() map[string]interface{} {
+	return map[string]interface{}{"match_phrase": map[string]interface{}{q.field: q.text}}
+}
+
+func (q matchPhraseQuery) MarshalJSON() ([]byte, error) {
+	return json.Marshal(q.Source())
+}
+
+// MultiMatchQuery matches the analysed text against several fields.
+type MultiMatchQuery struct {
+	text      string
+	fields    []string
+	typ       string
+	operator  string
+	fuzziness string
+}
+
+func MultiMatch(text string, fields ...string) *MultiMatchQuery {
+	return &MultiMatchQuery{text: text, fields: fields}
+}
+
+// Type sets how the fields are combined, e.g. "best_fields" (the default) or "bool_prefix".
+func (q *MultiMatchQuery) Type(typ string) *MultiMatchQuery {
+	q.typ = typ
+	return q
+}
+
+func (q *MultiMatchQuery) Operator(op string) *MultiMatchQuery {
+	q.operator = op
+	return q
+}
+
+func (q *MultiMatchQuery) Fuzziness(f string) *MultiMatchQuery {
+	q.fuzziness = f
+	return q
+}
+
+func (q *MultiMatchQuery) Source() map[string]interface{} {
+	m := map[string]interface{}{"query": q.text, "fields": q.fields}
+	if q.typ != "" {
+		m["type"] = q.typ
+	}
+	if q.operator != "" {
+		m["operator"] = q.operator
+	}
+	if q.fuzziness != "" {
+		m["fuzziness"] = q.fuzziness
+	}
+	return map[string]interface{}{"multi_match": m}
+}
+
+func (q *MultiMatchQuery) MarshalJSON() ([]byte, error) {
+	return json.Marshal(q.Source())
+}
+
+type termQuery struct {
+	field string
+	value interface{}
+}
+
+// Term matches documents whose field holds exactly value.
+func Term(field string, value interface{}) Query {
+	return termQuery{field: field, value: value}
+}
+
+func (q termQuery) Source() map[string]interface{} {
+	return map[string]interface{}{"term": map[string]interface{}{q.field: q.value}}
+}
+
+func (q termQuery) MarshalJSON() ([]byte, error) {
+	return json.Marshal(q.Source())
+}
+
+type termsQuery struct {
+	field  string
+	values []interface{}
+}
+
+// Terms matches documents whose field holds exactly any of values.
+func Terms(field string, values ...interface{}) Query {
+	return termsQuery{field: field, values: values}
+}
+
+func (q termsQuery) Source() map[string]interface{} {
+	return map[string]interface{}{"terms": map[string]interface{}{q.field: q.values}}
+}
+
+func (q termsQuery) MarshalJSON() ([]byte, error) {
+	return json.Marshal(q.Source())
+}
+
+// RangeQuery matches documents whose field lies within the bounds set; unset bounds are open.
+type RangeQuery struct {
+	field  string
+	bounds map[string]interface{}
+}
+
+func Range(field string) *RangeQuery {
+	return &RangeQuery{field: field, bounds: map[string]interface{}{}}
+}
+
+func (q *RangeQuery) Gte(v interface{}) *RangeQuery {
+	q.bounds["gte"] = v
+	return q
+}
+
+func (q *RangeQuery) Gt(v interface{}) *RangeQuery {
+	q.bounds["gt"] = v
+	return q
+}
+
+func (q *RangeQuery) Lte(v interface{}) *RangeQuery {
+	q.bounds["lte"] = v
+	return q
+}
+
+func (q *RangeQuery) Lt(v interface{}) *RangeQuery {
+	q.bounds["lt"] = v
+	return q
+}
+
+func (q *RangeQuery) Source() map[string]interface{} {
+	return map[string]interface{}{"range": map[string]interface{}{q.field: q.bounds}}
+}
+
+func (q *RangeQuery) MarshalJSON() ([]byte, error) {
+	return json.Marshal(q.Source())
+}
+
+// FunctionScoreQuery rescores the documents a query matches with score functions.
+type FunctionScoreQuery struct {
+	query     Query
+	functions []ScoreFunction
+	scoreMode string
+	boostMode string
+}
+
+func FunctionScore(q Query) *FunctionScoreQuery {
+	return &FunctionScoreQuery{query: q}
+}
+
+func (q *FunctionScoreQuery) Add(fns ...ScoreFunction) *FunctionScoreQuery {
+	q.functions = append(q.functions, fns...)
+	return q
+}
+
+// ScoreMode sets how the functions' scores combine, e.g. "multiply" (the default) or "sum".
+func (q *FunctionScoreQuery) ScoreMode(mode string) *FunctionScoreQuery {
+	q.scoreMode = mode
+	return q
+}
+
+// BoostMode sets how the functions' score combines with the query's, e.g. "multiply" (the default) or "replace".
+func (q *FunctionScoreQuery) BoostMode(mode string) *FunctionScoreQuery {
+	q.boostMode = mode
+	return q
+}
+
+func (q *FunctionScoreQuery) Source() map[string]interface{} {
+	m := map[string]interface{}{}
+	if q.query != nil {
+		m["query"] = q.query.Source()
+	}
+	if len(q.functions) > 0 {
+		fns := make([]interface{}, len(q.functions))
+		for i, fn := range q.functions {
+			fns[i] = fn.Source()
+		}
+		m["functions"] = fns
+	}
+	if q.scoreMode != "" {
+		m["score_mode"] = q.scoreMode
+	}
+	if q.boostMode != "" {
+		m["boost_mode"] = q.boostMode
+	}
+	return map[string]interface{}{"function_score": m}
+}
+
+func (q *FunctionScoreQuery) MarshalJSON() ([]byte, error) {
+	return json.Marshal(q.Source())
+}
+
+// ScoreFunction is one function of a function_score query.
+type ScoreFunction interface {
+	Source() map[string]interface{}
+}
+
+type weightFunction struct {
+	filter Query
+	weight float64
+}
+
+// Weight multiplies the score of the documents filter matches by weight; a nil filter matches all.
+func Weight(filter Query, weight float64) ScoreFunction {
+	return weightFunction{filter: filter, weight: weight}
+}
+
+func (f weightFunction) Source() map[string]interface{} {
+	m := map[string]interface{}{"weight": f.weight}
+	if f.filter != nil {
+		m["filter"] = f.filter.Source()
+	}
+	return m
+}
+
+// FieldValueFactorFunction scores documents by the value of a numeric field.
+type FieldValueFactorFunction struct {
+	field    string
+	factor   *float64
+	modifier string
+	missing  *float64
+}
+
+func FieldValueFactor(field string) *FieldValueFactorFunction {
+	return &FieldValueFactorFunction{field: field}
+}
+
+func (f *FieldValueFactorFunction) Factor(factor float64) *FieldValueFactorFunction {
+	f.factor = &factor
+	return f
+}
+
+// Modifier sets the function applied to the value, e.g. "log1p".
+func (f *FieldValueFactorFunction) Modifier(modifier string) *FieldValueFactorFunction {
+	f.modifier = modifier
+	return f
+}
+
+// Missing sets the value used for documents without the field.
+func (f *FieldValueFactorFunction) Missing(v float64) *FieldValueFactorFunction {
+	f.missing = &v
+	return f
+}
+
+func (f *FieldValueFactorFunction) Source() map[string]interface{} {
+	m := map[string]interface{}{"field": f.field}
+	if f.factor != nil {
+		m["factor"] = *f.factor
+	}
+	if f.modifier != "" {
+		m["modifier"] = f.modifier
+	}
+	if f.missing != nil {
+		m["missing"] = *f.missing
+	}
+	return map[string]interface{}{"field_value_factor": m}
+}
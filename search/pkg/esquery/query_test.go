@@ -0,0 +1,72 @@
+package esquery
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// marshals checks v marshals to want, byte for byte: maps marshal with their keys sorted.
+func marshals(t *testing.T, v interface{}, want string) {
+	t.Helper()
+	got, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+}
+
+func TestQueries(t *testing.T) {
+	tests := []struct {
+		name  string
+		query Query
+		want  string
+	}{
+		{"match_all", MatchAll(), `{"match_all":{}}`},
+		{"match", Match("name", "trail shoe"), `{"match":{"name":{"query":"trail shoe"}}}`},
+		{"match with options", Match("name", "trail shoe").Operator("and").Fuzziness("AUTO"),
+			`{"match":{"name":{"fuzziness":"AUTO","operator":"and","query":"trail shoe"}}}`},
+		{"match_phrase", MatchPhrase("name", "trail shoe"), `{"match_phrase":{"name":"trail shoe"}}`},
+		{"multi_match", MultiMatch("shoe", "name", "name.ngram").Type("best_fields").Operator("or").Fuzziness("AUTO"),
+			`{"multi_match":{"fields":["name","name.ngram"],"fuzziness":"AUTO","operator":"or","query":"shoe","type":"best_fields"}}`},
+		{"term", Term("category", "shoes"), `{"term":{"category":"shoes"}}`},
+		{"terms", Terms("id", "a", "b"), `{"terms":{"id":["a","b"]}}`},
+		{"range", Range("price").Gte(10).Lt(50), `{"range":{"price":{"gte":10,"lt":50}}}`},
+		{"exclusive range", Range("price").Gt(10.5).Lte(50), `{"range":{"price":{"gt":10.5,"lte":50}}}`},
+		{"empty bool", Bool(), `{"bool":{}}`},
+		{"bool", Bool().
+			Must(Match("name", "shoe")).
+			Filter(Term("category", "shoes"), nil).
+			Should(Range("price").Lt(10), Range("price").Gte(100)).
+			MinimumShouldMatch(1).
+			MustNot(Term("category", "sale")),
+			`{"bool":{"filter":[{"term":{"category":"shoes"}}],"minimum_should_match":1,` +
+				`"must":[{"match":{"name":{"query":"shoe"}}}],"must_not":[{"term":{"category":"sale"}}],` +
+				`"should":[{"range":{"price":{"lt":10}}},{"range":{"price":{"gte":100}}}]}}`},
+		{"function_score", FunctionScore(MatchAll()).
+			Add(Weight(Term("category", "shoes"), 2), Weight(nil, 0.5)).
+			Add(FieldValueFactor("popularity").Factor(1.2).Modifier("log1p").Missing(1)).
+			ScoreMode("sum").
+			BoostMode("multiply"),
+			`{"function_score":{"boost_mode":"multiply","functions":[` +
+				`{"filter":{"term":{"category":"shoes"}},"weight":2},{"weight":0.5},` +
+				`{"field_value_factor":{"factor":1.2,"field":"popularity","missing":1,"modifier":"log1p"}}],` +
+				`"query":{"match_all":{}},"score_mode":"sum"}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			marshals(t, tt.query, tt.want)
+		})
+	}
+}
+
+func TestBoolEmpty(t *testing.T) {
+	if !Bool().Filter(nil).Empty() {
+		t.Error("a bool query given only nil clauses is not empty")
+	}
+	if Bool().MustNot(Term("category", "sale")).Empty() {
+		t.Error("a bool query with a must_not clause is empty")
+	}
+}
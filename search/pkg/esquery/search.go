@@ -0,0 +1,200 @@
+package esquery
+
+import "encoding/json"
+
+// SortField orders hits by one field.
+type SortField struct {
+	field        string
+	order        string
+	unmappedType string
+}
+
+// SortBy orders hits by field, "asc" or "desc"; "_score" orders them by relevance.
+func SortBy(field, order string) *SortField {
+	return &SortField{field: field, order: order}
+}
+
+// UnmappedType sorts indices that don't map the field as if it were of this type, with
+// every value missing, rather than failing.
+func (s *SortField) UnmappedType(typ string) *SortField {
+	s.unmappedType = typ
+	return s
+}
+
+func (s *SortField) Source() map[string]interface{} {
+	m := map[string]interface{}{"order": s.order}
+	if s.unmappedType != "" {
+		m["unmapped_type"] = s.unmappedType
+	}
+	return map[string]interface{}{s.field: m}
+}
+
+func (s *SortField) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Source())
+}
+
+// HighlightRequest asks for the fragments of fields that matched the query.
+type HighlightRequest struct {
+	preTag, postTag string
+	encoder         string
+	fields          map[string]interface{}
+}
+
+// Highlight wraps matched terms between preTag and postTag.
+func Highlight(preTag, postTag string) *HighlightRequest {
+	return &HighlightRequest{preTag: preTag, postTag: postTag, fields: map[string]interface{}{}}
+}
+
+// Encoder sets how fragment text is encoded: "html" escapes it, so only the tags are markup.
+// The default, "default", leaves it as stored.
+func (h *HighlightRequest) Encoder(encoder string) *HighlightRequest {
+	h.encoder = encoder
+	return h
+}
+
+// Field highlights field in fragments of about fragmentSize characters.
+func (h *HighlightRequest) Field(field string, fragmentSize int) *HighlightRequest {
+	h.fields[field] = map[string]interface{}{"fragment_size": fragmentSize}
+	return h
+}
+
+func (h *HighlightRequest) Source() map[string]interface{} {
+	m := map[string]interface{}{
+		"pre_tags":  []string{h.preTag},
+		"post_tags": []string{h.postTag},
+		"fields":    h.fields,
+	}
+	if h.encoder != "" {
+		m["encoder"] = h.encoder
+	}
+	return m
+}
+
+func (h *HighlightRequest) MarshalJSON() ([]byte, error) {
+	return json.Marshal(h.Source())
+}
+
+// SearchRequest is the body of a search request. Unset parts are left to Elasticsearch's defaults.
+type SearchRequest struct {
+	query          Query
+	postFilter     Query
+	aggs           Aggregations
+	sort           []*SortField
+	from, size     *int
+	highlight      *HighlightRequest
+	searchAfter    []json.RawMessage
+	source         []string
+	pit, keepAlive string
+	trackTotalHits bool
+}
+
+func Search() *SearchRequest {
+	return &SearchRequest{aggs: Aggregations{}}
+}
+
+func (r *SearchRequest) Query(q Query) *SearchRequest {
+	r.query = q
+	return r
+}
+
+// PostFilter narrows the hits after aggregations are computed, so it doesn't narrow them.
+func (r *SearchRequest) PostFilter(q Query) *SearchRequest {
+	r.postFilter = q
+	return r
+}
+
+func (r *SearchRequest) Aggregation(name string, agg Aggregation) *SearchRequest {
+	r.aggs[name] = agg
+	return r
+}
+
+// Sort orders hits by fields, most significant first.
+func (r *SearchRequest) Sort(fields ...*SortField) *SearchRequest {
+	r.sort = fields
+	return r
+}
+
+func (r *SearchRequest) From(n int) *SearchRequest {
+	r.from = &n
+	return r
+}
+
+func (r *SearchRequest) Size(n int) *SearchRequest {
+	r.size = &n
+	return r
+}
+
+func (r *SearchRequest) Highlight(h *HighlightRequest) *SearchRequest {
+	r.highlight = h
+	return r
+}
+
+// SourceIncludes returns only fields of each hit's _source.
+func (r *SearchRequest) SourceIncludes(fields ...string) *SearchRequest {
+	r.source = fields
+	return r
+}
+
+// SearchAfter returns the hits sorting after values, the sort values of the last hit of the previous page.
+func (r *SearchRequest) SearchAfter(values []json.RawMessage) *SearchRequest {
+	r.searchAfter = values
+	return r
+}
+
+// PointInTime searches the point in time id, keeping it open for keepAlive, e.g. "5m".
+func (r *SearchRequest) PointInTime(id, keepAlive string) *SearchRequest {
+	r.pit, r.keepAlive = id, keepAlive
+	return r
+}
+
+// TrackTotalHits counts every match, rather than stopping at 10,000.
+func (r *SearchRequest) TrackTotalHits(track bool) *SearchRequest {
+	r.trackTotalHits = track
+	return r
+}
+
+func (r *SearchRequest) Source() map[string]interface{} {
+	body := map[string]interface{}{}
+	if r.query != nil {
+		body["query"] = r.query.Source()
+	}
+	if r.postFilter != nil {
+		body["post_filter"] = r.postFilter.Source()
+	}
+	if len(r.aggs) > 0 {
+		body["aggs"] = r.aggs.Source()
+	}
+	if len(r.sort) > 0 {
+		sort := make([]interface{}, len(r.sort))
+		for i, s := range r.sort {
+			sort[i] = s.Source()
+		}
+		body["sort"] = sort
+	}
+	if r.from != nil {
+		body["from"] = *r.from
+	}
+	if r.size != nil {
+		body["size"] = *r.size
+	}
+	if r.highlight != nil {
+		body["highlight"] = r.highlight.Source()
+	}
+	if len(r.source) > 0 {
+		body["_source"] = r.source
+	}
+	if len(r.searchAfter) > 0 {
+		body["search_after"] = r.searchAfter
+	}
+	if r.pit != "" {
+		body["pit"] = map[string]interface{}{"id": r.pit, "keep_alive": r.keepAlive}
+	}
+	if r.trackTotalHits {
+		body["track_total_hits"] = true
+	}
+	return body
+}
+
+func (r *SearchRequest) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.Source())
+}
@@ -0,0 +1,56 @@
+package esquery
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSortBy(t *testing.T) {
+	marshals(t, SortBy("price", "desc"), `{"price":{"order":"desc"}}`)
+	marshals(t, SortBy("name.raw", "asc").UnmappedType("keyword"), `{"name.raw":{"order":"asc","unmapped_type":"keyword"}}`)
+}
+
+func TestHighlight(t *testing.T) {
+	marshals(t, Highlight("<em>", "</em>").Field("name", 0),
+		`{"fields":{"name":{"fragment_size":0}},"post_tags":["\u003c/em\u003e"],"pre_tags":["\u003cem\u003e"]}`)
+	marshals(t, Highlight("<b>", "</b>").Encoder("html").Field("name", 50),
+		`{"encoder":"html","fields":{"name":{"fragment_size":50}},"post_tags":["\u003c/b\u003e"],"pre_tags":["\u003cb\u003e"]}`)
+}
+
+func TestSearch(t *testing.T) {
+	tests := []struct {
+		name    string
+		request *SearchRequest
+		want    string
+	}{
+		{"empty", Search(), `{}`},
+		{"offset page", Search().
+			Query(Bool().Must(Match("name", "shoe"))).
+			PostFilter(Term("category", "shoes")).
+			Aggregation("categories", TermsAgg("category")).
+			Sort(SortBy("price", "asc"), SortBy("_score", "desc")).
+			From(0).
+			Size(20).
+			Highlight(Highlight("<em>", "</em>").Field("name", 0)).
+			SourceIncludes("id", "name").
+			TrackTotalHits(true),
+			`{"_source":["id","name"],"aggs":{"categories":{"terms":{"field":"category"}}},"from":0,` +
+				`"highlight":{"fields":{"name":{"fragment_size":0}},"post_tags":["\u003c/em\u003e"],"pre_tags":["\u003cem\u003e"]},` +
+				`"post_filter":{"term":{"category":"shoes"}},"query":{"bool":{"must":[{"match":{"name":{"query":"shoe"}}}]}},` +
+				`"size":20,"sort":[{"price":{"order":"asc"}},{"_score":{"order":"desc"}}],"track_total_hits":true}`},
+		{"search_after page", Search().
+			Query(MatchAll()).
+			Size(10).
+			Sort(SortBy("id", "asc")).
+			PointInTime("pit-1", "5m").
+			SearchAfter([]json.RawMessage{json.RawMessage(`79.9`), json.RawMessage(`"a"`)}),
+			`{"pit":{"id":"pit-1","keep_alive":"5m"},"query":{"match_all":{}},"search_after":[79.9,"a"],` +
+				`"size":10,"sort":[{"id":{"order":"asc"}}]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			marshals(t, tt.request, tt.want)
+		})
+	}
+}